@@ -0,0 +1,130 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/alexflint/go-filemutex"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+)
+
+const (
+	defaultAuditMaxSize    = 10 << 20
+	defaultAuditMaxBackups = 3
+)
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	Network     string    `json:"network"`
+	ContainerID string    `json:"containerID"`
+	IfName      string    `json:"ifName"`
+	Pod         string    `json:"pod,omitempty"`
+	IPs         []string  `json:"ips"`
+}
+
+// audit appends an allocate or release record to the configured audit log.
+// The plugin has done its work by then, so a failure to record it is only
+// logged rather than failing the request.
+func audit(conf *allocator.IPAMConfig, event, containerID, ifName string, ips []net.IP) {
+	if conf.AuditLog == nil || len(ips) == 0 {
+		return
+	}
+
+	rec := auditRecord{
+		Time:        time.Now().UTC(),
+		Event:       event,
+		Network:     conf.Name,
+		ContainerID: containerID,
+		IfName:      ifName,
+		Pod:         conf.Pod,
+	}
+	for _, ip := range ips {
+		rec.IPs = append(rec.IPs, ip.String())
+	}
+
+	if err := writeAuditRecord(conf.AuditLog, &rec); err != nil {
+		log.Printf("failed to write audit log %s: %v", conf.AuditLog.Path, err)
+	}
+}
+
+func writeAuditRecord(cfg *allocator.AuditLog, rec *auditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	// Serializes rotation between concurrent invocations; the log itself
+	// is renamed away, so it cannot carry the lock
+	lk, err := filemutex.New(cfg.Path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lk.Close()
+	if err := lk.Lock(); err != nil {
+		return err
+	}
+	defer lk.Unlock()
+
+	maxSize := cfg.MaxSize
+	if maxSize == 0 {
+		maxSize = defaultAuditMaxSize
+	}
+	if fi, err := os.Stat(cfg.Path); err == nil && fi.Size() > 0 && fi.Size()+int64(len(line)) > maxSize {
+		if err := rotateAuditLog(cfg); err != nil {
+			return fmt.Errorf("failed to rotate: %v", err)
+		}
+	}
+
+	f, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rotateAuditLog shifts path.1 to path.2 and so on, dropping the oldest
+// backup, and moves the current log to path.1.
+func rotateAuditLog(cfg *allocator.AuditLog) error {
+	backups := cfg.MaxBackups
+	if backups == 0 {
+		backups = defaultAuditMaxBackups
+	}
+
+	for i := backups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", cfg.Path, i), fmt.Sprintf("%s.%d", cfg.Path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(cfg.Path, cfg.Path+".1")
+}
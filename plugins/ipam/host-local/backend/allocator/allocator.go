@@ -17,9 +17,11 @@ package allocator
 import (
 	"fmt"
 	"log"
+	"math/big"
 	"net"
 	"os"
 	"strconv"
+	"strings"
 
 	current "github.com/containernetworking/cni/pkg/types/100"
 
@@ -30,7 +32,38 @@ import (
 type IPAllocator struct {
 	rangeset *RangeSet
 	store    backend.Store
-	rangeID  string // Used for tracking last reserved ip
+	rangeID  string   // Used for tracking last reserved ip
+	pool     []net.IP // If set, the only addresses that may be allocated
+	strategy Strategy // Round robin if nil
+	// maxAttempts caps the addresses tried per allocation, if non-zero
+	maxAttempts int
+	useBitmap   bool              // Skip the addresses the store's bitmap has reserved
+	reserved    map[string]string // Never allocated, to the reason why
+	// releaseCheck, if set, is asked before an address is released
+	releaseCheck ReleaseCheck
+	withhold     bool // Keep the addresses releaseCheck finds configured
+}
+
+// ReleaseCheck reports whether ip is still configured on the interface it
+// was allocated for.
+type ReleaseCheck func(ip net.IP) (bool, error)
+
+// ExhaustedError is returned by Get when the range set has no address
+// left, or none was found in the attempts allowed.
+type ExhaustedError struct {
+	RangeSet string
+	Attempts int  // Zero if the range set is known to be full
+	Pool     bool // Set if it is the address pool of the range set
+}
+
+func (e *ExhaustedError) Error() string {
+	if e.Attempts > 0 {
+		return fmt.Sprintf("range set %s exhausted: no IP address available in %d attempts", e.RangeSet, e.Attempts)
+	}
+	if e.Pool {
+		return fmt.Sprintf("no IP addresses available in the address pool for range set: %s", e.RangeSet)
+	}
+	return fmt.Sprintf("no IP addresses available in range set: %s", e.RangeSet)
 }
 
 func NewIPAllocator(s *RangeSet, store backend.Store, id int) *IPAllocator {
@@ -41,6 +74,41 @@ func NewIPAllocator(s *RangeSet, store backend.Store, id int) *IPAllocator {
 	}
 }
 
+// SetStrategy sets the order in which addresses are allocated. Addresses
+// from a pool are always allocated in the order of the pool.
+func (a *IPAllocator) SetStrategy(s Strategy) {
+	a.strategy = s
+}
+
+// SetMaxAttempts makes Get give up after trying n addresses, so a nearly
+// full range set fails fast instead of being scanned in full. Zero means
+// no limit.
+func (a *IPAllocator) SetMaxAttempts(n int) {
+	a.maxAttempts = n
+}
+
+// UseBitmap makes Get consult the bitmap of the range set, for stores
+// that keep one, and skip the addresses it has marked reserved rather
+// than trying them. The bitmap is created on first use.
+func (a *IPAllocator) UseBitmap() {
+	a.useBitmap = true
+}
+
+// SetReserved keeps the addresses of reserved from being allocated. A
+// request for one of them fails with its reason.
+func (a *IPAllocator) SetReserved(reserved []ReservedAddress) {
+	a.reserved = map[string]string{}
+	for _, r := range reserved {
+		a.reserved[r.IP.String()] = r.Reason
+	}
+}
+
+// isReserved reports whether addr was passed to SetReserved.
+func (a *IPAllocator) isReserved(addr net.IP) bool {
+	_, ok := a.reserved[addr.String()]
+	return ok
+}
+
 // Get allocates an IP
 func (a *IPAllocator) Get(id string, ifname string, requestedIP net.IP) (*current.IPConfig, error) {
 	a.store.Lock()
@@ -63,6 +131,17 @@ func (a *IPAllocator) Get(id string, ifname string, requestedIP net.IP) (*curren
 			return nil, fmt.Errorf("requested ip %s is subnet's gateway", requestedIP.String())
 		}
 
+		if reason, ok := a.reserved[requestedIP.String()]; ok {
+			if reason == "" {
+				return nil, fmt.Errorf("requested ip %s is reserved", requestedIP.String())
+			}
+			return nil, fmt.Errorf("requested ip %s is reserved: %s", requestedIP.String(), reason)
+		}
+
+		if a.pool != nil && !a.inPool(requestedIP) {
+			return nil, fmt.Errorf("requested ip %s is not in the address pool", requestedIP.String())
+		}
+
 		reserved, err := a.store.Reserve(id, ifname, requestedIP, a.rangeID)
 		if err != nil {
 			return nil, err
@@ -74,40 +153,51 @@ func (a *IPAllocator) Get(id string, ifname string, requestedIP net.IP) (*curren
 		gw = r.Gateway
 
 	} else {
-		// try to get allocated IPs for this given id, if exists, just return error
-		// because duplicate allocation is not allowed in SPEC
-		// https://github.com/containernetworking/cni/blob/master/SPEC.md
-		allocatedIPs := a.store.GetByID(id, ifname)
-		for _, allocatedIP := range allocatedIPs {
-			// check whether the existing IP belong to this range set
-			if _, err := a.rangeset.RangeFor(allocatedIP); err == nil {
-				return nil, fmt.Errorf("%s has been allocated to %s, duplicate allocation is not allowed", allocatedIP.String(), id)
-			}
-		}
-
-		iter, err := a.GetIter()
-		if err != nil {
+		if err := a.checkDuplicate(id, ifname); err != nil {
 			return nil, err
 		}
-		for {
-			reservedIP, gw = iter.Next()
-			if reservedIP == nil {
-				break
-			}
 
-			reserved, err := a.store.Reserve(id, ifname, reservedIP.IP, a.rangeID)
-			if err != nil {
+		if a.pool != nil {
+			var err error
+			if reservedIP, gw, err = a.nextFromPool(id, ifname); err != nil {
 				return nil, err
 			}
+			if reservedIP == nil {
+				return nil, &ExhaustedError{RangeSet: a.rangeset.String(), Pool: true}
+			}
+			return &current.IPConfig{
+				Address: *reservedIP,
+				Gateway: gw,
+			}, nil
+		}
 
-			if reserved {
-				break
+		bm := a.bitmap(false)
+		if a.full(bm) {
+			if bm == nil {
+				return nil, &ExhaustedError{RangeSet: a.rangeset.String()}
 			}
+			// the bitmap may have missed a release
+			if bm = a.bitmap(true); a.full(bm) {
+				return nil, &ExhaustedError{RangeSet: a.rangeset.String()}
+			}
+		}
+
+		strategy := a.strategy
+		if strategy == nil {
+			strategy = &roundRobin{}
+		}
+		var err error
+		reservedIP, gw, err = a.search(id, ifname, strategy, bm)
+		if err == nil && reservedIP == nil && bm != nil {
+			reservedIP, gw, err = a.search(id, ifname, strategy, a.bitmap(true))
+		}
+		if err != nil {
+			return nil, err
 		}
 	}
 
 	if reservedIP == nil {
-		return nil, fmt.Errorf("no IP addresses available in range set: %s", a.rangeset.String())
+		return nil, &ExhaustedError{RangeSet: a.rangeset.String()}
 	}
 
 	return &current.IPConfig{
@@ -116,12 +206,184 @@ func (a *IPAllocator) Get(id string, ifname string, requestedIP net.IP) (*curren
 	}, nil
 }
 
+// search tries the addresses strategy picks until one can be reserved,
+// skipping those bm, if any, has marked reserved. It returns nil if the
+// strategy runs out of addresses.
+func (a *IPAllocator) search(id, ifname string, strategy Strategy, bm *backend.Bitmap) (*net.IPNet, net.IP, error) {
+	free := &FreeSet{a: a}
+	for attempts := 0; ; attempts++ {
+		if a.maxAttempts > 0 && attempts == a.maxAttempts {
+			return nil, nil, &ExhaustedError{RangeSet: a.rangeset.String(), Attempts: attempts}
+		}
+		addr, gw := strategy.Next(free)
+		for addr != nil && (a.isReserved(addr.IP) || bm != nil && bm.Reserved(addr.IP)) {
+			addr, gw = strategy.Next(free)
+		}
+		if addr == nil {
+			return nil, nil, nil
+		}
+
+		reserved, err := a.store.Reserve(id, ifname, addr.IP, a.rangeID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if reserved {
+			return addr, gw, nil
+		}
+	}
+}
+
+// bitmap returns the bitmap of the range set, after rebuilding it if
+// rebuild is set, or nil if UseBitmap was not called or the store keeps
+// none.
+func (a *IPAllocator) bitmap(rebuild bool) *backend.Bitmap {
+	bs, ok := a.store.(backend.BitmapStore)
+	if !a.useBitmap || !ok {
+		return nil
+	}
+	var ranges []backend.BitmapRange
+	for _, r := range *a.rangeset {
+		ranges = append(ranges, backend.BitmapRange{Start: r.RangeStart, End: r.RangeEnd})
+	}
+	load := bs.LoadBitmap
+	if rebuild {
+		load = bs.RebuildBitmap
+	}
+	bm, err := load(a.rangeID, ranges)
+	if err != nil {
+		log.Printf("failed to load the bitmap of range set %s: %v", a.rangeset.String(), err)
+		return nil
+	}
+	return bm
+}
+
+// full reports whether every address of the range set is reserved, for
+// stores that can list their reservations. Counting them, or the bits of
+// bm, is cheaper than trying every address.
+func (a *IPAllocator) full(bm *backend.Bitmap) bool {
+	free := (&FreeSet{a: a}).Size()
+	one := big.NewInt(1)
+	for _, r := range *a.rangeset {
+		if r.Gateway != nil && r.Contains(r.Gateway) {
+			free.Sub(free, one)
+		}
+	}
+
+	if bm != nil {
+		free.Sub(free, new(big.Int).SetUint64(bm.Count()))
+		for _, r := range *a.rangeset {
+			// a reserved gateway is not counted twice
+			if r.Gateway != nil && bm.Reserved(r.Gateway) {
+				free.Add(free, one)
+			}
+		}
+		return free.Sign() <= 0
+	}
+
+	lister, ok := a.store.(interface {
+		ReservedIPs() ([]net.IP, error)
+	})
+	if !ok {
+		return false
+	}
+	reserved, err := lister.ReservedIPs()
+	if err != nil {
+		return false
+	}
+	for _, ip := range reserved {
+		if r, err := a.rangeset.RangeFor(ip); err == nil && !ip.Equal(r.Gateway) {
+			free.Sub(free, one)
+		}
+	}
+	return free.Sign() <= 0
+}
+
+// checkDuplicate fails if the container already has an address in the range
+// set.
+func (a *IPAllocator) checkDuplicate(id string, ifname string) error {
+	// try to get allocated IPs for this given id, if exists, just return error
+	// because duplicate allocation is not allowed in SPEC
+	// https://github.com/containernetworking/cni/blob/master/SPEC.md
+	allocatedIPs := a.store.GetByID(id, ifname)
+	for _, allocatedIP := range allocatedIPs {
+		// check whether the existing IP belong to this range set
+		if _, err := a.rangeset.RangeFor(allocatedIP); err == nil {
+			return fmt.Errorf("%s has been allocated to %s, duplicate allocation is not allowed", allocatedIP.String(), id)
+		}
+	}
+	return nil
+}
+
+// GetGateway allocates the gateway address of the first range that has one.
+// The gateway can only be held by one container at a time.
+func (a *IPAllocator) GetGateway(id string, ifname string) (*current.IPConfig, error) {
+	a.store.Lock()
+	defer a.store.Unlock()
+
+	for _, r := range *a.rangeset {
+		if r.Gateway == nil {
+			continue
+		}
+
+		reserved, err := a.store.Reserve(id, ifname, r.Gateway, a.rangeID)
+		if err != nil {
+			return nil, err
+		}
+		if !reserved {
+			return nil, fmt.Errorf("gateway %s of range set %s is already allocated", r.Gateway, a.rangeset.String())
+		}
+		return &current.IPConfig{
+			Address: net.IPNet{IP: r.Gateway, Mask: r.Subnet.Mask},
+		}, nil
+	}
+
+	return nil, fmt.Errorf("range set %s has no gateway", a.rangeset.String())
+}
+
+// SetReleaseCheck makes Release ask check about each address before it
+// frees it. An address still configured, or that check fails for, is kept
+// reserved if withhold is set, and only logged otherwise.
+func (a *IPAllocator) SetReleaseCheck(check ReleaseCheck, withhold bool) {
+	a.releaseCheck, a.withhold = check, withhold
+}
+
 // Release clears all IPs allocated for the container with given ID
 func (a *IPAllocator) Release(id string, ifname string) error {
 	a.store.Lock()
 	defer a.store.Unlock()
 
-	return a.store.ReleaseByID(id, ifname)
+	if a.releaseCheck == nil {
+		return a.store.ReleaseByID(id, ifname)
+	}
+
+	var kept []string
+	var released []net.IP
+	for _, ip := range a.store.GetByID(id, ifname) {
+		configured, err := a.releaseCheck(ip)
+		switch {
+		case err != nil && a.withhold:
+			kept = append(kept, fmt.Sprintf("%s (%v)", ip, err))
+			continue
+		case err != nil:
+			log.Printf("WARNING: releasing %s of container %s without checking %s: %v", ip, id, ifname, err)
+		case configured && a.withhold:
+			kept = append(kept, ip.String())
+			continue
+		case configured:
+			log.Printf("WARNING: releasing %s of container %s, which is still configured on %s", ip, id, ifname)
+		}
+		released = append(released, ip)
+	}
+	if len(kept) == 0 {
+		return a.store.ReleaseByID(id, ifname)
+	}
+
+	for _, ip := range released {
+		if err := a.store.Release(ip); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("not releasing %s of container %s, which may still be configured on %s", strings.Join(kept, ", "), id, ifname)
 }
 
 type RangeIter struct {
@@ -250,6 +250,34 @@ var _ = Describe("host-local ip allocator", func() {
 			Expect(err).To(HaveOccurred())
 		})
 
+		It("should allocate both addresses of a point-to-point subnet", func() {
+			for _, tc := range []struct {
+				subnet string
+				exp    []string
+			}{
+				{"192.168.1.0/31", []string{"192.168.1.0/31", "192.168.1.1/31"}},
+				{"2001:db8::/127", []string{"2001:db8::/127", "2001:db8::1/127"}},
+			} {
+				p := RangeSet{Range{Subnet: mustSubnet(tc.subnet)}}
+				Expect(p.Canonicalize()).To(Succeed())
+				alloc := IPAllocator{
+					rangeset: &p,
+					store:    fakestore.NewFakeStore(map[string]string{}, map[string]net.IP{}),
+					rangeID:  "rangeid",
+				}
+
+				for i, exp := range tc.exp {
+					res, err := alloc.Get(fmt.Sprintf("ID%d", i), "eth0", nil)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(res.Address.String()).To(Equal(exp))
+					Expect(res.Gateway).To(BeNil())
+				}
+
+				_, err := alloc.Get("ID2", "eth0", nil)
+				Expect(err).To(HaveOccurred())
+			}
+		})
+
 		It("should allocate in a round-robin fashion", func() {
 			alloc := mkalloc()
 			res, err := alloc.Get("ID", "eth0", nil)
@@ -265,6 +293,61 @@ var _ = Describe("host-local ip allocator", func() {
 
 		})
 
+		It("withholds the addresses the release check finds configured", func() {
+			alloc := mkalloc()
+			res, err := alloc.Get("ID", "eth0", nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			var checked []string
+			configured := true
+			alloc.SetReleaseCheck(func(ip net.IP) (bool, error) {
+				checked = append(checked, ip.String())
+				return configured, nil
+			}, true)
+			err = alloc.Release("ID", "eth0")
+			Expect(err).To(MatchError("not releasing 192.168.1.2 of container ID, which may still be configured on eth0"))
+			Expect(checked).To(Equal([]string{"192.168.1.2"}))
+			Expect(alloc.store.GetByID("ID", "eth0")).To(HaveLen(1))
+			Expect(alloc.store.GetByID("ID", "eth0")[0].Equal(res.Address.IP)).To(BeTrue())
+
+			alloc.SetReleaseCheck(func(net.IP) (bool, error) { return false, fmt.Errorf("no netns") }, true)
+			err = alloc.Release("ID", "eth0")
+			Expect(err).To(MatchError("not releasing 192.168.1.2 (no netns) of container ID, which may still be configured on eth0"))
+
+			// only warned about
+			alloc.SetReleaseCheck(func(net.IP) (bool, error) { return true, nil }, false)
+			Expect(alloc.Release("ID", "eth0")).To(Succeed())
+			Expect(alloc.store.GetByID("ID", "eth0")).To(BeEmpty())
+
+			_, err = alloc.Get("ID", "eth0", nil)
+			Expect(err).ToNot(HaveOccurred())
+			configured = false
+			alloc.SetReleaseCheck(func(ip net.IP) (bool, error) { return configured, nil }, true)
+			Expect(alloc.Release("ID", "eth0")).To(Succeed())
+			Expect(alloc.store.GetByID("ID", "eth0")).To(BeEmpty())
+		})
+
+		It("should skip reserved addresses", func() {
+			alloc := mkalloc()
+			alloc.SetReserved([]ReservedAddress{
+				{IP: net.IP{192, 168, 1, 2}, Reason: "dns"},
+				{IP: net.IP{192, 168, 1, 3}},
+			})
+			res, err := alloc.Get("ID", "eth0", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Address.String()).To(Equal("192.168.1.4/29"))
+
+			_, err = alloc.Get("ID2", "eth0", net.IP{192, 168, 1, 2})
+			Expect(err).To(MatchError("requested ip 192.168.1.2 is reserved: dns"))
+			_, err = alloc.Get("ID2", "eth0", net.IP{192, 168, 1, 3})
+			Expect(err).To(MatchError("requested ip 192.168.1.3 is reserved"))
+
+			alloc.SetPool([]net.IP{{192, 168, 1, 2}, {192, 168, 1, 5}})
+			res, err = alloc.Get("ID2", "eth0", nil)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Address.String()).To(Equal("192.168.1.5/29"))
+		})
+
 		Context("when requesting a specific IP", func() {
 			It("must allocate the requested IP", func() {
 				alloc := mkalloc()
@@ -0,0 +1,141 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// diskAllocator returns an allocator for subnet, backed by a disk store
+// in dir, with its first n addresses reserved.
+func diskAllocator(dir, subnet string, n int, useBitmap bool) (*IPAllocator, *disk.Store, error) {
+	store, err := disk.New("net", dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := RangeSet{Range{Subnet: mustSubnet(subnet)}}
+	if err := p.Canonicalize(); err != nil {
+		return nil, nil, err
+	}
+	a := NewIPAllocator(&p, store, 0)
+	if useBitmap {
+		a.UseBitmap()
+	}
+	addr := p[0].RangeStart
+	for i := 0; i < n; i++ {
+		if _, err := store.Reserve(fmt.Sprintf("id%d", i), "eth0", addr, "0"); err != nil {
+			return nil, nil, err
+		}
+		addr = ip.NextIP(addr)
+	}
+	// round robin starts over at the reserved addresses
+	if err := ioutil.WriteFile(filepath.Join(dir, "net", "last_reserved_ip.0"), []byte(p[0].RangeEnd.String()), 0644); err != nil {
+		return nil, nil, err
+	}
+	return a, store, nil
+}
+
+var _ = Describe("allocating with a bitmap", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "host_local_bitmap")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("allocates the free addresses and keeps the bitmap in sync", func() {
+		a, store, err := diskAllocator(dir, "10.1.2.0/24", 100, true)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+
+		ipc, err := a.Get("new1", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipc.Address.IP.String()).To(Equal("10.1.2.101"))
+		Expect(filepath.Join(dir, "net", "bitmap.0")).To(BeAnExistingFile())
+
+		Expect(a.Release("id4", "eth0")).To(Succeed())
+		bm := a.bitmap(false)
+		Expect(bm.Reserved(net.ParseIP("10.1.2.101"))).To(BeTrue())
+		Expect(bm.Reserved(net.ParseIP("10.1.2.5"))).To(BeFalse())
+		Expect(bm.Reserved(net.ParseIP("10.1.2.6"))).To(BeTrue())
+		Expect(bm.Count()).To(Equal(uint64(100)))
+		Expect(a.bitmap(true).Bytes()).To(Equal(bm.Bytes()))
+	})
+
+	It("still finds addresses the bitmap wrongly has reserved", func() {
+		a, store, err := diskAllocator(dir, "10.1.2.0/26", 60, true)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+
+		// fill the range, then free an address behind the bitmap's back
+		for i := 0; ; i++ {
+			if _, err := a.Get(fmt.Sprintf("fill%d", i), "eth0", nil); err != nil {
+				Expect(err).To(BeAssignableToTypeOf(&ExhaustedError{}))
+				break
+			}
+		}
+		Expect(os.Remove(filepath.Join(dir, "net", "10.1.2.30"))).To(Succeed())
+
+		ipc, err := a.Get("new1", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipc.Address.IP.String()).To(Equal("10.1.2.30"))
+	})
+})
+
+func BenchmarkGetHalfFull(b *testing.B) {
+	for _, useBitmap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("bitmap=%t", useBitmap), func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "host_local_bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			// a /20 with its first half reserved
+			a, store, err := diskAllocator(dir, "10.1.0.0/20", 2047, useBitmap)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer store.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ipc, err := a.Get("bench", "eth0", nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StopTimer()
+				_ = store.Release(ipc.Address.IP)
+				_ = ioutil.WriteFile(filepath.Join(dir, "net", "last_reserved_ip.0"), []byte("10.1.15.254"), 0644)
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -18,6 +18,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/version"
@@ -35,6 +38,7 @@ type Net struct {
 		// The capability arg
 		IPRanges []RangeSet `json:"ipRanges,omitempty"`
 		IPs      []*ip.IP   `json:"ips,omitempty"`
+		Mac      string     `json:"mac,omitempty"`
 	} `json:"runtimeConfig,omitempty"`
 	Args *struct {
 		A *IPAMArgs `json:"cni"`
@@ -53,15 +57,139 @@ type IPAMConfig struct {
 	ResolvConf string         `json:"resolvConf"`
 	Ranges     []RangeSet     `json:"ranges"`
 	IPArgs     []net.IP       `json:"-"` // Requested IPs from CNI_ARGS, args and capabilities
+	NodeSlices *NodeSlices    `json:"nodeSlices,omitempty"`
+	PoolFile   string         `json:"poolFile,omitempty"` // Externally maintained list of allocatable addresses
+	// LayoutVersion of the reservation files; older data directories are
+	// migrated. Defaults to 1, the plain text layout.
+	LayoutVersion int `json:"layoutVersion,omitempty"`
+	// GatewayPod is the "namespace/name" of the pod that is allocated the
+	// gateway address of each range set, identified by CNI_ARGS.
+	GatewayPod  string `json:"gatewayPod,omitempty"`
+	OwnsGateway bool   `json:"-"` // Set if the requesting pod is GatewayPod
+	// AllocationStrategy is the order addresses are allocated in:
+	// "roundrobin", "random", "sticky" to the pod's name, "ordinal" or
+	// "hash" of the container ID, or "mac" of the interface. The default
+	// is roundrobin, or hash for range sets larger than a /64. It does not
+	// apply to addresses from PoolFile.
+	AllocationStrategy string `json:"allocationStrategy,omitempty"`
+	// StatefulSetOrdinal is the "ordinal" strategy: pods whose name ends
+	// in "-<ordinal>" are allocated the ordinal-th usable address of each
+	// range set, not counting gateways and reserved addresses, if it is free.
+	StatefulSetOrdinal bool `json:"statefulSetOrdinal,omitempty"`
+	Ordinal            *int `json:"-"` // Parsed from the requesting pod's name
+	// MAC the runtime set for the interface, from the same CNI_ARGS, args
+	// or runtimeConfig as the bridge plugin, for the "mac" strategy
+	MAC net.HardwareAddr `json:"-"`
+	// MaxAllocationAttempts is the number of addresses tried in a range
+	// set before giving up on it as exhausted. Zero means no limit.
+	MaxAllocationAttempts int `json:"maxAllocationAttempts,omitempty"`
+	// FreeBitmap keeps a bitmap of the reserved addresses of each range
+	// set next to the reservations, so allocation skips the reserved ones
+	// without trying them. The reservations stay authoritative.
+	FreeBitmap bool `json:"freeBitmap,omitempty"`
+
+	// ReservedAddresses are never allocated, the reason for each kept
+	// with it for tooling to report.
+	ReservedAddresses []ReservedAddress `json:"reservedAddresses,omitempty"`
+
+	// HoldDown, e.g. "5m", keeps released addresses from being allocated
+	// again until it has passed.
+	HoldDown       string        `json:"holdDown,omitempty"`
+	HoldDownPeriod time.Duration `json:"-"` // Parsed from HoldDown
+
+	// VerifyRelease checks on DEL that each address is no longer
+	// configured in the container before freeing it: "warn" only logs the
+	// ones that still are, "withhold" keeps them reserved and fails.
+	VerifyRelease string `json:"verifyRelease,omitempty"`
+
+	// Metadata is stored with the reservations, from the CNI_ARGS named
+	// MetadataArgPrefix followed by the key, e.g. "META_app=web".
+	Metadata map[string]string `json:"-"`
+
+	// Liveness reclaims the addresses of containers that are gone when a
+	// range set is exhausted.
+	Liveness *Liveness `json:"liveness,omitempty"`
+
+	// Quota caps the allocations of each pod namespace, as the
+	// K8S_POD_NAMESPACE in CNI_ARGS.
+	Quota     *Quota `json:"quota,omitempty"`
+	Namespace string `json:"-"` // Namespace of the requesting pod, if known
+
+	AuditLog *AuditLog `json:"auditLog,omitempty"`
+	Pod      string    `json:"-"` // "namespace/name" of the requesting pod, if known
+}
+
+// ReservedAddress is an address of a configured range that is kept out of
+// allocation, such as one used by a DNS server.
+type ReservedAddress struct {
+	IP     net.IP `json:"ip"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// AuditLog configures an append-only record of every allocation and
+// release, one JSON document per line.
+type AuditLog struct {
+	Path       string `json:"path"`
+	MaxSize    int64  `json:"maxSize,omitempty"`    // Bytes before the log is rotated, 10MiB by default
+	MaxBackups int    `json:"maxBackups,omitempty"` // Rotated logs kept, 3 by default
+}
+
+// Quota limits the interfaces of a namespace that have addresses in the
+// network, a zero limit not applying.
+type Quota struct {
+	Soft int `json:"soft,omitempty"` // Allocations beyond it are logged
+	Hard int `json:"hard,omitempty"` // Allocations beyond it are refused
+}
+
+// Liveness names a directory, maintained by the runtime, holding a file
+// named after the ID of every running container.
+type Liveness struct {
+	Dir string `json:"dir"`
+	TTL string `json:"ttl,omitempty"` // Files not modified this long count as gone too
+}
+
+// NodeSlices configures carving each range into per-node slices, claimed
+// through a directory shared between the nodes.
+type NodeSlices struct {
+	Dir        string `json:"dir"`
+	SliceLen   int    `json:"sliceLen"`             // Prefix length of each slice
+	NodeName   string `json:"nodeName,omitempty"`   // Defaults to the hostname
+	StaleAfter string `json:"staleAfter,omitempty"` // Claims idle this long, without reservations, may be taken over
+}
+
+// MetadataArgPrefix marks the CNI_ARGS that are allocation metadata.
+const MetadataArgPrefix = "META_"
+
+// splitMetadataArgs separates the metadata from the other CNI_ARGS.
+func splitMetadataArgs(envArgs string) (string, map[string]string) {
+	var rest []string
+	var meta map[string]string
+	for _, pair := range strings.Split(envArgs, ";") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], MetadataArgPrefix) {
+			rest = append(rest, pair)
+			continue
+		}
+		if meta == nil {
+			meta = map[string]string{}
+		}
+		meta[strings.TrimPrefix(kv[0], MetadataArgPrefix)] = kv[1]
+	}
+	return strings.Join(rest, ";"), meta
 }
 
 type IPAMEnvArgs struct {
 	types.CommonArgs
-	IP ip.IP `json:"ip,omitempty"`
+	IP  ip.IP                      `json:"ip,omitempty"`
+	MAC types.UnmarshallableString `json:"mac,omitempty"`
+
+	K8S_POD_NAMESPACE types.UnmarshallableString
+	K8S_POD_NAME      types.UnmarshallableString
 }
 
 type IPAMArgs struct {
 	IPs []*ip.IP `json:"ips"`
+	Mac string   `json:"mac,omitempty"`
 }
 
 type RangeSet []Range
@@ -71,6 +199,9 @@ type Range struct {
 	RangeEnd   net.IP      `json:"rangeEnd,omitempty"`   // The last ip, inclusive
 	Subnet     types.IPNet `json:"subnet"`
 	Gateway    net.IP      `json:"gateway,omitempty"`
+	// DNS is returned for addresses from this range, on top of the
+	// network's ResolvConf.
+	DNS *types.DNS `json:"dns,omitempty"`
 }
 
 // NewIPAMConfig creates a NetworkConfig from the given network name.
@@ -84,8 +215,24 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
 		return nil, "", fmt.Errorf("IPAM config missing 'ipam' key")
 	}
 
+	if err := validateStrategy(n.IPAM.AllocationStrategy); err != nil {
+		return nil, "", err
+	}
+	if n.IPAM.MaxAllocationAttempts < 0 {
+		return nil, "", fmt.Errorf("invalid maxAllocationAttempts %d (must not be negative)", n.IPAM.MaxAllocationAttempts)
+	}
+	if n.IPAM.StatefulSetOrdinal {
+		if n.IPAM.AllocationStrategy != "" && n.IPAM.AllocationStrategy != OrdinalStrategy {
+			return nil, "", fmt.Errorf("statefulSetOrdinal cannot be combined with allocationStrategy %q", n.IPAM.AllocationStrategy)
+		}
+		n.IPAM.AllocationStrategy = OrdinalStrategy
+	}
+
+	var mac string
 	// parse custom IP from env args
 	if envArgs != "" {
+		envArgs, n.IPAM.Metadata = splitMetadataArgs(envArgs)
+
 		e := IPAMEnvArgs{}
 		err := types.LoadArgs(envArgs, &e)
 		if err != nil {
@@ -95,6 +242,36 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
 		if e.IP.ToIP() != nil {
 			n.IPAM.IPArgs = []net.IP{e.IP.ToIP()}
 		}
+
+		n.IPAM.Namespace = string(e.K8S_POD_NAMESPACE)
+		if e.K8S_POD_NAME != "" {
+			n.IPAM.Pod = string(e.K8S_POD_NAMESPACE) + "/" + string(e.K8S_POD_NAME)
+		}
+
+		if n.IPAM.GatewayPod != "" && n.IPAM.Pod != "" {
+			n.IPAM.OwnsGateway = n.IPAM.GatewayPod == n.IPAM.Pod
+		}
+
+		if n.IPAM.AllocationStrategy == OrdinalStrategy {
+			n.IPAM.Ordinal = podOrdinal(string(e.K8S_POD_NAME))
+		}
+
+		mac = string(e.MAC)
+	}
+
+	// the MAC is overridden the way the bridge plugin does it
+	if n.Args != nil && n.Args.A != nil && n.Args.A.Mac != "" {
+		mac = n.Args.A.Mac
+	}
+	if n.RuntimeConfig.Mac != "" {
+		mac = n.RuntimeConfig.Mac
+	}
+	if n.IPAM.AllocationStrategy == MACStrategy && mac != "" {
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid mac %q: %v", mac, err)
+		}
+		n.IPAM.MAC = hw
 	}
 
 	// parse custom IPs from CNI args in network config
@@ -117,6 +294,45 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
 		}
 	}
 
+	if n.IPAM.LayoutVersion < 0 || n.IPAM.LayoutVersion > 2 {
+		return nil, "", fmt.Errorf("invalid layoutVersion %d (must be 1 or 2)", n.IPAM.LayoutVersion)
+	}
+
+	if n.IPAM.HoldDown != "" {
+		d, err := time.ParseDuration(n.IPAM.HoldDown)
+		if err != nil || d < 0 {
+			return nil, "", fmt.Errorf("invalid holdDown %q (must be a non-negative duration)", n.IPAM.HoldDown)
+		}
+		n.IPAM.HoldDownPeriod = d
+	}
+
+	switch n.IPAM.VerifyRelease {
+	case "", "warn", "withhold":
+	default:
+		return nil, "", fmt.Errorf("invalid verifyRelease %q (must be warn or withhold)", n.IPAM.VerifyRelease)
+	}
+
+	if q := n.IPAM.Quota; q != nil {
+		if q.Soft < 0 || q.Hard < 0 {
+			return nil, "", fmt.Errorf("quota: soft and hard must not be negative")
+		}
+		if q.Soft > 0 && q.Hard > 0 && q.Soft > q.Hard {
+			return nil, "", fmt.Errorf("quota: soft %d is above hard %d", q.Soft, q.Hard)
+		}
+		if n.IPAM.LayoutVersion < 2 {
+			return nil, "", fmt.Errorf("quota requires layoutVersion 2, which records the namespace of the reservations")
+		}
+	}
+
+	if a := n.IPAM.AuditLog; a != nil {
+		if a.Path == "" {
+			return nil, "", fmt.Errorf("auditLog: path must be set")
+		}
+		if a.MaxSize < 0 || a.MaxBackups < 0 {
+			return nil, "", fmt.Errorf("auditLog: maxSize and maxBackups must not be negative")
+		}
+	}
+
 	// If a single range (old-style config) is specified, prepend it to
 	// the Ranges array
 	if n.IPAM.Range != nil && n.IPAM.Range.Subnet.IP != nil {
@@ -165,8 +381,58 @@ func LoadIPAMConfig(bytes []byte, envArgs string) (*IPAMConfig, string, error) {
 		}
 	}
 
+	seen := map[string]bool{}
+	for i := range n.IPAM.ReservedAddresses {
+		addr := &n.IPAM.ReservedAddresses[i].IP
+		if *addr == nil {
+			return nil, "", fmt.Errorf("invalid reservedAddresses entry %d: missing ip", i)
+		}
+		if err := canonicalizeIP(addr); err != nil {
+			return nil, "", fmt.Errorf("invalid reservedAddresses entry %d: %v", i, err)
+		}
+		covered := false
+		for _, rangeset := range n.IPAM.Ranges {
+			if rangeset.Contains(*addr) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return nil, "", fmt.Errorf("reserved address %s is not in any configured range", *addr)
+		}
+		if seen[addr.String()] {
+			return nil, "", fmt.Errorf("reserved address %s is listed more than once", *addr)
+		}
+		seen[addr.String()] = true
+	}
+
 	// Copy net name into IPAM so not to drag Net struct around
 	n.IPAM.Name = n.Name
 
 	return n.IPAM, n.CNIVersion, nil
 }
+
+// ReservedReason returns the reason ip is one of the ReservedAddresses,
+// and false if it is not one of them.
+func (c *IPAMConfig) ReservedReason(ip net.IP) (string, bool) {
+	for _, r := range c.ReservedAddresses {
+		if r.IP.Equal(ip) {
+			return r.Reason, true
+		}
+	}
+	return "", false
+}
+
+// podOrdinal returns the ordinal a StatefulSet appends to the names of its
+// pods, or nil if name does not end in one.
+func podOrdinal(name string) *int {
+	i := strings.LastIndex(name, "-")
+	if i < 0 {
+		return nil
+	}
+	ordinal, err := strconv.Atoi(name[i+1:])
+	if err != nil || ordinal < 0 || strconv.Itoa(ordinal) != name[i+1:] {
+		return nil
+	}
+	return &ordinal
+}
@@ -15,6 +15,7 @@
 package allocator
 
 import (
+	"fmt"
 	"net"
 
 	"github.com/containernetworking/cni/pkg/types"
@@ -478,4 +479,121 @@ var _ = Describe("IPAM config", func() {
 			net.ParseIP("2001:db8::1"),
 		}))
 	})
+	It("Should parse and validate reserved addresses", func() {
+		input := `{
+			"cniVersion": "0.3.1",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"reservedAddresses": [
+					{"ip": "10.1.2.10", "reason": "dns"},
+					{"ip": "10.1.2.11"}
+				]
+			}
+		}`
+		conf, _, err := LoadIPAMConfig([]byte(input), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.ReservedAddresses).To(Equal([]ReservedAddress{
+			{IP: net.IPv4(10, 1, 2, 10).To4(), Reason: "dns"},
+			{IP: net.IPv4(10, 1, 2, 11).To4()},
+		}))
+		reason, ok := conf.ReservedReason(net.ParseIP("10.1.2.10"))
+		Expect(ok).To(BeTrue())
+		Expect(reason).To(Equal("dns"))
+		_, ok = conf.ReservedReason(net.ParseIP("10.1.2.12"))
+		Expect(ok).To(BeFalse())
+
+		for _, tc := range []struct {
+			reserved string
+			expErr   string
+		}{
+			{`[{"ip": "10.1.3.10", "reason": "dns"}]`, "reserved address 10.1.3.10 is not in any configured range"},
+			{`[{"ip": "10.1.2.10"}, {"ip": "10.1.2.10"}]`, "reserved address 10.1.2.10 is listed more than once"},
+			{`[{"reason": "dns"}]`, "invalid reservedAddresses entry 0: missing ip"},
+		} {
+			input := fmt.Sprintf(`{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.2.0/24",
+					"reservedAddresses": %s
+				}
+			}`, tc.reserved)
+			_, _, err := LoadIPAMConfig([]byte(input), "")
+			Expect(err).To(MatchError(tc.expErr))
+		}
+	})
+	It("Should parse and validate quotas", func() {
+		input := `{
+			"cniVersion": "0.3.1",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"layoutVersion": 2,
+				"quota": {"soft": 5, "hard": 10}
+			}
+		}`
+		conf, _, err := LoadIPAMConfig([]byte(input), "K8S_POD_NAMESPACE=team-a;K8S_POD_NAME=web-0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.Quota).To(Equal(&Quota{Soft: 5, Hard: 10}))
+		Expect(conf.Namespace).To(Equal("team-a"))
+
+		for _, tc := range []struct {
+			layout int
+			quota  string
+			expErr string
+		}{
+			{2, `{"soft": 10, "hard": 5}`, "quota: soft 10 is above hard 5"},
+			{2, `{"hard": -1}`, "quota: soft and hard must not be negative"},
+			{1, `{"hard": 5}`, "quota requires layoutVersion 2, which records the namespace of the reservations"},
+		} {
+			input := fmt.Sprintf(`{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.1.2.0/24",
+					"layoutVersion": %d,
+					"quota": %s
+				}
+			}`, tc.layout, tc.quota)
+			_, _, err := LoadIPAMConfig([]byte(input), "")
+			Expect(err).To(MatchError(tc.expErr))
+		}
+	})
+	It("Should parse the MAC for the mac strategy", func() {
+		input := `{
+			"cniVersion": "0.3.1",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"subnet": "10.1.2.0/24",
+				"allocationStrategy": "mac"
+			}%s
+		}`
+		conf, _, err := LoadIPAMConfig([]byte(fmt.Sprintf(input, "")), "IgnoreUnknown=1;MAC=0a:58:0a:01:02:04")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.MAC.String()).To(Equal("0a:58:0a:01:02:04"))
+
+		// runtimeConfig takes precedence, like with the bridge plugin
+		conf, _, err = LoadIPAMConfig([]byte(fmt.Sprintf(input, `, "runtimeConfig": {"mac": "0a:58:0a:01:02:05"}`)), "IgnoreUnknown=1;MAC=0a:58:0a:01:02:04")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conf.MAC.String()).To(Equal("0a:58:0a:01:02:05"))
+
+		_, _, err = LoadIPAMConfig([]byte(fmt.Sprintf(input, "")), "IgnoreUnknown=1;MAC=nope")
+		Expect(err).To(MatchError(`invalid mac "nope": address nope: invalid MAC address`))
+	})
 })
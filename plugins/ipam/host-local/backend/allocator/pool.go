@@ -0,0 +1,113 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+)
+
+// LoadPool reads the addresses available for allocation from an externally
+// maintained pool file. The file is either a JSON array of addresses, or
+// one address per line with any further comma-separated fields ignored.
+// Empty lines and lines starting with '#' are skipped. The file is read on
+// every invocation, so updates to it are picked up by the next ADD.
+func LoadPool(path string) ([]net.IP, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pool file: %v", err)
+	}
+
+	var entries []string
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &entries); err != nil {
+			return nil, fmt.Errorf("failed to parse pool file %s: %v", path, err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || line[0] == '#' {
+				continue
+			}
+			entries = append(entries, strings.TrimSpace(strings.Split(line, ",")[0]))
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	pool := make([]net.IP, 0, len(entries))
+	for _, entry := range entries {
+		addr := net.ParseIP(entry)
+		if addr == nil {
+			return nil, fmt.Errorf("invalid address %q in pool file %s", entry, path)
+		}
+		if err := canonicalizeIP(&addr); err != nil {
+			return nil, err
+		}
+		pool = append(pool, addr)
+	}
+	return pool, nil
+}
+
+// SetPool restricts the allocator to the addresses of pool which fall
+// within its range set. Addresses belonging to other range sets are
+// ignored.
+func (a *IPAllocator) SetPool(pool []net.IP) {
+	a.pool = []net.IP{}
+	for _, addr := range pool {
+		if a.rangeset.Contains(addr) {
+			a.pool = append(a.pool, addr)
+		}
+	}
+}
+
+func (a *IPAllocator) inPool(addr net.IP) bool {
+	for _, p := range a.pool {
+		if p.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextFromPool reserves the first free pool address, which is not the
+// gateway of its range nor one passed to SetReserved.
+func (a *IPAllocator) nextFromPool(id string, ifname string) (*net.IPNet, net.IP, error) {
+	for _, addr := range a.pool {
+		r, err := a.rangeset.RangeFor(addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if addr.Equal(r.Gateway) || a.isReserved(addr) {
+			continue
+		}
+
+		reserved, err := a.store.Reserve(id, ifname, addr, a.rangeID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if reserved {
+			return &net.IPNet{IP: addr, Mask: r.Subnet.Mask}, r.Gateway, nil
+		}
+	}
+	return nil, nil, nil
+}
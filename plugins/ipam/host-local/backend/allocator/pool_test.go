@@ -0,0 +1,94 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("address pool", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "pool_test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	writePool := func(contents string) string {
+		path := filepath.Join(tmpDir, "pool")
+		Expect(ioutil.WriteFile(path, []byte(contents), 0644)).To(Succeed())
+		return path
+	}
+
+	It("loads a JSON pool file", func() {
+		pool, err := LoadPool(writePool(`["192.168.1.4", "2001:db8::5"]`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pool).To(Equal([]net.IP{
+			{192, 168, 1, 4},
+			net.ParseIP("2001:db8::5"),
+		}))
+	})
+
+	It("loads a CSV pool file", func() {
+		pool, err := LoadPool(writePool(`# address,owner
+192.168.1.4,rack1
+
+192.168.1.5
+`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pool).To(Equal([]net.IP{{192, 168, 1, 4}, {192, 168, 1, 5}}))
+	})
+
+	It("rejects invalid addresses", func() {
+		path := writePool("192.168.1.4\nnot-an-ip\n")
+		_, err := LoadPool(path)
+		Expect(err).To(MatchError(`invalid address "not-an-ip" in pool file ` + path))
+	})
+
+	It("allocates only from the pool", func() {
+		alloc := mkalloc()
+		alloc.SetPool([]net.IP{
+			{10, 0, 0, 9}, // not in the range set
+			{192, 168, 1, 5},
+			{192, 168, 1, 3},
+		})
+
+		res, err := alloc.Get("ID1", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Address.String()).To(Equal("192.168.1.5/29"))
+
+		res, err = alloc.Get("ID2", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Address.String()).To(Equal("192.168.1.3/29"))
+
+		_, err = alloc.Get("ID3", "eth0", nil)
+		Expect(err).To(MatchError("no IP addresses available in the address pool for range set: 192.168.1.1-192.168.1.6"))
+		Expect(err).To(BeAssignableToTypeOf(&ExhaustedError{}))
+
+		_, err = alloc.Get("ID4", "eth0", net.IP{192, 168, 1, 4})
+		Expect(err).To(MatchError("requested ip 192.168.1.4 is not in the address pool"))
+	})
+})
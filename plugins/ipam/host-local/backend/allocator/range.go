@@ -30,9 +30,10 @@ func (r *Range) Canonicalize() error {
 	}
 
 	// Can't create an allocator for a network with no addresses, eg
-	// a /32 or /31
+	// a /32. Point-to-point networks (RFC 3021 /31s and /127s) have no
+	// network or broadcast address, so both of their addresses are usable.
 	ones, masklen := r.Subnet.Mask.Size()
-	if ones > masklen-2 {
+	if ones > masklen-1 {
 		return fmt.Errorf("Network %s too small to allocate from", (*net.IPNet)(&r.Subnet).String())
 	}
 
@@ -46,10 +47,11 @@ func (r *Range) Canonicalize() error {
 		return fmt.Errorf("Network has host bits set. For a subnet mask of length %d the network address is %s", ones, networkIP.String())
 	}
 
-	// If the gateway is nil, claim .1
-	if r.Gateway == nil {
+	// If the gateway is nil, claim .1, unless there is no address to spare
+	pointToPoint := ones == masklen-1
+	if r.Gateway == nil && !pointToPoint {
 		r.Gateway = ip.NextIP(r.Subnet.IP)
-	} else {
+	} else if r.Gateway != nil {
 		if err := canonicalizeIP(&r.Gateway); err != nil {
 			return err
 		}
@@ -66,6 +68,8 @@ func (r *Range) Canonicalize() error {
 		if !r.Contains(r.RangeStart) {
 			return fmt.Errorf("RangeStart %s not in network %s", r.RangeStart.String(), (*net.IPNet)(&r.Subnet).String())
 		}
+	} else if pointToPoint {
+		r.RangeStart = r.Subnet.IP
 	} else {
 		r.RangeStart = ip.NextIP(r.Subnet.IP)
 	}
@@ -87,6 +91,34 @@ func (r *Range) Canonicalize() error {
 	return nil
 }
 
+// Narrow returns the part of a canonicalized range that lies in slice, a
+// subnet of it. RangeStart and RangeEnd are clamped to the slice, and a
+// gateway outside of it is an error. Values that are the defaults for the
+// whole subnet are taken as unset and default to those of the slice.
+func (r *Range) Narrow(slice *net.IPNet) (*Range, error) {
+	n := &Range{Subnet: types.IPNet(*slice), DNS: r.DNS}
+	if !r.Gateway.Equal(ip.NextIP(r.Subnet.IP)) {
+		n.Gateway = r.Gateway
+	}
+	if err := n.Canonicalize(); err != nil {
+		return nil, err
+	}
+	if n.Gateway != nil && !slice.Contains(n.Gateway) {
+		return nil, fmt.Errorf("gateway %s is outside the node's slice %s", n.Gateway, slice)
+	}
+
+	if ip.Cmp(r.RangeStart, n.RangeStart) > 0 {
+		n.RangeStart = r.RangeStart
+	}
+	if ip.Cmp(r.RangeEnd, n.RangeEnd) < 0 {
+		n.RangeEnd = r.RangeEnd
+	}
+	if ip.Cmp(n.RangeStart, n.RangeEnd) > 0 {
+		return nil, fmt.Errorf("range %s does not overlap the node's slice %s", r, slice)
+	}
+	return n, nil
+}
+
 // IsValidIP checks if a given ip is a valid, allocatable address in a given Range
 func (r *Range) Contains(addr net.IP) bool {
 	if err := canonicalizeIP(&addr); err != nil {
@@ -152,13 +184,14 @@ func canonicalizeIP(ip *net.IP) error {
 	return fmt.Errorf("IP %s not v4 nor v6", *ip)
 }
 
-// Determine the last IP of a subnet, excluding the broadcast if IPv4
+// Determine the last IP of a subnet, excluding the broadcast if IPv4.
+// A /31 has no broadcast address.
 func lastIP(subnet types.IPNet) net.IP {
 	var end net.IP
 	for i := 0; i < len(subnet.IP); i++ {
 		end = append(end, subnet.IP[i]|^subnet.Mask[i])
 	}
-	if subnet.IP.To4() != nil {
+	if ones, _ := subnet.Mask.Size(); subnet.IP.To4() != nil && ones < 31 {
 		end[3]--
 	}
 
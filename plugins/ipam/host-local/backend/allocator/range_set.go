@@ -41,6 +41,17 @@ func (s *RangeSet) RangeFor(addr net.IP) (*Range, error) {
 	return nil, fmt.Errorf("%s not in range set %s", addr.String(), s.String())
 }
 
+// HasGateway returns true if any range in this set has a gateway. Point-to-
+// point ranges have none.
+func (s *RangeSet) HasGateway() bool {
+	for _, r := range *s {
+		if r.Gateway != nil {
+			return true
+		}
+	}
+	return false
+}
+
 // Overlaps returns true if any ranges in any set overlap with this one
 func (s *RangeSet) Overlaps(p1 *RangeSet) bool {
 	for _, r := range *s {
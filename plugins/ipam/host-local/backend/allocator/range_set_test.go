@@ -43,6 +43,18 @@ var _ = Describe("range sets", func() {
 
 	})
 
+	It("should report whether a set has a gateway", func() {
+		p := RangeSet{
+			{Subnet: mustSubnet("192.168.0.0/31")},
+		}
+		Expect(p.Canonicalize()).To(Succeed())
+		Expect(p.HasGateway()).To(BeFalse())
+
+		p = append(p, Range{Subnet: mustSubnet("172.16.1.0/24")})
+		Expect(p.Canonicalize()).To(Succeed())
+		Expect(p.HasGateway()).To(BeTrue())
+	})
+
 	It("should discover overlaps within a set", func() {
 		p := RangeSet{
 			{Subnet: mustSubnet("192.168.0.0/20")},
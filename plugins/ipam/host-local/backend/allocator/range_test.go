@@ -97,9 +97,27 @@ var _ = Describe("IP ranges", func() {
 	})
 
 	It("Should reject a network that's too small", func() {
-		r := Range{Subnet: mustSubnet("192.0.2.0/31")}
+		r := Range{Subnet: mustSubnet("192.0.2.0/32")}
 		err := r.Canonicalize()
-		Expect(err).Should(MatchError("Network 192.0.2.0/31 too small to allocate from"))
+		Expect(err).Should(MatchError("Network 192.0.2.0/32 too small to allocate from"))
+	})
+
+	It("should use both addresses of a point-to-point network", func() {
+		r := Range{Subnet: mustSubnet("192.0.2.0/31")}
+		Expect(r.Canonicalize()).To(Succeed())
+		Expect(r).To(Equal(Range{
+			Subnet:     networkSubnet("192.0.2.0/31"),
+			RangeStart: net.IP{192, 0, 2, 0},
+			RangeEnd:   net.IP{192, 0, 2, 1},
+		}))
+
+		r = Range{Subnet: mustSubnet("2001:db8::/127")}
+		Expect(r.Canonicalize()).To(Succeed())
+		Expect(r).To(Equal(Range{
+			Subnet:     networkSubnet("2001:db8::/127"),
+			RangeStart: net.ParseIP("2001:db8::"),
+			RangeEnd:   net.ParseIP("2001:db8::1"),
+		}))
 	})
 
 	It("should reject invalid RangeStart and RangeEnd specifications", func() {
@@ -174,6 +192,51 @@ var _ = Describe("IP ranges", func() {
 		Expect(r.Contains(net.ParseIP("2001:db8:1::51"))).Should(BeFalse())
 	})
 
+	It("should narrow a range to a slice of it", func() {
+		canonical := func(r Range) *Range {
+			Expect(r.Canonicalize()).To(Succeed())
+			return &r
+		}
+		_, slice, _ := net.ParseCIDR("10.1.1.0/24")
+
+		// defaults of the subnet become those of the slice
+		r, err := canonical(Range{Subnet: mustSubnet("10.1.0.0/16")}).Narrow(slice)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*r).To(Equal(Range{
+			Subnet:     networkSubnet("10.1.1.0/24"),
+			RangeStart: net.IP{10, 1, 1, 1},
+			RangeEnd:   net.IP{10, 1, 1, 254},
+			Gateway:    net.IP{10, 1, 1, 1},
+		}))
+
+		// the bounds are clamped, the gateway kept
+		r, err = canonical(Range{
+			Subnet:     mustSubnet("10.1.0.0/16"),
+			RangeStart: net.ParseIP("10.1.0.100"),
+			RangeEnd:   net.ParseIP("10.1.1.200"),
+			Gateway:    net.ParseIP("10.1.1.254"),
+		}).Narrow(slice)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*r).To(Equal(Range{
+			Subnet:     networkSubnet("10.1.1.0/24"),
+			RangeStart: net.IP{10, 1, 1, 1},
+			RangeEnd:   net.IP{10, 1, 1, 200},
+			Gateway:    net.IP{10, 1, 1, 254},
+		}))
+
+		_, err = canonical(Range{
+			Subnet:  mustSubnet("10.1.0.0/16"),
+			Gateway: net.ParseIP("10.1.0.254"),
+		}).Narrow(slice)
+		Expect(err).To(MatchError("gateway 10.1.0.254 is outside the node's slice 10.1.1.0/24"))
+
+		_, err = canonical(Range{
+			Subnet:     mustSubnet("10.1.0.0/16"),
+			RangeStart: net.ParseIP("10.1.2.1"),
+		}).Narrow(slice)
+		Expect(err).To(MatchError("range 10.1.2.1-10.1.255.254 does not overlap the node's slice 10.1.1.0/24"))
+	})
+
 	DescribeTable("Detecting overlap",
 		func(r1 Range, r2 Range, expected bool) {
 			r1.Canonicalize()
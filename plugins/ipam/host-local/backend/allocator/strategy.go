@@ -0,0 +1,385 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/big"
+	"net"
+	"sort"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+)
+
+// Allocation strategies selectable with the allocationStrategy option.
+const (
+	RoundRobinStrategy = "roundrobin"
+	RandomStrategy     = "random"
+	StickyStrategy     = "sticky"
+	OrdinalStrategy    = "ordinal"
+	HashStrategy       = "hash"
+	MACStrategy        = "mac"
+)
+
+// hugeSetSize is the number of addresses in a /64. Larger sets cannot be
+// run through in order and are allocated from with hash by default.
+var hugeSetSize = new(big.Int).Lsh(big.NewInt(1), 64)
+
+// maxHashProbes is the number of hashed addresses hash tries.
+const maxHashProbes = 64
+
+// Strategy decides the order in which the addresses of a range set are
+// tried. The allocator calls Next until it manages to reserve the address
+// returned, so Next must eventually return nil once every address of the
+// set has been returned.
+type Strategy interface {
+	Next(free *FreeSet) (*net.IPNet, net.IP)
+}
+
+// FreeSet is the range set a Strategy allocates from. The allocator passes
+// a new FreeSet for every allocation. Which addresses are free is only
+// known once they are tried, so strategies pick where to start and the
+// allocator skips over the reserved ones.
+type FreeSet struct {
+	a *IPAllocator
+}
+
+// Size returns the number of addresses in the set, gateways included.
+func (f *FreeSet) Size() *big.Int {
+	size := big.NewInt(0)
+	for _, r := range *f.a.rangeset {
+		size.Add(size, rangeSize(&r))
+	}
+	return size
+}
+
+func rangeSize(r *Range) *big.Int {
+	size := new(big.Int).SetBytes(r.RangeEnd)
+	size.Sub(size, new(big.Int).SetBytes(r.RangeStart))
+	return size.Add(size, big.NewInt(1))
+}
+
+// At returns the address offset places after the start of the set,
+// counting on into the next range once one is exhausted, and its gateway.
+// It returns nil if the set has fewer addresses.
+func (f *FreeSet) At(offset *big.Int) (*net.IPNet, net.IP) {
+	offset = new(big.Int).Set(offset)
+	for _, r := range *f.a.rangeset {
+		size := rangeSize(&r)
+		if offset.Cmp(size) >= 0 {
+			offset.Sub(offset, size)
+			continue
+		}
+		addr := offset.Add(offset, new(big.Int).SetBytes(r.RangeStart))
+		return &net.IPNet{IP: intToIP(addr, len(r.RangeStart)), Mask: r.Subnet.Mask}, r.Gateway
+	}
+	return nil, nil
+}
+
+// Usable returns the address offset places after the start of the set
+// like At, but counts only the addresses that can be allocated: the
+// gateways and the addresses passed to SetReserved are skipped.
+func (f *FreeSet) Usable(offset *big.Int) (*net.IPNet, net.IP) {
+	offset = new(big.Int).Set(offset)
+	for _, r := range *f.a.rangeset {
+		skipped := f.skipped(&r)
+		size := rangeSize(&r)
+		size.Sub(size, big.NewInt(int64(len(skipped))))
+		if offset.Cmp(size) >= 0 {
+			offset.Sub(offset, size)
+			continue
+		}
+		addr := offset.Add(offset, new(big.Int).SetBytes(r.RangeStart))
+		for _, skip := range skipped {
+			if skip.Cmp(addr) <= 0 {
+				addr.Add(addr, big.NewInt(1))
+			}
+		}
+		return &net.IPNet{IP: intToIP(addr, len(r.RangeStart)), Mask: r.Subnet.Mask}, r.Gateway
+	}
+	return nil, nil
+}
+
+// skipped returns the addresses of r that are never allocated, in order.
+func (f *FreeSet) skipped(r *Range) []*big.Int {
+	addrs := []net.IP{r.Gateway}
+	for reserved := range f.a.reserved {
+		addrs = append(addrs, net.ParseIP(reserved))
+	}
+	seen := map[string]bool{}
+	var skipped []*big.Int
+	for _, addr := range addrs {
+		if addr == nil || !r.Contains(addr) || seen[addr.String()] {
+			continue
+		}
+		seen[addr.String()] = true
+		if v4 := addr.To4(); v4 != nil {
+			addr = v4
+		}
+		skipped = append(skipped, new(big.Int).SetBytes(addr))
+	}
+	sort.Slice(skipped, func(i, j int) bool { return skipped[i].Cmp(skipped[j]) < 0 })
+	return skipped
+}
+
+func intToIP(i *big.Int, size int) net.IP {
+	b := i.Bytes()
+	ip := make(net.IP, size)
+	copy(ip[size-len(b):], b)
+	return ip
+}
+
+// From returns an iterator over the whole set which starts at addr and
+// wraps around. It starts at the beginning if addr is not in the set.
+func (f *FreeSet) From(addr net.IP) *RangeIter {
+	iter := &RangeIter{rangeset: f.a.rangeset}
+	for i, r := range *f.a.rangeset {
+		if r.Contains(addr) {
+			iter.rangeIdx = i
+			if !addr.Equal(r.RangeStart) {
+				// Next advances before returning anything
+				iter.cur = ip.PrevIP(addr)
+			}
+			break
+		}
+	}
+	return iter
+}
+
+// cursor walks a FreeSet, starting over for every new one.
+type cursor struct {
+	free *FreeSet
+	iter *RangeIter
+}
+
+func (c *cursor) next(free *FreeSet, start func() *RangeIter) (*net.IPNet, net.IP) {
+	if c.free != free || c.iter == nil {
+		c.free, c.iter = free, start()
+	}
+	return c.iter.Next()
+}
+
+// roundRobin continues after the address reserved last, so a crash-looping
+// container does not see the same address until the whole set has been
+// run through.
+type roundRobin struct {
+	cursor
+}
+
+func (s *roundRobin) Next(free *FreeSet) (*net.IPNet, net.IP) {
+	return s.next(free, func() *RangeIter {
+		iter, _ := free.a.GetIter()
+		return iter
+	})
+}
+
+// random starts at a random address, spreading allocations over the set
+// so that released addresses are unlikely to be handed out again soon.
+type random struct {
+	cursor
+}
+
+func (s *random) Next(free *FreeSet) (*net.IPNet, net.IP) {
+	return s.next(free, func() *RangeIter {
+		offset, err := rand.Int(rand.Reader, free.Size())
+		if err != nil {
+			log.Printf("failed to pick a random address, starting at the beginning: %v", err)
+			offset = big.NewInt(0)
+		}
+		start, _ := free.At(offset)
+		return free.From(start.IP)
+	})
+}
+
+// sticky starts at an address derived from key, so a pod that is
+// recreated under the same name gets its previous address back while
+// nobody else has taken it.
+type sticky struct {
+	cursor
+	key string
+}
+
+func (s *sticky) Next(free *FreeSet) (*net.IPNet, net.IP) {
+	return s.next(free, func() *RangeIter {
+		h := fnv.New64a()
+		h.Write([]byte(s.key))
+		offset := new(big.Int).SetUint64(h.Sum64())
+		start, _ := free.At(offset.Mod(offset, free.Size()))
+		return free.From(start.IP)
+	})
+}
+
+// ordinal tries the ordinal-th usable address of the set first, so the
+// gateway and reserved addresses do not take up ordinals, then continues
+// like roundRobin. Without an ordinal it is roundRobin.
+type ordinal struct {
+	roundRobin
+	ordinal *int
+}
+
+func (s *ordinal) Next(free *FreeSet) (*net.IPNet, net.IP) {
+	if s.ordinal == nil {
+		return s.roundRobin.Next(free)
+	}
+	if s.free != free {
+		s.free, s.iter = free, nil
+		addr, gw := free.Usable(big.NewInt(int64(*s.ordinal)))
+		if addr != nil {
+			return addr, gw
+		}
+	}
+	if s.iter == nil {
+		log.Printf("address for ordinal %d in range %s is not available, allocating another", *s.ordinal, free.a.rangeID)
+	}
+	return s.roundRobin.Next(free)
+}
+
+// hashed tries addresses derived from key, so a container is allocated
+// the same address every time it is free, whatever the size of the set.
+// If all probes are taken it continues in order, except in sets larger
+// than a /64: one that many probes found no room in is as good as full.
+type hashed struct {
+	cursor
+	key   string
+	probe int
+	last  net.IP
+	tried map[string]bool
+}
+
+func (s *hashed) Next(free *FreeSet) (*net.IPNet, net.IP) {
+	if s.free != free {
+		s.free, s.iter, s.probe, s.tried = free, nil, 0, map[string]bool{}
+	}
+	size := free.Size()
+	for s.iter == nil && s.probe < maxHashProbes {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d", s.key, s.probe)))
+		s.probe++
+		offset := new(big.Int).SetBytes(sum[:])
+		addr, gw := free.At(offset.Mod(offset, size))
+		s.last = addr.IP
+		if !addr.IP.Equal(gw) && !s.tried[addr.IP.String()] {
+			s.tried[addr.IP.String()] = true
+			return addr, gw
+		}
+	}
+	if size.Cmp(hugeSetSize) > 0 {
+		return nil, nil
+	}
+	for {
+		addr, gw := s.next(free, func() *RangeIter { return free.From(s.last) })
+		if addr == nil || !s.tried[addr.IP.String()] {
+			return addr, gw
+		}
+	}
+}
+
+// macAffinity tries first the address of every range of the set whose
+// host part is the low bits of mac, e.g. the last octet of the MAC in a
+// /24, so each MAC keeps its address. It then continues like roundRobin,
+// which is all it does without a MAC.
+type macAffinity struct {
+	roundRobin
+	mac   net.HardwareAddr
+	tried int // Ranges whose address for mac has been returned
+}
+
+func (s *macAffinity) Next(free *FreeSet) (*net.IPNet, net.IP) {
+	if s.mac == nil {
+		return s.roundRobin.Next(free)
+	}
+	if s.free != free {
+		s.free, s.iter, s.tried = free, nil, 0
+	}
+	ranges := *free.a.rangeset
+	for s.iter == nil && s.tried < len(ranges) {
+		r := &ranges[s.tried]
+		s.tried++
+		if addr := macAddr(r, s.mac); addr != nil && !addr.Equal(r.Gateway) {
+			return &net.IPNet{IP: addr, Mask: r.Subnet.Mask}, r.Gateway
+		}
+	}
+	if s.iter == nil {
+		log.Printf("address for MAC %s in range %s is not available, allocating another", s.mac, free.a.rangeID)
+	}
+	return s.roundRobin.Next(free)
+}
+
+// macAddr returns the address of r's subnet whose host part is the low
+// bits of mac, or nil if it is outside r.
+func macAddr(r *Range, mac net.HardwareAddr) net.IP {
+	ones, bits := r.Subnet.Mask.Size()
+	host := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	host.Sub(host, big.NewInt(1))
+	host.And(host, new(big.Int).SetBytes(mac))
+
+	subnet := r.Subnet.IP.To16()
+	if len(r.RangeStart) == net.IPv4len {
+		subnet = r.Subnet.IP.To4()
+	}
+	addr := intToIP(host.Or(host, new(big.Int).SetBytes(subnet)), len(r.RangeStart))
+	if !r.Contains(addr) {
+		return nil
+	}
+	return addr
+}
+
+// auto is the default: roundRobin, and hashed in sets larger than a /64.
+type auto struct {
+	roundRobin
+	hashed hashed
+}
+
+func (s *auto) Next(free *FreeSet) (*net.IPNet, net.IP) {
+	if free.Size().Cmp(hugeSetSize) > 0 {
+		return s.hashed.Next(free)
+	}
+	return s.roundRobin.Next(free)
+}
+
+func validateStrategy(name string) error {
+	switch name {
+	case "", RoundRobinStrategy, RandomStrategy, StickyStrategy, OrdinalStrategy, HashStrategy, MACStrategy:
+		return nil
+	}
+	return fmt.Errorf("unknown allocationStrategy %q", name)
+}
+
+// NewStrategy returns the configured strategy for allocating an address
+// for the container's interface. Every range set needs its own.
+func NewStrategy(conf *IPAMConfig, id string, ifname string) Strategy {
+	switch conf.AllocationStrategy {
+	case RandomStrategy:
+		return &random{}
+	case StickyStrategy:
+		key := conf.Pod
+		if key == "" {
+			key = id
+		}
+		return &sticky{key: key + "/" + ifname}
+	case OrdinalStrategy:
+		return &ordinal{ordinal: conf.Ordinal}
+	case RoundRobinStrategy:
+		return &roundRobin{}
+	case HashStrategy:
+		return &hashed{key: id + "/" + ifname}
+	case MACStrategy:
+		return &macAffinity{mac: conf.MAC}
+	}
+	return &auto{hashed: hashed{key: id + "/" + ifname}}
+}
@@ -0,0 +1,266 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocator
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	fakestore "github.com/containernetworking/plugins/plugins/ipam/host-local/backend/testing"
+)
+
+var _ = Describe("allocation strategies", func() {
+	three := 3
+
+	newStrategy := func(name string, ordinal *int) Strategy {
+		return NewStrategy(&IPAMConfig{AllocationStrategy: name, Pod: "default/web", Ordinal: ordinal}, "ID", "eth0")
+	}
+
+	// drain collects what the strategy returns until it gives up.
+	drain := func(a *IPAllocator, s Strategy) []string {
+		free := &FreeSet{a: a}
+		var addrs []string
+		for {
+			addr, gw := s.Next(free)
+			if addr == nil {
+				return addrs
+			}
+			Expect(gw).To(Equal(net.IP{192, 168, 1, 1}))
+			addrs = append(addrs, addr.IP.String())
+		}
+	}
+
+	for _, name := range []string{RoundRobinStrategy, RandomStrategy, StickyStrategy, OrdinalStrategy, HashStrategy, MACStrategy} {
+		name := name
+		It("returns every address of the set with "+name, func() {
+			a := mkalloc()
+			Expect(drain(&a, newStrategy(name, nil))).To(ConsistOf(
+				"192.168.1.2", "192.168.1.3", "192.168.1.4", "192.168.1.5", "192.168.1.6"))
+
+			// and starts over for the next allocation
+			a.SetStrategy(newStrategy(name, nil))
+			for i := 0; i < 5; i++ {
+				_, err := a.Get("ID", "eth0", nil)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(a.store.ReleaseByID("ID", "eth0")).To(Succeed())
+			}
+		})
+	}
+
+	It("continues after the last reserved address with roundrobin", func() {
+		a := mkalloc()
+		a.store.Reserve("other", "eth0", net.IP{192, 168, 1, 4}, a.rangeID)
+		Expect(drain(&a, newStrategy(RoundRobinStrategy, nil))).To(Equal([]string{
+			"192.168.1.5", "192.168.1.6", "192.168.1.2", "192.168.1.3", "192.168.1.4"}))
+	})
+
+	It("allocates every address with random", func() {
+		a := mkalloc()
+		a.SetStrategy(newStrategy(RandomStrategy, nil))
+		allocated := map[string]bool{}
+		for _, id := range []string{"a", "b", "c", "d", "e"} {
+			ipc, err := a.Get(id, "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			allocated[ipc.Address.IP.String()] = true
+		}
+		Expect(allocated).To(HaveLen(5))
+		_, err := a.Get("f", "eth0", nil)
+		Expect(err).To(MatchError("no IP addresses available in range set: 192.168.1.1-192.168.1.6"))
+	})
+
+	It("allocates a recreated pod its previous address with sticky", func() {
+		a := mkalloc()
+		a.SetStrategy(newStrategy(StickyStrategy, nil))
+		first, err := a.Get("ID", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a.Release("ID", "eth0")).To(Succeed())
+
+		// someone else is allocated in between
+		_, err = a.Get("other", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(a.Release("other", "eth0")).To(Succeed())
+
+		a.SetStrategy(NewStrategy(&IPAMConfig{AllocationStrategy: StickyStrategy, Pod: "default/web"}, "ID2", "eth0"))
+		second, err := a.Get("ID2", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(second.Address).To(Equal(first.Address))
+	})
+
+	It("tries the address of the ordinal first with ordinal", func() {
+		a := mkalloc()
+		Expect(drain(&a, newStrategy(OrdinalStrategy, &three))[0]).To(Equal("192.168.1.5"))
+
+		a.SetStrategy(newStrategy(OrdinalStrategy, &three))
+		ipc, err := a.Get("ID", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipc.Address.IP).To(Equal(net.IP{192, 168, 1, 5}))
+
+		// taken, so it continues after the last reserved address
+		a.SetStrategy(newStrategy(OrdinalStrategy, &three))
+		ipc, err = a.Get("ID2", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipc.Address.IP).To(Equal(net.IP{192, 168, 1, 6}))
+	})
+
+	It("counts ordinals from the first usable address with the default rangeStart", func() {
+		// rangeStart defaults to the gateway, which takes no ordinal
+		a := mkalloc()
+		Expect((*a.rangeset)[0].RangeStart).To(Equal(net.IP{192, 168, 1, 1}))
+		for ordinal, addr := range []net.IP{{192, 168, 1, 2}, {192, 168, 1, 3}, {192, 168, 1, 4}} {
+			ordinal := ordinal
+			a.SetStrategy(newStrategy(OrdinalStrategy, &ordinal))
+			ipc, err := a.Get(fmt.Sprintf("app-%d", ordinal), "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ipc.Address.IP).To(Equal(addr))
+		}
+
+		// nor do reserved addresses
+		a = mkalloc()
+		a.SetReserved([]ReservedAddress{{IP: net.IP{192, 168, 1, 3}}})
+		one := 1
+		a.SetStrategy(newStrategy(OrdinalStrategy, &one))
+		ipc, err := a.Get("app-1", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipc.Address.IP).To(Equal(net.IP{192, 168, 1, 4}))
+	})
+
+	It("counts ordinals on into the next range", func() {
+		p := RangeSet{
+			Range{Subnet: mustSubnet("192.168.1.0/30")},
+			Range{Subnet: mustSubnet("192.168.2.0/30")},
+		}
+		Expect(p.Canonicalize()).To(Succeed())
+		a := mkalloc()
+		a.rangeset = &p
+		// 192.168.1.1 and 192.168.2.1 are the gateways
+		one := 1
+		addr, gw := newStrategy(OrdinalStrategy, &one).Next(&FreeSet{a: &a})
+		Expect(addr.IP).To(Equal(net.IP{192, 168, 2, 2}))
+		Expect(gw).To(Equal(net.IP{192, 168, 2, 1}))
+	})
+
+	It("never allocates the gateway for an ordinal", func() {
+		zero := 0
+		a := mkalloc()
+		a.SetStrategy(newStrategy(OrdinalStrategy, &zero))
+		ipc, err := a.Get("ID", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipc.Address.IP).To(Equal(net.IP{192, 168, 1, 2}))
+	})
+
+	It("allocates the address of the MAC with mac", func() {
+		macStrategy := func(mac string) Strategy {
+			hw, err := net.ParseMAC(mac)
+			Expect(err).NotTo(HaveOccurred())
+			return NewStrategy(&IPAMConfig{AllocationStrategy: MACStrategy, MAC: hw}, "ID", "eth0")
+		}
+
+		a := mkalloc()
+		a.SetStrategy(macStrategy("0a:58:0a:01:02:04"))
+		ipc, err := a.Get("ID", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipc.Address.IP).To(Equal(net.IP{192, 168, 1, 4}))
+
+		// taken, so it continues after the last reserved address
+		a.SetStrategy(macStrategy("0a:58:0a:01:02:0c"))
+		ipc, err = a.Get("ID2", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipc.Address.IP).To(Equal(net.IP{192, 168, 1, 5}))
+
+		// neither the gateway nor addresses outside the range
+		Expect(drain(&a, macStrategy("0a:58:0a:01:02:01"))[0]).To(Equal("192.168.1.6"))
+		Expect(drain(&a, macStrategy("0a:58:0a:01:02:07"))[0]).To(Equal("192.168.1.6"))
+
+		p := RangeSet{Range{Subnet: mustSubnet("2001:db8:1::/64")}}
+		Expect(p.Canonicalize()).To(Succeed())
+		v6 := IPAllocator{rangeset: &p, store: fakestore.NewFakeStore(map[string]string{}, map[string]net.IP{}), rangeID: "v6"}
+		v6.SetStrategy(macStrategy("0a:58:0a:01:02:04"))
+		ipc, err = v6.Get("ID", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipc.Address.IP.String()).To(Equal("2001:db8:1::a58:a01:204"))
+	})
+
+	It("allocates from a /48 by hashing the container ID by default", func() {
+		p := RangeSet{Range{Subnet: mustSubnet("2001:db8:1::/48")}}
+		Expect(p.Canonicalize()).To(Succeed())
+		a := IPAllocator{
+			rangeset: &p,
+			store:    fakestore.NewFakeStore(map[string]string{}, map[string]net.IP{}),
+			rangeID:  "rangeid",
+		}
+
+		start := time.Now()
+		allocated := map[string]string{}
+		for i := 0; i < 500; i++ {
+			id := fmt.Sprintf("ID%d", i)
+			a.SetStrategy(NewStrategy(&IPAMConfig{}, id, "eth0"))
+			ipc, err := a.Get(id, "eth0", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(allocated).NotTo(HaveKey(ipc.Address.IP.String()))
+			allocated[ipc.Address.IP.String()] = id
+		}
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+
+		// the same container gets the same address again
+		var addr string
+		for ip, id := range allocated {
+			if id == "ID7" {
+				addr = ip
+			}
+		}
+		Expect(a.Release("ID7", "eth0")).To(Succeed())
+		a.SetStrategy(NewStrategy(&IPAMConfig{}, "ID7", "eth0"))
+		ipc, err := a.Get("ID7", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipc.Address.IP.String()).To(Equal(addr))
+
+		// a collision moves on to the next probe
+		a.SetStrategy(&hashed{key: "ID7/eth0"})
+		ipc, err = a.Get("other", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipc.Address.IP.String()).NotTo(Equal(addr))
+	})
+
+	It("gives up after the maximum number of attempts", func() {
+		p := RangeSet{Range{Subnet: mustSubnet("10.0.0.0/8")}}
+		Expect(p.Canonicalize()).To(Succeed())
+		store := fakestore.NewFakeStore(map[string]string{}, map[string]net.IP{})
+		for i := 2; i < 12; i++ {
+			store.Reserve("other", "eth0", net.IPv4(10, 0, 0, byte(i)), "rangeid")
+		}
+		a := IPAllocator{rangeset: &p, store: store, rangeID: "other"}
+		a.SetMaxAttempts(5)
+
+		_, err := a.Get("ID", "eth0", nil)
+		var exhausted *ExhaustedError
+		Expect(errors.As(err, &exhausted)).To(BeTrue())
+		Expect(exhausted.Attempts).To(Equal(5))
+		Expect(err).To(MatchError("range set 10.0.0.1-10.255.255.254 exhausted: no IP address available in 5 attempts"))
+
+		a.SetMaxAttempts(0)
+		ipc, err := a.Get("ID", "eth0", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipc.Address.IP.String()).To(Equal("10.0.0.12"))
+	})
+
+	It("rejects unknown strategies", func() {
+		Expect(validateStrategy("leastrecent")).To(MatchError(`unknown allocationStrategy "leastrecent"`))
+	})
+})
@@ -0,0 +1,191 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"fmt"
+	"math/big"
+	"math/bits"
+	"net"
+	"strings"
+)
+
+// MaxBitmapSize is the number of addresses of the largest range set that
+// gets a Bitmap, 2MiB of it.
+const MaxBitmapSize = 1 << 24
+
+// bitmapMagic starts the header of an encoded Bitmap.
+const bitmapMagic = "host-local-bitmap-v1"
+
+// BitmapRange is a range of addresses, Start and End included.
+type BitmapRange struct {
+	Start net.IP
+	End   net.IP
+}
+
+// Bitmap records which addresses of a range set are reserved, one bit per
+// address in the order of its ranges.
+type Bitmap struct {
+	ranges []BitmapRange
+	sizes  []uint64
+	bits   []byte
+}
+
+// BitmapStore is a Store that keeps a Bitmap of each range set it
+// allocates from, so a new allocator can tell the free addresses apart
+// without trying them. The reservations stay authoritative: a Bitmap may
+// be out of date, and is rebuilt from them when it is found to be.
+type BitmapStore interface {
+	Store
+	// LoadBitmap returns the Bitmap of the range set rangeID, made of
+	// ranges, and builds it if there is none yet or the range set has
+	// changed. It returns nil for range sets larger than MaxBitmapSize.
+	LoadBitmap(rangeID string, ranges []BitmapRange) (*Bitmap, error)
+	// RebuildBitmap builds the Bitmap of the range set from the
+	// reservations.
+	RebuildBitmap(rangeID string, ranges []BitmapRange) (*Bitmap, error)
+}
+
+// NewBitmap returns an empty Bitmap for ranges, or nil if they hold more
+// than MaxBitmapSize addresses.
+func NewBitmap(ranges []BitmapRange) (*Bitmap, error) {
+	b := &Bitmap{ranges: ranges}
+	total := big.NewInt(0)
+	for _, r := range ranges {
+		if r.Start == nil || r.End == nil || len(r.Start.To16()) != len(r.End.To16()) {
+			return nil, fmt.Errorf("invalid bitmap range %s-%s", r.Start, r.End)
+		}
+		size := new(big.Int).SetBytes(r.End.To16())
+		size.Sub(size, new(big.Int).SetBytes(r.Start.To16()))
+		size.Add(size, big.NewInt(1))
+		if size.Sign() <= 0 {
+			return nil, fmt.Errorf("invalid bitmap range %s-%s", r.Start, r.End)
+		}
+		total.Add(total, size)
+		if total.Cmp(big.NewInt(MaxBitmapSize)) > 0 {
+			return nil, nil
+		}
+		b.sizes = append(b.sizes, size.Uint64())
+	}
+	b.bits = make([]byte, (total.Uint64()+7)/8)
+	return b, nil
+}
+
+// Size returns the number of addresses in the Bitmap.
+func (b *Bitmap) Size() uint64 {
+	var size uint64
+	for _, s := range b.sizes {
+		size += s
+	}
+	return size
+}
+
+// Count returns the number of addresses marked reserved.
+func (b *Bitmap) Count() uint64 {
+	var n uint64
+	for _, c := range b.bits {
+		n += uint64(bits.OnesCount8(c))
+	}
+	return n
+}
+
+// Offset returns the position of ip in the Bitmap, and false if ip is not
+// in any of its ranges.
+func (b *Bitmap) Offset(ip net.IP) (uint64, bool) {
+	addr := new(big.Int).SetBytes(ip.To16())
+	var base uint64
+	for i, r := range b.ranges {
+		start := new(big.Int).SetBytes(r.Start.To16())
+		end := new(big.Int).SetBytes(r.End.To16())
+		if (ip.To4() == nil) == (r.Start.To4() == nil) && addr.Cmp(start) >= 0 && addr.Cmp(end) <= 0 {
+			return base + new(big.Int).Sub(addr, start).Uint64(), true
+		}
+		base += b.sizes[i]
+	}
+	return 0, false
+}
+
+// Reserved reports whether ip is marked reserved.
+func (b *Bitmap) Reserved(ip net.IP) bool {
+	off, ok := b.Offset(ip)
+	return ok && b.bits[off/8]&(1<<(off%8)) != 0
+}
+
+// Set marks ip reserved or free, and returns false if it is not in the
+// Bitmap.
+func (b *Bitmap) Set(ip net.IP, reserved bool) bool {
+	off, ok := b.Offset(ip)
+	if !ok {
+		return false
+	}
+	if reserved {
+		b.bits[off/8] |= 1 << (off % 8)
+	} else {
+		b.bits[off/8] &^= 1 << (off % 8)
+	}
+	return true
+}
+
+// Header returns the first line of the encoded Bitmap, which identifies
+// its ranges.
+func (b *Bitmap) Header() string {
+	ranges := make([]string, 0, len(b.ranges))
+	for _, r := range b.ranges {
+		ranges = append(ranges, r.Start.String()+"-"+r.End.String())
+	}
+	return bitmapMagic + " " + strings.Join(ranges, ",") + "\n"
+}
+
+// Bytes returns the bits of the Bitmap, which follow the header when it
+// is encoded.
+func (b *Bitmap) Bytes() []byte {
+	return b.bits
+}
+
+// Encode returns the Bitmap as a header and its bits.
+func (b *Bitmap) Encode() []byte {
+	return append([]byte(b.Header()), b.bits...)
+}
+
+// DecodeBitmap parses an encoded Bitmap.
+func DecodeBitmap(data []byte) (*Bitmap, error) {
+	i := strings.IndexByte(string(data), '\n')
+	if i < 0 {
+		return nil, fmt.Errorf("bitmap has no header")
+	}
+	fields := strings.Fields(string(data[:i]))
+	if len(fields) != 2 || fields[0] != bitmapMagic {
+		return nil, fmt.Errorf("invalid bitmap header %q", data[:i])
+	}
+	var ranges []BitmapRange
+	for _, s := range strings.Split(fields[1], ",") {
+		parts := strings.SplitN(s, "-", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid bitmap range %q", s)
+		}
+		ranges = append(ranges, BitmapRange{Start: net.ParseIP(parts[0]), End: net.ParseIP(parts[1])})
+	}
+	b, err := NewBitmap(ranges)
+	if err != nil {
+		return nil, err
+	} else if b == nil {
+		return nil, fmt.Errorf("bitmap is too large")
+	}
+	if len(data)-i-1 != len(b.bits) {
+		return nil, fmt.Errorf("bitmap has %d bytes, expected %d", len(data)-i-1, len(b.bits))
+	}
+	copy(b.bits, data[i+1:])
+	return b, nil
+}
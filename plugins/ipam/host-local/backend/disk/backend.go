@@ -21,6 +21,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
 )
@@ -34,7 +35,16 @@ var defaultDataDir = "/var/lib/cni/networks"
 // address in a given directory. The contents of the file are the container ID.
 type Store struct {
 	*FileLock
-	dataDir string
+	dataDir   string
+	layout    int
+	holdDown  time.Duration
+	metadata  map[string]string
+	namespace string
+	holder    string
+	readOnly  bool
+	bitmaps   map[string]*backend.Bitmap // Loaded by markBitmaps
+	// cloneLimit caps the reservations Clone copies, if non-zero
+	cloneLimit int
 }
 
 // Store implements the Store interface
@@ -49,16 +59,72 @@ func New(network, dataDir string) (*Store, error) {
 		return nil, err
 	}
 
+	layout, err := readLayout(dir)
+	if err != nil {
+		return nil, err
+	}
+
 	lk, err := NewFileLock(dir)
 	if err != nil {
 		return nil, err
 	}
-	return &Store{lk, dir}, nil
+	return &Store{FileLock: lk, dataDir: dir, layout: layout}, nil
 }
 
 func (s *Store) Reserve(id string, ifname string, ip net.IP, rangeID string) (bool, error) {
+	if err := s.writable(); err != nil {
+		return false, err
+	}
 	fname := GetEscapedPath(s.dataDir, ip.String())
+	if s.held(fname) {
+		return false, nil
+	}
+
+	data, err := s.encodeReservation(id, ifname, rangeID, s.namespace, s.metadata)
+	if err != nil {
+		return false, err
+	}
+
+	created, err := createReservation(fname, data)
+	if err == nil {
+		// an address found reserved is marked as well, in case its bit
+		// was out of date
+		s.markBitmaps(ip, true)
+	}
+	if !created {
+		return false, err
+	}
+	// store the reserved ip in lastIPFile
+	ipfile := GetEscapedPath(s.dataDir, lastIPFilePrefix+rangeID)
+	err = ioutil.WriteFile(ipfile, []byte(ip.String()), 0644)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ReservedIPs returns every address reserved in the store.
+func (s *Store) ReservedIPs() ([]net.IP, error) {
+	files, err := ioutil.ReadDir(s.dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+		if ip := net.ParseIP(fi.Name()); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
 
+// createReservation writes a new reservation file, or returns false if
+// the address is already reserved.
+func createReservation(fname string, data []byte) (bool, error) {
 	f, err := os.OpenFile(fname, os.O_RDWR|os.O_EXCL|os.O_CREATE, 0644)
 	if os.IsExist(err) {
 		return false, nil
@@ -66,7 +132,7 @@ func (s *Store) Reserve(id string, ifname string, ip net.IP, rangeID string) (bo
 	if err != nil {
 		return false, err
 	}
-	if _, err := f.WriteString(strings.TrimSpace(id) + LineBreak + ifname); err != nil {
+	if _, err := f.Write(data); err != nil {
 		f.Close()
 		os.Remove(f.Name())
 		return false, err
@@ -75,12 +141,6 @@ func (s *Store) Reserve(id string, ifname string, ip net.IP, rangeID string) (bo
 		os.Remove(f.Name())
 		return false, err
 	}
-	// store the reserved ip in lastIPFile
-	ipfile := GetEscapedPath(s.dataDir, lastIPFilePrefix+rangeID)
-	err = ioutil.WriteFile(ipfile, []byte(ip.String()), 0644)
-	if err != nil {
-		return false, err
-	}
 	return true, nil
 }
 
@@ -95,7 +155,16 @@ func (s *Store) LastReservedIP(rangeID string) (net.IP, error) {
 }
 
 func (s *Store) Release(ip net.IP) error {
-	return os.Remove(GetEscapedPath(s.dataDir, ip.String()))
+	if err := s.writable(); err != nil {
+		return err
+	}
+	fname := GetEscapedPath(s.dataDir, ip.String())
+	s.markBitmaps(ip, false)
+	if err := os.Remove(fname); err != nil {
+		return err
+	}
+	s.hold(fname)
+	return nil
 }
 
 func (s *Store) FindByKey(id string, ifname string, match string) (bool, error) {
@@ -109,7 +178,7 @@ func (s *Store) FindByKey(id string, ifname string, match string) (bool, error)
 		if err != nil {
 			return nil
 		}
-		if strings.TrimSpace(string(data)) == match {
+		if reservationKey(data) == match {
 			found = true
 		}
 		return nil
@@ -136,6 +205,9 @@ func (s *Store) FindByID(id string, ifname string) bool {
 }
 
 func (s *Store) ReleaseByKey(id string, ifname string, match string) (bool, error) {
+	if err := s.writable(); err != nil {
+		return false, err
+	}
 	found := false
 	err := filepath.Walk(s.dataDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil || info.IsDir() {
@@ -145,10 +217,14 @@ func (s *Store) ReleaseByKey(id string, ifname string, match string) (bool, erro
 		if err != nil {
 			return nil
 		}
-		if strings.TrimSpace(string(data)) == match {
+		if reservationKey(data) == match {
+			if ip := net.ParseIP(info.Name()); ip != nil {
+				s.markBitmaps(ip, false)
+			}
 			if err := os.Remove(path); err != nil {
 				return nil
 			}
+			s.hold(path)
 			found = true
 		}
 		return nil
@@ -189,7 +265,7 @@ func (s *Store) GetByID(id string, ifname string) []net.IP {
 		if err != nil {
 			return nil
 		}
-		if strings.TrimSpace(string(data)) == match || strings.TrimSpace(string(data)) == matchOld {
+		if key := reservationKey(data); key == match || key == matchOld {
 			_, ipString := filepath.Split(path)
 			if ip := net.ParseIP(ipString); ip != nil {
 				ips = append(ips, ip)
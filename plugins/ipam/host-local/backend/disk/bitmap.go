@@ -0,0 +1,126 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
+)
+
+// bitmapFilePrefix names the bitmap of a range set, followed by its ID.
+const bitmapFilePrefix = "bitmap."
+
+// Store implements the BitmapStore interface
+var _ backend.BitmapStore = &Store{}
+
+func (s *Store) LoadBitmap(rangeID string, ranges []backend.BitmapRange) (*backend.Bitmap, error) {
+	want, err := backend.NewBitmap(ranges)
+	if err != nil || want == nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(GetEscapedPath(s.dataDir, bitmapFilePrefix+rangeID))
+	if err == nil {
+		if b, err := backend.DecodeBitmap(data); err == nil && b.Header() == want.Header() {
+			return b, nil
+		}
+	}
+	return s.RebuildBitmap(rangeID, ranges)
+}
+
+func (s *Store) RebuildBitmap(rangeID string, ranges []backend.BitmapRange) (*backend.Bitmap, error) {
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	b, err := backend.NewBitmap(ranges)
+	if err != nil || b == nil {
+		return nil, err
+	}
+
+	dir, err := os.Open(s.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			b.Set(ip, true)
+		}
+	}
+
+	if err := writeFileAtomic(GetEscapedPath(s.dataDir, bitmapFilePrefix+rangeID), b.Encode()); err != nil {
+		return nil, err
+	}
+	s.bitmaps = nil
+	return b, nil
+}
+
+// markBitmaps sets the bit of ip in every bitmap of the store. It is called
+// after a reservation is created and before one is removed, so a bitmap
+// can claim a reserved address to be free, which trying it reveals, but
+// not the other way round. Failures only leave a bitmap out of date.
+func (s *Store) markBitmaps(ip net.IP, reserved bool) {
+	if s.bitmaps == nil {
+		s.bitmaps = map[string]*backend.Bitmap{}
+		paths, _ := filepath.Glob(filepath.Join(s.dataDir, bitmapFilePrefix+"*"))
+		for _, path := range paths {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			if b, err := backend.DecodeBitmap(data); err == nil {
+				s.bitmaps[path] = b
+			}
+		}
+	}
+
+	for path, b := range s.bitmaps {
+		off, ok := b.Offset(ip)
+		if !ok {
+			continue
+		}
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			continue
+		}
+		pos := int64(len(b.Header())) + int64(off/8)
+		buf := make([]byte, 1)
+		if _, err := f.ReadAt(buf, pos); err == nil {
+			if reserved {
+				buf[0] |= 1 << (off % 8)
+			} else {
+				buf[0] &^= 1 << (off % 8)
+			}
+			_, _ = f.WriteAt(buf, pos)
+		}
+		f.Close()
+	}
+}
+
+// removeBitmaps removes every bitmap of the store.
+func (s *Store) removeBitmaps() {
+	paths, _ := filepath.Glob(filepath.Join(s.dataDir, bitmapFilePrefix+"*"))
+	for _, path := range paths {
+		os.Remove(path)
+	}
+	s.bitmaps = nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store bitmaps", func() {
+	var dataDir string
+	var s *Store
+	ranges := []backend.BitmapRange{
+		{Start: net.ParseIP("10.1.2.2"), End: net.ParseIP("10.1.2.9")},
+		{Start: net.ParseIP("10.1.3.2"), End: net.ParseIP("10.1.3.9")},
+	}
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host_local_bitmap")
+		Expect(err).NotTo(HaveOccurred())
+		s, err = New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		s.Close()
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	reserve := func(id, addr string) {
+		_, err := s.Reserve(id, "eth0", net.ParseIP(addr), "0")
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	It("builds the bitmap from the reservations and keeps it in sync", func() {
+		reserve("id1", "10.1.2.2")
+		reserve("id2", "10.1.3.9")
+		reserve("id3", "10.1.4.2") // outside the ranges
+
+		bm, err := s.LoadBitmap("0", ranges)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bm.Size()).To(Equal(uint64(16)))
+		Expect(bm.Count()).To(Equal(uint64(2)))
+		Expect(bm.Reserved(net.ParseIP("10.1.2.2"))).To(BeTrue())
+		Expect(bm.Reserved(net.ParseIP("10.1.3.9"))).To(BeTrue())
+
+		reserve("id4", "10.1.3.2")
+		Expect(s.Release(net.ParseIP("10.1.2.2"))).To(Succeed())
+		Expect(s.ReleaseByID("id2", "eth0")).To(Succeed())
+
+		bm, err = s.LoadBitmap("0", ranges)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bm.Count()).To(Equal(uint64(1)))
+		Expect(bm.Reserved(net.ParseIP("10.1.3.2"))).To(BeTrue())
+
+		rebuilt, err := s.RebuildBitmap("0", ranges)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rebuilt.Bytes()).To(Equal(bm.Bytes()))
+	})
+
+	It("rebuilds a bitmap that is corrupt or for other ranges", func() {
+		reserve("id1", "10.1.2.5")
+		_, err := s.LoadBitmap("0", ranges)
+		Expect(err).NotTo(HaveOccurred())
+		path := filepath.Join(dataDir, "net", "bitmap.0")
+
+		Expect(ioutil.WriteFile(path, []byte("host-local-bitmap-v1 10.1.2.2-10.1.2.9,10.1.3.2-10.1.3.9\n\x00"), 0644)).To(Succeed())
+		bm, err := s.LoadBitmap("0", ranges)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bm.Reserved(net.ParseIP("10.1.2.5"))).To(BeTrue())
+
+		bm, err = s.LoadBitmap("0", ranges[:1])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bm.Size()).To(Equal(uint64(8)))
+		Expect(bm.Reserved(net.ParseIP("10.1.2.5"))).To(BeTrue())
+	})
+
+	It("keeps no bitmap of huge range sets", func() {
+		bm, err := s.LoadBitmap("0", []backend.BitmapRange{{Start: net.ParseIP("fd00::"), End: net.ParseIP("fd00::ffff:ffff")}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bm).To(BeNil())
+		Expect(filepath.Join(dataDir, "net", "bitmap.0")).NotTo(BeAnExistingFile())
+	})
+})
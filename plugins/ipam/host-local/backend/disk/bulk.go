@@ -0,0 +1,79 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// PodID identifies the reservations of a container's interface. An empty
+// IfName stands for all of its interfaces.
+type PodID struct {
+	ContainerID string
+	IfName      string
+}
+
+// BulkRelease releases the reservations of every identity in ids, taking
+// the lock once, e.g. when a whole namespace is torn down. Identities
+// without reservations are skipped. Like ReleaseByID, it also releases
+// reservations of the container that name no interface, and holds the
+// addresses down. It goes on past the files it fails to remove, and
+// returns how many it released along with all the failures.
+func (s *Store) BulkRelease(ids []PodID) (int, error) {
+	if err := s.writable(); err != nil {
+		return 0, err
+	}
+
+	want := map[string]map[string]bool{}
+	for _, id := range ids {
+		cid := strings.TrimSpace(id.ContainerID)
+		if want[cid] == nil {
+			want[cid] = map[string]bool{}
+		}
+		want[cid][id.IfName] = true
+	}
+
+	if err := s.Lock(); err != nil {
+		return 0, err
+	}
+	defer s.Unlock()
+
+	released := 0
+	var failed []string
+	err := s.forEach(func(r Reservation) error {
+		ifNames := want[r.ContainerID]
+		if ifNames == nil || !(ifNames[""] || ifNames[r.IfName] || r.IfName == "") {
+			return nil
+		}
+		path := GetEscapedPath(s.dataDir, r.IP.String())
+		s.markBitmaps(r.IP, false)
+		if err := os.Remove(path); err != nil {
+			failed = append(failed, err.Error())
+			return nil
+		}
+		s.hold(path)
+		released++
+		return nil
+	})
+	if err != nil {
+		return released, err
+	}
+	if len(failed) > 0 {
+		return released, fmt.Errorf("failed to release %d reservations: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return released, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store BulkRelease", func() {
+	var dataDir string
+	var s *Store
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host_local_bulk")
+		Expect(err).NotTo(HaveOccurred())
+		s, err = New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, r := range []Reservation{
+			{IP: net.ParseIP("10.1.2.2"), ContainerID: "id1", IfName: "eth0"},
+			{IP: net.ParseIP("10.1.2.3"), ContainerID: "id1", IfName: "net1"},
+			{IP: net.ParseIP("10.1.2.4"), ContainerID: "id2", IfName: "eth0"},
+			{IP: net.ParseIP("10.1.2.5"), ContainerID: "id2", IfName: "net1"},
+			{IP: net.ParseIP("10.1.2.6"), ContainerID: "id3", IfName: "eth0"},
+		} {
+			reserved, err := s.Reserve(r.ContainerID, r.IfName, r.IP, "0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+		}
+	})
+
+	AfterEach(func() {
+		s.Close()
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	It("releases the reservations of the identities that have some", func() {
+		released, err := s.BulkRelease([]PodID{
+			{ContainerID: "id1", IfName: "eth0"},
+			{ContainerID: "id2"},
+			{ContainerID: "id3", IfName: "net1"},
+			{ContainerID: "missing", IfName: "eth0"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(released).To(Equal(3))
+
+		Expect(s.GetByID("id1", "eth0")).To(BeEmpty())
+		Expect(s.GetByID("id1", "net1")).To(Equal([]net.IP{net.ParseIP("10.1.2.3")}))
+		Expect(s.GetByID("id2", "eth0")).To(BeEmpty())
+		Expect(s.GetByID("id2", "net1")).To(BeEmpty())
+		Expect(s.GetByID("id3", "eth0")).To(Equal([]net.IP{net.ParseIP("10.1.2.6")}))
+
+		released, err = s.BulkRelease([]PodID{{ContainerID: "id1", IfName: "eth0"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(released).To(BeZero())
+	})
+
+	It("holds the released addresses down", func() {
+		s.SetHoldDown(time.Hour)
+		released, err := s.BulkRelease([]PodID{{ContainerID: "id3"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(released).To(Equal(1))
+
+		reserved, err := s.Reserve("id4", "eth0", net.ParseIP("10.1.2.6"), "0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reserved).To(BeFalse())
+	})
+})
@@ -0,0 +1,61 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// errCloneLimit stops the scan of Clone once the limit is exceeded.
+var errCloneLimit = errors.New("clone limit exceeded")
+
+// SetCloneLimit makes Clone fail rather than copy more than n
+// reservations into memory. Zero, the default, sets no limit.
+func (s *Store) SetCloneLimit(n int) {
+	s.cloneLimit = n
+}
+
+// Clone returns a copy of every reservation in the store, sorted by
+// address, read under the lock in one go so it is consistent. The
+// callers process it without the lock, and the copy does not follow
+// later changes to the store.
+func (s *Store) Clone() ([]Reservation, error) {
+	if err := s.Lock(); err != nil {
+		return nil, err
+	}
+	defer s.Unlock()
+
+	var clone []Reservation
+	err := s.forEach(func(r Reservation) error {
+		if s.cloneLimit > 0 && len(clone) == s.cloneLimit {
+			return errCloneLimit
+		}
+		clone = append(clone, r)
+		return nil
+	})
+	if err == errCloneLimit {
+		return nil, fmt.Errorf("store %s has more than %d reservations to clone", s.dataDir, s.cloneLimit)
+	} else if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(clone, func(i, j int) bool {
+		return bytes.Compare(clone[i].IP.To16(), clone[j].IP.To16()) < 0
+	})
+	return clone, nil
+}
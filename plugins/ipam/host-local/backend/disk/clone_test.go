@@ -0,0 +1,83 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store Clone", func() {
+	var dataDir string
+	var s *Store
+	reservations := []Reservation{
+		{IP: net.ParseIP("10.1.2.2"), ContainerID: "id1", IfName: "eth0"},
+		{IP: net.ParseIP("10.1.2.10"), ContainerID: "id2", IfName: "eth0"},
+		{IP: net.ParseIP("2001:db8::2"), ContainerID: "id1", IfName: "eth0"},
+	}
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host_local_clone")
+		Expect(err).NotTo(HaveOccurred())
+		s, err = New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, r := range reservations {
+			reserved, err := s.Reserve(r.ContainerID, r.IfName, r.IP, "0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+		}
+	})
+
+	AfterEach(func() {
+		s.Close()
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	It("returns a snapshot that does not follow later changes", func() {
+		clone, err := s.Clone()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(clone).To(Equal(reservations))
+
+		Expect(s.ReleaseByID("id1", "eth0")).To(Succeed())
+		reserved, err := s.Reserve("id3", "eth0", net.ParseIP("10.1.2.3"), "0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+		Expect(clone).To(Equal(reservations))
+
+		clone, err = s.Clone()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(clone).To(Equal([]Reservation{
+			{IP: net.ParseIP("10.1.2.3"), ContainerID: "id3", IfName: "eth0"},
+			{IP: net.ParseIP("10.1.2.10"), ContainerID: "id2", IfName: "eth0"},
+		}))
+	})
+
+	It("fails rather than copy more reservations than the limit", func() {
+		s.SetCloneLimit(3)
+		clone, err := s.Clone()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(clone).To(HaveLen(3))
+
+		s.SetCloneLimit(2)
+		_, err = s.Clone()
+		Expect(err).To(MatchError("store " + s.dataDir + " has more than 2 reservations to clone"))
+	})
+})
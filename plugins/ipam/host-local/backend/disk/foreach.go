@@ -0,0 +1,150 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// forEachBatch is the number of directory entries read at a time.
+const forEachBatch = 256
+
+// ForEach calls fn for every reservation in the store, in no particular
+// order, holding the lock throughout. The directory is read in batches,
+// so memory use does not grow with the store. It stops at the first
+// error fn returns and returns it. Reservation files that cannot be read
+// or parsed are skipped with a warning.
+func (s *Store) ForEach(fn func(Reservation) error) error {
+	if err := s.Lock(); err != nil {
+		return err
+	}
+	defer s.Unlock()
+	return s.forEach(fn)
+}
+
+// ReleaseIf releases, under the lock, every reservation that release
+// returns true for, and returns them. The addresses are not held down.
+func (s *Store) ReleaseIf(release func(Reservation) bool) ([]Reservation, error) {
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	if err := s.Lock(); err != nil {
+		return nil, err
+	}
+	defer s.Unlock()
+
+	var released []Reservation
+	err := s.forEach(func(r Reservation) error {
+		if !release(r) {
+			return nil
+		}
+		s.markBitmaps(r.IP, false)
+		if err := os.Remove(GetEscapedPath(s.dataDir, r.IP.String())); err != nil {
+			return err
+		}
+		released = append(released, r)
+		return nil
+	})
+	return released, err
+}
+
+// ReservationsByID returns, under the lock, every reservation of the
+// container, for all of its interfaces, sorted by interface and address.
+// Unlike GetByID it is meant for callers that do not know the interface
+// names, such as a CHECK comparing the reservations to the live ones.
+func (s *Store) ReservationsByID(containerID string) ([]Reservation, error) {
+	if err := s.Lock(); err != nil {
+		return nil, err
+	}
+	defer s.Unlock()
+
+	id := strings.TrimSpace(containerID)
+	var found []Reservation
+	err := s.forEach(func(r Reservation) error {
+		if r.ContainerID == id {
+			found = append(found, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].IfName != found[j].IfName {
+			return found[i].IfName < found[j].IfName
+		}
+		return bytes.Compare(found[i].IP.To16(), found[j].IP.To16()) < 0
+	})
+	return found, nil
+}
+
+// forEach is ForEach for callers holding the lock.
+func (s *Store) forEach(fn func(Reservation) error) error {
+	dir, err := os.Open(s.dataDir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	for {
+		names, err := dir.Readdirnames(forEachBatch)
+		for _, name := range names {
+			ip := net.ParseIP(name)
+			if ip == nil {
+				continue
+			}
+			r, ok := readReservation(filepath.Join(s.dataDir, name))
+			if !ok {
+				log.Printf("skipping malformed reservation of %s in %s", name, s.dataDir)
+				continue
+			}
+			r.IP = ip
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// readReservation parses the reservation file at path, in either layout.
+func readReservation(path string) (Reservation, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Reservation{}, false
+	}
+	var r reservation
+	if isJSON(data) && json.Unmarshal(data, &r) != nil {
+		return Reservation{}, false
+	}
+	id, ifname := splitKey(reservationKey(data))
+	if id == "" {
+		return Reservation{}, false
+	}
+	return Reservation{ContainerID: id, IfName: ifname, RangeID: r.RangeID, Namespace: r.Namespace}, true
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store ForEach", func() {
+	var dataDir string
+	var s *Store
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host_local_foreach")
+		Expect(err).NotTo(HaveOccurred())
+		s, err = New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		s.Close()
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	It("visits every reservation and skips malformed ones", func() {
+		var want []Reservation
+		for i := 0; i < 2*forEachBatch+3; i++ {
+			r := Reservation{
+				IP:          net.IPv4(10, 1, byte(i/250), byte(i%250+2)),
+				ContainerID: fmt.Sprintf("id%d", i),
+				IfName:      "eth0",
+			}
+			reserved, err := s.Reserve(r.ContainerID, r.IfName, r.IP, "0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+			want = append(want, r)
+		}
+		Expect(ioutil.WriteFile(filepath.Join(dataDir, "net", "10.9.9.9"), nil, 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dataDir, "net", "10.9.9.8"), []byte(`{"containerID": `), 0644)).To(Succeed())
+
+		var got []Reservation
+		Expect(s.ForEach(func(r Reservation) error {
+			got = append(got, r)
+			return nil
+		})).To(Succeed())
+		Expect(got).To(ConsistOf(want))
+	})
+
+	It("stops at the first error", func() {
+		for i := 0; i < 5; i++ {
+			_, err := s.Reserve(fmt.Sprintf("id%d", i), "eth0", net.IPv4(10, 1, 2, byte(i+2)), "0")
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		stop := errors.New("stop")
+		visited := 0
+		err := s.ForEach(func(Reservation) error {
+			visited++
+			if visited == 2 {
+				return stop
+			}
+			return nil
+		})
+		Expect(err).To(Equal(stop))
+		Expect(visited).To(Equal(2))
+	})
+
+	It("releases the reservations selected by ReleaseIf", func() {
+		for i := 0; i < 5; i++ {
+			_, err := s.Reserve(fmt.Sprintf("id%d", i), "eth0", net.IPv4(10, 1, 2, byte(i+2)), "0")
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		released, err := s.ReleaseIf(func(r Reservation) bool {
+			return r.ContainerID == "id1" || r.ContainerID == "id3"
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(released).To(ConsistOf(
+			Reservation{IP: net.ParseIP("10.1.2.3"), ContainerID: "id1", IfName: "eth0"},
+			Reservation{IP: net.ParseIP("10.1.2.5"), ContainerID: "id3", IfName: "eth0"},
+		))
+		Expect(s.GetByID("id1", "eth0")).To(BeEmpty())
+		Expect(s.GetByID("id2", "eth0")).To(Equal([]net.IP{net.ParseIP("10.1.2.4")}))
+	})
+	It("returns every reservation of a container from ReservationsByID", func() {
+		for _, r := range []Reservation{
+			{IP: net.ParseIP("10.1.2.4"), ContainerID: "id1", IfName: "net1"},
+			{IP: net.ParseIP("2001:db8::3"), ContainerID: "id1", IfName: "eth0"},
+			{IP: net.ParseIP("10.1.2.3"), ContainerID: "id1", IfName: "eth0"},
+			{IP: net.ParseIP("10.1.2.2"), ContainerID: "id2", IfName: "eth0"},
+		} {
+			reserved, err := s.Reserve(r.ContainerID, r.IfName, r.IP, "0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(reserved).To(BeTrue())
+		}
+
+		found, err := s.ReservationsByID("id1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(Equal([]Reservation{
+			{IP: net.ParseIP("10.1.2.3"), ContainerID: "id1", IfName: "eth0"},
+			{IP: net.ParseIP("2001:db8::3"), ContainerID: "id1", IfName: "eth0"},
+			{IP: net.ParseIP("10.1.2.4"), ContainerID: "id1", IfName: "net1"},
+		}))
+
+		found, err = s.ReservationsByID("id3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(BeEmpty())
+	})
+
+	It("reads back the range set of LayoutV2 reservations only", func() {
+		_, err := s.Reserve("id1", "eth0", net.ParseIP("10.1.2.2"), "1")
+		Expect(err).NotTo(HaveOccurred())
+
+		v2, err := NewWithLayout("net2", dataDir, LayoutV2)
+		Expect(err).NotTo(HaveOccurred())
+		defer v2.Close()
+		_, err = v2.Reserve("id1", "eth0", net.ParseIP("10.1.3.2"), "1")
+		Expect(err).NotTo(HaveOccurred())
+
+		found, err := s.ReservationsByID("id1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(Equal([]Reservation{{IP: net.ParseIP("10.1.2.2"), ContainerID: "id1", IfName: "eth0"}}))
+		found, err = v2.ReservationsByID("id1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(Equal([]Reservation{{IP: net.ParseIP("10.1.3.2"), ContainerID: "id1", IfName: "eth0", RangeID: "1"}}))
+	})
+})
@@ -0,0 +1,62 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// heldFilePrefix marks the files recording when an address was released.
+const heldFilePrefix = "released."
+
+// SetHoldDown keeps released addresses from being reserved again until d
+// has passed, so a new container does not inherit the connections upstream
+// firewalls and conntrack still associate with the previous one. The
+// release times are persisted next to the reservations.
+func (s *Store) SetHoldDown(d time.Duration) {
+	s.holdDown = d
+}
+
+// hold records that the reservation file at path was released.
+func (s *Store) hold(path string) {
+	if s.holdDown <= 0 {
+		return
+	}
+	dir, name := filepath.Split(path)
+	released := []byte(now().UTC().Format(time.RFC3339Nano))
+	// best effort, a missing record only shortens the hold-down
+	_ = ioutil.WriteFile(filepath.Join(dir, heldFilePrefix+name), released, 0644)
+}
+
+// held reports whether the address of the reservation file at path is
+// still in its hold-down period. An expired record is removed.
+func (s *Store) held(path string) bool {
+	dir, name := filepath.Split(path)
+	record := filepath.Join(dir, heldFilePrefix+name)
+	data, err := ioutil.ReadFile(record)
+	if err != nil {
+		return false
+	}
+	released, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+	if err == nil && s.holdDown > 0 && now().Before(released.Add(s.holdDown)) {
+		return true
+	}
+	os.Remove(record)
+	return false
+}
@@ -0,0 +1,98 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store hold-down", func() {
+	var dataDir string
+	var fake *fakeClock
+	addr := net.ParseIP("10.1.2.2")
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host_local_holddown")
+		Expect(err).NotTo(HaveOccurred())
+		fake = newFakeClock(time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC))
+		clock = fake
+	})
+
+	AfterEach(func() {
+		clock = realClock{}
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	reserve := func(s *Store, id string) bool {
+		reserved, err := s.Reserve(id, "eth0", addr, "0")
+		Expect(err).NotTo(HaveOccurred())
+		return reserved
+	}
+
+	It("does not reserve a released address again until the hold-down has passed", func() {
+		s, err := New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+		s.SetHoldDown(time.Minute)
+
+		Expect(reserve(s, "id1")).To(BeTrue())
+		Expect(s.ReleaseByID("id1", "eth0")).To(Succeed())
+		Expect(reserve(s, "id2")).To(BeFalse())
+
+		fake.Advance(59 * time.Second)
+		Expect(reserve(s, "id2")).To(BeFalse())
+
+		// the release time is persisted, so a new store holds it as well
+		s2, err := New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer s2.Close()
+		s2.SetHoldDown(time.Minute)
+		Expect(reserve(s2, "id2")).To(BeFalse())
+
+		fake.Advance(time.Second)
+		Expect(reserve(s2, "id2")).To(BeTrue())
+		Expect(s2.GetByID("id2", "eth0")).To(Equal([]net.IP{addr}))
+		_, err = os.Stat(filepath.Join(dataDir, "net", heldFilePrefix+"10.1.2.2"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		// releasing by address holds it too
+		Expect(s2.Release(addr)).To(Succeed())
+		Expect(reserve(s2, "id3")).To(BeFalse())
+	})
+
+	It("reuses released addresses right away without a hold-down", func() {
+		s, err := New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+
+		Expect(reserve(s, "id1")).To(BeTrue())
+		Expect(s.ReleaseByID("id1", "eth0")).To(Succeed())
+		Expect(reserve(s, "id2")).To(BeTrue())
+
+		files, err := ioutil.ReadDir(filepath.Join(dataDir, "net"))
+		Expect(err).NotTo(HaveOccurred())
+		for _, fi := range files {
+			Expect(fi.Name()).NotTo(HavePrefix(heldFilePrefix))
+		}
+	})
+})
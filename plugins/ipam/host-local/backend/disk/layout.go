@@ -0,0 +1,201 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reservation file layouts. LayoutV1 files hold the container ID and the
+// interface name separated by LineBreak; LayoutV2 files hold a JSON
+// document. Both are always readable, the layout only decides what is
+// written.
+const (
+	LayoutV1 = 1
+	LayoutV2 = 2
+)
+
+// layoutFile records the layout of a data directory once it has been
+// migrated, so later invocations neither rescan nor downgrade it.
+const layoutFile = "layout_version"
+
+// tmpFilePrefix marks files in the middle of being rewritten.
+const tmpFilePrefix = ".tmp."
+
+type reservation struct {
+	ContainerID string    `json:"containerID"`
+	IfName      string    `json:"ifName,omitempty"`
+	Reserved    time.Time `json:"reserved"`
+	// Metadata passed through from the allocation, see SetMetadata
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// RangeID of the range set the address was allocated from
+	RangeID string `json:"rangeID,omitempty"`
+	// Namespace of the pod, see SetNamespace
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// NewWithLayout opens the store like New and upgrades its data directory to
+// the given layout if it is older. Directories are never downgraded.
+func NewWithLayout(network, dataDir string, layout int) (*Store, error) {
+	s, err := New(network, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	if layout <= s.layout {
+		return s, nil
+	}
+	if layout != LayoutV2 {
+		s.Close()
+		return nil, fmt.Errorf("unknown reservation layout version %d", layout)
+	}
+
+	if err := s.Lock(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	defer s.Unlock()
+
+	if err := s.migrate(); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("failed to migrate %s to layout version %d: %v", s.dataDir, layout, err)
+	}
+	return s, nil
+}
+
+func readLayout(dir string) (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, layoutFile))
+	if os.IsNotExist(err) {
+		return LayoutV1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	layout, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s in %s: %v", layoutFile, dir, err)
+	}
+	return layout, nil
+}
+
+// migrate rewrites every LayoutV1 reservation as LayoutV2. Each file is
+// replaced atomically, so a crash leaves a mix of both layouts which the
+// next run picks up from; the layout file is only written at the end. The
+// caller must hold the lock.
+func (s *Store) migrate() error {
+	files, err := ioutil.ReadDir(s.dataDir)
+	if err != nil {
+		return err
+	}
+
+	for _, fi := range files {
+		path := filepath.Join(s.dataDir, fi.Name())
+		if strings.HasPrefix(fi.Name(), tmpFilePrefix) {
+			// left behind by an interrupted migration
+			os.Remove(path)
+			continue
+		}
+		if fi.IsDir() || net.ParseIP(fi.Name()) == nil {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if isJSON(data) {
+			continue
+		}
+
+		id, ifname := splitKey(strings.TrimSpace(string(data)))
+		v2, err := json.Marshal(reservation{ContainerID: id, IfName: ifname, Reserved: fi.ModTime().UTC()})
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path, v2); err != nil {
+			return err
+		}
+	}
+
+	if err := writeFileAtomic(filepath.Join(s.dataDir, layoutFile), []byte(strconv.Itoa(LayoutV2))); err != nil {
+		return err
+	}
+	s.layout = LayoutV2
+	return nil
+}
+
+// encodeReservation returns the file contents for a reservation in the
+// store's layout.
+func (s *Store) encodeReservation(id, ifname, rangeID, namespace string, metadata map[string]string) ([]byte, error) {
+	id = strings.TrimSpace(id)
+	if s.layout < LayoutV2 {
+		return []byte(id + LineBreak + ifname), nil
+	}
+	return json.Marshal(reservation{ContainerID: id, IfName: ifname, Reserved: now().UTC(), Metadata: metadata, RangeID: rangeID, Namespace: namespace})
+}
+
+// reservationKey returns a reservation in its LayoutV1 form, which is what
+// lookups match against regardless of the layout the file is in.
+func reservationKey(data []byte) string {
+	if isJSON(data) {
+		var r reservation
+		if err := json.Unmarshal(data, &r); err == nil {
+			if r.IfName == "" {
+				return r.ContainerID
+			}
+			return r.ContainerID + LineBreak + r.IfName
+		}
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func splitKey(key string) (string, string) {
+	parts := strings.SplitN(key, LineBreak, 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func isJSON(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] == '{'
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	dir, name := filepath.Split(path)
+	tmp := filepath.Join(dir, tmpFilePrefix+name)
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	f, err := os.Open(tmp)
+	if err == nil {
+		err = f.Sync()
+		f.Close()
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
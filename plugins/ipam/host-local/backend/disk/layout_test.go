@@ -0,0 +1,152 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reservation layout", func() {
+	var dataDir, netDir string
+	var seeded time.Time
+
+	seed := func(name, contents string) {
+		path := filepath.Join(netDir, name)
+		Expect(ioutil.WriteFile(path, []byte(contents), 0644)).To(Succeed())
+		Expect(os.Chtimes(path, seeded, seeded)).To(Succeed())
+	}
+
+	readReservation := func(name string) reservation {
+		data, err := ioutil.ReadFile(filepath.Join(netDir, name))
+		Expect(err).NotTo(HaveOccurred())
+		var r reservation
+		Expect(json.Unmarshal(data, &r)).To(Succeed())
+		return r
+	}
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host_local_layout")
+		Expect(err).NotTo(HaveOccurred())
+		netDir = filepath.Join(dataDir, "net")
+		Expect(os.MkdirAll(netDir, 0755)).To(Succeed())
+		seeded = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	It("upgrades v1 reservations to v2", func() {
+		seed("10.1.2.2", "id1"+LineBreak+"eth0")
+		seed("10.1.2.3", "id2")
+		seed(lastIPFilePrefix+"0", "10.1.2.3")
+
+		s, err := NewWithLayout("net", dataDir, LayoutV2)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+
+		Expect(readReservation("10.1.2.2")).To(Equal(reservation{ContainerID: "id1", IfName: "eth0", Reserved: seeded}))
+		Expect(readReservation("10.1.2.3")).To(Equal(reservation{ContainerID: "id2", Reserved: seeded}))
+
+		data, err := ioutil.ReadFile(filepath.Join(netDir, layoutFile))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal("2"))
+		data, err = ioutil.ReadFile(filepath.Join(netDir, lastIPFilePrefix+"0"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal("10.1.2.3"))
+
+		// the upgraded reservations are found as before
+		Expect(s.FindByID("id1", "eth0")).To(BeTrue())
+		Expect(s.GetByID("id2", "eth0")).To(Equal([]net.IP{net.ParseIP("10.1.2.3")}))
+		Expect(s.ReleaseByID("id1", "eth0")).To(Succeed())
+		_, err = os.Stat(filepath.Join(netDir, "10.1.2.2"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		// new reservations use v2 as well
+		reserved, err := s.Reserve("id3", "eth0", net.ParseIP("10.1.2.4"), "0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+		r := readReservation("10.1.2.4")
+		Expect(r.ContainerID).To(Equal("id3"))
+		Expect(r.IfName).To(Equal("eth0"))
+		Expect(r.Reserved).NotTo(BeZero())
+	})
+
+	It("resumes an interrupted migration", func() {
+		seed("10.1.2.2", `{"containerID":"id1","ifName":"eth0","reserved":"2020-01-02T03:04:05Z"}`)
+		seed("10.1.2.3", "id2"+LineBreak+"eth0")
+		seed(tmpFilePrefix+"10.1.2.3", `{"containerID":"id2"`)
+
+		s, err := NewWithLayout("net", dataDir, LayoutV2)
+		Expect(err).NotTo(HaveOccurred())
+		s.Close()
+
+		Expect(readReservation("10.1.2.2")).To(Equal(reservation{ContainerID: "id1", IfName: "eth0", Reserved: seeded}))
+		Expect(readReservation("10.1.2.3")).To(Equal(reservation{ContainerID: "id2", IfName: "eth0", Reserved: seeded}))
+		_, err = os.Stat(filepath.Join(netDir, tmpFilePrefix+"10.1.2.3"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		// running again changes nothing
+		before, err := ioutil.ReadFile(filepath.Join(netDir, "10.1.2.3"))
+		Expect(err).NotTo(HaveOccurred())
+		s, err = NewWithLayout("net", dataDir, LayoutV2)
+		Expect(err).NotTo(HaveOccurred())
+		s.Close()
+		after, err := ioutil.ReadFile(filepath.Join(netDir, "10.1.2.3"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(after).To(Equal(before))
+	})
+
+	It("never downgrades a migrated directory", func() {
+		seed("10.1.2.2", "id1"+LineBreak+"eth0")
+		s, err := NewWithLayout("net", dataDir, LayoutV2)
+		Expect(err).NotTo(HaveOccurred())
+		s.Close()
+
+		s, err = New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+		Expect(s.FindByID("id1", "eth0")).To(BeTrue())
+
+		reserved, err := s.Reserve("id2", "eth0", net.ParseIP("10.1.2.3"), "0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+		Expect(readReservation("10.1.2.3").ContainerID).To(Equal("id2"))
+	})
+
+	It("keeps writing v1 by default", func() {
+		s, err := NewWithLayout("net", dataDir, 0)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+
+		reserved, err := s.Reserve("id1", "eth0", net.ParseIP("10.1.2.2"), "0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+		data, err := ioutil.ReadFile(filepath.Join(netDir, "10.1.2.2"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal("id1" + LineBreak + "eth0"))
+		_, err = os.Stat(filepath.Join(netDir, layoutFile))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+})
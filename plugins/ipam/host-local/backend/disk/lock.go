@@ -53,7 +53,23 @@ func (l *FileLock) Lock() error {
 	return l.f.Lock()
 }
 
+// TryLock acquires an exclusive lock if it is free, and returns
+// filemutex.AlreadyLocked otherwise
+func (l *FileLock) TryLock() error {
+	return l.f.TryLock()
+}
+
 // Unlock releases the lock
 func (l *FileLock) Unlock() error {
 	return l.f.Unlock()
 }
+
+// RLock acquires a shared lock
+func (l *FileLock) RLock() error {
+	return l.f.RLock()
+}
+
+// RUnlock releases a shared lock
+func (l *FileLock) RUnlock() error {
+	return l.f.RUnlock()
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// lockInfoFile describes the holder of the lock while it is held.
+const lockInfoFile = "lock.info"
+
+// LockHolder is the process holding the lock of a store.
+type LockHolder struct {
+	PID         int
+	ContainerID string
+}
+
+type lockInfo struct {
+	PID    int       `json:"pid"`
+	Holder string    `json:"holder,omitempty"`
+	Since  time.Time `json:"since"`
+}
+
+// SetHolder names the container the store is locked for in LockInfo.
+func (s *Store) SetHolder(containerID string) {
+	s.holder = containerID
+}
+
+// Lock acquires the lock and records this process as its holder. The lock
+// of a store opened with OpenReadOnly is shared and not recorded.
+func (s *Store) Lock() error {
+	if s.readOnly {
+		return s.FileLock.RLock()
+	}
+	if err := s.FileLock.Lock(); err != nil {
+		return err
+	}
+	// other processes may have changed the bitmaps meanwhile
+	s.bitmaps = nil
+	data, err := json.Marshal(lockInfo{PID: os.Getpid(), Holder: s.holder, Since: now().UTC()})
+	if err == nil {
+		// best effort, it is only informational
+		_ = writeFileAtomic(filepath.Join(s.dataDir, lockInfoFile), data)
+	}
+	return nil
+}
+
+// Unlock removes the holder record and releases the lock.
+func (s *Store) Unlock() error {
+	if s.readOnly {
+		return s.FileLock.RUnlock()
+	}
+	os.Remove(filepath.Join(s.dataDir, lockInfoFile))
+	return s.FileLock.Unlock()
+}
+
+// LockInfo returns the holder of the lock and since when it has held it,
+// without acquiring the lock, so it can tell what a stalled caller waits
+// for. The holder is nil if the lock is free. A record left behind by a
+// process that has exited is ignored, since the lock went with it.
+func (s *Store) LockInfo() (*LockHolder, time.Time, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.dataDir, lockInfoFile))
+	if os.IsNotExist(err) {
+		return nil, time.Time{}, nil
+	} else if err != nil {
+		return nil, time.Time{}, err
+	}
+	var info lockInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, time.Time{}, fmt.Errorf("invalid %s in %s: %v", lockInfoFile, s.dataDir, err)
+	}
+	if !processExists(info.PID) {
+		return nil, time.Time{}, nil
+	}
+	return &LockHolder{PID: info.PID, ContainerID: info.Holder}, info.Since, nil
+}
+
+func processExists(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || err == syscall.EPERM
+}
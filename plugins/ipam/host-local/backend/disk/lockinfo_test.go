@@ -0,0 +1,90 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store LockInfo", func() {
+	var dataDir string
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host_local_lockinfo")
+		Expect(err).NotTo(HaveOccurred())
+		clock = newFakeClock(start)
+	})
+
+	AfterEach(func() {
+		clock = realClock{}
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	It("reports the holder while the lock is held", func() {
+		s, err := New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+		observer, err := New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer observer.Close()
+
+		holder, _, err := observer.LockInfo()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(holder).To(BeNil())
+
+		s.SetHolder("id1")
+		Expect(s.Lock()).To(Succeed())
+		holder, since, err := observer.LockInfo()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(holder).To(Equal(&LockHolder{PID: os.Getpid(), ContainerID: "id1"}))
+		Expect(since).To(Equal(start))
+
+		// the record is not mistaken for a reservation
+		Expect(s.FindByKey("id1", "", "id1")).To(BeFalse())
+		Expect(s.ReservedIPs()).To(BeEmpty())
+
+		Expect(s.Unlock()).To(Succeed())
+		holder, _, err = observer.LockInfo()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(holder).To(BeNil())
+
+	})
+
+	It("ignores the record of a process that has exited", func() {
+		s, err := New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+
+		cmd := exec.Command("true")
+		Expect(cmd.Run()).To(Succeed())
+		stale := fmt.Sprintf(`{"pid": %d, "holder": "id1", "since": "2021-06-01T11:00:00Z"}`, cmd.Process.Pid)
+		Expect(ioutil.WriteFile(filepath.Join(dataDir, "net", lockInfoFile), []byte(stale), 0644)).To(Succeed())
+
+		holder, since, err := s.LockInfo()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(holder).To(BeNil())
+		Expect(since.IsZero()).To(BeTrue())
+	})
+})
@@ -0,0 +1,105 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits on the metadata stored with a reservation.
+const (
+	MaxMetadataEntries  = 16
+	MaxMetadataValueLen = 256
+	MaxMetadataSize     = 4096
+)
+
+var metadataKey = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,62}$`)
+
+// ValidateMetadata checks that m is small enough to store with every
+// reservation, that its keys are made of letters, digits, '.', '_' and '-',
+// and that its values are printable text.
+func ValidateMetadata(m map[string]string) error {
+	if len(m) > MaxMetadataEntries {
+		return fmt.Errorf("too many metadata entries %d (must be at most %d)", len(m), MaxMetadataEntries)
+	}
+	size := 0
+	for k, v := range m {
+		if !metadataKey.MatchString(k) {
+			return fmt.Errorf("invalid metadata key %q", k)
+		}
+		if len(v) > MaxMetadataValueLen {
+			return fmt.Errorf("metadata value of %q is longer than %d bytes", k, MaxMetadataValueLen)
+		}
+		if !utf8.ValidString(v) {
+			return fmt.Errorf("metadata value of %q is not valid UTF-8", k)
+		}
+		for _, r := range v {
+			if !unicode.IsPrint(r) {
+				return fmt.Errorf("metadata value of %q contains unprintable characters", k)
+			}
+		}
+		size += len(k) + len(v)
+	}
+	if size > MaxMetadataSize {
+		return fmt.Errorf("metadata of %d bytes is too large (must be at most %d)", size, MaxMetadataSize)
+	}
+	return nil
+}
+
+// SetMetadata stores m with the reservations made from now on. Only the
+// LayoutV2 files have room for it.
+func (s *Store) SetMetadata(m map[string]string) error {
+	if len(m) == 0 {
+		s.metadata = nil
+		return nil
+	}
+	if err := ValidateMetadata(m); err != nil {
+		return err
+	}
+	if s.layout < LayoutV2 {
+		return fmt.Errorf("metadata requires reservation layout version %d", LayoutV2)
+	}
+	s.metadata = m
+	return nil
+}
+
+// SetNamespace records ns as the namespace of the pod in the reservations
+// made from now on, if the layout has room for it.
+func (s *Store) SetNamespace(ns string) {
+	s.namespace = ns
+}
+
+// Metadata returns the metadata stored with the reservation of ip, nil if
+// there is none. It fails if ip is not reserved.
+func (s *Store) Metadata(ip net.IP) (map[string]string, error) {
+	data, err := ioutil.ReadFile(GetEscapedPath(s.dataDir, ip.String()))
+	if err != nil {
+		return nil, err
+	}
+	if !isJSON(data) {
+		return nil, nil
+	}
+	var r reservation
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("invalid reservation of %s: %v", ip, err)
+	}
+	return r.Metadata, nil
+}
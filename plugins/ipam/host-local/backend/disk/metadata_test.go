@@ -0,0 +1,99 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store metadata", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host_local_metadata")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	It("stores metadata with the reservations made after it is set", func() {
+		s, err := NewWithLayout("net", dataDir, LayoutV2)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+
+		_, err = s.Reserve("id1", "eth0", net.ParseIP("10.1.2.2"), "0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.SetMetadata(map[string]string{"app": "foo", "tier": "web"})).To(Succeed())
+		_, err = s.Reserve("id2", "eth0", net.ParseIP("10.1.2.3"), "0")
+		Expect(err).NotTo(HaveOccurred())
+
+		meta, err := s.Metadata(net.ParseIP("10.1.2.3"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(meta).To(Equal(map[string]string{"app": "foo", "tier": "web"}))
+		Expect(s.GetByID("id2", "eth0")).To(Equal([]net.IP{net.ParseIP("10.1.2.3")}))
+
+		meta, err = s.Metadata(net.ParseIP("10.1.2.2"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(meta).To(BeNil())
+
+		_, err = s.Metadata(net.ParseIP("10.1.2.4"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("requires the JSON layout", func() {
+		s, err := New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+		Expect(s.SetMetadata(map[string]string{"app": "foo"})).To(MatchError("metadata requires reservation layout version 2"))
+		Expect(s.SetMetadata(nil)).To(Succeed())
+	})
+
+	It("rejects metadata that is malformed or too large", func() {
+		many := map[string]string{}
+		for i := 0; i <= MaxMetadataEntries; i++ {
+			many[fmt.Sprintf("k%d", i)] = "v"
+		}
+		large := map[string]string{}
+		for i := 0; i < MaxMetadataEntries; i++ {
+			large[fmt.Sprintf("k%d", i)] = strings.Repeat("v", MaxMetadataValueLen)
+		}
+
+		for _, tc := range []struct {
+			meta   map[string]string
+			expErr string
+		}{
+			{map[string]string{"a/b": "v"}, `invalid metadata key "a/b"`},
+			{map[string]string{"": "v"}, `invalid metadata key ""`},
+			{map[string]string{"app": "foo\nbar"}, `metadata value of "app" contains unprintable characters`},
+			{map[string]string{"app": "\xff"}, `metadata value of "app" is not valid UTF-8`},
+			{map[string]string{"app": strings.Repeat("v", MaxMetadataValueLen+1)}, `metadata value of "app" is longer than 256 bytes`},
+			{many, "too many metadata entries 17 (must be at most 16)"},
+			{large, "metadata of 4134 bytes is too large (must be at most 4096)"},
+		} {
+			Expect(ValidateMetadata(tc.meta)).To(MatchError(tc.expErr))
+		}
+		Expect(ValidateMetadata(map[string]string{"app.kubernetes.io_name-1": "web tier"})).To(Succeed())
+	})
+})
@@ -0,0 +1,176 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MigrateDataDir copies the reservations of network from oldDir to newDir,
+// holding the locks of both, and verifies the copies before it removes the
+// originals, if removeOld is set. Files are copied atomically and the ones
+// already present with the same contents are skipped, so an interrupted
+// migration is completed by running it again. An address reserved for a
+// different container in newDir fails the migration before anything is
+// removed.
+func MigrateDataDir(network, oldDir, newDir string, removeOld bool) error {
+	if oldDir == "" {
+		oldDir = defaultDataDir
+	}
+	if newDir == "" {
+		newDir = defaultDataDir
+	}
+	if filepath.Clean(oldDir) == filepath.Clean(newDir) {
+		return fmt.Errorf("cannot migrate %s onto itself", filepath.Join(oldDir, network))
+	}
+
+	src, err := New(network, oldDir)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := New(network, newDir)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if err := src.Lock(); err != nil {
+		return err
+	}
+	defer src.Unlock()
+	if err := dst.Lock(); err != nil {
+		return err
+	}
+	defer dst.Unlock()
+
+	names, err := migratedFiles(src.dataDir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := copyStoreFile(src.dataDir, dst.dataDir, name); err != nil {
+			return fmt.Errorf("failed to migrate %s to %s: %v", filepath.Join(src.dataDir, name), dst.dataDir, err)
+		}
+	}
+	// the bitmaps of newDir may not know the new reservations
+	dst.removeBitmaps()
+	if src.layout > dst.layout {
+		if err := dst.migrate(); err != nil {
+			return fmt.Errorf("failed to migrate %s to layout version %d: %v", dst.dataDir, src.layout, err)
+		}
+	}
+
+	for _, name := range names {
+		if net.ParseIP(name) == nil {
+			continue
+		}
+		if err := verifyReservation(src.dataDir, dst.dataDir, name); err != nil {
+			return err
+		}
+	}
+
+	if !removeOld {
+		return nil
+	}
+	for _, name := range names {
+		if err := os.Remove(filepath.Join(src.dataDir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	os.Remove(filepath.Join(src.dataDir, layoutFile))
+	src.removeBitmaps()
+	return nil
+}
+
+// migratedFiles lists the reservations, last reserved IPs and hold-down
+// records in dir.
+func migratedFiles(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() {
+			continue
+		}
+		if net.ParseIP(name) != nil ||
+			strings.HasPrefix(name, lastIPFilePrefix) ||
+			(strings.HasPrefix(name, heldFilePrefix) && net.ParseIP(strings.TrimPrefix(name, heldFilePrefix)) != nil) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// copyStoreFile copies name from srcDir to dstDir, keeping its
+// modification time, which dates LayoutV1 reservations. A reservation
+// already in dstDir is kept if it is for the same interface.
+func copyStoreFile(srcDir, dstDir, name string) error {
+	srcPath := filepath.Join(srcDir, name)
+	data, err := ioutil.ReadFile(srcPath)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(srcPath)
+	if err != nil {
+		return err
+	}
+
+	dstPath := filepath.Join(dstDir, name)
+	if existing, err := ioutil.ReadFile(dstPath); err == nil {
+		if bytes.Equal(existing, data) {
+			return nil
+		}
+		if net.ParseIP(name) != nil {
+			if reservationKey(existing) == reservationKey(data) {
+				return nil
+			}
+			return fmt.Errorf("address %s is already reserved for %q", name, reservationKey(existing))
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := writeFileAtomic(dstPath, data); err != nil {
+		return err
+	}
+	return os.Chtimes(dstPath, fi.ModTime(), fi.ModTime())
+}
+
+// verifyReservation checks that the reservation name in dstDir is for the
+// same interface as the one in srcDir.
+func verifyReservation(srcDir, dstDir, name string) error {
+	want, err := ioutil.ReadFile(filepath.Join(srcDir, name))
+	if err != nil {
+		return err
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dstDir, name))
+	if err != nil {
+		return fmt.Errorf("reservation of %s is missing from %s after migration: %v", name, dstDir, err)
+	}
+	if reservationKey(got) != reservationKey(want) {
+		return fmt.Errorf("reservation of %s in %s does not match %s after migration", name, dstDir, srcDir)
+	}
+	return nil
+}
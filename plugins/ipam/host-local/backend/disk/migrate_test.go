@@ -0,0 +1,107 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MigrateDataDir", func() {
+	var oldDir, newDir string
+
+	BeforeEach(func() {
+		var err error
+		oldDir, err = ioutil.TempDir("", "host_local_migrate_old")
+		Expect(err).NotTo(HaveOccurred())
+		newDir, err = ioutil.TempDir("", "host_local_migrate_new")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(oldDir)).To(Succeed())
+		Expect(os.RemoveAll(newDir)).To(Succeed())
+	})
+
+	populate := func(layout int) {
+		s, err := NewWithLayout("net", oldDir, layout)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+		for i := 2; i < 12; i++ {
+			_, err := s.Reserve(fmt.Sprintf("id%d", i), "eth0", net.IPv4(10, 1, 2, byte(i)), "0")
+			Expect(err).NotTo(HaveOccurred())
+		}
+	}
+
+	expectMigrated := func(dir string) {
+		s, err := New("net", dir)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+		for i := 2; i < 12; i++ {
+			Expect(s.GetByID(fmt.Sprintf("id%d", i), "eth0")).To(Equal([]net.IP{net.IPv4(10, 1, 2, byte(i))}))
+		}
+		Expect(s.LastReservedIP("0")).To(Equal(net.IPv4(10, 1, 2, 11)))
+	}
+
+	It("copies every reservation and keeps the originals", func() {
+		populate(LayoutV1)
+		Expect(MigrateDataDir("net", oldDir, newDir, false)).To(Succeed())
+		expectMigrated(newDir)
+		expectMigrated(oldDir)
+	})
+
+	It("removes the originals once they are copied", func() {
+		populate(LayoutV2)
+		Expect(MigrateDataDir("net", oldDir, newDir, true)).To(Succeed())
+		expectMigrated(newDir)
+
+		names, err := migratedFiles(filepath.Join(oldDir, "net"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names).To(BeEmpty())
+		Expect(readLayout(filepath.Join(newDir, "net"))).To(Equal(LayoutV2))
+	})
+
+	It("completes an interrupted migration", func() {
+		populate(LayoutV1)
+		Expect(MigrateDataDir("net", oldDir, newDir, false)).To(Succeed())
+		// as if it was interrupted after some originals were removed
+		Expect(os.Remove(filepath.Join(oldDir, "net", "10.1.2.2"))).To(Succeed())
+		Expect(os.Remove(filepath.Join(newDir, "net", "10.1.2.7"))).To(Succeed())
+
+		Expect(MigrateDataDir("net", oldDir, newDir, true)).To(Succeed())
+		expectMigrated(newDir)
+	})
+
+	It("does not overwrite an address reserved for another container", func() {
+		populate(LayoutV1)
+		s, err := New("net", newDir)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = s.Reserve("other", "eth0", net.IPv4(10, 1, 2, 5), "0")
+		Expect(err).NotTo(HaveOccurred())
+		s.Close()
+
+		err = MigrateDataDir("net", oldDir, newDir, true)
+		Expect(err).To(MatchError(ContainSubstring(`address 10.1.2.5 is already reserved for "other\r\neth0"`)))
+		Expect(filepath.Join(oldDir, "net", "10.1.2.5")).To(BeAnExistingFile())
+
+		Expect(MigrateDataDir("net", oldDir, oldDir, false)).To(MatchError(ContainSubstring("onto itself")))
+	})
+})
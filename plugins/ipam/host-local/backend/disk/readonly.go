@@ -0,0 +1,55 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// OpenReadOnly opens the store of network for inspection. Its Lock takes
+// the lock shared, so ForEach, ReservationsByID and Stats of any number
+// of read-only stores proceed together, while writers still wait for
+// them and exclude them. The data directory has to exist already, and
+// the methods that would change it fail.
+func OpenReadOnly(network, dataDir string) (*Store, error) {
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	dir := filepath.Join(dataDir, network)
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+
+	layout, err := readLayout(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	lk, err := NewFileLock(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{FileLock: lk, dataDir: dir, layout: layout, readOnly: true}, nil
+}
+
+// writable fails for stores opened with OpenReadOnly.
+func (s *Store) writable() error {
+	if s.readOnly {
+		return fmt.Errorf("store %s is open read-only", s.dataDir)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/alexflint/go-filemutex"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store OpenReadOnly", func() {
+	var dataDir string
+	var w *Store
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host_local_readonly")
+		Expect(err).NotTo(HaveOccurred())
+		w, err = New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = w.Reserve("id1", "eth0", net.ParseIP("10.1.2.2"), "0")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		w.Close()
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	open := func() *Store {
+		s, err := OpenReadOnly("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		return s
+	}
+
+	count := func(s *Store) int {
+		n := 0
+		Expect(s.ForEach(func(Reservation) error {
+			n++
+			return nil
+		})).To(Succeed())
+		return n
+	}
+
+	It("lets readers in together and keeps writers out", func() {
+		r1 := open()
+		defer r1.Close()
+		r2 := open()
+		defer r2.Close()
+
+		Expect(r1.Lock()).To(Succeed())
+		// another reader is not held up by the first one
+		Expect(count(r2)).To(Equal(1))
+		st, err := r2.Stats()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(st.Reservations).To(Equal(1))
+		Expect(w.FileLock.TryLock()).To(Equal(filemutex.AlreadyLocked))
+		// and readers leave no holder behind
+		_, err = os.Stat(filepath.Join(dataDir, "net", lockInfoFile))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		written := make(chan error)
+		go func() {
+			defer GinkgoRecover()
+			if err := w.Lock(); err != nil {
+				written <- err
+				return
+			}
+			_, err := w.Reserve("id2", "eth0", net.ParseIP("10.1.2.3"), "0")
+			w.Unlock()
+			written <- err
+		}()
+		Consistently(written, "200ms").ShouldNot(Receive())
+		Expect(r1.Unlock()).To(Succeed())
+		Eventually(written).Should(Receive(BeNil()))
+		Expect(count(r1)).To(Equal(2))
+	})
+
+	It("waits for a writer holding the lock", func() {
+		r := open()
+		defer r.Close()
+
+		Expect(w.Lock()).To(Succeed())
+		read := make(chan int)
+		go func() {
+			defer GinkgoRecover()
+			read <- count(r)
+		}()
+		Consistently(read, "200ms").ShouldNot(Receive())
+		_, err := w.Reserve("id2", "eth0", net.ParseIP("10.1.2.3"), "0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(w.Unlock()).To(Succeed())
+		Eventually(read).Should(Receive(Equal(2)))
+	})
+
+	It("refuses changes", func() {
+		r := open()
+		defer r.Close()
+
+		_, err := r.Reserve("id2", "eth0", net.ParseIP("10.1.2.3"), "0")
+		Expect(err).To(MatchError("store " + filepath.Join(dataDir, "net") + " is open read-only"))
+		Expect(r.Release(net.ParseIP("10.1.2.2"))).To(HaveOccurred())
+		Expect(r.ReleaseByID("id1", "eth0")).To(HaveOccurred())
+		_, err = r.ReleaseIf(func(Reservation) bool { return true })
+		Expect(err).To(HaveOccurred())
+		Expect(r.Repair([]Reservation{{IP: net.ParseIP("10.1.2.4"), ContainerID: "id3"}})).To(HaveOccurred())
+		_, err = r.VacuumLockDir()
+		Expect(err).To(HaveOccurred())
+
+		Expect(r.GetByID("id1", "eth0")).To(Equal([]net.IP{net.ParseIP("10.1.2.2")}))
+		found, err := r.ReservationsByID("id1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(HaveLen(1))
+	})
+
+	It("does not create a missing data directory", func() {
+		_, err := OpenReadOnly("other", dataDir)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+		_, err = os.Stat(filepath.Join(dataDir, "other"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+})
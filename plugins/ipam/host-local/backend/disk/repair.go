@@ -0,0 +1,71 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Reservation is an address reserved for a container's interface.
+type Reservation struct {
+	IP          net.IP
+	ContainerID string
+	IfName      string
+	// RangeID is the range set the address was allocated from, the index
+	// of its range set in the configuration. It is only recorded by
+	// LayoutV2 stores, and empty for older reservations.
+	RangeID string
+	// Namespace is the namespace of the pod, where LayoutV2 stores
+	// recorded it.
+	Namespace string
+}
+
+// Repair recreates the reservation files of entries, typically gathered
+// from the interfaces that are still configured after the data directory
+// was lost. Addresses that are already reserved are left as they are, so
+// running it again changes nothing. Unlike Reserve, it does not move the
+// last reserved IPs, and records the namespace of each entry rather than
+// the one set on the store, without metadata.
+func (s *Store) Repair(entries []Reservation) error {
+	if err := s.writable(); err != nil {
+		return err
+	}
+	for _, r := range entries {
+		if r.IP == nil || strings.TrimSpace(r.ContainerID) == "" {
+			return fmt.Errorf("invalid reservation %+v: an IP and a container ID are required", r)
+		}
+	}
+
+	if err := s.Lock(); err != nil {
+		return err
+	}
+	defer s.Unlock()
+
+	for _, r := range entries {
+		// the namespace and metadata set for the current call are not
+		// those of the entries
+		data, err := s.encodeReservation(r.ContainerID, r.IfName, r.RangeID, r.Namespace, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := createReservation(GetEscapedPath(s.dataDir, r.IP.String()), data); err != nil {
+			return fmt.Errorf("failed to repair reservation of %s: %v", r.IP, err)
+		}
+		s.markBitmaps(r.IP, true)
+	}
+	return nil
+}
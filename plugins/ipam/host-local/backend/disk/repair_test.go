@@ -0,0 +1,101 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store repair", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host_local_repair")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	It("recreates missing reservations and keeps existing ones", func() {
+		s, err := New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+
+		entries := []Reservation{
+			{IP: net.ParseIP("10.1.2.2"), ContainerID: "id1", IfName: "eth0"},
+			{IP: net.ParseIP("10.1.2.3"), ContainerID: "id2", IfName: "eth0"},
+			{IP: net.ParseIP("2001:db8::2"), ContainerID: "id2", IfName: "eth0"},
+		}
+		Expect(s.Repair(entries)).To(Succeed())
+
+		for _, name := range []string{"10.1.2.2", "10.1.2.3", GetEscapedPath("", "2001:db8::2")} {
+			_, err := os.Stat(filepath.Join(dataDir, "net", name))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(s.GetByID("id1", "eth0")).To(Equal([]net.IP{net.ParseIP("10.1.2.2")}))
+		Expect(s.GetByID("id2", "eth0")).To(ConsistOf(net.ParseIP("10.1.2.3"), net.ParseIP("2001:db8::2")))
+		_, err = s.LastReservedIP("0")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		// running again, or with a conflicting entry, changes nothing
+		before, err := ioutil.ReadFile(filepath.Join(dataDir, "net", "10.1.2.2"))
+		Expect(err).NotTo(HaveOccurred())
+		entries = append(entries, Reservation{IP: net.ParseIP("10.1.2.2"), ContainerID: "other", IfName: "eth1"})
+		Expect(s.Repair(entries)).To(Succeed())
+		after, err := ioutil.ReadFile(filepath.Join(dataDir, "net", "10.1.2.2"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(after).To(Equal(before))
+
+		Expect(s.Repair([]Reservation{{IP: net.ParseIP("10.1.2.9")}})).To(HaveOccurred())
+		_, err = os.Stat(filepath.Join(dataDir, "net", "10.1.2.9"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("keeps the namespace of each entry", func() {
+		s, err := NewWithLayout("net", dataDir, LayoutV2)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+		// what the current call would stamp on its own reservations
+		s.SetNamespace("default")
+		Expect(s.SetMetadata(map[string]string{"pod": "repairer"})).To(Succeed())
+
+		Expect(s.Repair([]Reservation{
+			{IP: net.ParseIP("10.1.2.2"), ContainerID: "id1", IfName: "eth0", Namespace: "team-a"},
+			{IP: net.ParseIP("10.1.2.3"), ContainerID: "id2", IfName: "eth0", Namespace: "team-a"},
+			{IP: net.ParseIP("10.1.2.4"), ContainerID: "id3", IfName: "eth0", Namespace: "team-b"},
+		})).To(Succeed())
+
+		// as the quota counts them
+		counts := map[string]int{}
+		Expect(s.ForEach(func(r Reservation) error {
+			counts[r.Namespace]++
+			return nil
+		})).To(Succeed())
+		Expect(counts).To(Equal(map[string]int{"team-a": 2, "team-b": 1}))
+
+		m, err := s.Metadata(net.ParseIP("10.1.2.2"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m).To(BeNil())
+	})
+})
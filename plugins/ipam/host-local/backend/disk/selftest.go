@@ -0,0 +1,75 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/alexflint/go-filemutex"
+)
+
+// SelfTest checks that the data directory exists, that files can be
+// created in it and that its lock can be taken, so a broken node fails
+// its preflight rather than its first pod. It does not wait for the
+// lock: a lock that is held fails the test, naming the holder if known.
+func (s *Store) SelfTest() error {
+	fi, err := os.Stat(s.dataDir)
+	if err != nil {
+		return fmt.Errorf("data directory %s is not usable: %v", s.dataDir, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("data directory %s is not a directory", s.dataDir)
+	}
+
+	f, err := ioutil.TempFile(s.dataDir, tmpFilePrefix+"selftest.")
+	if err != nil {
+		return fmt.Errorf("data directory %s is not writable: %v", s.dataDir, err)
+	}
+	_, err = f.Write([]byte("selftest"))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if rerr := os.Remove(f.Name()); err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return fmt.Errorf("data directory %s is not writable: %v", s.dataDir, err)
+	}
+
+	// a lock of its own, which conflicts with the store's too
+	lk, err := NewFileLock(s.dataDir)
+	if err != nil {
+		return fmt.Errorf("failed to open the lock of %s: %v", s.dataDir, err)
+	}
+	defer lk.Close()
+	if err := lk.TryLock(); err == filemutex.AlreadyLocked {
+		if holder, since, ierr := s.LockInfo(); ierr == nil && holder != nil {
+			return fmt.Errorf("lock of %s is held by pid %d for %q since %s", s.dataDir, holder.PID, holder.ContainerID, since.Format(time.RFC3339))
+		}
+		return fmt.Errorf("lock of %s is held by another process", s.dataDir)
+	} else if err != nil {
+		return fmt.Errorf("failed to lock %s: %v", s.dataDir, err)
+	}
+	if err := lk.Unlock(); err != nil {
+		return fmt.Errorf("failed to unlock %s: %v", s.dataDir, err)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store SelfTest", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host_local_selftest")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	It("passes on a writable, unlocked data directory and leaves nothing behind", func() {
+		s, err := New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+
+		before, err := ioutil.ReadDir(filepath.Join(dataDir, "net"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.SelfTest()).To(Succeed())
+		after, err := ioutil.ReadDir(filepath.Join(dataDir, "net"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(after).To(HaveLen(len(before)))
+
+		// the lock is free again
+		Expect(s.Lock()).To(Succeed())
+		Expect(s.Unlock()).To(Succeed())
+	})
+
+	It("fails while another store holds the lock", func() {
+		s, err := New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+		other, err := New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer other.Close()
+
+		other.SetHolder("id1")
+		Expect(other.Lock()).To(Succeed())
+		err = s.SelfTest()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(HavePrefix(fmt.Sprintf(`lock of %s is held by pid %d for "id1" since `, filepath.Join(dataDir, "net"), os.Getpid())))
+		Expect(other.Unlock()).To(Succeed())
+
+		Expect(s.SelfTest()).To(Succeed())
+	})
+
+	It("fails when the data directory is not writable", func() {
+		// not even root can create files in /proc
+		s := &Store{dataDir: "/proc/self"}
+		err := s.SelfTest()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(HavePrefix("data directory /proc/self is not writable: "))
+	})
+
+	It("fails when the data directory is gone", func() {
+		s, err := New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+
+		err = s.SelfTest()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(HavePrefix(fmt.Sprintf("data directory %s is not usable: ", filepath.Join(dataDir, "net"))))
+	})
+})
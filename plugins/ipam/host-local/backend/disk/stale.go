@@ -0,0 +1,113 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// WatchStale reports, every interval until ctx is done, the reservations
+// that are older than ttl, when the returned channel is closed. Each one
+// is reported once, as it crosses ttl; a controller decides what to do
+// with it, nothing is released. The age of LayoutV1 reservations is that
+// of their file.
+func (s *Store) WatchStale(ctx context.Context, ttl, interval time.Duration) (<-chan Reservation, error) {
+	if ttl <= 0 || interval <= 0 {
+		return nil, fmt.Errorf("invalid ttl %v or interval %v (must be positive)", ttl, interval)
+	}
+	reported := map[string]string{}
+	stale, err := s.scanStale(ttl, reported)
+	if err != nil {
+		return nil, err
+	}
+
+	reservations := make(chan Reservation)
+	ticks, stop := clock.NewTicker(interval)
+	go s.watchStale(ctx, ttl, ticks, stop, reported, stale, reservations)
+	return reservations, nil
+}
+
+func (s *Store) watchStale(ctx context.Context, ttl time.Duration, ticks <-chan time.Time, stop func(), reported map[string]string, stale []Reservation, reservations chan<- Reservation) {
+	defer close(reservations)
+	defer stop()
+
+	for {
+		for _, r := range stale {
+			select {
+			case reservations <- r:
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticks:
+		}
+		// a failed scan is tried again on the next tick
+		stale, _ = s.scanStale(ttl, reported)
+	}
+}
+
+// scanStale returns the reservations older than ttl that are not in
+// reported yet, and adds them. Addresses released or reserved again since
+// are dropped from reported, so a new reservation is reported in turn.
+func (s *Store) scanStale(ttl time.Duration, reported map[string]string) ([]Reservation, error) {
+	files, err := ioutil.ReadDir(s.dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	current := map[string]string{}
+	var stale []Reservation
+	for _, fi := range files {
+		ip := net.ParseIP(fi.Name())
+		if fi.IsDir() || ip == nil {
+			continue
+		}
+		path := filepath.Join(s.dataDir, fi.Name())
+		key, ok := readKey(path)
+		if !ok {
+			continue
+		}
+		current[fi.Name()] = key
+		if reported[fi.Name()] == key {
+			continue
+		}
+		delete(reported, fi.Name())
+		reserved, ok := reservedAt(path, fi.ModTime())
+		if !ok || now().Sub(reserved) < ttl {
+			continue
+		}
+		r, ok := readReservation(path)
+		if !ok {
+			continue
+		}
+		r.IP = ip
+		reported[fi.Name()] = key
+		stale = append(stale, r)
+	}
+	for name, key := range reported {
+		if current[name] != key {
+			delete(reported, name)
+		}
+	}
+	return stale, nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store stale watch", func() {
+	var dataDir string
+	var s *Store
+	var fake *fakeClock
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host_local_stale")
+		Expect(err).NotTo(HaveOccurred())
+		fake = newFakeClock(time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC))
+		clock = fake
+		s, err = NewWithLayout("net", dataDir, LayoutV2)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		s.Close()
+		clock = realClock{}
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	reserve := func(id, addr string) {
+		reserved, err := s.Reserve(id, "eth0", net.ParseIP(addr), "0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+	}
+
+	It("reports reservations once they age past the ttl", func() {
+		reserve("id1", "10.1.2.2")
+		fake.Advance(30 * time.Second)
+		reserve("id2", "10.1.2.3")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stale, err := s.WatchStale(ctx, time.Minute, 10*time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		Consistently(stale, 50*time.Millisecond).ShouldNot(Receive())
+
+		fake.Advance(30 * time.Second)
+		Eventually(stale).Should(Receive(Equal(Reservation{IP: net.ParseIP("10.1.2.2"), ContainerID: "id1", IfName: "eth0", RangeID: "0"})))
+		Consistently(stale, 50*time.Millisecond).ShouldNot(Receive())
+
+		fake.Advance(30 * time.Second)
+		Eventually(stale).Should(Receive(Equal(Reservation{IP: net.ParseIP("10.1.2.3"), ContainerID: "id2", IfName: "eth0", RangeID: "0"})))
+
+		// nothing is released
+		Expect(s.GetByID("id1", "eth0")).To(Equal([]net.IP{net.ParseIP("10.1.2.2")}))
+
+		cancel()
+		Eventually(stale).Should(BeClosed())
+	})
+
+	It("reports an address reserved again for another container", func() {
+		reserve("id1", "10.1.2.2")
+		fake.Advance(2 * time.Minute)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stale, err := s.WatchStale(ctx, time.Minute, 10*time.Second)
+		Expect(err).NotTo(HaveOccurred())
+		var r Reservation
+		Eventually(stale).Should(Receive(&r))
+		Expect(r.ContainerID).To(Equal("id1"))
+
+		Expect(s.ReleaseByID("id1", "eth0")).To(Succeed())
+		reserve("id2", "10.1.2.2")
+		Consistently(stale, 50*time.Millisecond).ShouldNot(Receive())
+		fake.Advance(time.Minute)
+		Eventually(stale).Should(Receive(&r))
+		Expect(r.ContainerID).To(Equal("id2"))
+	})
+
+	It("dates LayoutV1 reservations by their file", func() {
+		v1, err := NewWithLayout("v1", dataDir, LayoutV1)
+		Expect(err).NotTo(HaveOccurred())
+		defer v1.Close()
+		reserved, err := v1.Reserve("id1", "eth0", net.ParseIP("10.1.2.2"), "0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+		old := fake.Now().Add(-time.Hour)
+		Expect(os.Chtimes(filepath.Join(dataDir, "v1", "10.1.2.2"), old, old)).To(Succeed())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stale, err := v1.WatchStale(ctx, time.Minute, time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		var r Reservation
+		Eventually(stale).Should(Receive(&r))
+		Expect(r.ContainerID).To(Equal("id1"))
+	})
+
+	It("rejects a zero ttl or interval", func() {
+		_, err := s.WatchStale(context.Background(), 0, time.Second)
+		Expect(err).To(MatchError("invalid ttl 0s or interval 1s (must be positive)"))
+		_, err = s.WatchStale(context.Background(), time.Second, 0)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,99 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// StoreStats is a snapshot of the reservations in a store.
+type StoreStats struct {
+	Reservations int
+	// ParseErrors counts the reservation files that could not be read or
+	// name no container.
+	ParseErrors int
+	// OldestAge is the age of the oldest reservation, zero if there is none.
+	OldestAge time.Duration
+}
+
+// Stats walks the store once under the lock and summarizes it. The age of
+// a reservation is its recorded time in LayoutV2 and the file's
+// modification time otherwise.
+func (s *Store) Stats() (StoreStats, error) {
+	if err := s.Lock(); err != nil {
+		return StoreStats{}, err
+	}
+	defer s.Unlock()
+
+	return s.stats(time.Now())
+}
+
+func (s *Store) stats(now time.Time) (StoreStats, error) {
+	var st StoreStats
+
+	files, err := ioutil.ReadDir(s.dataDir)
+	if err != nil {
+		return st, err
+	}
+
+	var oldest time.Time
+	for _, fi := range files {
+		if fi.IsDir() || net.ParseIP(fi.Name()) == nil {
+			continue
+		}
+		st.Reservations++
+
+		reserved, ok := reservedAt(filepath.Join(s.dataDir, fi.Name()), fi.ModTime())
+		if !ok {
+			st.ParseErrors++
+			continue
+		}
+		if oldest.IsZero() || reserved.Before(oldest) {
+			oldest = reserved
+		}
+	}
+
+	if !oldest.IsZero() {
+		st.OldestAge = now.Sub(oldest)
+	}
+	return st, nil
+}
+
+// reservedAt returns when the reservation in path was made, or false if the
+// file is not a valid reservation.
+func reservedAt(path string, modTime time.Time) (time.Time, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	if isJSON(data) {
+		var r reservation
+		if err := json.Unmarshal(data, &r); err != nil || r.ContainerID == "" {
+			return time.Time{}, false
+		}
+		return r.Reserved, true
+	}
+
+	if id, _ := splitKey(strings.TrimSpace(string(data))); id == "" {
+		return time.Time{}, false
+	}
+	return modTime, true
+}
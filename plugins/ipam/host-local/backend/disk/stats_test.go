@@ -0,0 +1,74 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store stats", func() {
+	var dataDir string
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host_local_stats")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	It("counts reservations and reports the oldest one", func() {
+		s, err := New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+
+		now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+		seed := func(name, contents string, age time.Duration) {
+			path := filepath.Join(dataDir, "net", name)
+			Expect(ioutil.WriteFile(path, []byte(contents), 0644)).To(Succeed())
+			Expect(os.Chtimes(path, now.Add(-age), now.Add(-age))).To(Succeed())
+		}
+
+		st, err := s.stats(now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(st).To(Equal(StoreStats{}))
+
+		seed("10.1.2.2", "id1"+LineBreak+"eth0", time.Hour)
+		seed("10.1.2.3", `{"containerID":"id2","reserved":"2021-05-31T12:00:00Z"}`, time.Minute)
+		seed("10.1.2.4", "id3", 2*time.Hour)
+		seed("10.1.2.5", "", 48*time.Hour)
+		seed("10.1.2.6", `{"containerID":`, 48*time.Hour)
+		seed(lastIPFilePrefix+"0", "10.1.2.6", 72*time.Hour)
+
+		st, err = s.stats(now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(st).To(Equal(StoreStats{
+			Reservations: 5,
+			ParseErrors:  2,
+			OldestAge:    24 * time.Hour,
+		}))
+
+		_, err = s.Stats()
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,74 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alexflint/go-filemutex"
+)
+
+// selfTestGrace is how long the file of a SelfTest, which runs without the
+// lock, is left alone.
+const selfTestGrace = time.Minute
+
+// VacuumLockDir removes what processes that died holding the lock left
+// behind: the record of the holder and half written temporary files. It
+// only does so if it can take the lock without waiting, and fails
+// otherwise, since those files belong to the holder while it is alive.
+// The lock file itself is never removed; a process waiting on it would
+// no longer exclude the ones that open a new one. It returns the names of
+// the files removed.
+func (s *Store) VacuumLockDir() ([]string, error) {
+	if err := s.writable(); err != nil {
+		return nil, err
+	}
+	if err := s.FileLock.TryLock(); err == filemutex.AlreadyLocked {
+		return nil, fmt.Errorf("lock of %s is held, not vacuuming it", s.dataDir)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to lock %s: %v", s.dataDir, err)
+	}
+	defer s.FileLock.Unlock()
+
+	files, err := ioutil.ReadDir(s.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, fi := range files {
+		name := fi.Name()
+		switch {
+		case fi.IsDir():
+			continue
+		case strings.HasPrefix(name, tmpFilePrefix+"selftest."):
+			if now().Sub(fi.ModTime()) < selfTestGrace {
+				continue
+			}
+		case name == lockInfoFile, strings.HasPrefix(name, tmpFilePrefix):
+		default:
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dataDir, name)); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed = append(removed, name)
+	}
+	return removed, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store VacuumLockDir", func() {
+	var dataDir, netDir string
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host_local_vacuum")
+		Expect(err).NotTo(HaveOccurred())
+		netDir = filepath.Join(dataDir, "net")
+		clock = newFakeClock(start)
+	})
+
+	AfterEach(func() {
+		clock = realClock{}
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	seed := func(name, data string, modTime time.Time) {
+		path := filepath.Join(netDir, name)
+		Expect(ioutil.WriteFile(path, []byte(data), 0644)).To(Succeed())
+		Expect(os.Chtimes(path, modTime, modTime)).To(Succeed())
+	}
+
+	It("removes what a dead holder left behind and keeps the lock", func() {
+		s, err := New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+		reserved, err := s.Reserve("id1", "eth0", net.ParseIP("10.1.2.2"), "0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+
+		cmd := exec.Command("true")
+		Expect(cmd.Run()).To(Succeed())
+		seed(lockInfoFile, fmt.Sprintf(`{"pid": %d, "holder": "id2", "since": "2021-06-01T11:00:00Z"}`, cmd.Process.Pid), start)
+		seed(tmpFilePrefix+"10.1.2.3", "id2\neth0", start)
+		seed(tmpFilePrefix+"selftest.1", "selftest", start.Add(-time.Hour))
+		seed(tmpFilePrefix+"selftest.2", "selftest", start)
+
+		removed, err := s.VacuumLockDir()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(removed).To(ConsistOf(lockInfoFile, tmpFilePrefix+"10.1.2.3", tmpFilePrefix+"selftest.1"))
+
+		for _, name := range []string{"lock", "10.1.2.2", tmpFilePrefix + "selftest.2"} {
+			_, err := os.Stat(filepath.Join(netDir, name))
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		// the store still locks as before
+		Expect(s.Lock()).To(Succeed())
+		Expect(s.Unlock()).To(Succeed())
+	})
+
+	It("leaves a held lock alone", func() {
+		s, err := New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer s.Close()
+		holder, err := New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer holder.Close()
+
+		holder.SetHolder("id1")
+		Expect(holder.Lock()).To(Succeed())
+		seed(tmpFilePrefix+"10.1.2.3", "id1\neth0", start)
+
+		_, err = s.VacuumLockDir()
+		Expect(err).To(MatchError(fmt.Sprintf("lock of %s is held, not vacuuming it", netDir)))
+		for _, name := range []string{"lock", lockInfoFile, tmpFilePrefix + "10.1.2.3"} {
+			_, err := os.Stat(filepath.Join(netDir, name))
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		info, _, err := s.LockInfo()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info).To(Equal(&LockHolder{PID: os.Getpid(), ContainerID: "id1"}))
+		Expect(holder.Unlock()).To(Succeed())
+	})
+})
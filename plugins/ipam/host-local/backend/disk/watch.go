@@ -0,0 +1,210 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// resyncInterval is how often Watch rescans the whole store, in case
+// events were lost.
+var resyncInterval = time.Minute
+
+// ReservationOp is the kind of change a ReservationEvent reports.
+type ReservationOp int
+
+const (
+	Reserved ReservationOp = iota
+	Released
+)
+
+// ReservationEvent reports that an address was reserved for, or released
+// by, a container.
+type ReservationEvent struct {
+	Op          ReservationOp
+	IP          net.IP
+	ContainerID string
+	IfName      string
+}
+
+// Watch reports changes to the reservations in the store until ctx is
+// done, when the returned channel is closed. Reservations that exist when
+// Watch is called are not reported. Besides reacting to file system
+// events, the store is rescanned periodically and whenever the kernel
+// dropped events, so a slow reader misses no change, although changes
+// that cancel out between two scans are not reported.
+func (s *Store) Watch(ctx context.Context) (<-chan ReservationEvent, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Add(s.dataDir); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	known, err := s.scan()
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	events := make(chan ReservationEvent)
+	go s.watch(ctx, w, known, events)
+	return events, nil
+}
+
+func (s *Store) watch(ctx context.Context, w *fsnotify.Watcher, known map[string]string, events chan<- ReservationEvent) {
+	defer close(events)
+	defer w.Close()
+
+	ticks, stop := clock.NewTicker(resyncInterval)
+	defer stop()
+
+	deliver := func(evs []ReservationEvent) bool {
+		for _, ev := range evs {
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return false
+			}
+		}
+		return true
+	}
+
+	for {
+		var evs []ReservationEvent
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			// Whatever happened to the file, its current contents
+			// tell what changed
+			name := filepath.Base(ev.Name)
+			if net.ParseIP(name) == nil {
+				continue
+			}
+			key, _ := readKey(filepath.Join(s.dataDir, name))
+			evs = diffReservation(known, name, key)
+		case _, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			// typically fsnotify.ErrEventOverflow
+			evs = s.resync(known)
+		case <-ticks:
+			evs = s.resync(known)
+		}
+		if !deliver(evs) {
+			return
+		}
+	}
+}
+
+// scan returns the reservation key of every address in the store.
+func (s *Store) scan() (map[string]string, error) {
+	files, err := ioutil.ReadDir(s.dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := map[string]string{}
+	for _, fi := range files {
+		if fi.IsDir() || net.ParseIP(fi.Name()) == nil {
+			continue
+		}
+		if key, ok := readKey(filepath.Join(s.dataDir, fi.Name())); ok {
+			keys[fi.Name()] = key
+		}
+	}
+	return keys, nil
+}
+
+// resync rescans the store and returns the changes since known, which it
+// brings up to date. A failed scan is tried again on the next resync.
+func (s *Store) resync(known map[string]string) []ReservationEvent {
+	current, err := s.scan()
+	if err != nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(known)+len(current))
+	for name := range known {
+		names = append(names, name)
+	}
+	for name := range current {
+		if _, ok := known[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var evs []ReservationEvent
+	for _, name := range names {
+		evs = append(evs, diffReservation(known, name, current[name])...)
+	}
+	return evs
+}
+
+// diffReservation updates known with the reservation key of name, empty if
+// the address is free, and returns the resulting events.
+func diffReservation(known map[string]string, name, key string) []ReservationEvent {
+	old, reserved := known[name]
+	if reserved && old == key {
+		return nil
+	}
+
+	var evs []ReservationEvent
+	ip := net.ParseIP(name)
+	if reserved {
+		delete(known, name)
+		evs = append(evs, newReservationEvent(Released, ip, old))
+	}
+	if key != "" {
+		known[name] = key
+		evs = append(evs, newReservationEvent(Reserved, ip, key))
+	}
+	return evs
+}
+
+func newReservationEvent(op ReservationOp, ip net.IP, key string) ReservationEvent {
+	id, ifname := splitKey(key)
+	return ReservationEvent{Op: op, IP: ip, ContainerID: id, IfName: ifname}
+}
+
+// readKey returns the reservation key in path, or false if there is no
+// valid reservation. Reserve creates the file before writing it, so an
+// empty file is not one yet.
+func readKey(path string) (string, bool) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	key := reservationKey(data)
+	if id, _ := splitKey(key); id == "" {
+		return "", false
+	}
+	return key, true
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package disk
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store watch", func() {
+	var dataDir string
+	var s *Store
+
+	BeforeEach(func() {
+		var err error
+		dataDir, err = ioutil.TempDir("", "host_local_watch")
+		Expect(err).NotTo(HaveOccurred())
+		s, err = New("net", dataDir)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		s.Close()
+		Expect(os.RemoveAll(dataDir)).To(Succeed())
+	})
+
+	It("reports reservations being made and released", func() {
+		reserved, err := s.Reserve("old", "eth0", net.ParseIP("10.1.2.2"), "0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		events, err := s.Watch(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		reserved, err = s.Reserve("id1", "eth0", net.ParseIP("10.1.2.3"), "0")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reserved).To(BeTrue())
+		Eventually(events).Should(Receive(Equal(ReservationEvent{
+			Op:          Reserved,
+			IP:          net.ParseIP("10.1.2.3"),
+			ContainerID: "id1",
+			IfName:      "eth0",
+		})))
+
+		Expect(s.ReleaseByID("old", "eth0")).To(Succeed())
+		Eventually(events).Should(Receive(Equal(ReservationEvent{
+			Op:          Released,
+			IP:          net.ParseIP("10.1.2.2"),
+			ContainerID: "old",
+			IfName:      "eth0",
+		})))
+
+		// the store's own bookkeeping is not reported
+		Consistently(events, 100*time.Millisecond).ShouldNot(Receive())
+
+		cancel()
+		Eventually(events).Should(BeClosed())
+	})
+
+	It("catches up on lost events with a full resync", func() {
+		netDir := filepath.Join(dataDir, "net")
+		Expect(ioutil.WriteFile(filepath.Join(netDir, "10.1.2.2"), []byte("id1"+LineBreak+"eth0"), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(netDir, "10.1.2.3"), []byte("id2"), 0644)).To(Succeed())
+		known, err := s.scan()
+		Expect(err).NotTo(HaveOccurred())
+
+		// changed while no event was seen
+		Expect(os.Remove(filepath.Join(netDir, "10.1.2.2"))).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(netDir, "10.1.2.3"), []byte(`{"containerID":"id3","ifName":"eth1"}`), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(netDir, "10.1.2.4"), []byte("id4"+LineBreak+"eth0"), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(netDir, "10.1.2.5"), nil, 0644)).To(Succeed())
+
+		Expect(s.resync(known)).To(Equal([]ReservationEvent{
+			{Op: Released, IP: net.ParseIP("10.1.2.2"), ContainerID: "id1", IfName: "eth0"},
+			{Op: Released, IP: net.ParseIP("10.1.2.3"), ContainerID: "id2"},
+			{Op: Reserved, IP: net.ParseIP("10.1.2.3"), ContainerID: "id3", IfName: "eth1"},
+			{Op: Reserved, IP: net.ParseIP("10.1.2.4"), ContainerID: "id4", IfName: "eth0"},
+		}))
+		Expect(s.resync(known)).To(BeEmpty())
+	})
+})
@@ -62,3 +62,45 @@ func parseResolvConf(filename string) (*types.DNS, error) {
 
 	return &dns, nil
 }
+
+// mergeDNS adds the DNS settings of the ranges addresses were allocated
+// from to the network's. Ranges take precedence over the network and
+// earlier ranges over later ones: their nameservers, search domains and
+// options come first, and the first domain set wins. Duplicates are
+// dropped.
+func mergeDNS(network types.DNS, ranges []*types.DNS) types.DNS {
+	if len(ranges) == 0 {
+		return network
+	}
+
+	var merged types.DNS
+	add := func(dns *types.DNS) {
+		if merged.Domain == "" {
+			merged.Domain = dns.Domain
+		}
+		merged.Nameservers = appendUnique(merged.Nameservers, dns.Nameservers)
+		merged.Search = appendUnique(merged.Search, dns.Search)
+		merged.Options = appendUnique(merged.Options, dns.Options)
+	}
+	for _, dns := range ranges {
+		add(dns)
+	}
+	add(&network)
+	return merged
+}
+
+func appendUnique(list []string, values []string) []string {
+	for _, v := range values {
+		found := false
+		for _, l := range list {
+			if l == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -15,21 +15,27 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/testutils"
 
 	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/vishvananda/netlink"
 )
 
 const LineBreak = "\r\n"
@@ -679,6 +685,740 @@ var _ = Describe("host-local Operations", func() {
 			}
 		})
 	}
+
+	It("allocates only from the addresses of a pool file", func() {
+		poolFile := filepath.Join(tmpDir, "pool.json")
+		err := ioutil.WriteFile(poolFile, []byte(`["10.1.2.40", "10.1.2.30"]`), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24",
+				"poolFile": "%s"
+			}
+		}`, tmpDir, poolFile)
+
+		var allocated []string
+		for i := 0; i < 2; i++ {
+			args := &skel.CmdArgs{
+				ContainerID: fmt.Sprintf("dummy-%d", i),
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			allocated = append(allocated, result.IPs[0].Address.IP.String())
+		}
+		Expect(allocated).To(Equal([]string{"10.1.2.40", "10.1.2.30"}))
+
+		// The pool is exhausted until the file gains an address
+		args := &skel.CmdArgs{
+			ContainerID: "dummy-2",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(conf),
+		}
+		_, _, err = testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).To(Equal(types.NewError(types.ErrTryAgainLater, "failed to allocate for range 0: no IP addresses available in the address pool for range set: 10.1.2.1-10.1.2.254", "")))
+
+		err = ioutil.WriteFile(poolFile, []byte(`["10.1.2.40", "10.1.2.30", "10.1.2.50"]`), 0644)
+		Expect(err).NotTo(HaveOccurred())
+		r, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := types100.GetResult(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPs[0].Address.IP.String()).To(Equal("10.1.2.50"))
+	})
+
+	It("allocates the gateway only to the designated pod", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24",
+				"gatewayPod": "edge/gw"
+			}
+		}`, tmpDir)
+
+		add := func(containerID, pod string) (*types100.Result, error) {
+			args := &skel.CmdArgs{
+				ContainerID: containerID,
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+				Args:        "K8S_POD_NAMESPACE=edge;K8S_POD_NAME=" + pod,
+			}
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			if err != nil {
+				return nil, err
+			}
+			return types100.GetResult(r)
+		}
+
+		result, err := add("dummy-0", "web")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPs[0].Address.String()).To(Equal("10.1.2.2/24"))
+		Expect(result.IPs[0].Gateway.String()).To(Equal("10.1.2.1"))
+
+		result, err = add("dummy-1", "gw")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPs[0].Address.String()).To(Equal("10.1.2.1/24"))
+		Expect(result.IPs[0].Gateway).To(BeNil())
+
+		// a second instance of the designated pod is refused
+		_, err = add("dummy-2", "gw")
+		Expect(err).To(MatchError("failed to allocate for range 0: gateway 10.1.2.1 of range set 10.1.2.1-10.1.2.254 is already allocated"))
+
+		result, err = add("dummy-3", "web-2")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPs[0].Address.String()).To(Equal("10.1.2.3/24"))
+	})
+
+	It("allocates the designated pod as usual from range sets without a gateway", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"ranges": [
+					[{ "subnet": "10.1.2.0/24" }],
+					[{ "subnet": "10.1.3.0/31" }]
+				],
+				"gatewayPod": "edge/gw"
+			}
+		}`, tmpDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(conf),
+			Args:        "K8S_POD_NAMESPACE=edge;K8S_POD_NAME=gw",
+		}
+		r, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := types100.GetResult(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPs).To(HaveLen(2))
+		Expect(result.IPs[0].Address.String()).To(Equal("10.1.2.1/24"))
+		Expect(result.IPs[1].Address.String()).To(Equal("10.1.3.0/31"))
+		Expect(result.IPs[1].Gateway).To(BeNil())
+	})
+
+	It("allocates StatefulSet pods the address of their ordinal", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24",
+				"rangeStart": "10.1.2.10",
+				"statefulSetOrdinal": true
+			}
+		}`, tmpDir)
+
+		add := func(containerID, pod string) string {
+			args := &skel.CmdArgs{
+				ContainerID: containerID,
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+				Args:        "K8S_POD_NAMESPACE=default;K8S_POD_NAME=" + pod,
+			}
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			return result.IPs[0].Address.IP.String()
+		}
+
+		Expect(add("dummy-2", "app-2")).To(Equal("10.1.2.12"))
+		Expect(add("dummy-0", "app-0")).To(Equal("10.1.2.10"))
+		Expect(add("dummy-1", "app-1")).To(Equal("10.1.2.11"))
+
+		// pods without an ordinal are allocated as usual
+		Expect(add("dummy-web", "web")).To(Equal("10.1.2.13"))
+
+		// the address of the ordinal is taken, so another one is used
+		Expect(add("dummy-3", "app-3")).To(Equal("10.1.2.14"))
+	})
+
+	It("records allocations and releases in the audit log", func() {
+		auditPath := filepath.Join(tmpDir, "audit.log")
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24",
+				"auditLog": {"path": "%s", "maxSize": 400, "maxBackups": 1}
+			}
+		}`, tmpDir, auditPath)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(conf),
+			Args:        "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web",
+		}
+
+		readRecords := func(path string) []auditRecord {
+			data, err := ioutil.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			var records []auditRecord
+			for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+				var rec auditRecord
+				Expect(json.Unmarshal([]byte(line), &rec)).To(Succeed())
+				Expect(rec.Time).NotTo(BeZero())
+				rec.Time = time.Time{}
+				records = append(records, rec)
+			}
+			return records
+		}
+
+		before := time.Now()
+		_, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		err = testutils.CmdDelWithArgs(args, func() error {
+			return cmdDel(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		data, err := ioutil.ReadFile(auditPath)
+		Expect(err).NotTo(HaveOccurred())
+		var first auditRecord
+		Expect(json.Unmarshal([]byte(strings.SplitN(string(data), "\n", 2)[0]), &first)).To(Succeed())
+		Expect(first.Time).To(BeTemporally(">=", before.Add(-time.Second)))
+
+		Expect(readRecords(auditPath)).To(Equal([]auditRecord{
+			{Event: "allocate", Network: "mynet", ContainerID: "dummy", IfName: ifname, Pod: "default/web", IPs: []string{"10.1.2.2"}},
+			{Event: "release", Network: "mynet", ContainerID: "dummy", IfName: ifname, Pod: "default/web", IPs: []string{"10.1.2.2"}},
+		}))
+
+		// a DEL without a reservation records nothing
+		err = testutils.CmdDelWithArgs(args, func() error {
+			return cmdDel(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(readRecords(auditPath)).To(HaveLen(2))
+
+		// the next record no longer fits and rotates the log
+		_, _, err = testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(readRecords(auditPath + ".1")).To(HaveLen(2))
+		Expect(readRecords(auditPath)).To(Equal([]auditRecord{
+			{Event: "allocate", Network: "mynet", ContainerID: "dummy", IfName: ifname, Pod: "default/web", IPs: []string{"10.1.2.3"}},
+		}))
+	})
+
+	It("picks up ranges added and removed between invocations", func() {
+		confFor := func(ranges string) []byte {
+			return []byte(fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "mynet",
+				"type": "ipvlan",
+				"master": "foo0",
+				"ipam": {
+					"type": "host-local",
+					"dataDir": "%s",
+					"ranges": [%s]
+				}
+			}`, tmpDir, ranges))
+		}
+		add := func(containerID string, conf []byte) (string, error) {
+			args := &skel.CmdArgs{
+				ContainerID: containerID,
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   conf,
+			}
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			if err != nil {
+				return "", err
+			}
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			return result.IPs[0].Address.IP.String(), nil
+		}
+
+		var logs bytes.Buffer
+		log.SetOutput(&logs)
+		defer log.SetOutput(os.Stderr)
+
+		small := confFor(`[{"subnet": "10.1.2.0/30"}]`)
+		Expect(add("dummy-0", small)).To(Equal("10.1.2.2"))
+		_, err := add("dummy-1", small)
+		Expect(err).To(MatchError(ContainSubstring("no IP addresses available")))
+
+		// a subnet added to the range set is used right away
+		grown := confFor(`[{"subnet": "10.1.2.0/30"}, {"subnet": "10.1.3.0/24"}]`)
+		Expect(add("dummy-1", grown)).To(Equal("10.1.3.2"))
+		Expect(logs.String()).To(BeEmpty())
+
+		// once the first subnet is gone, its reservation is left alone
+		shrunk := confFor(`[{"subnet": "10.1.3.0/24"}]`)
+		Expect(add("dummy-2", shrunk)).To(Equal("10.1.3.3"))
+		Expect(logs.String()).To(ContainSubstring("reserved address 10.1.2.2 is outside the configured ranges"))
+		_, err = os.Stat(filepath.Join(tmpDir, "mynet", "10.1.2.2"))
+		Expect(err).NotTo(HaveOccurred())
+
+		// and released with its container
+		args := &skel.CmdArgs{
+			ContainerID: "dummy-0",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   shrunk,
+		}
+		err = testutils.CmdDelWithArgs(args, func() error {
+			return cmdDel(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = os.Stat(filepath.Join(tmpDir, "mynet", "10.1.2.2"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("returns the DNS of the ranges addresses are allocated from", func() {
+		err := ioutil.WriteFile(filepath.Join(tmpDir, "resolv.conf"), []byte("nameserver 192.0.2.3\ndomain net.example\nsearch example\n"), 0644)
+		Expect(err).NotTo(HaveOccurred())
+
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"resolvConf": "%s/resolv.conf",
+				"ranges": [
+					[
+						{"subnet": "10.1.2.0/24", "dns": {"nameservers": ["10.1.2.53"], "domain": "a.example", "search": ["a.example"]}},
+						{"subnet": "10.2.2.0/24", "dns": {"nameservers": ["10.2.2.53"]}}
+					],
+					[{"subnet": "2001:db8:1::0/64", "dns": {"nameservers": ["2001:db8:1::53", "192.0.2.3"], "domain": "b.example", "search": ["b.example", "example"], "options": ["ndots:2"]}}]
+				]
+			}
+		}`, tmpDir, tmpDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(conf),
+		}
+		r, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := types100.GetResult(r)
+		Expect(err).NotTo(HaveOccurred())
+
+		// ranges first, in order, then the network's resolvConf
+		Expect(result.DNS).To(Equal(types.DNS{
+			Nameservers: []string{"10.1.2.53", "2001:db8:1::53", "192.0.2.3"},
+			Domain:      "a.example",
+			Search:      []string{"a.example", "b.example", "example"},
+			Options:     []string{"ndots:2"},
+		}))
+	})
+
+	It("holds released addresses down before allocating them again", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24",
+				"rangeStart": "10.1.2.2",
+				"rangeEnd": "10.1.2.2",
+				"holdDown": "1h"
+			}
+		}`, tmpDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(conf),
+		}
+		_, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		err = testutils.CmdDelWithArgs(args, func() error {
+			return cmdDel(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		args.ContainerID = "dummy2"
+		_, _, err = testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).To(MatchError("failed to allocate for range 0: no IP addresses available in range set: 10.1.2.2-10.1.2.2"))
+
+		args.StdinData = []byte(strings.Replace(conf, `"1h"`, `"-1h"`, 1))
+		_, _, err = testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).To(MatchError(`invalid holdDown "-1h" (must be a non-negative duration)`))
+	})
+	It("fails with a retriable error once the range is full", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24",
+				"rangeStart": "10.1.2.2",
+				"rangeEnd": "10.1.2.4"
+			}
+		}`, tmpDir)
+
+		args := &skel.CmdArgs{
+			Netns:     nspath,
+			IfName:    ifname,
+			StdinData: []byte(conf),
+		}
+		for i := 0; i < 3; i++ {
+			args.ContainerID = fmt.Sprintf("dummy%d", i)
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		args.ContainerID = "dummy3"
+		_, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).To(Equal(types.NewError(types.ErrTryAgainLater, "failed to allocate for range 0: no IP addresses available in range set: 10.1.2.2-10.1.2.4", "")))
+
+		args.StdinData = []byte(strings.Replace(conf, `"rangeEnd"`, `"maxAllocationAttempts": -1, "rangeEnd"`, 1))
+		_, _, err = testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).To(MatchError("invalid maxAllocationAttempts -1 (must not be negative)"))
+	})
+	It("stores metadata from CNI_ARGS with the reservation", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"layoutVersion": 2,
+				"subnet": "10.1.2.0/24"
+			}
+		}`, tmpDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(conf),
+			Args:        "IgnoreUnknown=1;META_app=foo;META_tier=web;K8S_POD_NAME=web-0",
+		}
+		r, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := types100.GetResult(r)
+		Expect(err).NotTo(HaveOccurred())
+
+		store, err := disk.New("mynet", tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+		meta, err := store.Metadata(result.IPs[0].Address.IP)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(meta).To(Equal(map[string]string{"app": "foo", "tier": "web"}))
+
+		args.ContainerID = "dummy2"
+		args.Args = "META_bad/key=x"
+		_, _, err = testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).To(MatchError(`invalid metadata key "bad/key"`))
+	})
+	It("reclaims the addresses of containers without a liveness file once the range is full", func() {
+		livenessDir := filepath.Join(tmpDir, "alive")
+		Expect(os.Mkdir(livenessDir, 0755)).To(Succeed())
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24",
+				"rangeStart": "10.1.2.2",
+				"rangeEnd": "10.1.2.4",
+				"liveness": {"dir": "%s", "ttl": "1h"}
+			}
+		}`, tmpDir, livenessDir)
+
+		args := &skel.CmdArgs{
+			Netns:     nspath,
+			IfName:    ifname,
+			StdinData: []byte(conf),
+		}
+		add := func(id string) (*types100.Result, error) {
+			args.ContainerID = id
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			if err != nil {
+				return nil, err
+			}
+			return types100.GetResult(r)
+		}
+
+		addrs := map[string]string{}
+		for _, id := range []string{"alive", "dead", "stale"} {
+			result, err := add(id)
+			Expect(err).NotTo(HaveOccurred())
+			addrs[id] = result.IPs[0].Address.IP.String()
+		}
+		Expect(ioutil.WriteFile(filepath.Join(livenessDir, "alive"), nil, 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(livenessDir, "stale"), nil, 0644)).To(Succeed())
+		old := time.Now().Add(-2 * time.Hour)
+		Expect(os.Chtimes(filepath.Join(livenessDir, "stale"), old, old)).To(Succeed())
+
+		// the range is full, so the addresses of the gone containers are freed
+		result, err := add("new1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect([]string{addrs["dead"], addrs["stale"]}).To(ContainElement(result.IPs[0].Address.IP.String()))
+
+		Expect(ioutil.WriteFile(filepath.Join(livenessDir, "new1"), nil, 0644)).To(Succeed())
+		result, err = add("new2")
+		Expect(err).NotTo(HaveOccurred())
+		Expect([]string{addrs["dead"], addrs["stale"]}).To(ContainElement(result.IPs[0].Address.IP.String()))
+
+		store, err := disk.New("mynet", tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+		Expect(store.GetByID("alive", ifname)).To(HaveLen(1))
+		Expect(store.GetByID("dead", ifname)).To(BeEmpty())
+		Expect(store.GetByID("stale", ifname)).To(BeEmpty())
+
+		// everything left is alive
+		Expect(ioutil.WriteFile(filepath.Join(livenessDir, "new2"), nil, 0644)).To(Succeed())
+		_, err = add("new3")
+		Expect(err).To(Equal(types.NewError(types.ErrTryAgainLater, "failed to allocate for range 0: no IP addresses available in range set: 10.1.2.2-10.1.2.4", "")))
+
+		// nothing is reclaimed without the liveness directory
+		Expect(os.RemoveAll(livenessDir)).To(Succeed())
+		_, err = add("new4")
+		Expect(err).To(HaveOccurred())
+		Expect(store.GetByID("alive", ifname)).To(HaveLen(1))
+	})
+	It("records the range set each address was allocated from", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"layoutVersion": 2,
+				"ranges": [
+					[{ "subnet": "10.1.2.0/24" }],
+					[{ "subnet": "2001:db8:1::/64" }]
+				]
+			}
+		}`, tmpDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       nspath,
+			IfName:      ifname,
+			StdinData:   []byte(conf),
+		}
+		r, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := types100.GetResult(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPs).To(HaveLen(2))
+
+		store, err := disk.New("mynet", tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+		found, err := store.ReservationsByID("dummy")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found).To(ConsistOf(
+			disk.Reservation{IP: result.IPs[0].Address.IP, ContainerID: "dummy", IfName: ifname, RangeID: "0"},
+			disk.Reservation{IP: result.IPs[1].Address.IP, ContainerID: "dummy", IfName: ifname, RangeID: "1"},
+		))
+	})
+	It("refuses allocations beyond the hard quota of a namespace", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"layoutVersion": 2,
+				"quota": {"soft": 1, "hard": 2},
+				"subnet": "10.1.2.0/24"
+			}
+		}`, tmpDir)
+
+		add := func(id, namespace string) error {
+			args := &skel.CmdArgs{
+				ContainerID: id,
+				Netns:       nspath,
+				IfName:      ifname,
+				StdinData:   []byte(conf),
+			}
+			if namespace != "" {
+				args.Args = "K8S_POD_NAMESPACE=" + namespace + ";K8S_POD_NAME=" + id
+			}
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			return err
+		}
+
+		Expect(add("a1", "team-a")).To(Succeed())
+		Expect(add("a2", "team-a")).To(Succeed())
+		Expect(add("a3", "team-a")).To(MatchError(`namespace "team-a" is at its quota of 2 allocations`))
+		// other namespaces, and pods without one, are not held back
+		Expect(add("b1", "team-b")).To(Succeed())
+		Expect(add("c1", "")).To(Succeed())
+
+		store, err := disk.New("mynet", tmpDir)
+		Expect(err).NotTo(HaveOccurred())
+		defer store.Close()
+		Expect(store.GetByID("a3", ifname)).To(BeEmpty())
+		Expect(store.GetByID("b1", ifname)).To(HaveLen(1))
+
+		// a released allocation makes room again
+		Expect(store.ReleaseByID("a1", ifname)).To(Succeed())
+		Expect(add("a3", "team-a")).To(Succeed())
+	})
+
+	It("withholds addresses still configured in the container on DEL", func() {
+		targetNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer func() {
+			targetNS.Close()
+			testutils.UnmountNS(targetNS)
+		}()
+
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "ipvlan",
+			"master": "foo0",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24",
+				"verifyRelease": "withhold"
+			}
+		}`, tmpDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      ifname,
+			StdinData:   []byte(conf),
+		}
+		_, _, err = testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		var link netlink.Link
+		err = targetNS.Do(func(ns.NetNS) error {
+			link = &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: ifname}, PeerName: "peer0"}
+			if err := netlink.LinkAdd(link); err != nil {
+				return err
+			}
+			addr := mustCIDR("10.1.2.2/24")
+			return netlink.AddrAdd(link, &netlink.Addr{IPNet: &addr})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = testutils.CmdDelWithArgs(args, func() error {
+			return cmdDel(args)
+		})
+		Expect(err).To(MatchError("not releasing 10.1.2.2 of container dummy, which may still be configured on " + ifname))
+		_, err = os.Stat(filepath.Join(tmpDir, "mynet", "10.1.2.2"))
+		Expect(err).NotTo(HaveOccurred())
+
+		// released once the interface is gone
+		err = targetNS.Do(func(ns.NetNS) error {
+			return netlink.LinkDel(link)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		err = testutils.CmdDelWithArgs(args, func() error {
+			return cmdDel(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = os.Stat(filepath.Join(tmpDir, "mynet", "10.1.2.2"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		args.StdinData = []byte(strings.Replace(conf, `"withhold"`, `"fail"`, 1))
+		err = testutils.CmdDelWithArgs(args, func() error {
+			return cmdDel(args)
+		})
+		Expect(err).To(MatchError(`invalid verifyRelease "fail" (must be warn or withhold)`))
+	})
 })
 
 func mustCIDR(s string) net.IPNet {
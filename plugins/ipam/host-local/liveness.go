@@ -0,0 +1,88 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+)
+
+// reaper reclaims the reservations of containers that have no file in the
+// liveness directory, typically leaked when the node crashed before the
+// runtime could DEL them.
+type reaper struct {
+	dir string
+	ttl time.Duration
+}
+
+func newReaper(cfg *allocator.Liveness) (*reaper, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("liveness: dir must be set")
+	}
+	r := &reaper{dir: cfg.Dir}
+	if cfg.TTL != "" {
+		var err error
+		if r.ttl, err = time.ParseDuration(cfg.TTL); err != nil || r.ttl < 0 {
+			return nil, fmt.Errorf("liveness: invalid ttl %q (must be a non-negative duration)", cfg.TTL)
+		}
+	}
+	return r, nil
+}
+
+// alive reports whether container id still has a liveness file, touched
+// within the ttl if there is one. When that cannot be told, the container
+// is taken to be alive.
+func (r *reaper) alive(id string, now time.Time) bool {
+	if filepath.Base(id) != id {
+		return true
+	}
+	fi, err := os.Stat(filepath.Join(r.dir, id))
+	if os.IsNotExist(err) {
+		return false
+	} else if err != nil {
+		return true
+	}
+	return r.ttl == 0 || now.Sub(fi.ModTime()) <= r.ttl
+}
+
+// reclaim releases the reservations of every container but containerID
+// that is no longer alive, and returns how many it released. Nothing is
+// released if the liveness directory itself is unavailable, since every
+// container would look gone.
+func (r *reaper) reclaim(store *disk.Store, conf *allocator.IPAMConfig, containerID string) (int, error) {
+	if fi, err := os.Stat(r.dir); err != nil {
+		return 0, fmt.Errorf("liveness: %v", err)
+	} else if !fi.IsDir() {
+		return 0, fmt.Errorf("liveness: %s is not a directory", r.dir)
+	}
+
+	now := time.Now()
+	released, err := store.ReleaseIf(func(res disk.Reservation) bool {
+		return res.ContainerID != containerID && !r.alive(res.ContainerID, now)
+	})
+	for _, res := range released {
+		audit(conf, "reclaim", res.ContainerID, res.IfName, []net.IP{res.IP})
+	}
+	if err != nil {
+		return len(released), fmt.Errorf("liveness: failed to reclaim addresses: %v", err)
+	}
+	return len(released), nil
+}
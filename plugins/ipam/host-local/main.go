@@ -15,7 +15,9 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"net"
 	"strings"
 
@@ -33,6 +35,13 @@ func main() {
 	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, bv.BuildString("host-local"))
 }
 
+// exhausted reports whether err is a range set running out of addresses,
+// which is worth retrying once pods have been deleted.
+func exhausted(err error) bool {
+	var e *allocator.ExhaustedError
+	return errors.As(err, &e)
+}
+
 func cmdCheck(args *skel.CmdArgs) error {
 
 	ipamConf, _, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
@@ -42,12 +51,18 @@ func cmdCheck(args *skel.CmdArgs) error {
 
 	// Look to see if there is at least one IP address allocated to the container
 	// in the data dir, irrespective of what that address actually is
-	store, err := disk.New(ipamConf.Name, ipamConf.DataDir)
+	store, err := disk.NewWithLayout(ipamConf.Name, ipamConf.DataDir, ipamConf.LayoutVersion)
 	if err != nil {
 		return err
 	}
 	defer store.Close()
 
+	if ipamConf.NodeSlices != nil {
+		if err := refreshNodeSlices(ipamConf, store); err != nil {
+			log.Printf("nodeSlices: failed to refresh the claims of the node: %v", err)
+		}
+	}
+
 	containerIpFound := store.FindByID(args.ContainerID, args.IfName)
 	if containerIpFound == false {
 		return fmt.Errorf("host-local: Failed to find address added by container %v", args.ContainerID)
@@ -62,6 +77,13 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
+	var slices []*net.IPNet
+	if ipamConf.NodeSlices != nil {
+		if slices, err = claimNodeSlices(ipamConf); err != nil {
+			return err
+		}
+	}
+
 	result := &current.Result{CNIVersion: current.ImplementedSpecVersion}
 
 	if ipamConf.ResolvConf != "" {
@@ -72,15 +94,51 @@ func cmdAdd(args *skel.CmdArgs) error {
 		result.DNS = *dns
 	}
 
-	store, err := disk.New(ipamConf.Name, ipamConf.DataDir)
+	var pool []net.IP
+	if ipamConf.PoolFile != "" {
+		if pool, err = allocator.LoadPool(ipamConf.PoolFile); err != nil {
+			return err
+		}
+		for _, addr := range pool {
+			found := false
+			for _, rangeset := range ipamConf.Ranges {
+				if rangeset.Contains(addr) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("pool address %s is not in any configured range", addr)
+			}
+		}
+	}
+
+	store, err := disk.NewWithLayout(ipamConf.Name, ipamConf.DataDir, ipamConf.LayoutVersion)
 	if err != nil {
 		return err
 	}
 	defer store.Close()
+	store.SetHoldDown(ipamConf.HoldDownPeriod)
+	store.SetHolder(args.ContainerID)
+	store.SetNamespace(ipamConf.Namespace)
+	if err := store.SetMetadata(ipamConf.Metadata); err != nil {
+		return err
+	}
+
+	checkRanges(store, ipamConf)
+
+	var reclaimer *reaper
+	if ipamConf.Liveness != nil {
+		if reclaimer, err = newReaper(ipamConf.Liveness); err != nil {
+			return err
+		}
+	}
 
 	// Keep the allocators we used, so we can release all IPs if an error
 	// occurs after we start allocating
 	allocs := []*allocator.IPAllocator{}
+	// DNS of the ranges addresses are allocated from, in order
+	var rangeDNS []*types.DNS
 
 	// Store all requested IPs in a map, so we can easily remove ones we use
 	// and error if some remain
@@ -91,7 +149,19 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 
 	for idx, rangeset := range ipamConf.Ranges {
+		strategy := allocator.NewStrategy(ipamConf, args.ContainerID, args.IfName)
 		allocator := allocator.NewIPAllocator(&rangeset, store, idx)
+		allocator.SetStrategy(strategy)
+		allocator.SetMaxAttempts(ipamConf.MaxAllocationAttempts)
+		if ipamConf.FreeBitmap {
+			allocator.UseBitmap()
+		}
+		if pool != nil {
+			allocator.SetPool(pool)
+		}
+		if len(ipamConf.ReservedAddresses) > 0 {
+			allocator.SetReserved(ipamConf.ReservedAddresses)
+		}
 
 		// Check to see if there are any custom IPs requested in this range.
 		var requestedIP net.IP
@@ -103,19 +173,41 @@ func cmdAdd(args *skel.CmdArgs) error {
 			}
 		}
 
-		ipConf, err := allocator.Get(args.ContainerID, args.IfName, requestedIP)
+		get := func() (*current.IPConfig, error) {
+			// range sets without a gateway are allocated from as usual
+			if ipamConf.OwnsGateway && requestedIP == nil && rangeset.HasGateway() {
+				return allocator.GetGateway(args.ContainerID, args.IfName)
+			}
+			return allocator.Get(args.ContainerID, args.IfName, requestedIP)
+		}
+		ipConf, err := get()
+		if exhausted(err) && reclaimer != nil {
+			// try again if containers that are gone held some of the range
+			if n, rerr := reclaimer.reclaim(store, ipamConf, args.ContainerID); rerr != nil {
+				log.Print(rerr)
+			} else if n > 0 {
+				ipConf, err = get()
+			}
+		}
 		if err != nil {
 			// Deallocate all already allocated IPs
 			for _, alloc := range allocs {
 				_ = alloc.Release(args.ContainerID, args.IfName)
 			}
+			if exhausted(err) {
+				return types.NewError(types.ErrTryAgainLater, fmt.Sprintf("failed to allocate for range %d: %v", idx, err), "")
+			}
 			return fmt.Errorf("failed to allocate for range %d: %v", idx, err)
 		}
 
 		allocs = append(allocs, allocator)
 
 		result.IPs = append(result.IPs, ipConf)
+		if r, err := rangeset.RangeFor(ipConf.Address.IP); err == nil && r.DNS != nil {
+			rangeDNS = append(rangeDNS, r.DNS)
+		}
 	}
+	result.DNS = mergeDNS(result.DNS, rangeDNS)
 
 	// If an IP was requested that wasn't fulfilled, fail
 	if len(requestedIPs) != 0 {
@@ -129,34 +221,115 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return fmt.Errorf(errstr)
 	}
 
+	if err := checkQuota(store, ipamConf); err != nil {
+		for _, alloc := range allocs {
+			_ = alloc.Release(args.ContainerID, args.IfName)
+		}
+		return err
+	}
+
 	result.Routes = ipamConf.Routes
 
+	var allocated []net.IP
+	for _, ipc := range result.IPs {
+		allocated = append(allocated, ipc.Address.IP)
+	}
+	audit(ipamConf, "allocate", args.ContainerID, args.IfName, allocated)
+
+	if ipamConf.NodeSlices != nil {
+		if err := recordSliceUsage(ipamConf, slices, store); err != nil {
+			log.Printf("nodeSlices: failed to record the reservations of the node: %v", err)
+		}
+	}
+
 	return types.PrintResult(result, confVersion)
 }
 
+// checkRanges logs the reservations no configured range covers any more,
+// because their range was removed or shrunk since. The ranges are read
+// from the configuration on every invocation, so nothing is allocated
+// from them again; the reservations stay until their containers are
+// deleted. It logs the reservations of reservedAddresses the same way.
+func checkRanges(store *disk.Store, conf *allocator.IPAMConfig) {
+	ips, err := store.ReservedIPs()
+	if err != nil {
+		log.Printf("failed to list reservations: %v", err)
+		return
+	}
+
+	for _, addr := range ips {
+		covered := false
+		for _, rangeset := range conf.Ranges {
+			if rangeset.Contains(addr) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			log.Printf("reserved address %s is outside the configured ranges, keeping it until its container is deleted", addr)
+		}
+		if reason, ok := conf.ReservedReason(addr); ok {
+			log.Printf("address %s is allocated although it is a reserved address (%s), keeping it until its container is deleted", addr, reason)
+		}
+	}
+}
+
 func cmdDel(args *skel.CmdArgs) error {
 	ipamConf, _, err := allocator.LoadIPAMConfig(args.StdinData, args.Args)
 	if err != nil {
 		return err
 	}
 
-	store, err := disk.New(ipamConf.Name, ipamConf.DataDir)
+	store, err := disk.NewWithLayout(ipamConf.Name, ipamConf.DataDir, ipamConf.LayoutVersion)
 	if err != nil {
 		return err
 	}
 	defer store.Close()
+	store.SetHoldDown(ipamConf.HoldDownPeriod)
+	store.SetHolder(args.ContainerID)
+
+	var released []net.IP
+	if ipamConf.AuditLog != nil {
+		released = store.GetByID(args.ContainerID, args.IfName)
+	}
 
 	// Loop through all ranges, releasing all IPs, even if an error occurs
 	var errors []string
 	for idx, rangeset := range ipamConf.Ranges {
 		ipAllocator := allocator.NewIPAllocator(&rangeset, store, idx)
+		if ipamConf.VerifyRelease != "" {
+			ipAllocator.SetReleaseCheck(liveAddrCheck(args.Netns, args.IfName), ipamConf.VerifyRelease == "withhold")
+		}
 
 		err := ipAllocator.Release(args.ContainerID, args.IfName)
-		if err != nil {
+		// the addresses withheld are reported by every range set
+		if err != nil && (len(errors) == 0 || errors[len(errors)-1] != err.Error()) {
 			errors = append(errors, err.Error())
 		}
 	}
 
+	if errors != nil {
+		// only record what is actually gone
+		held := map[string]bool{}
+		for _, ip := range store.GetByID(args.ContainerID, args.IfName) {
+			held[ip.String()] = true
+		}
+		gone := released[:0]
+		for _, ip := range released {
+			if !held[ip.String()] {
+				gone = append(gone, ip)
+			}
+		}
+		released = gone
+	}
+	audit(ipamConf, "release", args.ContainerID, args.IfName, released)
+
+	if ipamConf.NodeSlices != nil {
+		if err := refreshNodeSlices(ipamConf, store); err != nil {
+			log.Printf("nodeSlices: failed to refresh the claims of the node: %v", err)
+		}
+	}
+
 	if errors != nil {
 		return fmt.Errorf(strings.Join(errors, ";"))
 	}
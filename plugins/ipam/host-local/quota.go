@@ -0,0 +1,57 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+)
+
+// checkQuota counts the interfaces of the requesting pod's namespace with
+// addresses in the store, the one just allocated included. It logs the
+// namespaces above their soft limit and fails for those above the hard
+// one. Counting after allocating, rather than before, keeps concurrent
+// ADDs from all getting in under the limit. Pods without a namespace are
+// not limited.
+func checkQuota(store *disk.Store, conf *allocator.IPAMConfig) error {
+	q := conf.Quota
+	if q == nil || conf.Namespace == "" {
+		return nil
+	}
+
+	type key struct{ id, ifName string }
+	allocations := map[key]bool{}
+	err := store.ForEach(func(r disk.Reservation) error {
+		if r.Namespace == conf.Namespace {
+			allocations[key{r.ContainerID, r.IfName}] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("quota: failed to count the allocations of %q: %v", conf.Namespace, err)
+	}
+
+	n := len(allocations)
+	if q.Hard > 0 && n > q.Hard {
+		return fmt.Errorf("namespace %q is at its quota of %d allocations", conf.Namespace, q.Hard)
+	}
+	if q.Soft > 0 && n > q.Soft {
+		log.Printf("namespace %q has %d allocations, above its soft quota of %d", conf.Namespace, n, q.Soft)
+	}
+	return nil
+}
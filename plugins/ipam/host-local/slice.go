@@ -0,0 +1,339 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/disk"
+)
+
+// maxSliceBits bounds how many slices a subnet may be split into, since
+// every claim scans all of them.
+const maxSliceBits = 16
+
+// sliceClaims is the directory shared between the nodes that they claim
+// the slices of a network's ranges in.
+type sliceClaims struct {
+	dir        string
+	node       string
+	sliceLen   int
+	staleAfter time.Duration
+}
+
+func openSliceClaims(conf *allocator.IPAMConfig) (*sliceClaims, error) {
+	cfg := conf.NodeSlices
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("nodeSlices: dir must be set")
+	}
+
+	c := &sliceClaims{
+		dir:      filepath.Join(cfg.Dir, conf.Name),
+		node:     cfg.NodeName,
+		sliceLen: cfg.SliceLen,
+	}
+	if c.node == "" {
+		var err error
+		if c.node, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("nodeSlices: failed to determine node name: %v", err)
+		}
+	}
+	if cfg.StaleAfter != "" {
+		var err error
+		if c.staleAfter, err = time.ParseDuration(cfg.StaleAfter); err != nil {
+			return nil, fmt.Errorf("nodeSlices: invalid staleAfter %q: %v", cfg.StaleAfter, err)
+		}
+	}
+
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// locked runs fn holding the lock on the claims directory.
+func (c *sliceClaims) locked(fn func() error) error {
+	lk, err := disk.NewFileLock(c.dir)
+	if err != nil {
+		return err
+	}
+	defer lk.Close()
+	if err := lk.Lock(); err != nil {
+		return err
+	}
+	defer lk.Unlock()
+	return fn()
+}
+
+// claimNodeSlices replaces every configured range with the slice of it that
+// belongs to this node, claiming a free slice in the shared directory the
+// first time the node allocates from a range, and returns the slices. Each
+// slice becomes a subnet of its own, with the gateway defaulting to its
+// first address. A configured gateway must be in the slice, and rangeStart
+// and rangeEnd are clamped to it.
+func claimNodeSlices(conf *allocator.IPAMConfig) ([]*net.IPNet, error) {
+	c, err := openSliceClaims(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	var slices []*net.IPNet
+	err = c.locked(func() error {
+		now := time.Now()
+		for i := range conf.Ranges {
+			for j := range conf.Ranges[i] {
+				r := &conf.Ranges[i][j]
+				slice, err := claimSlice(c.dir, c.node, (*net.IPNet)(&r.Subnet), c.sliceLen, c.staleAfter, now)
+				if err != nil {
+					return fmt.Errorf("nodeSlices: %v", err)
+				}
+				narrowed, err := r.Narrow(slice)
+				if err != nil {
+					return fmt.Errorf("nodeSlices: %v", err)
+				}
+				*r = *narrowed
+				slices = append(slices, slice)
+			}
+		}
+		return nil
+	})
+	return slices, err
+}
+
+// refreshNodeSlices records the reservations the node holds in each slice
+// of the configured ranges it has claimed, without claiming any. DEL and
+// CHECK run it, so a node keeps its slices while it runs no new pods.
+func refreshNodeSlices(conf *allocator.IPAMConfig, store *disk.Store) error {
+	c, err := openSliceClaims(conf)
+	if err != nil {
+		return err
+	}
+
+	var slices []*net.IPNet
+	err = c.locked(func() error {
+		for _, rangeset := range conf.Ranges {
+			for _, r := range rangeset {
+				slice, err := ownedSlice(c.dir, c.node, (*net.IPNet)(&r.Subnet), c.sliceLen)
+				if err != nil {
+					return fmt.Errorf("nodeSlices: %v", err)
+				}
+				if slice != nil {
+					slices = append(slices, slice)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return recordSliceUsage(conf, slices, store)
+}
+
+// recordSliceUsage writes the number of reservations in store that are in
+// each of the node's slices to the slice's claim, refreshing it. A stale
+// claim is only handed to another node while it records none.
+func recordSliceUsage(conf *allocator.IPAMConfig, slices []*net.IPNet, store *disk.Store) error {
+	if len(slices) == 0 {
+		return nil
+	}
+	c, err := openSliceClaims(conf)
+	if err != nil {
+		return err
+	}
+
+	counts := make([]int, len(slices))
+	err = store.ForEach(func(r disk.Reservation) error {
+		for i, slice := range slices {
+			if slice.Contains(r.IP) {
+				counts[i]++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.locked(func() error {
+		now := time.Now()
+		for i, slice := range slices {
+			path := sliceFile(c.dir, slice)
+			owner, _, err := readClaim(path)
+			if err != nil {
+				return err
+			}
+			if owner != c.node {
+				continue
+			}
+			if err := writeClaim(path, c.node, counts[i], now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// claimSlice returns the slice of subnet claimed by node, claiming the first
+// free one if it has none yet. Claims are files in dir holding the node name
+// and the number of reservations the node has in the slice; the node
+// refreshes them on every invocation. A slice whose claim has not been
+// touched for staleAfter and records no reservations is handed to another
+// node when no free slice remains. The caller must hold the lock on dir.
+func claimSlice(dir, node string, subnet *net.IPNet, sliceLen int, staleAfter time.Duration, now time.Time) (*net.IPNet, error) {
+	if err := checkSliceLen(subnet, sliceLen); err != nil {
+		return nil, err
+	}
+	ones, _ := subnet.Mask.Size()
+
+	var free, stale *net.IPNet
+	for i := 0; i < 1<<(sliceLen-ones); i++ {
+		slice := nthSlice(subnet, sliceLen, i)
+		path := sliceFile(dir, slice)
+
+		owner, reservations, err := readClaim(path)
+		if os.IsNotExist(err) {
+			if free == nil {
+				free = slice
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if owner == node {
+			if err := os.Chtimes(path, now, now); err != nil {
+				return nil, err
+			}
+			return slice, nil
+		}
+
+		// the owner may still hand out addresses it holds there
+		if stale == nil && staleAfter > 0 && reservations == 0 {
+			fi, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			if now.Sub(fi.ModTime()) > staleAfter {
+				stale = slice
+			}
+		}
+	}
+
+	claim := free
+	if claim == nil {
+		if stale == nil {
+			return nil, fmt.Errorf("no free /%d slice left in %s", sliceLen, subnet)
+		}
+		log.Printf("reclaiming stale slice %s for node %s", stale, node)
+		claim = stale
+	}
+
+	if err := writeClaim(sliceFile(dir, claim), node, 0, now); err != nil {
+		return nil, err
+	}
+	return claim, nil
+}
+
+// ownedSlice returns the slice of subnet claimed by node, or nil if it has
+// none. The caller must hold the lock on dir.
+func ownedSlice(dir, node string, subnet *net.IPNet, sliceLen int) (*net.IPNet, error) {
+	if err := checkSliceLen(subnet, sliceLen); err != nil {
+		return nil, err
+	}
+	ones, _ := subnet.Mask.Size()
+
+	for i := 0; i < 1<<(sliceLen-ones); i++ {
+		slice := nthSlice(subnet, sliceLen, i)
+		owner, _, err := readClaim(sliceFile(dir, slice))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if owner == node {
+			return slice, nil
+		}
+	}
+	return nil, nil
+}
+
+func checkSliceLen(subnet *net.IPNet, sliceLen int) error {
+	ones, bits := subnet.Mask.Size()
+	if sliceLen <= ones || sliceLen > bits-2 {
+		return fmt.Errorf("sliceLen %d must be between %d and %d for %s", sliceLen, ones+1, bits-2, subnet)
+	}
+	if sliceLen-ones > maxSliceBits {
+		return fmt.Errorf("sliceLen %d splits %s into more than %d slices", sliceLen, subnet, 1<<maxSliceBits)
+	}
+	return nil
+}
+
+// readClaim returns the owner of a claim and the number of reservations it
+// records, or -1 if it records none, as claims written before the count
+// was added do.
+func readClaim(path string) (string, int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return "", -1, nil
+	}
+	reservations := -1
+	if len(fields) > 1 {
+		if n, err := strconv.Atoi(fields[1]); err == nil && n >= 0 {
+			reservations = n
+		}
+	}
+	return fields[0], reservations, nil
+}
+
+func writeClaim(path, node string, reservations int, now time.Time) error {
+	if err := ioutil.WriteFile(path, []byte(fmt.Sprintf("%s\n%d\n", node, reservations)), 0644); err != nil {
+		return err
+	}
+	return os.Chtimes(path, now, now)
+}
+
+// nthSlice returns the i-th subnet of length sliceLen within subnet.
+func nthSlice(subnet *net.IPNet, sliceLen, i int) *net.IPNet {
+	base := subnet.IP.Mask(subnet.Mask)
+	_, bits := subnet.Mask.Size()
+
+	n := new(big.Int).SetBytes(base)
+	n.Add(n, new(big.Int).Lsh(big.NewInt(int64(i)), uint(bits-sliceLen)))
+
+	ip := make(net.IP, len(base))
+	b := n.Bytes()
+	copy(ip[len(ip)-len(b):], b)
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(sliceLen, bits)}
+}
+
+func sliceFile(dir string, slice *net.IPNet) string {
+	return disk.GetEscapedPath(dir, strings.Replace(slice.String(), "/", "_", -1))
+}
@@ -0,0 +1,212 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/testutils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("node slices", func() {
+	var tmpDir string
+	var subnet *net.IPNet
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "host-local_slice_test")
+		Expect(err).NotTo(HaveOccurred())
+		_, subnet, err = net.ParseCIDR("10.1.0.0/16")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("gives two nodes disjoint slices and reuses them", func() {
+		now := time.Now()
+		a, err := claimSlice(tmpDir, "node-a", subnet, 24, 0, now)
+		Expect(err).NotTo(HaveOccurred())
+		b, err := claimSlice(tmpDir, "node-b", subnet, 24, 0, now)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(a.String()).To(Equal("10.1.0.0/24"))
+		Expect(b.String()).To(Equal("10.1.1.0/24"))
+
+		again, err := claimSlice(tmpDir, "node-a", subnet, 24, 0, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again).To(Equal(a))
+	})
+
+	It("reclaims a stale slice once no free slice is left", func() {
+		now := time.Now()
+		_, err := claimSlice(tmpDir, "node-a", subnet, 17, time.Hour, now.Add(-2*time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = claimSlice(tmpDir, "node-b", subnet, 17, time.Hour, now)
+		Expect(err).NotTo(HaveOccurred())
+
+		// node-b's claim is fresh, so node-c may only take node-a's
+		c, err := claimSlice(tmpDir, "node-c", subnet, 17, time.Hour, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.String()).To(Equal("10.1.0.0/17"))
+
+		_, err = claimSlice(tmpDir, "node-d", subnet, 17, time.Hour, now)
+		Expect(err).To(MatchError("no free /17 slice left in 10.1.0.0/16"))
+	})
+
+	It("rejects invalid slice lengths", func() {
+		_, err := claimSlice(tmpDir, "node-a", subnet, 16, 0, time.Now())
+		Expect(err).To(MatchError("sliceLen 16 must be between 17 and 30 for 10.1.0.0/16"))
+
+		_, v6, err := net.ParseCIDR("2001:db8::/32")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = claimSlice(tmpDir, "node-a", v6, 64, 0, time.Now())
+		Expect(err).To(MatchError("sliceLen 64 splits 2001:db8::/32 into more than 65536 slices"))
+	})
+
+	It("allocates from the node's slice with ADD", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "bridge",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.0.0/16",
+				"nodeSlices": {
+					"dir": "%s",
+					"sliceLen": 24,
+					"nodeName": "node-b"
+				}
+			}
+		}`, filepath.Join(tmpDir, "data"), filepath.Join(tmpDir, "shared"))
+
+		// node-a already holds the first slice
+		shared := filepath.Join(tmpDir, "shared", "mynet")
+		Expect(os.MkdirAll(shared, 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(sliceFile(shared, &net.IPNet{
+			IP:   net.IPv4(10, 1, 0, 0).To4(),
+			Mask: net.CIDRMask(24, 32),
+		}), []byte("node-a"), 0644)).To(Succeed())
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       "/some/where",
+			IfName:      "eth0",
+			StdinData:   []byte(conf),
+		}
+
+		r, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		result, err := types100.GetResult(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPs).To(HaveLen(1))
+		Expect(result.IPs[0].Address.String()).To(Equal("10.1.1.2/24"))
+		Expect(result.IPs[0].Gateway.String()).To(Equal("10.1.1.1"))
+	})
+
+	It("keeps the slice of an idle node that still holds reservations", func() {
+		now := time.Now()
+		for _, node := range []string{"node-a", "node-b"} {
+			_, err := claimSlice(tmpDir, node, subnet, 17, time.Hour, now.Add(-2*time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+		}
+		// node-a has pods, node-b wrote its claim before the count was kept
+		a := sliceFile(tmpDir, nthSlice(subnet, 17, 0))
+		Expect(writeClaim(a, "node-a", 2, now.Add(-2*time.Hour))).To(Succeed())
+		b := sliceFile(tmpDir, nthSlice(subnet, 17, 1))
+		Expect(ioutil.WriteFile(b, []byte("node-b"), 0644)).To(Succeed())
+		Expect(os.Chtimes(b, now.Add(-2*time.Hour), now.Add(-2*time.Hour))).To(Succeed())
+
+		_, err := claimSlice(tmpDir, "node-c", subnet, 17, time.Hour, now)
+		Expect(err).To(MatchError("no free /17 slice left in 10.1.0.0/16"))
+	})
+
+	It("refreshes the claim of the node on every command", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "mynet",
+			"type": "bridge",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.0.0/16",
+				"rangeStart": "10.1.0.100",
+				"nodeSlices": {
+					"dir": "%s",
+					"sliceLen": 24,
+					"nodeName": "node-a",
+					"staleAfter": "1h"
+				}
+			}
+		}`, filepath.Join(tmpDir, "data"), filepath.Join(tmpDir, "shared"))
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       "/some/where",
+			IfName:      "eth0",
+			StdinData:   []byte(conf),
+		}
+		claim := sliceFile(filepath.Join(tmpDir, "shared", "mynet"), nthSlice(subnet, 24, 0))
+		age := func() {
+			old := time.Now().Add(-2 * time.Hour)
+			Expect(os.Chtimes(claim, old, old)).To(Succeed())
+		}
+		expectClaim := func(reservations int) {
+			owner, n, err := readClaim(claim)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(owner).To(Equal("node-a"))
+			Expect(n).To(Equal(reservations))
+			fi, err := os.Stat(claim)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(time.Since(fi.ModTime())).To(BeNumerically("<", time.Hour))
+		}
+
+		r, _, err := testutils.CmdAddWithArgs(args, func() error {
+			return cmdAdd(args)
+		})
+		Expect(err).NotTo(HaveOccurred())
+		result, err := types100.GetResult(r)
+		Expect(err).NotTo(HaveOccurred())
+		// rangeStart is kept in the slice
+		Expect(result.IPs[0].Address.String()).To(Equal("10.1.0.100/24"))
+		expectClaim(1)
+
+		age()
+		Expect(testutils.CmdCheckWithArgs(args, func() error {
+			return cmdCheck(args)
+		})).To(Succeed())
+		expectClaim(1)
+
+		age()
+		Expect(testutils.CmdDelWithArgs(args, func() error {
+			return cmdDel(args)
+		})).To(Succeed())
+		expectClaim(0)
+	})
+})
@@ -0,0 +1,56 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/plugins/ipam/host-local/backend/allocator"
+	"github.com/vishvananda/netlink"
+)
+
+// liveAddrCheck returns an allocator.ReleaseCheck looking for the address
+// on ifName in netns. It is not there once either is gone.
+func liveAddrCheck(netns, ifName string) allocator.ReleaseCheck {
+	return func(ip net.IP) (bool, error) {
+		if netns == "" {
+			return false, nil
+		}
+		var configured bool
+		err := ns.WithNetNSPath(netns, func(_ ns.NetNS) error {
+			link, err := netlink.LinkByName(ifName)
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+			if err != nil {
+				return err
+			}
+			for _, addr := range addrs {
+				if addr.IP.Equal(ip) {
+					configured = true
+				}
+			}
+			return nil
+		})
+		if _, ok := err.(ns.NSPathNotExistErr); ok {
+			return false, nil
+		}
+		return configured, err
+	}
+}
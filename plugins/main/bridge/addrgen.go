@@ -0,0 +1,130 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+)
+
+// IPv6 address generation modes, as in IN6_ADDR_GEN_MODE_*.
+var addrGenModes = map[string]int{
+	"eui64":          0,
+	"none":           1,
+	"stable-privacy": 2,
+	"random":         3,
+}
+
+// IPv6AddrGen selects how the container interface generates its
+// link-local and SLAAC addresses. StableSecret, an address-formatted
+// secret, is required for stable-privacy and not allowed otherwise.
+type IPv6AddrGen struct {
+	Mode         string `json:"mode"`
+	StableSecret string `json:"stableSecret,omitempty"`
+}
+
+func (g *IPv6AddrGen) validate() error {
+	if _, ok := addrGenModes[g.Mode]; !ok {
+		return fmt.Errorf("invalid ipv6AddrGen mode %q (must be eui64, none, stable-privacy or random)", g.Mode)
+	}
+	if g.Mode != "stable-privacy" {
+		if g.StableSecret != "" {
+			return fmt.Errorf("ipv6AddrGen stableSecret requires mode stable-privacy")
+		}
+		return nil
+	}
+	if g.StableSecret == "" {
+		return fmt.Errorf("ipv6AddrGen mode stable-privacy requires a stableSecret")
+	}
+	if ip := net.ParseIP(g.StableSecret); ip == nil || ip.To4() != nil {
+		return fmt.Errorf("invalid ipv6AddrGen stableSecret %q (must be formatted as an IPv6 address)", g.StableSecret)
+	}
+	return nil
+}
+
+// setAddrGen configures address generation on ifName, which must be done
+// before the interface sees router advertisements. The secret goes first,
+// stable-privacy is rejected without one.
+func setAddrGen(ifName string, g *IPv6AddrGen) error {
+	if g.StableSecret != "" {
+		if _, err := sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/stable_secret", ifName), g.StableSecret); err != nil {
+			return fmt.Errorf("failed to set stable_secret of %q: %v", ifName, err)
+		}
+	}
+	mode := strconv.Itoa(addrGenModes[g.Mode])
+	if _, err := sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/addr_gen_mode", ifName), mode); err != nil {
+		return fmt.Errorf("failed to set addr_gen_mode of %q: %v", ifName, err)
+	}
+	return nil
+}
+
+// eui64Addr returns the address in prefix, a /64, with the modified EUI-64
+// interface identifier of mac (RFC 4291 appendix A).
+func eui64Addr(prefix *net.IPNet, mac string) (*net.IPNet, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil || len(hw) != 6 {
+		return nil, fmt.Errorf("cannot derive an EUI-64 address from MAC %q", mac)
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16()[:8])
+	ip[8] = hw[0] ^ 0x02
+	ip[9], ip[10] = hw[1], hw[2]
+	ip[11], ip[12] = 0xff, 0xfe
+	ip[13], ip[14], ip[15] = hw[3], hw[4], hw[5]
+	return &net.IPNet{IP: ip, Mask: prefix.Mask}, nil
+}
+
+// AcceptRAConf sets accept_ra on the bridge, the container interface or
+// both, e.g. to 2 so router advertisements are still accepted on the
+// bridge once forwarding is enabled. Interfaces defaults to the bridge.
+type AcceptRAConf struct {
+	Value      int      `json:"value"`
+	Interfaces []string `json:"interfaces,omitempty"`
+}
+
+func (a *AcceptRAConf) validate() error {
+	if a.Value < 0 || a.Value > 2 {
+		return fmt.Errorf("invalid acceptRA value %d (must be between 0 and 2)", a.Value)
+	}
+	for _, iface := range a.Interfaces {
+		if iface != "bridge" && iface != "container" {
+			return fmt.Errorf("invalid acceptRA interface %q (must be bridge or container)", iface)
+		}
+	}
+	return nil
+}
+
+// applies reports whether accept_ra is to be set on iface.
+func (a *AcceptRAConf) applies(iface string) bool {
+	if len(a.Interfaces) == 0 {
+		return iface == "bridge"
+	}
+	for _, i := range a.Interfaces {
+		if i == iface {
+			return true
+		}
+	}
+	return false
+}
+
+func setAcceptRA(ifName string, value int) error {
+	if _, err := sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/accept_ra", ifName), strconv.Itoa(value)); err != nil {
+		return fmt.Errorf("failed to set accept_ra of %q: %v", ifName, err)
+	}
+	return nil
+}
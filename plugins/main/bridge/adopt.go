@@ -0,0 +1,103 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// adoptVeth describes the veth ifName that already exists in netns, left
+// behind e.g. by the plugin managing the container before, so it can be
+// taken over as it is. Its host end has to be a port of br. It returns nil
+// if there is no ifName, and requires addresses if requireIPs is set.
+func adoptVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, requireIPs bool) (*current.Result, error) {
+	result := &current.Result{CNIVersion: current.ImplementedSpecVersion}
+	contIface := &current.Interface{Name: ifName, Sandbox: netns.Path()}
+	var peerIndex int
+
+	err := netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		veth, ok := link.(*netlink.Veth)
+		if !ok {
+			return fmt.Errorf("cannot adopt %q, which is a %s rather than a veth", ifName, link.Type())
+		}
+		if peerIndex, err = netlink.VethPeerIndex(veth); err != nil {
+			return fmt.Errorf("failed to get the peer of %q: %v", ifName, err)
+		}
+		contIface.Mac = link.Attrs().HardwareAddr.String()
+
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return fmt.Errorf("failed to list the addresses of %q: %v", ifName, err)
+		}
+		for _, addr := range addrs {
+			if addr.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			result.IPs = append(result.IPs, &current.IPConfig{
+				Interface: current.Int(2),
+				Address:   *addr.IPNet,
+			})
+		}
+
+		routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return fmt.Errorf("failed to list the routes of %q: %v", ifName, err)
+		}
+		for _, route := range routes {
+			if route.Dst != nil || route.Gw == nil {
+				continue
+			}
+			result.Routes = append(result.Routes, &types.Route{Dst: *defaultRouteDst(ipFamily(route.Gw)), GW: route.Gw})
+			for _, ipc := range result.IPs {
+				if ipc.Gateway == nil && ipFamily(ipc.Address.IP) == ipFamily(route.Gw) {
+					ipc.Gateway = route.Gw
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil || peerIndex == 0 {
+		return nil, err
+	}
+	if requireIPs && len(result.IPs) == 0 {
+		return nil, fmt.Errorf("cannot adopt %q, which has no addresses", ifName)
+	}
+
+	hostVeth, err := netlink.LinkByIndex(peerIndex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup the host end of %q: %v", ifName, err)
+	}
+	if hostVeth.Attrs().MasterIndex != br.Attrs().Index {
+		return nil, fmt.Errorf("cannot adopt %q, its host end %q is not a port of %q", ifName, hostVeth.Attrs().Name, br.Attrs().Name)
+	}
+
+	result.Interfaces = []*current.Interface{
+		{Name: br.Attrs().Name, Mac: br.Attrs().HardwareAddr.String()},
+		{Name: hostVeth.Attrs().Name, Mac: hostVeth.Attrs().HardwareAddr.String()},
+		contIface,
+	}
+	return result, nil
+}
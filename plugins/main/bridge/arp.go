@@ -0,0 +1,86 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+)
+
+// ARPConf sets arp_announce and arp_ignore in the container, to keep the
+// interfaces of a multi-homed pod from answering ARP for each other's
+// addresses. Scopes selects whether the container interface, the
+// "default" of the namespace used by interfaces created later, or both
+// get the values; the default is the interface alone.
+type ARPConf struct {
+	Announce *int     `json:"announce,omitempty"`
+	Ignore   *int     `json:"ignore,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`
+}
+
+func (a *ARPConf) validate() error {
+	if a.Announce != nil && (*a.Announce < 0 || *a.Announce > 2) {
+		return fmt.Errorf("invalid arp announce %d (must be between 0 and 2)", *a.Announce)
+	}
+	if a.Ignore != nil {
+		switch *a.Ignore {
+		case 0, 1, 2, 3, 8:
+		default:
+			return fmt.Errorf("invalid arp ignore %d (must be 0-3 or 8)", *a.Ignore)
+		}
+	}
+	for _, scope := range a.Scopes {
+		if scope != "interface" && scope != "default" {
+			return fmt.Errorf("invalid arp scope %q (must be interface or default)", scope)
+		}
+	}
+	return nil
+}
+
+// setARPSysctls applies a to the scopes it selects in netns, with ifName
+// standing for the interface scope.
+func setARPSysctls(netns ns.NetNS, ifName string, a *ARPConf) error {
+	scopes := a.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"interface"}
+	}
+	set := func(conf, name string, value *int) error {
+		if value == nil {
+			return nil
+		}
+		if _, err := sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/%s", conf, name), strconv.Itoa(*value)); err != nil {
+			return fmt.Errorf("failed to set %s of %q: %v", name, conf, err)
+		}
+		return nil
+	}
+	return netns.Do(func(_ ns.NetNS) error {
+		for _, scope := range scopes {
+			conf := ifName
+			if scope == "default" {
+				conf = "default"
+			}
+			if err := set(conf, "arp_announce", a.Announce); err != nil {
+				return err
+			}
+			if err := set(conf, "arp_ignore", a.Ignore); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
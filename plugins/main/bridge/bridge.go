@@ -15,12 +15,16 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net"
 	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -34,7 +38,6 @@ import (
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
-	"github.com/containernetworking/plugins/pkg/utils"
 	bv "github.com/containernetworking/plugins/pkg/utils/buildversion"
 	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 )
@@ -42,6 +45,20 @@ import (
 // For testcases to force an error after IPAM has been performed
 var debugPostIPAMError error
 
+// For testcases to force an error once the firewall has been set up
+var debugFirewallError error
+
+// For testcases to force an error once the veth has joined the bridge
+var debugSetupVethError error
+
+// For testcases to intercept sysctls that only exist in the initial
+// network namespace
+var neighSysctl = sysctl.Sysctl
+
+// For testcases to observe the container interface before it is
+// configured
+var configureIface = ipam.ConfigureIface
+
 const defaultBrName = "cni0"
 
 type NetConf struct {
@@ -55,6 +72,145 @@ type NetConf struct {
 	HairpinMode  bool   `json:"hairpinMode"`
 	PromiscMode  bool   `json:"promiscMode"`
 	Vlan         int    `json:"vlan"`
+	VlanAware    bool   `json:"vlanAware"`
+	VlanTrunk    []int  `json:"vlanTrunk,omitempty"`
+	Master       string `json:"master"`
+	// DisableBridgeIP keeps the bridge a pure L2 device: it gets no
+	// address at all and pods get no gateway through it.
+	DisableBridgeIP bool `json:"disableBridgeIP"`
+	// AllowSharedGateway adds the gateway address to the bridge even if
+	// another interface already has it, e.g. for an anycast gateway.
+	// Otherwise ADD fails, naming that interface.
+	AllowSharedGateway bool `json:"allowSharedGateway,omitempty"`
+	// VlanPortMode of the container's port on a vlanAware bridge: an
+	// "access" port egresses its vlan, the PVID, untagged and the
+	// vlanTrunk tagged; a "trunk" port carries only tagged vlanTrunk. It
+	// defaults to access with a vlan and to trunk otherwise.
+	VlanPortMode string `json:"vlanPortMode,omitempty"`
+	// HostRoutes adds a host route to each container address via the
+	// bridge, for return traffic when routing is done outside the bridge.
+	HostRoutes bool `json:"hostRoutes,omitempty"`
+	// RequireGateway fails ADD for container addresses that get no
+	// gateway, from IPAM, isGateway or ecmpGateways. Otherwise they only
+	// get no default route.
+	RequireGateway bool `json:"requireGateway,omitempty"`
+	// FdbMaxSize caps the MAC addresses the bridge learns, where the
+	// kernel supports it.
+	FdbMaxSize *int `json:"fdbMaxSize,omitempty"`
+
+	NeighGCThresh *NeighGCThresh `json:"neighGCThresh,omitempty"`
+	ECMPGateways  []ECMPGateway  `json:"ecmpGateways,omitempty"`
+	TableRoutes   []TableRoute   `json:"tableRoutes,omitempty"`
+	VXLAN         *VXLANConf     `json:"vxlan,omitempty"`
+	Tap           *TapConf       `json:"tap,omitempty"`
+	DSCP          *int           `json:"dscp,omitempty"`
+	// MSSClamp rewrites the MSS of the TCP connections the container
+	// opens, so they stay below the path MTU of tunnelled uplinks.
+	MSSClamp *MSSClampConf `json:"mssClamp,omitempty"`
+	// ConntrackZone isolates the container's connection tracking state.
+	// CT_ZONE in CNI_ARGS takes precedence.
+	ConntrackZone *int `json:"conntrackZone,omitempty"`
+	// SNATAddress is the host address the container's egress is
+	// source-NATed to, instead of masquerading. Only container addresses
+	// of the same family are NATed. SNAT_ADDRESS in CNI_ARGS takes
+	// precedence.
+	SNATAddress string `json:"snatAddress,omitempty"`
+	// RPSCPUs lists the CPUs, e.g. "0-3,8", that packets received on the
+	// host side of the container's veth are steered to.
+	RPSCPUs string `json:"rpsCPUs,omitempty"`
+	// StableHostVethName derives the host veth name from the pod, so it
+	// stays the same when the pod is recreated.
+	StableHostVethName bool `json:"stableHostVethName,omitempty"`
+	// ReclaimStaleVeth deletes a veth left behind with the stable host
+	// veth name by an earlier sandbox of the same pod, whose container end
+	// is not in the container's namespace, instead of moving on to the
+	// next name. The host veths are marked with their pod in their alias
+	// to tell them apart.
+	ReclaimStaleVeth bool `json:"reclaimStaleVeth,omitempty"`
+	// DelayCarrier keeps the host end of the veth down, so the container
+	// interface has no carrier and nothing flows, until the addresses are
+	// configured. The plugin then waits for the container to see carrier.
+	DelayCarrier bool `json:"delayCarrier,omitempty"`
+	// ReceiveOnly leaves the host end of the veth down for good, so the
+	// container cannot send onto the bridge. It only receives what is
+	// mirrored to it, e.g. by tc rules set up elsewhere.
+	ReceiveOnly bool `json:"receiveOnly,omitempty"`
+	// Adopt takes over a veth that already exists in the container, with
+	// its host end on the bridge, and reports it as it is rather than
+	// creating one. IPAM is not consulted for it.
+	Adopt bool `json:"adopt,omitempty"`
+	// SharedNetns handles an ADD into a namespace another container has
+	// already connected to the bridge. "reuse" reports that container's
+	// interface, whose addresses stay reserved for it; "add" creates one
+	// more, named after ifName and the container ID if ifName is taken.
+	// Only interfaces set up with sharedNetns are recognized, it records
+	// their owner in the alias of the container interface.
+	SharedNetns string `json:"sharedNetns,omitempty"`
+	// DelAction "down" makes DEL leave the veth in place for inspection,
+	// down and without addresses, instead of deleting it. It still goes
+	// away with the container's namespace.
+	DelAction string `json:"delAction,omitempty"`
+	// FirewallFailure decides what happens when the iptables rules of
+	// the container cannot be set up. "closed", the default, undoes the
+	// ADD and fails it; "open" logs a warning and brings the container up
+	// without them.
+	FirewallFailure string `json:"firewallFailure,omitempty"`
+	// NestedBridging lets the container run a bridge of its own: its
+	// port learns every source MAC behind it and gets the frames flooded
+	// to unknown destinations. It also lets the container claim any MAC
+	// on the bridge, and fill its FDB unless fdbMaxSize is set, so it is
+	// meant for trusted workloads only.
+	NestedBridging bool `json:"nestedBridging,omitempty"`
+	// InterfaceAlias sets the ifalias of the "host" or "container" end of
+	// the veth, or of "both", to the pod's namespace/name from CNI_ARGS.
+	InterfaceAlias string `json:"interfaceAlias,omitempty"`
+	// GSOMaxSize and GROMaxSize cap the segments both ends of the veth
+	// build and aggregate, so they fit what a tunnel on the path takes.
+	GSOMaxSize *int `json:"gsoMaxSize,omitempty"`
+	GROMaxSize *int `json:"groMaxSize,omitempty"`
+	// TxQueueLen is applied to both ends of the veth pair
+	TxQueueLen *int `json:"txQueueLen,omitempty"`
+	// IPv6AddrGen is applied to the container interface
+	IPv6AddrGen *IPv6AddrGen `json:"ipv6AddrGen,omitempty"`
+	// EUI64Prefix is an IPv6 /64 in which the container gets the address
+	// with the EUI-64 interface identifier of its MAC, in addition to the
+	// addresses from IPAM.
+	EUI64Prefix string `json:"eui64Prefix,omitempty"`
+	// AcceptRA is applied to the bridge and the container interface
+	AcceptRA *AcceptRAConf `json:"acceptRA,omitempty"`
+	// ARP is applied in the container
+	ARP *ARPConf `json:"arp,omitempty"`
+	// SysctlProfile names a built-in set of sysctls, "hardened" or
+	// "performance", applied in the container.
+	SysctlProfile string `json:"sysctlProfile,omitempty"`
+	// Sysctl is applied in the container after the profile, so its
+	// values take precedence.
+	Sysctl map[string]string `json:"sysctl,omitempty"`
+	// MacPrefix is the locally administered prefix, e.g. "0a:58", of the
+	// MACs generated for containers that do not request one.
+	MacPrefix string `json:"macPrefix,omitempty"`
+	// StableMac derives the MACs generated for containers from the pod,
+	// or the container ID without one, and the interface name, rather than
+	// picking them at random. Each interface of a pod gets its own.
+	StableMac bool `json:"stableMac,omitempty"`
+
+	// IPFamilies limits the container to the "ipv4" or "ipv6" addresses
+	// and routes of a dual-stack IPAM result. IP_FAMILIES in CNI_ARGS, a
+	// comma separated list, takes precedence. neighGCThresh only raises
+	// the neighbor tables of these families.
+	IPFamilies []string `json:"ipFamilies,omitempty"`
+	// PreferredSource holds up to one prefix, or address, per family. The
+	// container address within it becomes the source of the routes via
+	// a gateway, so egress does not depend on the kernel's choice among
+	// several addresses.
+	PreferredSource []string `json:"preferredSource,omitempty"`
+
+	PostSetupHooks []Hook `json:"postSetupHooks,omitempty"`
+
+	NetlinkRetry *RetryConf      `json:"netlinkRetry,omitempty"`
+	NetnsRetry   *NetnsRetryConf `json:"netnsRetry,omitempty"`
+	IPAMWebhook  *IPAMWebhook    `json:"ipamWebhook,omitempty"`
+	IPAMRetry    *IPAMRetryConf  `json:"ipamRetry,omitempty"`
 
 	Args struct {
 		Cni BridgeArgs `json:"cni,omitempty"`
@@ -63,7 +219,46 @@ type NetConf struct {
 		Mac string `json:"mac,omitempty"`
 	} `json:"runtimeConfig,omitempty"`
 
-	mac string
+	mac       string
+	macPrefix net.HardwareAddr
+	mark      *uint32
+	rpsMask   string
+	podID     string
+	families  map[int]bool
+	preferred []*net.IPNet
+	snatIP    net.IP
+	eui64     *net.IPNet
+	unknown   []string
+}
+
+// snatted reports whether egress from addr is source-NATed to snatIP.
+func (n *NetConf) snatted(addr net.IP) bool {
+	return n.snatIP != nil && ipFamily(addr) == ipFamily(n.snatIP)
+}
+
+// NeighGCThresh holds the minimum neighbor table garbage collection
+// thresholds for the node, applied to both IPv4 and IPv6. Zero leaves a
+// threshold untouched.
+type NeighGCThresh struct {
+	Thresh1 int `json:"thresh1,omitempty"`
+	Thresh2 int `json:"thresh2,omitempty"`
+	Thresh3 int `json:"thresh3,omitempty"`
+}
+
+// ECMPGateway is one nexthop of the multipath default route installed in
+// the container when ecmpGateways is set.
+type ECMPGateway struct {
+	GW     net.IP `json:"gw"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+// TableRoute is a route installed in the container in a routing table of
+// its own, for pods doing policy routing. Without a gw the destination is
+// on-link.
+type TableRoute struct {
+	Dst   types.IPNet `json:"dst"`
+	GW    net.IP      `json:"gw,omitempty"`
+	Table int         `json:"table"`
 }
 
 type BridgeArgs struct {
@@ -73,7 +268,14 @@ type BridgeArgs struct {
 // MacEnvArgs represents CNI_ARGS
 type MacEnvArgs struct {
 	types.CommonArgs
-	MAC types.UnmarshallableString `json:"mac,omitempty"`
+	MAC  types.UnmarshallableString `json:"mac,omitempty"`
+	MARK types.UnmarshallableString `json:"mark,omitempty"`
+
+	K8S_POD_NAMESPACE types.UnmarshallableString
+	K8S_POD_NAME      types.UnmarshallableString
+	IP_FAMILIES       types.UnmarshallableString
+	CT_ZONE           types.UnmarshallableString
+	SNAT_ADDRESS      types.UnmarshallableString
 }
 
 type gwInfo struct {
@@ -89,17 +291,30 @@ func init() {
 	runtime.LockOSThread()
 }
 
+// loadNetConf parses the configuration for ADD and CHECK, and rejects it
+// if it does not validate.
 func loadNetConf(bytes []byte, envArgs string) (*NetConf, string, error) {
+	n, cniVersion, err := parseNetConf(bytes, envArgs)
+	if err != nil {
+		return nil, "", err
+	}
+	n.unknown = unknownFields(bytes)
+	if err := n.validate(); err != nil {
+		return nil, "", err
+	}
+	return n, cniVersion, nil
+}
+
+// parseNetConf parses the configuration without validating it. DEL uses it
+// directly, so that it still cleans up after a configuration that ADD
+// would now reject, say for rpsCPUs on a node that lost CPUs.
+func parseNetConf(bytes []byte, envArgs string) (*NetConf, string, error) {
 	n := &NetConf{
 		BrName: defaultBrName,
 	}
 	if err := json.Unmarshal(bytes, n); err != nil {
 		return nil, "", fmt.Errorf("failed to load netconf: %v", err)
 	}
-	if n.Vlan < 0 || n.Vlan > 4094 {
-		return nil, "", fmt.Errorf("invalid VLAN ID %d (must be between 0 and 4094)", n.Vlan)
-	}
-
 	if envArgs != "" {
 		e := MacEnvArgs{}
 		if err := types.LoadArgs(envArgs, &e); err != nil {
@@ -109,6 +324,35 @@ func loadNetConf(bytes []byte, envArgs string) (*NetConf, string, error) {
 		if e.MAC != "" {
 			n.mac = string(e.MAC)
 		}
+
+		if e.K8S_POD_NAME != "" {
+			n.podID = string(e.K8S_POD_NAMESPACE) + "/" + string(e.K8S_POD_NAME)
+		}
+
+		if e.IP_FAMILIES != "" {
+			n.IPFamilies = strings.Split(string(e.IP_FAMILIES), ",")
+		}
+
+		if e.MARK != "" {
+			mark, err := strconv.ParseUint(string(e.MARK), 0, 32)
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid mark %q (must be a valid uint32)", e.MARK)
+			}
+			m := uint32(mark)
+			n.mark = &m
+		}
+
+		if e.CT_ZONE != "" {
+			zone, err := strconv.Atoi(string(e.CT_ZONE))
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid conntrack zone %q (must be a valid uint16)", e.CT_ZONE)
+			}
+			n.ConntrackZone = &zone
+		}
+
+		if e.SNAT_ADDRESS != "" {
+			n.SNATAddress = string(e.SNAT_ADDRESS)
+		}
 	}
 
 	if mac := n.Args.Cni.Mac; mac != "" {
@@ -189,7 +433,7 @@ func calcGateways(result *current.Result, n *NetConf) (*gwInfo, *gwInfo, error)
 	return gwsV4, gwsV6, nil
 }
 
-func ensureAddr(br netlink.Link, family int, ipn *net.IPNet, forceAddress bool) error {
+func ensureAddr(br netlink.Link, family int, ipn *net.IPNet, forceAddress, allowShared bool, r *RetryConf) error {
 	addrs, err := netlink.AddrList(br, family)
 	if err != nil && err != syscall.ENOENT {
 		return fmt.Errorf("could not get list of IP addresses: %v", err)
@@ -212,14 +456,34 @@ func ensureAddr(br netlink.Link, family int, ipn *net.IPNet, forceAddress bool)
 				if err = deleteAddr(br, a.IPNet); err != nil {
 					return err
 				}
+			} else if a.IP.Equal(ipn.IP) {
+				return fmt.Errorf("%q already has %v, with a different prefix length than %v", br.Attrs().Name, a.IPNet, ipnStr)
 			} else {
 				return fmt.Errorf("%q already has an IP address different from %v", br.Attrs().Name, ipnStr)
 			}
 		}
 	}
 
+	if !allowShared {
+		holder, err := addrHolder(ipn.IP, family, br.Attrs().Index)
+		if err != nil {
+			return err
+		}
+		if holder != "" {
+			return fmt.Errorf("cannot add %v to %q, the address is already in use by %q", ipnStr, br.Attrs().Name, holder)
+		}
+	}
+
 	addr := &netlink.Addr{IPNet: ipn, Label: ""}
-	if err := netlink.AddrAdd(br, addr); err != nil && err != syscall.EEXIST {
+	err = r.retry(func() error {
+		return addrAdd(br, addr)
+	})
+	if err == syscall.EADDRINUSE {
+		if holder, _ := addrHolder(ipn.IP, family, br.Attrs().Index); holder != "" {
+			return fmt.Errorf("cannot add %v to %q, the address is already in use by %q", ipnStr, br.Attrs().Name, holder)
+		}
+	}
+	if err != nil && err != syscall.EEXIST {
 		return fmt.Errorf("could not add IP address to %q: %v", br.Attrs().Name, err)
 	}
 
@@ -232,6 +496,26 @@ func ensureAddr(br netlink.Link, family int, ipn *net.IPNet, forceAddress bool)
 	return nil
 }
 
+// addrHolder returns the name of the interface other than the one with
+// index except that ip is configured on, or "" if there is none.
+func addrHolder(ip net.IP, family, except int) (string, error) {
+	addrs, err := netlink.AddrList(nil, family)
+	if err != nil {
+		return "", fmt.Errorf("could not get list of IP addresses: %v", err)
+	}
+	for _, a := range addrs {
+		if a.LinkIndex == except || !a.IP.Equal(ip) {
+			continue
+		}
+		link, err := netlink.LinkByIndex(a.LinkIndex)
+		if err != nil {
+			return fmt.Sprintf("ifindex %d", a.LinkIndex), nil
+		}
+		return link.Attrs().Name, nil
+	}
+	return "", nil
+}
+
 func deleteAddr(br netlink.Link, ipn *net.IPNet) error {
 	addr := &netlink.Addr{IPNet: ipn, Label: ""}
 
@@ -247,6 +531,17 @@ func bridgeByName(name string) (*netlink.Bridge, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not lookup %q: %v", name, err)
 	}
+	return asBridge(l)
+}
+
+// asBridge returns l if it is a Linux bridge. Open vSwitch bridges show up
+// as datapath ports of their own type and cannot be managed through the
+// Linux bridge netlink API at all, so they get an explicit error.
+func asBridge(l netlink.Link) (*netlink.Bridge, error) {
+	name := l.Attrs().Name
+	if l.Type() == "openvswitch" {
+		return nil, fmt.Errorf("%q is an Open vSwitch bridge, not a Linux bridge; use a plugin for OVS such as ovs-cni, or choose another bridge name", name)
+	}
 	br, ok := l.(*netlink.Bridge)
 	if !ok {
 		return nil, fmt.Errorf("%q already exists but is not a bridge", name)
@@ -254,7 +549,7 @@ func bridgeByName(name string) (*netlink.Bridge, error) {
 	return br, nil
 }
 
-func ensureBridge(brName string, mtu int, promiscMode, vlanFiltering bool) (*netlink.Bridge, error) {
+func ensureBridge(brName string, mtu int, promiscMode, vlanFiltering bool, r *RetryConf) (*netlink.Bridge, error) {
 	br := &netlink.Bridge{
 		LinkAttrs: netlink.LinkAttrs{
 			Name: brName,
@@ -270,7 +565,9 @@ func ensureBridge(brName string, mtu int, promiscMode, vlanFiltering bool) (*net
 		br.VlanFiltering = &vlanFiltering
 	}
 
-	err := netlink.LinkAdd(br)
+	err := r.retry(func() error {
+		return linkAdd(br)
+	})
 	if err != nil && err != syscall.EEXIST {
 		return nil, fmt.Errorf("could not add %q: %v", brName, err)
 	}
@@ -298,6 +595,303 @@ func ensureBridge(brName string, mtu int, promiscMode, vlanFiltering bool) (*net
 	return br, nil
 }
 
+// ensureBridgeMaster enslaves the named bond or team uplink to the bridge.
+// The membership of the bond itself is left to whoever manages it.
+func ensureBridgeMaster(br *netlink.Bridge, master string) error {
+	m, err := netlink.LinkByName(master)
+	if err != nil {
+		return fmt.Errorf("failed to lookup master %q: %v", master, err)
+	}
+
+	if t := m.Type(); t != "bond" && t != "team" {
+		return fmt.Errorf("master %q has link type %s, must be a bond or team", master, t)
+	}
+
+	switch m.Attrs().MasterIndex {
+	case br.Attrs().Index:
+		return nil
+	case 0:
+	default:
+		return fmt.Errorf("master %q is already enslaved to another device", master)
+	}
+
+	if err := netlink.LinkSetMaster(m, br); err != nil {
+		return fmt.Errorf("failed to connect %q to bridge %v: %v", master, br.Attrs().Name, err)
+	}
+
+	return nil
+}
+
+// raiseNeighGCThresholds makes sure the neighbor table GC thresholds are at
+// least the configured values. Thresholds already above them are left alone,
+// so networks asking for different values never lower one another's. Only
+// the tables of families are raised, those of both if it is nil.
+func raiseNeighGCThresholds(t *NeighGCThresh, families map[int]bool) error {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		if families != nil && !families[family] {
+			continue
+		}
+		table := "ipv4"
+		if family == netlink.FAMILY_V6 {
+			table = "ipv6"
+		}
+		for i, min := range []int{t.Thresh1, t.Thresh2, t.Thresh3} {
+			if min == 0 {
+				continue
+			}
+
+			name := fmt.Sprintf("net/%s/neigh/default/gc_thresh%d", table, i+1)
+			val, err := neighSysctl(name)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %v", name, err)
+			}
+			cur, err := strconv.Atoi(strings.TrimSpace(val))
+			if err != nil {
+				return fmt.Errorf("failed to parse %s value %q: %v", name, val, err)
+			}
+			if cur >= min {
+				continue
+			}
+
+			if _, err := neighSysctl(name, strconv.Itoa(min)); err != nil {
+				return fmt.Errorf("failed to set %s: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func defaultRouteDst(family int) *net.IPNet {
+	if family == netlink.FAMILY_V4 {
+		return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+	}
+	return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+}
+
+func ipFamily(addr net.IP) int {
+	if addr.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+// filterFamilies drops the addresses and routes of the families the
+// container is not to have. IPAM keeps the dropped addresses allocated,
+// they are released with the others on DEL.
+func filterFamilies(result *current.Result, families map[int]bool) {
+	ips := result.IPs[:0]
+	for _, ipc := range result.IPs {
+		if families[ipFamily(ipc.Address.IP)] {
+			ips = append(ips, ipc)
+		}
+	}
+	result.IPs = ips
+
+	routes := result.Routes[:0]
+	for _, r := range result.Routes {
+		if families[ipFamily(r.Dst.IP)] {
+			routes = append(routes, r)
+		}
+	}
+	result.Routes = routes
+}
+
+// checkECMPGateways makes sure every ECMP gateway is on-link for one of the
+// container addresses, and that nothing else provides a default route for
+// the families they cover.
+func checkECMPGateways(result *current.Result, gws []ECMPGateway) error {
+	for _, gw := range gws {
+		onLink := false
+		for _, ipc := range result.IPs {
+			if ipc.Address.Contains(gw.GW) {
+				onLink = true
+				break
+			}
+		}
+		if !onLink {
+			return fmt.Errorf("ECMP gateway %s is not on-link for any container address", gw.GW)
+		}
+
+		dst := defaultRouteDst(ipFamily(gw.GW)).String()
+		for _, route := range result.Routes {
+			if route.Dst.String() == dst {
+				return fmt.Errorf("ecmpGateways conflicts with the default route %s via %s", dst, route.GW)
+			}
+		}
+	}
+	return nil
+}
+
+// checkGateways makes sure, with requireGateway, that every container
+// address family has a gateway or a default route through one, and logs
+// the families without.
+func checkGateways(result *current.Result, n *NetConf) error {
+	hasGW := map[int]bool{}
+	for _, ipc := range result.IPs {
+		if ipc.Gateway != nil {
+			hasGW[ipFamily(ipc.Address.IP)] = true
+		}
+	}
+	for _, gw := range n.ECMPGateways {
+		hasGW[ipFamily(gw.GW)] = true
+	}
+	for _, route := range result.Routes {
+		family := ipFamily(route.Dst.IP)
+		if route.GW != nil && route.Dst.String() == defaultRouteDst(family).String() {
+			hasGW[family] = true
+		}
+	}
+
+	logged := map[int]bool{}
+	for _, ipc := range result.IPs {
+		family := ipFamily(ipc.Address.IP)
+		if hasGW[family] || logged[family] {
+			continue
+		}
+		if n.RequireGateway {
+			return fmt.Errorf("requireGateway is set, but there is no gateway for %s", ipc.Address.String())
+		}
+		log.Printf("no gateway for %s, the container gets no default route for it", ipc.Address.String())
+		logged[family] = true
+	}
+	return nil
+}
+
+// addECMPRoutes installs one multipath default route per family on ifName,
+// with a nexthop for each gateway of that family.
+func addECMPRoutes(ifName string, gws []ECMPGateway, r *RetryConf) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	nexthops := map[int][]*netlink.NexthopInfo{}
+	for _, gw := range gws {
+		family := ipFamily(gw.GW)
+		nexthops[family] = append(nexthops[family], &netlink.NexthopInfo{
+			LinkIndex: link.Attrs().Index,
+			Gw:        gw.GW,
+			Hops:      gw.Weight - 1,
+		})
+	}
+
+	for family, nh := range nexthops {
+		route := &netlink.Route{
+			Dst:       defaultRouteDst(family),
+			MultiPath: nh,
+		}
+		err := r.retry(func() error {
+			return routeAdd(route)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add multipath default route on %q: %v", ifName, err)
+		}
+	}
+	return nil
+}
+
+func (r *TableRoute) route(link netlink.Link) *netlink.Route {
+	dst := net.IPNet(r.Dst)
+	route := &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       &dst,
+		Gw:        r.GW,
+		Table:     r.Table,
+	}
+	if r.GW == nil {
+		route.Scope = netlink.SCOPE_LINK
+	}
+	return route
+}
+
+// addTableRoutes installs the tableRoutes on ifName.
+func addTableRoutes(ifName string, routes []TableRoute, r *RetryConf) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	for i := range routes {
+		route := routes[i].route(link)
+		err := r.retry(func() error {
+			return routeAdd(route)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add route to %s in table %d: %v", route.Dst, route.Table, err)
+		}
+	}
+	return nil
+}
+
+// delTableRoutes removes the tableRoutes from ifName. They go away with
+// the interface anyway, so routes and interfaces that are gone already
+// are fine.
+func delTableRoutes(ifName string, routes []TableRoute) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	for i := range routes {
+		route := routes[i].route(link)
+		if err := netlink.RouteDel(route); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("failed to delete route to %s in table %d: %v", route.Dst, route.Table, err)
+		}
+	}
+	return nil
+}
+
+// preferredSources picks the container address within each preferred
+// prefix.
+func preferredSources(result *current.Result, prefixes []*net.IPNet) ([]net.IP, error) {
+	var srcs []net.IP
+	for _, prefix := range prefixes {
+		var src net.IP
+		for _, ipc := range result.IPs {
+			if prefix.Contains(ipc.Address.IP) {
+				src = ipc.Address.IP
+				break
+			}
+		}
+		if src == nil {
+			return nil, fmt.Errorf("no container address within preferredSource %s", prefix)
+		}
+		srcs = append(srcs, src)
+	}
+	return srcs, nil
+}
+
+// setPreferredSource makes each of srcs the source address of the routes
+// of its family that go through a gateway. The kernel picks the source of
+// on-link routes from their subnet already.
+func setPreferredSource(ifName string, srcs []net.IP) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	for _, src := range srcs {
+		routes, err := netlink.RouteList(link, ipFamily(src))
+		if err != nil {
+			return fmt.Errorf("failed to list routes on %q: %v", ifName, err)
+		}
+		for i := range routes {
+			route := &routes[i]
+			if route.Gw == nil && len(route.MultiPath) == 0 {
+				continue
+			}
+			route.Src = src
+			if err := netlink.RouteReplace(route); err != nil {
+				return fmt.Errorf("failed to set source %s on route %v: %v", src, route, err)
+			}
+		}
+	}
+	return nil
+}
+
 func ensureVlanInterface(br *netlink.Bridge, vlanId int) (netlink.Link, error) {
 	name := fmt.Sprintf("%s.%d", br.Name, vlanId)
 
@@ -312,7 +906,7 @@ func ensureVlanInterface(br *netlink.Bridge, vlanId int) (netlink.Link, error) {
 			return nil, fmt.Errorf("faild to find host namespace: %v", err)
 		}
 
-		_, brGatewayIface, err := setupVeth(hostNS, br, name, br.MTU, false, vlanId, "")
+		_, brGatewayIface, err := setupVeth(hostNS, br, name, "", br.MTU, nil, false, vlanId, nil, "", nil, false)
 		if err != nil {
 			return nil, fmt.Errorf("faild to create vlan gateway %q: %v", name, err)
 		}
@@ -326,13 +920,119 @@ func ensureVlanInterface(br *netlink.Bridge, vlanId int) (netlink.Link, error) {
 	return brGatewayVeth, nil
 }
 
-func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, hairpinMode bool, vlanID int, mac string) (*current.Interface, *current.Interface, error) {
+// maxHostVethNameTries bounds the fallback names tried on a collision.
+const maxHostVethNameTries = 10
+
+// stableHostVethName derives the host veth name from the pod and the
+// interface, falling back to the container ID outside of Kubernetes. When
+// the name is taken, the next of a fixed series of names is used, so a pod
+// still ends up with the same name every time unless it collides twice.
+// With reclaimStaleVeth, a veth holding the name whose peer is not in
+// netns, left behind by an earlier incarnation of the pod, is deleted and
+// the name reused.
+func stableHostVethName(n *NetConf, args *skel.CmdArgs, netns ns.NetNS) (string, error) {
+	id := n.podID
+	if id == "" {
+		id = args.ContainerID
+	}
+
+	for i := 0; i < maxHostVethNameTries; i++ {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%s\x00%d", n.Name, id, args.IfName, i)))
+		// "veth" plus 11 hex digits fills IFNAMSIZ
+		name := fmt.Sprintf("veth%x", sum[:6])[:15]
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				return name, nil
+			}
+			return "", fmt.Errorf("failed to lookup %q: %v", name, err)
+		}
+		if n.ReclaimStaleVeth {
+			stale, err := staleVeth(link, hostVethOwner(n, args), netns)
+			if err != nil {
+				return "", err
+			}
+			if stale {
+				log.Printf("deleting stale veth %q of %s, its peer is not in %s", name, id, netns.Path())
+				if err := netlink.LinkDel(link); err != nil {
+					return "", fmt.Errorf("failed to delete stale veth %q: %v", name, err)
+				}
+				return name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("failed to find a free host veth name for %s", id)
+}
+
+// hostVethOwner is the alias reclaimStaleVeth marks the host veth of the
+// pod's interface with, so only a veth of the same pod is ever reclaimed.
+func hostVethOwner(n *NetConf, args *skel.CmdArgs) string {
+	id := n.podID
+	if id == "" {
+		id = args.ContainerID
+	}
+	owner := fmt.Sprintf("cni/%s/%s/%s", n.Name, id, args.IfName)
+	if len(owner) > maxIfAliasLen {
+		owner = owner[:maxIfAliasLen]
+	}
+	return owner
+}
+
+// staleVeth reports whether link is a veth of owner, as its alias tells,
+// whose peer is not in netns. A veth of another pod, e.g. one whose name
+// collides, is never stale.
+func staleVeth(link netlink.Link, owner string, netns ns.NetNS) (bool, error) {
+	veth, ok := link.(*netlink.Veth)
+	if !ok || link.Attrs().Alias != owner {
+		return false, nil
+	}
+	peerIndex, err := netlink.VethPeerIndex(veth)
+	if err != nil {
+		return false, fmt.Errorf("failed to get the peer of %q: %v", link.Attrs().Name, err)
+	}
+
+	// the peer is in netns if one of its veths pairs with link
+	var inNetns bool
+	err = netns.Do(func(_ ns.NetNS) error {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return fmt.Errorf("failed to list links: %v", err)
+		}
+		for _, l := range links {
+			v, ok := l.(*netlink.Veth)
+			if !ok || l.Attrs().Index != peerIndex {
+				continue
+			}
+			if index, err := netlink.VethPeerIndex(v); err == nil && index == link.Attrs().Index {
+				inNetns = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return !inNetns, nil
+}
+
+func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName, hostVethName string, mtu int, txQueueLen *int, hairpinMode bool, vlanID int, vlanTrunk []int, mac string, addrGen *IPv6AddrGen, delayCarrier bool) (_ *current.Interface, _ *current.Interface, err error) {
 	contIface := &current.Interface{}
 	hostIface := &current.Interface{}
 
-	err := netns.Do(func(hostNS ns.NetNS) error {
+	// a pair that fails part way is deleted again, the host end with it
+	defer func() {
+		if err != nil && contIface.Name != "" {
+			if derr := netns.Do(func(_ ns.NetNS) error {
+				return ip.DelLinkByName(contIface.Name)
+			}); derr != nil && derr != ip.ErrLinkNotFound {
+				log.Printf("failed to delete %q after a failed setup: %v", contIface.Name, derr)
+			}
+		}
+	}()
+
+	err = netns.Do(func(hostNS ns.NetNS) error {
 		// create the veth pair in the container and move host end into host netns
-		hostVeth, containerVeth, err := ip.SetupVeth(ifName, mtu, mac, hostNS)
+		hostVeth, containerVeth, err := ip.SetupVethWithName(ifName, hostVethName, mtu, mac, hostNS)
 		if err != nil {
 			return err
 		}
@@ -340,6 +1040,17 @@ func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, hairp
 		contIface.Mac = containerVeth.HardwareAddr.String()
 		contIface.Sandbox = netns.Path()
 		hostIface.Name = hostVeth.Name
+
+		if txQueueLen != nil {
+			if err := setTxQueueLen(containerVeth.Name, *txQueueLen); err != nil {
+				return err
+			}
+		}
+		if addrGen != nil {
+			if err := setAddrGen(containerVeth.Name, addrGen); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 	if err != nil {
@@ -353,6 +1064,19 @@ func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, hairp
 	}
 	hostIface.Mac = hostVeth.Attrs().HardwareAddr.String()
 
+	// before the port joins the bridge, nothing got through yet
+	if delayCarrier {
+		if err := netlink.LinkSetDown(hostVeth); err != nil {
+			return nil, nil, fmt.Errorf("failed to set %q down: %v", hostIface.Name, err)
+		}
+	}
+
+	if txQueueLen != nil {
+		if err := netlink.LinkSetTxQLen(hostVeth, *txQueueLen); err != nil {
+			return nil, nil, fmt.Errorf("failed to set TX queue length of %q: %v", hostIface.Name, err)
+		}
+	}
+
 	// connect host veth end to the bridge
 	if err := netlink.LinkSetMaster(hostVeth, br); err != nil {
 		return nil, nil, fmt.Errorf("failed to connect %q to bridge %v: %v", hostVeth.Attrs().Name, br.Attrs().Name, err)
@@ -370,84 +1094,468 @@ func setupVeth(netns ns.NetNS, br *netlink.Bridge, ifName string, mtu int, hairp
 		}
 	}
 
+	// tagged memberships; these go away with the port when the veth is deleted
+	for _, id := range vlanTrunk {
+		err = netlink.BridgeVlanAdd(hostVeth, uint16(id), false, false, false, true)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to add trunk vlan %d on interface %q: %v", id, hostIface.Name, err)
+		}
+	}
+
+	// Return an error requested by testcases, if any
+	if debugSetupVethError != nil {
+		return nil, nil, debugSetupVethError
+	}
+
 	return hostIface, contIface, nil
 }
 
+// pruneVlans removes the VLAN memberships of a bridge port that were not
+// configured, the bridge's default PVID in particular, so the port egresses
+// nothing but pvid untagged.
+func pruneVlans(name string, pvid int, trunk []int) error {
+	port, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", name, err)
+	}
+	vlans, err := netlink.BridgeVlanList()
+	if err != nil {
+		return fmt.Errorf("failed to list vlans: %v", err)
+	}
+
+	configured := map[uint16]bool{uint16(pvid): pvid != 0}
+	for _, id := range trunk {
+		configured[uint16(id)] = true
+	}
+	for _, v := range vlans[int32(port.Attrs().Index)] {
+		if configured[v.Vid] {
+			continue
+		}
+		if err := netlink.BridgeVlanDel(port, v.Vid, v.PortVID(), v.EngressUntag(), false, true); err != nil {
+			return fmt.Errorf("failed to remove vlan %d from interface %q: %v", v.Vid, name, err)
+		}
+	}
+	return nil
+}
+
+// setContainerLink brings ifName in netns up or down.
+func setContainerLink(netns ns.NetNS, ifName string, up bool) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		state, set := "down", netlink.LinkSetDown
+		if up {
+			state, set = "up", netlink.LinkSetUp
+		}
+		if err := set(link); err != nil {
+			return fmt.Errorf("failed to set %q %s: %v", ifName, state, err)
+		}
+		return nil
+	})
+}
+
+// raiseCarrier brings up the host end of the veth that delayCarrier kept
+// down and waits for the container end to report carrier.
+func raiseCarrier(netns ns.NetNS, hostName, contName string) error {
+	hostVeth, err := netlink.LinkByName(hostName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", hostName, err)
+	}
+	if err := netlink.LinkSetUp(hostVeth); err != nil {
+		return fmt.Errorf("failed to set %q up: %v", hostName, err)
+	}
+
+	return netns.Do(func(_ ns.NetNS) error {
+		retries := []int{0, 10, 50, 100, 500, 1000}
+		for idx, sleep := range retries {
+			time.Sleep(time.Duration(sleep) * time.Millisecond)
+
+			contVeth, err := netlink.LinkByName(contName)
+			if err != nil {
+				return fmt.Errorf("failed to lookup %q: %v", contName, err)
+			}
+			if contVeth.Attrs().OperState == netlink.OperUp {
+				break
+			}
+
+			if idx == len(retries)-1 {
+				return fmt.Errorf("container interface %q has no carrier: %s", contName, contVeth.Attrs().OperState)
+			}
+		}
+		return nil
+	})
+}
+
+func setTxQueueLen(ifName string, qlen int) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	if err := netlink.LinkSetTxQLen(link, qlen); err != nil {
+		return fmt.Errorf("failed to set TX queue length of %q: %v", ifName, err)
+	}
+	return nil
+}
+
+// hostRoute sends the traffic for a container address to the bridge.
+func hostRoute(br netlink.Link, addr net.IP) *netlink.Route {
+	bits := 128
+	if ipFamily(addr) == netlink.FAMILY_V4 {
+		addr, bits = addr.To4(), 32
+	}
+	return &netlink.Route{
+		LinkIndex: br.Attrs().Index,
+		Scope:     netlink.SCOPE_LINK,
+		Dst:       &net.IPNet{IP: addr, Mask: net.CIDRMask(bits, bits)},
+	}
+}
+
+// delHostRoutes removes the host routes of the container addresses, if the
+// bridge and they are still there.
+func delHostRoutes(brName string, ipnets []*net.IPNet) error {
+	br, err := netlink.LinkByName(brName)
+	if err != nil {
+		return nil
+	}
+	for _, ipn := range ipnets {
+		err := netlink.RouteDel(hostRoute(br, ipn.IP))
+		if err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("failed to delete host route to %s: %v", ipn.IP, err)
+		}
+	}
+	return nil
+}
+
+// maxIfAliasLen is IFALIASZ less the terminating NUL.
+const maxIfAliasLen = 255
+
+// setInterfaceAlias sets the alias of the selected ends of the veth,
+// truncated to what the kernel stores.
+func setInterfaceAlias(netns ns.NetNS, which, hostName, contName, alias string) error {
+	if len(alias) > maxIfAliasLen {
+		alias = alias[:maxIfAliasLen]
+	}
+
+	set := func(ifName string) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		if err := netlink.LinkSetAlias(link, alias); err != nil {
+			return fmt.Errorf("failed to set alias of %q: %v", ifName, err)
+		}
+		return nil
+	}
+
+	if which == "host" || which == "both" {
+		if err := set(hostName); err != nil {
+			return err
+		}
+	}
+	if which == "container" || which == "both" {
+		return netns.Do(func(_ ns.NetNS) error {
+			return set(contName)
+		})
+	}
+	return nil
+}
+
 func calcGatewayIP(ipn *net.IPNet) net.IP {
 	nid := ipn.IP.Mask(ipn.Mask)
 	return ip.NextIP(nid)
 }
 
-func setupBridge(n *NetConf) (*netlink.Bridge, *current.Interface, error) {
-	vlanFiltering := false
-	if n.Vlan != 0 {
-		vlanFiltering = true
+func setupBridge(n *NetConf) (*netlink.Bridge, *current.Interface, error) {
+	vlanFiltering := false
+	if n.Vlan != 0 || n.VlanAware {
+		vlanFiltering = true
+	}
+	// create bridge if necessary
+	br, err := ensureBridge(n.BrName, n.MTU, n.PromiscMode, vlanFiltering, n.NetlinkRetry)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create bridge %q: %v", n.BrName, err)
+	}
+
+	if n.Master != "" {
+		if err := ensureBridgeMaster(br, n.Master); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if n.FdbMaxSize != nil {
+		if err := setFdbMaxLearned(br, uint32(*n.FdbMaxSize)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if n.NeighGCThresh != nil {
+		if err := raiseNeighGCThresholds(n.NeighGCThresh, n.families); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if n.VXLAN != nil {
+		if _, err := ensureVXLAN(br, n.VXLAN); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if n.DisableBridgeIP {
+		// keep the kernel from giving the bridge an IPv6 link-local address
+		if _, err := sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/disable_ipv6", n.BrName), "1"); err != nil {
+			return nil, nil, fmt.Errorf("failed to disable IPv6 on bridge %q: %v", n.BrName, err)
+		}
+	}
+
+	return br, &current.Interface{
+		Name: br.Attrs().Name,
+		Mac:  br.Attrs().HardwareAddr.String(),
+	}, nil
+}
+
+// disableIPV6DAD disables IPv6 Duplicate Address Detection (DAD)
+// for an interface, if the interface does not support enhanced_dad.
+// We do this because interfaces with hairpin mode will see their own DAD packets
+func disableIPV6DAD(ifName string) error {
+	// ehanced_dad sends a nonce with the DAD packets, so that we can safely
+	// ignore ourselves
+	enh, err := ioutil.ReadFile(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/enhanced_dad", ifName))
+	if err == nil && string(enh) == "1\n" {
+		return nil
+	}
+	f := fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/accept_dad", ifName)
+	return ioutil.WriteFile(f, []byte("0"), 0644)
+}
+
+func enableIPForward(family int) error {
+	if family == netlink.FAMILY_V4 {
+		return ip.EnableIP4Forward()
+	}
+	return ip.EnableIP6Forward()
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	var success bool = false
+
+	n, cniVersion, err := loadNetConf(args.StdinData, args.Args)
+	if err != nil {
+		return err
+	}
+
+	isLayer3 := n.IPAM.Type != "" || n.IPAMWebhook != nil
+
+	if n.IsDefaultGW {
+		n.IsGW = true
+	}
+
+	if n.snatIP != nil {
+		if err := checkHostAddr(n.snatIP); err != nil {
+			return err
+		}
+	}
+
+	br, brInterface, err := setupBridge(n)
+	if err != nil {
+		return err
+	}
+
+	netns, err := openNetNS(args.Netns, n.NetnsRetry)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	if n.Adopt {
+		adopted, err := adoptVeth(netns, br, args.IfName, isLayer3)
+		if err != nil {
+			return err
+		}
+		if adopted != nil {
+			adopted.DNS = n.DNS
+			if err := runHooks(n, args, adopted); err != nil {
+				return err
+			}
+			return types.PrintResult(adopted, cniVersion)
+		}
+	}
+
+	switch n.SharedNetns {
+	case "reuse":
+		name, owner, err := sharedPort(netns, br)
+		if err != nil {
+			return err
+		}
+		if owner != "" && owner != args.ContainerID {
+			shared, err := adoptVeth(netns, br, name, false)
+			if err != nil {
+				return err
+			}
+			if shared != nil {
+				shared.DNS = n.DNS
+				if err := runHooks(n, args, shared); err != nil {
+					return err
+				}
+				return types.PrintResult(shared, cniVersion)
+			}
+		}
+	case "add":
+		if args.IfName, err = ownedIfName(netns, args.IfName, args.ContainerID); err != nil {
+			return err
+		}
+	}
+
+	if n.mac == "" && n.StableMac {
+		pod := n.podID
+		if pod == "" {
+			pod = args.ContainerID
+		}
+		n.mac = stableMac(n.macPrefix, n.Name, pod, args.IfName)
+	} else if n.mac == "" && n.macPrefix != nil {
+		if n.mac, err = randomMac(n.macPrefix); err != nil {
+			return err
+		}
+	}
+
+	// everything set up for the container from here on is undone if the
+	// ADD fails
+	var undo rollback
+	defer func() {
+		if !success {
+			undo.run(args.ContainerID)
+		}
+	}()
+	if n.VXLAN != nil {
+		undo.add("release the VXLAN device", func() error {
+			return releaseVXLAN(n)
+		})
+	}
+
+	var hostInterface, containerInterface *current.Interface
+	if n.Tap != nil {
+		hostInterface, err = setupTap(br, n, args.ContainerID)
+	} else {
+		var hostVethName string
+		if n.StableHostVethName {
+			if hostVethName, err = stableHostVethName(n, args, netns); err != nil {
+				return err
+			}
+		}
+		hostInterface, containerInterface, err = setupVeth(netns, br, args.IfName, hostVethName, n.MTU, n.TxQueueLen, n.HairpinMode, n.Vlan, n.VlanTrunk, n.mac, n.IPv6AddrGen, n.DelayCarrier || n.ReceiveOnly)
 	}
-	// create bridge if necessary
-	br, err := ensureBridge(n.BrName, n.MTU, n.PromiscMode, vlanFiltering)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create bridge %q: %v", n.BrName, err)
+		return err
+	}
+	if n.Tap != nil {
+		undo.add("delete tap "+hostInterface.Name, func() error {
+			return teardownTap(n.Tap, args.ContainerID)
+		})
+	} else {
+		ifName := args.IfName
+		undo.add("delete "+ifName, func() error {
+			err := netns.Do(func(_ ns.NetNS) error {
+				return ip.DelLinkByName(ifName)
+			})
+			if err == ip.ErrLinkNotFound {
+				return nil
+			}
+			return err
+		})
+	}
+
+	// The container interface is set up in a fixed order, each step done
+	// before the next starts:
+	//  1. the veth is created and taken down again, which drops the
+	//     link-local address it got when ip.SetupVeth brought it up,
+	//  2. the sysctls of the interface and its namespace are set, those of
+	//     ipv6AddrGen, arp, sysctlProfile, sysctl and acceptRA, and DAD is
+	//     disabled where it cannot complete,
+	//  3. the interface comes up, generating its link-local address and
+	//     listening to router advertisements with those sysctls,
+	//  4. its addresses are added,
+	//  5. its routes are installed.
+	// With IPAM, ipam.ConfigureIface does steps 3 to 5.
+	if n.Tap == nil {
+		if err := setContainerLink(netns, args.IfName, false); err != nil {
+			return err
+		}
 	}
 
-	return br, &current.Interface{
-		Name: br.Attrs().Name,
-		Mac:  br.Attrs().HardwareAddr.String(),
-	}, nil
-}
-
-// disableIPV6DAD disables IPv6 Duplicate Address Detection (DAD)
-// for an interface, if the interface does not support enhanced_dad.
-// We do this because interfaces with hairpin mode will see their own DAD packets
-func disableIPV6DAD(ifName string) error {
-	// ehanced_dad sends a nonce with the DAD packets, so that we can safely
-	// ignore ourselves
-	enh, err := ioutil.ReadFile(fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/enhanced_dad", ifName))
-	if err == nil && string(enh) == "1\n" {
-		return nil
+	if n.VlanAware {
+		if err := pruneVlans(hostInterface.Name, n.Vlan, n.VlanTrunk); err != nil {
+			return err
+		}
 	}
-	f := fmt.Sprintf("/proc/sys/net/ipv6/conf/%s/accept_dad", ifName)
-	return ioutil.WriteFile(f, []byte("0"), 0644)
-}
 
-func enableIPForward(family int) error {
-	if family == netlink.FAMILY_V4 {
-		return ip.EnableIP4Forward()
+	if n.GSOMaxSize != nil || n.GROMaxSize != nil {
+		if err := setGSOMaxSize(hostInterface.Name, n.GSOMaxSize, n.GROMaxSize); err != nil {
+			return err
+		}
+		if n.Tap == nil {
+			if err := netns.Do(func(_ ns.NetNS) error {
+				return setGSOMaxSize(args.IfName, n.GSOMaxSize, n.GROMaxSize)
+			}); err != nil {
+				return err
+			}
+		}
 	}
-	return ip.EnableIP6Forward()
-}
 
-func cmdAdd(args *skel.CmdArgs) error {
-	var success bool = false
+	if n.NestedBridging {
+		if err := setNestedBridging(hostInterface.Name); err != nil {
+			return err
+		}
+	}
 
-	n, cniVersion, err := loadNetConf(args.StdinData, args.Args)
-	if err != nil {
-		return err
+	if n.rpsMask != "" {
+		if err := setRPSMask(hostInterface.Name, n.rpsMask); err != nil {
+			return err
+		}
 	}
 
-	isLayer3 := n.IPAM.Type != ""
+	if n.ARP != nil {
+		if err := setARPSysctls(netns, args.IfName, n.ARP); err != nil {
+			return err
+		}
+	}
 
-	if n.IsDefaultGW {
-		n.IsGW = true
+	if sysctls := resolveSysctls(n); len(sysctls) > 0 {
+		if err := setSysctls(netns, sysctls); err != nil {
+			return err
+		}
 	}
 
-	if n.HairpinMode && n.PromiscMode {
-		return fmt.Errorf("cannot set hairpin mode and promiscuous mode at the same time.")
+	if n.AcceptRA != nil {
+		if n.AcceptRA.applies("bridge") {
+			if err := setAcceptRA(n.BrName, n.AcceptRA.Value); err != nil {
+				return err
+			}
+		}
+		if n.AcceptRA.applies("container") {
+			if err := netns.Do(func(_ ns.NetNS) error {
+				return setAcceptRA(args.IfName, n.AcceptRA.Value)
+			}); err != nil {
+				return err
+			}
+		}
 	}
 
-	br, brInterface, err := setupBridge(n)
-	if err != nil {
-		return err
+	if n.SharedNetns != "" {
+		if err := setSharedOwner(netns, args.IfName, args.ContainerID); err != nil {
+			return err
+		}
 	}
 
-	netns, err := ns.GetNS(args.Netns)
-	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	if n.ReclaimStaleVeth {
+		if err := setInterfaceAlias(netns, "host", hostInterface.Name, "", hostVethOwner(n, args)); err != nil {
+			return err
+		}
 	}
-	defer netns.Close()
 
-	hostInterface, containerInterface, err := setupVeth(netns, br, args.IfName, n.MTU, n.HairpinMode, n.Vlan, n.mac)
-	if err != nil {
-		return err
+	if n.InterfaceAlias != "" && n.podID != "" {
+		if err := setInterfaceAlias(netns, n.InterfaceAlias, hostInterface.Name, args.IfName, n.podID); err != nil {
+			return err
+		}
 	}
 
 	// Assume L2 interface only
@@ -456,28 +1564,50 @@ func cmdAdd(args *skel.CmdArgs) error {
 		Interfaces: []*current.Interface{
 			brInterface,
 			hostInterface,
-			containerInterface,
 		},
 	}
+	if containerInterface != nil {
+		result.Interfaces = append(result.Interfaces, containerInterface)
+	}
 
-	if isLayer3 {
-		// run the IPAM plugin and get back the config to apply
-		r, err := ipam.ExecAdd(n.IPAM.Type, args.StdinData)
-		if err != nil {
+	// step 3 without IPAM, see above
+	if !isLayer3 && n.Tap == nil {
+		if err := setContainerLink(netns, args.IfName, true); err != nil {
 			return err
 		}
+	}
 
-		// release IP in case of failure
-		defer func() {
-			if !success {
-				ipam.ExecDel(n.IPAM.Type, args.StdinData)
+	if isLayer3 {
+		var ipamResult *current.Result
+		if n.IPAMWebhook != nil {
+			ctx, cancel := webhookContext(n.IPAMWebhook)
+			ipamResult, err = webhookAdd(ctx, n.IPAMWebhook, newWebhookRequest("ADD", n, args))
+			cancel()
+			if err != nil {
+				return err
 			}
-		}()
 
-		// Convert whatever the IPAM result was into the current Result type
-		ipamResult, err := current.NewResultFromResult(r)
-		if err != nil {
-			return err
+			undo.add("release the addresses from the ipamWebhook", func() error {
+				ctx, cancel := webhookContext(n.IPAMWebhook)
+				defer cancel()
+				return webhookDel(ctx, n.IPAMWebhook, newWebhookRequest("DEL", n, args))
+			})
+		} else {
+			// run the IPAM plugin and get back the config to apply
+			r, sec, err := ipamAdd(n, args.StdinData)
+			if err != nil {
+				return err
+			}
+
+			undo.add("release the addresses from "+sec.plugin, func() error {
+				return ipam.ExecDel(sec.plugin, sec.stdin)
+			})
+
+			// Convert whatever the IPAM result was into the current Result type
+			ipamResult, err = current.NewResultFromResult(r)
+			if err != nil {
+				return err
+			}
 		}
 
 		result.IPs = ipamResult.IPs
@@ -487,79 +1617,150 @@ func cmdAdd(args *skel.CmdArgs) error {
 			return errors.New("IPAM plugin returned missing IP config")
 		}
 
+		if n.families != nil {
+			filterFamilies(result, n.families)
+			if len(result.IPs) == 0 {
+				return fmt.Errorf("IPAM plugin returned no address of ipFamilies %v", n.IPFamilies)
+			}
+		}
+
+		if n.eui64 != nil {
+			addr, err := eui64Addr(n.eui64, containerInterface.Mac)
+			if err != nil {
+				return err
+			}
+			result.IPs = append(result.IPs, &current.IPConfig{Address: *addr})
+		}
+
 		// Gather gateway information for each IP family
 		gwsV4, gwsV6, err := calcGateways(result, n)
 		if err != nil {
 			return err
 		}
 
-		// Configure the container hardware address and IP address(es)
-		if err := netns.Do(func(_ ns.NetNS) error {
-			// Disable IPv6 DAD just in case hairpin mode is enabled on the
-			// bridge. Hairpin mode causes echos of neighbor solicitation
-			// packets, which causes DAD failures.
-			for _, ipc := range result.IPs {
-				if ipc.Address.IP.To4() == nil && (n.HairpinMode || n.PromiscMode) {
-					if err := disableIPV6DAD(args.IfName); err != nil {
-						return err
-					}
-					break
-				}
+		if len(n.ECMPGateways) > 0 {
+			if err := checkECMPGateways(result, n.ECMPGateways); err != nil {
+				return err
 			}
+		}
 
-			// Add the IP to the interface
-			if err := ipam.ConfigureIface(args.IfName, result); err != nil {
-				return err
+		srcs, err := preferredSources(result, n.preferred)
+		if err != nil {
+			return err
+		}
+
+		// The IPAM gateway would have to live on the bridge, which has no
+		// address in pure L2 mode; only routes with an explicit gateway
+		// elsewhere on the segment make sense
+		if n.DisableBridgeIP {
+			for _, ipc := range result.IPs {
+				ipc.Gateway = nil
 			}
-			return nil
-		}); err != nil {
+		}
+
+		if err := checkGateways(result, n); err != nil {
 			return err
 		}
 
-		// check bridge port state
-		retries := []int{0, 50, 500, 1000, 1000}
-		for idx, sleep := range retries {
-			time.Sleep(time.Duration(sleep) * time.Millisecond)
+		if n.Tap != nil {
+			// The VM behind the tap configures its own addresses
+			for _, ipc := range result.IPs {
+				ipc.Interface = current.Int(1)
+			}
+		} else {
+			// Configure the container hardware address and IP address(es)
+			if err := netns.Do(func(_ ns.NetNS) error {
+				// Disable IPv6 DAD just in case hairpin mode is enabled on the
+				// bridge. Hairpin mode causes echos of neighbor solicitation
+				// packets, which causes DAD failures.
+				for _, ipc := range result.IPs {
+					// DAD cannot complete without carrier either
+					if ipc.Address.IP.To4() == nil && (n.HairpinMode || n.PromiscMode || n.DelayCarrier || n.ReceiveOnly) {
+						if err := disableIPV6DAD(args.IfName); err != nil {
+							return err
+						}
+						break
+					}
+				}
 
-			hostVeth, err := netlink.LinkByName(hostInterface.Name)
-			if err != nil {
+				// Add the IP to the interface
+				if err := configureIface(args.IfName, result); err != nil {
+					return err
+				}
+
+				if len(n.ECMPGateways) > 0 {
+					if err := addECMPRoutes(args.IfName, n.ECMPGateways, n.NetlinkRetry); err != nil {
+						return err
+					}
+				}
+				if len(n.TableRoutes) > 0 {
+					if err := addTableRoutes(args.IfName, n.TableRoutes, n.NetlinkRetry); err != nil {
+						return err
+					}
+				}
+				if len(srcs) > 0 {
+					return setPreferredSource(args.IfName, srcs)
+				}
+				return nil
+			}); err != nil {
 				return err
 			}
-			if hostVeth.Attrs().OperState == netlink.OperUp {
-				break
-			}
 
-			if idx == len(retries)-1 {
-				return fmt.Errorf("bridge port in error state: %s", hostVeth.Attrs().OperState)
+			// Report each ECMP nexthop as a default route
+			for _, gw := range n.ECMPGateways {
+				result.Routes = append(result.Routes, &types.Route{Dst: *defaultRouteDst(ipFamily(gw.GW)), GW: gw.GW})
 			}
-		}
 
-		// Send a gratuitous arp
-		if err := netns.Do(func(_ ns.NetNS) error {
-			contVeth, err := net.InterfaceByName(args.IfName)
-			if err != nil {
-				return err
+			if n.DelayCarrier {
+				if err := raiseCarrier(netns, hostInterface.Name, args.IfName); err != nil {
+					return err
+				}
 			}
 
-			for _, ipc := range result.IPs {
-				if ipc.Address.IP.To4() != nil {
-					_ = arping.GratuitousArpOverIface(ipc.Address.IP, *contVeth)
+			// A receive-only port stays down, and cannot announce anything
+			if !n.ReceiveOnly {
+				// check bridge port state
+				retries := []int{0, 50, 500, 1000, 1000}
+				for idx, sleep := range retries {
+					time.Sleep(time.Duration(sleep) * time.Millisecond)
+
+					hostVeth, err := netlink.LinkByName(hostInterface.Name)
+					if err != nil {
+						return err
+					}
+					if hostVeth.Attrs().OperState == netlink.OperUp {
+						break
+					}
+
+					if idx == len(retries)-1 {
+						return fmt.Errorf("bridge port in error state: %s", hostVeth.Attrs().OperState)
+					}
+				}
+
+				// Send a gratuitous arp
+				if err := netns.Do(func(_ ns.NetNS) error {
+					contVeth, err := net.InterfaceByName(args.IfName)
+					if err != nil {
+						return err
+					}
+
+					for _, ipc := range result.IPs {
+						if ipc.Address.IP.To4() != nil {
+							_ = arping.GratuitousArpOverIface(ipc.Address.IP, *contVeth)
+						}
+					}
+					return nil
+				}); err != nil {
+					return err
 				}
 			}
-			return nil
-		}); err != nil {
-			return err
 		}
 
 		if n.IsGW {
-			var firstV4Addr net.IP
 			var vlanInterface *current.Interface
 			// Set the IP address(es) on the bridge and enable forwarding
 			for _, gws := range []*gwInfo{gwsV4, gwsV6} {
 				for _, gw := range gws.gws {
-					if gw.IP.To4() != nil && firstV4Addr == nil {
-						firstV4Addr = gw.IP
-					}
 					if n.Vlan != 0 {
 						vlanIface, err := ensureVlanInterface(br, n.Vlan)
 						if err != nil {
@@ -572,12 +1773,12 @@ func cmdAdd(args *skel.CmdArgs) error {
 							result.Interfaces = append(result.Interfaces, vlanInterface)
 						}
 
-						err = ensureAddr(vlanIface, gws.family, &gw, n.ForceAddress)
+						err = ensureAddr(vlanIface, gws.family, &gw, n.ForceAddress, n.AllowSharedGateway, n.NetlinkRetry)
 						if err != nil {
 							return fmt.Errorf("failed to set vlan interface for bridge with addr: %v", err)
 						}
 					} else {
-						err = ensureAddr(br, gws.family, &gw, n.ForceAddress)
+						err = ensureAddr(br, gws.family, &gw, n.ForceAddress, n.AllowSharedGateway, n.NetlinkRetry)
 						if err != nil {
 							return fmt.Errorf("failed to set bridge addr: %v", err)
 						}
@@ -592,15 +1793,40 @@ func cmdAdd(args *skel.CmdArgs) error {
 			}
 		}
 
-		if n.IPMasq {
-			chain := utils.FormatChainName(n.Name, args.ContainerID)
-			comment := utils.FormatComment(n.Name, args.ContainerID)
+		ipnets := resultAddrs(result)
+		undo.add("remove the firewall rules", func() error {
+			return teardownFirewall(n, args.ContainerID, ipnets)
+		})
+		if err := setupFirewall(n, args.ContainerID, result.IPs); err != nil {
+			if n.FirewallFailure != "open" {
+				return err
+			}
+			log.Printf("WARNING: container %s is up on %q WITHOUT its firewall rules, since firewallFailure is open: %v", args.ContainerID, n.BrName, err)
+		}
+
+		if n.HostRoutes {
+			undo.add("delete the host routes", func() error {
+				return delHostRoutes(n.BrName, ipnets)
+			})
 			for _, ipc := range result.IPs {
-				if err = ip.SetupIPMasq(&ipc.Address, chain, comment); err != nil {
-					return err
+				if ipFamily(ipc.Address.IP) == netlink.FAMILY_V6 {
+					// without an address of its own the bridge may
+					// have IPv6 disabled, which refuses the route
+					if _, err := sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/disable_ipv6", n.BrName), "0"); err != nil {
+						return fmt.Errorf("failed to enable IPv6 on %q: %v", n.BrName, err)
+					}
+				}
+				// Replacing keeps a repeated ADD from failing on the
+				// route it added before
+				if err := netlink.RouteReplace(hostRoute(br, ipc.Address.IP)); err != nil {
+					return fmt.Errorf("failed to add host route to %s: %v", ipc.Address.IP, err)
 				}
 			}
 		}
+	} else if n.DelayCarrier {
+		if err := raiseCarrier(netns, hostInterface.Name, args.IfName); err != nil {
+			return err
+		}
 	}
 
 	// Refetch the bridge since its MAC address may change when the first
@@ -618,57 +1844,162 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return debugPostIPAMError
 	}
 
+	if err := runHooks(n, args, result); err != nil {
+		return err
+	}
+
 	success = true
 
 	return types.PrintResult(result, cniVersion)
 }
 
 func cmdDel(args *skel.CmdArgs) error {
-	n, _, err := loadNetConf(args.StdinData, args.Args)
+	n, _, err := parseNetConf(args.StdinData, args.Args)
 	if err != nil {
 		return err
 	}
+	// the firewall teardown needs the SNAT address that validate would
+	// have parsed
+	n.snatIP = net.ParseIP(n.SNATAddress)
+
+	isLayer3 := n.IPAM.Type != "" || n.IPAMWebhook != nil
+
+	if n.SharedNetns != "" && args.Netns != "" {
+		// another container sharing the namespace may own ifName
+		if netns, err := openNetNS(args.Netns, n.NetnsRetry); err == nil {
+			args.IfName, err = ownedIfName(netns, args.IfName, args.ContainerID)
+			netns.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if n.IPAMWebhook != nil {
+		ctx, cancel := webhookContext(n.IPAMWebhook)
+		err := webhookDel(ctx, n.IPAMWebhook, newWebhookRequest("DEL", n, args))
+		cancel()
+		if err != nil {
+			return err
+		}
+	} else if isLayer3 {
+		if err := ipamDel(n, args.StdinData); err != nil {
+			return err
+		}
+	}
+
+	var ipnets []*net.IPNet
+	if n.Tap != nil {
+		if err := teardownTap(n.Tap, args.ContainerID); err != nil {
+			return err
+		}
+	} else if args.Netns != "" {
+		// There is a netns so try to clean up. Delete can be called multiple times
+		// so don't return an error if the device is already removed.
+		err = withNetNSPath(args.Netns, n.NetnsRetry, func(_ ns.NetNS) error {
+			var err error
+			if len(n.TableRoutes) > 0 {
+				if err = delTableRoutes(args.IfName, n.TableRoutes); err != nil {
+					return err
+				}
+			}
+			if n.DelAction == "down" {
+				ipnets, err = downLinkByNameAddr(args.IfName)
+			} else {
+				ipnets, err = ip.DelLinkByNameAddr(args.IfName)
+			}
+			if err != nil && err == ip.ErrLinkNotFound {
+				return nil
+			}
+			return err
+		})
+
+		if err != nil {
+			return err
+		}
+	}
 
-	isLayer3 := n.IPAM.Type != ""
+	if isLayer3 && len(ipnets) == 0 {
+		// The addresses only ever lived in the VM, or the container
+		// interface or its netns is gone already, but the chains and
+		// routes of the container are not
+		if ipnets, err = prevResultAddrs(n); err != nil {
+			return err
+		}
+	}
 
 	if isLayer3 {
-		if err := ipam.ExecDel(n.IPAM.Type, args.StdinData); err != nil {
+		if err := teardownFirewall(n, args.ContainerID, ipnets); err != nil {
 			return err
 		}
 	}
 
-	if args.Netns == "" {
-		return nil
+	if isLayer3 && n.HostRoutes {
+		if err := delHostRoutes(n.BrName, ipnets); err != nil {
+			return err
+		}
 	}
 
-	// There is a netns so try to clean up. Delete can be called multiple times
-	// so don't return an error if the device is already removed.
-	// If the device isn't there then don't try to clean up IP masq either.
-	var ipnets []*net.IPNet
-	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-		var err error
-		ipnets, err = ip.DelLinkByNameAddr(args.IfName)
-		if err != nil && err == ip.ErrLinkNotFound {
-			return nil
+	return releaseVXLAN(n)
+}
+
+// downLinkByNameAddr is ip.DelLinkByNameAddr, except that it only removes
+// the addresses of ifName and sets it down.
+func downLinkByNameAddr(ifName string) ([]*net.IPNet, error) {
+	iface, err := netlink.LinkByName(ifName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil, ip.ErrLinkNotFound
 		}
-		return err
-	})
+		return nil, fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
 
+	addrs, err := netlink.AddrList(iface, netlink.FAMILY_ALL)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to get IP addresses for %q: %v", ifName, err)
 	}
 
-	if isLayer3 && n.IPMasq {
-		chain := utils.FormatChainName(n.Name, args.ContainerID)
-		comment := utils.FormatComment(n.Name, args.ContainerID)
-		for _, ipn := range ipnets {
-			if err := ip.TeardownIPMasq(ipn, chain, comment); err != nil {
-				return err
-			}
+	if err = netlink.LinkSetDown(iface); err != nil {
+		return nil, fmt.Errorf("failed to set %q down: %v", ifName, err)
+	}
+
+	out := []*net.IPNet{}
+	for _, addr := range addrs {
+		if !addr.IP.IsGlobalUnicast() {
+			continue
 		}
+		if err := netlink.AddrDel(iface, &addr); err != nil {
+			return nil, fmt.Errorf("failed to remove %s from %q: %v", addr.IPNet, ifName, err)
+		}
+		out = append(out, addr.IPNet)
+	}
+	return out, nil
+}
+
+// prevResultAddrs returns the container addresses of the previous result,
+// if the runtime passed one.
+func prevResultAddrs(n *NetConf) ([]*net.IPNet, error) {
+	if n.RawPrevResult == nil {
+		return nil, nil
+	}
+	if err := version.ParsePrevResult(&n.NetConf); err != nil {
+		return nil, err
+	}
+	result, err := current.NewResultFromResult(n.PrevResult)
+	if err != nil {
+		return nil, err
 	}
+	return resultAddrs(result), nil
+}
 
-	return err
+// resultAddrs returns the addresses of result.
+func resultAddrs(result *current.Result) []*net.IPNet {
+	var ipnets []*net.IPNet
+	for _, ipc := range result.IPs {
+		ipn := ipc.Address
+		ipnets = append(ipnets, &ipn)
+	}
+	return ipnets
 }
 
 func main() {
@@ -819,16 +2150,18 @@ func cmdCheck(args *skel.CmdArgs) error {
 	if err != nil {
 		return err
 	}
-	netns, err := ns.GetNS(args.Netns)
+	netns, err := openNetNS(args.Netns, n.NetnsRetry)
 	if err != nil {
 		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
 	}
 	defer netns.Close()
 
 	// run the IPAM plugin and get back the config to apply
-	err = ipam.ExecCheck(n.IPAM.Type, args.StdinData)
-	if err != nil {
-		return err
+	if n.IPAMWebhook == nil {
+		err = ipamCheck(n, args.StdinData)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Parse previous result.
@@ -867,6 +2200,11 @@ func cmdCheck(args *skel.CmdArgs) error {
 		return err
 	}
 
+	// There is nothing of ours inside the sandbox of a VM
+	if n.Tap != nil {
+		return checkTap(n.Tap, args.ContainerID, brCNI)
+	}
+
 	// The namespace must be the same as what was configured
 	if args.Netns != contMap.Sandbox {
 		return fmt.Errorf("Sandbox in prevResult %s doesn't match configured netns: %s",
@@ -15,23 +15,34 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
 	"github.com/containernetworking/cni/pkg/types/040"
 	"github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ipam"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/testutils"
+	"github.com/containernetworking/plugins/pkg/utils"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
 
 	"github.com/vishvananda/netlink"
 
@@ -1592,6 +1603,8 @@ var _ = Describe("bridge Operations", func() {
 
 		// Do not emulate an error, each test will set this if needed
 		debugPostIPAMError = nil
+		debugFirewallError = nil
+		debugSetupVethError = nil
 	})
 
 	AfterEach(func() {
@@ -1898,13 +1911,13 @@ var _ = Describe("bridge Operations", func() {
 					Expect(conf.ForceAddress).To(Equal(false))
 
 					// Set first address on bridge
-					err = ensureAddr(bridge, family, &gwnFirst, conf.ForceAddress)
+					err = ensureAddr(bridge, family, &gwnFirst, conf.ForceAddress, false, nil)
 					Expect(err).NotTo(HaveOccurred())
 					checkBridgeIPs(tc.gwCIDRFirst, "")
 
 					// Attempt to set the second address on the bridge
 					// with ForceAddress set to false.
-					err = ensureAddr(bridge, family, &gwnSecond, false)
+					err = ensureAddr(bridge, family, &gwnSecond, false, false, nil)
 					if family == netlink.FAMILY_V4 || subnetsOverlap {
 						// IPv4 or overlapping IPv6 subnets:
 						// Expect an error, and address should remain the same
@@ -1920,7 +1933,7 @@ var _ = Describe("bridge Operations", func() {
 
 					// Set the second address on the bridge
 					// with ForceAddress set to true.
-					err = ensureAddr(bridge, family, &gwnSecond, true)
+					err = ensureAddr(bridge, family, &gwnSecond, true, false, nil)
 					Expect(err).NotTo(HaveOccurred())
 					if family == netlink.FAMILY_V4 || subnetsOverlap {
 						// IPv4 or overlapping IPv6 subnets:
@@ -2210,4 +2223,4068 @@ var _ = Describe("bridge Operations", func() {
 			}
 		}
 	})
+
+	It("enslaves a bond master to the bridge", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := netlink.LinkAdd(&netlink.Bond{
+				LinkAttrs: netlink.LinkAttrs{Name: "bond0"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			conf := testCase{cniVersion: "1.0.0"}.netConf()
+			conf.Master = "bond0"
+
+			bridge, _, err := setupBridge(conf)
+			Expect(err).NotTo(HaveOccurred())
+
+			bond, err := netlink.LinkByName("bond0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(bond.Attrs().MasterIndex).To(Equal(bridge.Attrs().Index))
+
+			// A second setup must leave the enslaved bond alone
+			_, _, err = setupBridge(conf)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects a master that is not a bond or team", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			err := netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: "veth0"},
+				PeerName:  "veth1",
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			conf := testCase{cniVersion: "1.0.0"}.netConf()
+			conf.Master = "veth0"
+			_, _, err = setupBridge(conf)
+			Expect(err).To(MatchError(`master "veth0" has link type veth, must be a bond or team`))
+
+			conf.Master = "missing0"
+			_, _, err = setupBridge(conf)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix(`failed to lookup master "missing0"`))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("installs and removes a firewall mark from CNI_ARGS", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			tc := testCase{
+				cniVersion: "1.0.0",
+				subnet:     "10.1.2.0/24",
+				envArgs:    "MARK=0x2a",
+			}
+
+			args := tc.createCmdArgs(originalNS, dataDir)
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).Should(HaveLen(1))
+
+			ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+			Expect(err).NotTo(HaveOccurred())
+
+			chain := markChain("testConfig", args.ContainerID)
+			rules, err := ipt.List("mangle", chain.name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).Should(ContainElement(ContainSubstring("--set-xmark 0x2a/0xffffffff")))
+
+			rules, err = ipt.List("mangle", "PREROUTING")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).Should(ContainElement(ContainSubstring(result.IPs[0].Address.IP.String())))
+
+			err = testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			exists, err := utils.ChainExists(ipt, "mangle", chain.name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects a firewall mark that is not a uint32", func() {
+		tc := testCase{cniVersion: "1.0.0", subnet: "10.1.2.0/24"}
+		for _, mark := range []string{"-1", "0x100000000", "foo"} {
+			_, _, err := loadNetConf([]byte(tc.netConfJSON("")), "MARK="+mark)
+			Expect(err).To(MatchError(fmt.Sprintf("invalid mark %q (must be a valid uint32)", mark)))
+		}
+
+		n, _, err := loadNetConf([]byte(tc.netConfJSON("")), "MARK=4294967295")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*n.mark).To(Equal(uint32(4294967295)))
+	})
+
+	It("raises but never lowers the neighbor GC thresholds", func() {
+		values := map[string]string{
+			"net/ipv4/neigh/default/gc_thresh1": "128",
+			"net/ipv4/neigh/default/gc_thresh2": "512",
+			"net/ipv4/neigh/default/gc_thresh3": "1024",
+			"net/ipv6/neigh/default/gc_thresh1": "128",
+			"net/ipv6/neigh/default/gc_thresh2": "8192",
+			"net/ipv6/neigh/default/gc_thresh3": "1024",
+		}
+		neighSysctl = func(name string, params ...string) (string, error) {
+			val, ok := values[name]
+			if !ok {
+				return "", fmt.Errorf("unexpected sysctl %s", name)
+			}
+			if len(params) == 1 {
+				values[name] = params[0]
+				val = params[0]
+			}
+			return val, nil
+		}
+		defer func() { neighSysctl = sysctl.Sysctl }()
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			conf := testCase{cniVersion: "1.0.0"}.netConf()
+			conf.NeighGCThresh = &NeighGCThresh{Thresh1: 1024, Thresh2: 4096, Thresh3: 8192}
+			_, _, err := setupBridge(conf)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(values).To(Equal(map[string]string{
+			"net/ipv4/neigh/default/gc_thresh1": "1024",
+			"net/ipv4/neigh/default/gc_thresh2": "4096",
+			"net/ipv4/neigh/default/gc_thresh3": "8192",
+			"net/ipv6/neigh/default/gc_thresh1": "1024",
+			"net/ipv6/neigh/default/gc_thresh2": "8192",
+			"net/ipv6/neigh/default/gc_thresh3": "8192",
+		}))
+	})
+
+	It("leaves the bridge without any address with disableBridgeIP", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"disableBridgeIP": true,
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24"
+			}
+		}`, BRNAME, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(1))
+			Expect(result.IPs[0].Gateway).To(BeNil())
+
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			addrs, err := netlink.AddrList(br, netlink.FAMILY_ALL)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(BeEmpty())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(HaveLen(1))
+
+			routes, err := netlink.RouteList(link, netlink.FAMILY_ALL)
+			Expect(err).NotTo(HaveOccurred())
+			for _, route := range routes {
+				Expect(route.Gw).To(BeNil())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects disableBridgeIP with a gateway", func() {
+		tc := testCase{cniVersion: "1.0.0", subnet: "10.1.2.0/24"}
+		conf := strings.Replace(tc.netConfJSON(dataDir), `"isDefaultGateway": true`, `"isDefaultGateway": true, "disableBridgeIP": true`, 1)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(MatchError("disableBridgeIP cannot be combined with isGateway or isDefaultGateway"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("installs a multipath default route for ecmpGateways", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"ecmpGateways": [
+				{"gw": "10.1.2.1"},
+				{"gw": "10.1.2.254", "weight": 3}
+			],
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24"
+			}
+		}`, BRNAME, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Routes).To(HaveLen(2))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: nil}, netlink.RT_FILTER_DST)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(HaveLen(1))
+
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+
+			nexthops := routes[0].MultiPath
+			Expect(nexthops).To(HaveLen(2))
+			Expect(nexthops[0].Gw.String()).To(Equal("10.1.2.1"))
+			Expect(nexthops[0].Hops).To(Equal(0))
+			Expect(nexthops[0].LinkIndex).To(Equal(link.Attrs().Index))
+			Expect(nexthops[1].Gw.String()).To(Equal("10.1.2.254"))
+			Expect(nexthops[1].Hops).To(Equal(2))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects ecmpGateways that are not on-link", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"ecmpGateways": [{"gw": "10.1.2.1"}, {"gw": "10.9.9.1"}],
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24"
+			}
+		}`, BRNAME, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(MatchError("ECMP gateway 10.9.9.1 is not on-link for any container address"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("programs the PVID and trunk vlans on a vlan-aware bridge", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"vlanAware": true,
+			"vlan": 100,
+			"vlanTrunk": [200, 300],
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24"
+			}
+		}`, BRNAME, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			link, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*link.(*netlink.Bridge).VlanFiltering).To(BeTrue())
+
+			hostVeth, err := netlink.LinkByName(result.Interfaces[1].Name)
+			Expect(err).NotTo(HaveOccurred())
+			interfaceMap, err := netlink.BridgeVlanList()
+			Expect(err).NotTo(HaveOccurred())
+			vlans, isExist := interfaceMap[int32(hostVeth.Attrs().Index)]
+			Expect(isExist).To(BeTrue())
+
+			flags := map[uint16]uint16{}
+			for _, v := range vlans {
+				flags[v.Vid] = v.Flags
+			}
+			Expect(flags).To(HaveLen(3))
+			Expect(flags[100]).To(Equal(uint16(nl.BRIDGE_VLAN_INFO_PVID | nl.BRIDGE_VLAN_INFO_UNTAGGED)))
+			Expect(flags[200]).To(BeZero())
+			Expect(flags[300]).To(BeZero())
+
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+
+			interfaceMap, err = netlink.BridgeVlanList()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(interfaceMap).NotTo(HaveKey(int32(hostVeth.Attrs().Index)))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("leaves a trunk port without an untagged vlan", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"vlanAware": true,
+			"vlanPortMode": "trunk",
+			"vlanTrunk": [200, 300]
+		}`, BRNAME)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			hostVeth, err := netlink.LinkByName(result.Interfaces[1].Name)
+			Expect(err).NotTo(HaveOccurred())
+			interfaceMap, err := netlink.BridgeVlanList()
+			Expect(err).NotTo(HaveOccurred())
+
+			// the bridge's default PVID is gone as well
+			flags := map[uint16]uint16{}
+			for _, v := range interfaceMap[int32(hostVeth.Attrs().Index)] {
+				flags[v.Vid] = v.Flags
+			}
+			Expect(flags).To(Equal(map[uint16]uint16{200: 0, 300: 0}))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects invalid vlanTrunk configurations", func() {
+		for _, tc := range []struct {
+			extra  string
+			expErr string
+		}{
+			{`"vlanTrunk": [200]`, "vlanTrunk requires vlanAware to be set"},
+			{`"vlanAware": true, "vlanTrunk": [0]`, "invalid trunk VLAN ID 0 (must be between 1 and 4094)"},
+			{`"vlanAware": true, "vlanTrunk": [4095]`, "invalid trunk VLAN ID 4095 (must be between 1 and 4094)"},
+			{`"vlanAware": true, "vlan": 100, "vlanTrunk": [100]`, "trunk VLAN ID 100 is already the port's PVID"},
+			{`"vlanAware": true, "vlanPortMode": "access", "vlanTrunk": [200]`, "an access port needs exactly one untagged VLAN, set vlan"},
+			{`"vlanAware": true, "vlanPortMode": "trunk", "vlan": 100`, "a trunk port has no untagged VLAN, move vlan 100 to vlanTrunk"},
+			{`"vlanAware": true, "vlanPortMode": "hybrid"`, `invalid vlanPortMode "hybrid" (must be access or trunk)`},
+			{`"vlan": 100, "vlanPortMode": "access"`, "vlanPortMode requires vlanAware to be set"},
+		} {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "testConfig",
+				"type": "bridge",
+				"bridge": "%s",
+				%s
+			}`, BRNAME, tc.extra)
+			_, _, err := loadNetConf([]byte(conf), "")
+			Expect(err).To(MatchError(tc.expErr))
+		}
+	})
+
+	It("bridges pods over a shared VXLAN device to the remote VTEPs", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"vxlan": {
+				"vni": 42,
+				"remotes": ["192.0.2.10", "192.0.2.11"]
+			},
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24"
+			}
+		}`, BRNAME, dataDir)
+
+		secondNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer func() {
+			Expect(secondNS.Close()).To(Succeed())
+			Expect(testutils.UnmountNS(secondNS)).To(Succeed())
+		}()
+
+		args1 := &skel.CmdArgs{
+			ContainerID: "dummy1",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+		args2 := &skel.CmdArgs{
+			ContainerID: "dummy2",
+			Netns:       secondNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			for _, args := range []*skel.CmdArgs{args1, args2} {
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			link, err := netlink.LinkByName("vxlan42")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link).To(BeAssignableToTypeOf(&netlink.Vxlan{}))
+			Expect(link.(*netlink.Vxlan).VxlanId).To(Equal(42))
+			Expect(link.(*netlink.Vxlan).Port).To(Equal(4789))
+			Expect(link.Attrs().MasterIndex).To(Equal(br.Attrs().Index))
+
+			fdb, err := netlink.NeighList(link.Attrs().Index, syscall.AF_BRIDGE)
+			Expect(err).NotTo(HaveOccurred())
+			var remotes []string
+			for _, entry := range fdb {
+				if entry.HardwareAddr.String() == "00:00:00:00:00:00" {
+					remotes = append(remotes, entry.IP.String())
+				}
+			}
+			Expect(remotes).To(ConsistOf("192.0.2.10", "192.0.2.11"))
+
+			// the device stays as long as a pod uses it
+			Expect(testutils.CmdDelWithArgs(args1, func() error {
+				return cmdDel(args1)
+			})).To(Succeed())
+			_, err = netlink.LinkByName("vxlan42")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(testutils.CmdDelWithArgs(args2, func() error {
+				return cmdDel(args2)
+			})).To(Succeed())
+			_, err = netlink.LinkByName("vxlan42")
+			Expect(err).To(BeAssignableToTypeOf(netlink.LinkNotFoundError{}))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("releases the VXLAN device from a VLAN gateway bridge", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"isGateway": true,
+			"vlan": 100,
+			"vxlan": {
+				"vni": 42,
+				"remotes": ["192.0.2.10"]
+			},
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24"
+			}
+		}`, BRNAME, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = netlink.LinkByName(BRNAMEVLAN)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = netlink.LinkByName("vxlan42")
+			Expect(err).NotTo(HaveOccurred())
+
+			// the gateway veth stays on the bridge but is no pod
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+			_, err = netlink.LinkByName(BRNAMEVLAN)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = netlink.LinkByName("vxlan42")
+			Expect(err).To(BeAssignableToTypeOf(netlink.LinkNotFoundError{}))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("does not count VLAN gateways as users of the VXLAN device", func() {
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			n := testCase{cniVersion: "1.0.0"}.netConf()
+			n.VXLAN = &VXLANConf{VNI: 42, Remotes: []net.IP{net.ParseIP("192.0.2.10")}}
+			br, _, err := setupBridge(n)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = ensureVXLAN(br, n.VXLAN)
+			Expect(err).NotTo(HaveOccurred())
+
+			// a gateway as ensureVlanInterface leaves it, and a pod
+			for _, pair := range [][2]string{{"vethgw0", BRNAMEVLAN}, {"vethpod0", "eth9"}} {
+				Expect(netlink.LinkAdd(&netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{Name: pair[0]},
+					PeerName:  pair[1],
+				})).To(Succeed())
+				link, err := netlink.LinkByName(pair[0])
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkSetMaster(link, br)).To(Succeed())
+			}
+			pod, err := netlink.LinkByName("eth9")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetNsFd(pod, int(targetNS.Fd()))).To(Succeed())
+
+			Expect(releaseVXLAN(n)).To(Succeed())
+			_, err = netlink.LinkByName("vxlan42")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(netlink.LinkDel(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "vethpod0"}})).To(Succeed())
+			Expect(releaseVXLAN(n)).To(Succeed())
+			_, err = netlink.LinkByName("vxlan42")
+			Expect(err).To(BeAssignableToTypeOf(netlink.LinkNotFoundError{}))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects invalid VXLAN configurations", func() {
+		for _, tc := range []struct {
+			vxlan  string
+			expErr string
+		}{
+			{`{"vni": 0, "remotes": ["192.0.2.10"]}`, "invalid VXLAN VNI 0 (must be between 1 and 16777215)"},
+			{`{"vni": 16777216, "remotes": ["192.0.2.10"]}`, "invalid VXLAN VNI 16777216 (must be between 1 and 16777215)"},
+			{`{"vni": 42}`, "VXLAN requires at least one remote VTEP"},
+			{`{"vni": 42, "remotes": ["192.0.2.10"], "port": 70000}`, "invalid VXLAN port 70000"},
+		} {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "testConfig",
+				"type": "bridge",
+				"bridge": "%s",
+				"vxlan": %s
+			}`, BRNAME, tc.vxlan)
+			_, _, err := loadNetConf([]byte(conf), "")
+			Expect(err).To(MatchError(tc.expErr))
+		}
+	})
+
+	It("generates container MACs with the configured macPrefix", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"macPrefix": "0a:58",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24"
+			}
+		}`, BRNAME, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		var result *types100.Result
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err = types100.GetResult(r)
+			return err
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Interfaces[2].Mac).To(HavePrefix("0a:58:"))
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().HardwareAddr.String()).To(Equal(result.Interfaces[2].Mac))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects invalid macPrefix values", func() {
+		for _, tc := range []struct {
+			prefix string
+			expErr string
+		}{
+			{"0a:58:00:01", `macPrefix "0a:58:00:01" is too long (at most 3 bytes)`},
+			{"0a:5", `invalid macPrefix "0a:5"`},
+			{"zz", `invalid macPrefix "zz"`},
+			{"00:50:56", `macPrefix "00:50:56" is not a locally administered unicast prefix`},
+			{"03:00", `macPrefix "03:00" is not a locally administered unicast prefix`},
+		} {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "testConfig",
+				"type": "bridge",
+				"bridge": "%s",
+				"macPrefix": "%s"
+			}`, BRNAME, tc.prefix)
+			_, _, err := loadNetConf([]byte(conf), "")
+			Expect(err).To(MatchError(tc.expErr))
+		}
+	})
+
+	It("bridges a tap device with the requested owner instead of a veth", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"tap": {"owner": 107, "group": 108},
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24"
+			}
+		}`, BRNAME, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "0123456789abcdef",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(result.Interfaces).To(HaveLen(2))
+			Expect(result.Interfaces[1].Name).To(Equal("tap0123456789ab"))
+			Expect(result.Interfaces[1].Sandbox).To(BeEmpty())
+			Expect(result.IPs).To(HaveLen(1))
+			Expect(*result.IPs[0].Interface).To(Equal(1))
+
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			link, err := netlink.LinkByName("tap0123456789ab")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link).To(BeAssignableToTypeOf(&netlink.Tuntap{}))
+			tap := link.(*netlink.Tuntap)
+			Expect(tap.Mode).To(Equal(netlink.TUNTAP_MODE_TAP))
+			Expect(tap.Owner).To(Equal(uint32(107)))
+			Expect(tap.Group).To(Equal(uint32(108)))
+			Expect(tap.MasterIndex).To(Equal(br.Attrs().Index))
+
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+			_, err = netlink.LinkByName("tap0123456789ab")
+			Expect(err).To(BeAssignableToTypeOf(netlink.LinkNotFoundError{}))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// the container namespace is left untouched
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, err := netlink.LinkByName(IFNAME)
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("attaches an existing tap and only detaches it on DEL", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"tap": {"name": "vmtap0", "owner": 107}
+		}`, BRNAME)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			err := netlink.LinkAdd(&netlink.Tuntap{
+				LinkAttrs: netlink.LinkAttrs{Name: "vmtap0"},
+				Mode:      netlink.TUNTAP_MODE_TAP,
+				Owner:     107,
+				Group:     108,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			defer netlink.LinkDel(&netlink.Tuntap{LinkAttrs: netlink.LinkAttrs{Name: "vmtap0"}})
+
+			_, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			link, err := netlink.LinkByName("vmtap0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().MasterIndex).To(Equal(br.Attrs().Index))
+
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+			link, err = netlink.LinkByName("vmtap0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().MasterIndex).To(BeZero())
+
+			// a tap with a different owner is refused
+			args.StdinData = []byte(strings.Replace(conf, `"owner": 107`, `"owner": 200`, 1))
+			_, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(MatchError(`tap "vmtap0" is owned by uid 107, not 200`))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects invalid tap names", func() {
+		for _, tc := range []struct {
+			name   string
+			expErr string
+		}{
+			{"tap-name-too-long", `invalid tap name: "tap-name-too-long" is longer than 15 characters`},
+			{"..", `invalid tap name: ".." is not a valid interface name`},
+			{"tap/0", `invalid tap name: "tap/0" contains an invalid character`},
+		} {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "testConfig",
+				"type": "bridge",
+				"bridge": "%s",
+				"tap": {"name": "%s"}
+			}`, BRNAME, tc.name)
+			_, _, err := loadNetConf([]byte(conf), "")
+			Expect(err).To(MatchError(tc.expErr))
+		}
+	})
+
+	It("installs and removes DSCP marking of pod egress", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"dscp": 46,
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24"
+			}
+		}`, BRNAME, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+			Expect(err).NotTo(HaveOccurred())
+
+			chain := dscpChain("testConfig", args.ContainerID)
+			rules, err := ipt.List("mangle", chain.name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).Should(ContainElement(ContainSubstring("--set-dscp 0x2e")))
+
+			rules, err = ipt.List("mangle", "PREROUTING")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).Should(ContainElement(ContainSubstring(result.IPs[0].Address.IP.String())))
+
+			err = testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			exists, err := utils.ChainExists(ipt, "mangle", chain.name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("removes the chains of the container on DEL without a netns", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"ipMasq": true,
+			"dscp": 46,
+			"conntrackZone": 7,
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24"
+			}
+		}`, BRNAME, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			Args:        "MARK=0x2a",
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+			Expect(err).NotTo(HaveOccurred())
+			chains := map[string]string{
+				utils.FormatChainName("testConfig", args.ContainerID): "nat",
+				markChain("testConfig", args.ContainerID).name:        "mangle",
+				dscpChain("testConfig", args.ContainerID).name:        "mangle",
+				ctZoneChain("testConfig", args.ContainerID).name:      "raw",
+			}
+			for chain, table := range chains {
+				exists, err := utils.ChainExists(ipt, table, chain)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exists).To(BeTrue())
+			}
+
+			// the runtime lost the netns, only the prevResult knows the
+			// addresses
+			var delConf map[string]interface{}
+			Expect(json.Unmarshal([]byte(conf), &delConf)).To(Succeed())
+			delConf["prevResult"] = result
+			delArgs := *args
+			delArgs.Netns = ""
+			delArgs.StdinData, err = json.Marshal(delConf)
+			Expect(err).NotTo(HaveOccurred())
+			err = testutils.CmdDelWithArgs(&delArgs, func() error {
+				return cmdDel(&delArgs)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			for chain, table := range chains {
+				exists, err := utils.ChainExists(ipt, table, chain)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exists).To(BeFalse())
+			}
+			rules, err := ipt.List("mangle", "PREROUTING")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).ShouldNot(ContainElement(ContainSubstring(result.IPs[0].Address.IP.String())))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects DSCP values outside 0-63", func() {
+		for _, dscp := range []int{-1, 64} {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "testConfig",
+				"type": "bridge",
+				"bridge": "%s",
+				"dscp": %d,
+				"ipam": {"type": "host-local", "subnet": "10.1.2.0/24"}
+			}`, BRNAME, dscp)
+			_, _, err := loadNetConf([]byte(conf), "")
+			Expect(err).To(MatchError(fmt.Sprintf("invalid DSCP value %d (must be between 0 and 63)", dscp)))
+		}
+		Expect(dscpRules(0)).To(Equal([][]string{{"-j", "DSCP", "--set-dscp", "0x00"}}))
+	})
+
+	It("computes RPS masks and writes them to every receive queue", func() {
+		for _, tc := range []struct {
+			list string
+			ncpu int
+			mask string
+		}{
+			{"0", 4, "1"},
+			{"0-3", 4, "f"},
+			{"1,3", 4, "a"},
+			{"0-1,32", 40, "1,00000003"},
+			{"63", 64, "80000000,00000000"},
+		} {
+			mask, err := rpsMask(tc.list, tc.ncpu)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mask).To(Equal(tc.mask))
+		}
+
+		root, err := ioutil.TempDir("", "sys_class_net")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(root)
+		for _, q := range []string{"rx-0", "rx-1", "tx-0"} {
+			dir := filepath.Join(root, "veth0", "queues", q)
+			Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "rps_cpus"), []byte("0"), 0644)).To(Succeed())
+		}
+		sysClassNet = root
+		defer func() { sysClassNet = "/sys/class/net" }()
+
+		Expect(setRPSMask("veth0", "a")).To(Succeed())
+		for q, exp := range map[string]string{"rx-0": "a", "rx-1": "a", "tx-0": "0"} {
+			data, err := ioutil.ReadFile(filepath.Join(root, "veth0", "queues", q, "rps_cpus"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(data)).To(Equal(exp))
+		}
+		Expect(setRPSMask("veth1", "a")).To(MatchError(`no receive queues found for "veth1"`))
+	})
+
+	It("counts the CPUs of the node, not those the plugin may run on", func() {
+		dir, err := ioutil.TempDir("", "sys_cpu")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		sysCPUPossible = filepath.Join(dir, "possible")
+		defer func() { sysCPUPossible = "/sys/devices/system/cpu/possible" }()
+
+		for list, exp := range map[string]int{"0\n": 1, "0-63\n": 64, "0,2-5\n": 6} {
+			Expect(ioutil.WriteFile(sysCPUPossible, []byte(list), 0644)).To(Succeed())
+			Expect(hostCPUs()).To(Equal(exp))
+		}
+
+		Expect(ioutil.WriteFile(sysCPUPossible, []byte("\n"), 0644)).To(Succeed())
+		Expect(hostCPUs()).To(Equal(runtime.NumCPU()))
+		Expect(os.Remove(sysCPUPossible)).To(Succeed())
+		Expect(hostCPUs()).To(Equal(runtime.NumCPU()))
+	})
+
+	It("validates rpsCPUs against the node's CPUs", func() {
+		numCPU = func() int { return 4 }
+		defer func() { numCPU = hostCPUs }()
+
+		for _, tc := range []struct {
+			list   string
+			expErr string
+		}{
+			{"0-4", `CPU 4 in "0-4" does not exist, the node has 4 CPUs`},
+			{"3-1", `invalid CPU list "3-1"`},
+			{"a", `invalid CPU list "a"`},
+			{"-1", `invalid CPU list "-1"`},
+		} {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "testConfig",
+				"type": "bridge",
+				"bridge": "%s",
+				"rpsCPUs": "%s"
+			}`, BRNAME, tc.list)
+			_, _, err := loadNetConf([]byte(conf), "")
+			Expect(err).To(MatchError(tc.expErr))
+		}
+
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"rpsCPUs": "2-3"
+		}`, BRNAME)
+		n, _, err := loadNetConf([]byte(conf), "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n.rpsMask).To(Equal("c"))
+	})
+
+	It("derives a stable host veth name from the pod identity", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"stableHostVethName": true
+		}`, BRNAME)
+
+		addDel := func(containerID, pod string) string {
+			args := &skel.CmdArgs{
+				ContainerID: containerID,
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(conf),
+				Args:        "K8S_POD_NAMESPACE=default;K8S_POD_NAME=" + pod,
+			}
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+			return result.Interfaces[1].Name
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			name := addDel("container1", "web-0")
+			Expect(name).To(HavePrefix("veth"))
+			Expect(name).To(HaveLen(15))
+
+			// a restarted pod gets a new container ID but the same name
+			Expect(addDel("container2", "web-0")).To(Equal(name))
+			Expect(addDel("container3", "web-1")).NotTo(Equal(name))
+
+			// a name taken by another device falls back to the next
+			// candidate, which is just as stable
+			err := netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: name},
+				PeerName:  "collision0",
+			})
+			Expect(err).NotTo(HaveOccurred())
+			fallback := addDel("container4", "web-0")
+			Expect(fallback).NotTo(Equal(name))
+			Expect(addDel("container5", "web-0")).To(Equal(fallback))
+			Expect(netlink.LinkDel(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}})).To(Succeed())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("reports every configuration problem at once", func() {
+		for _, tc := range []struct {
+			extra  string
+			expErr string
+		}{
+			{
+				`"mtu": -1`,
+				"invalid MTU -1 (must not be negative)",
+			},
+			{
+				`"vlan": 5000, "hairpinMode": true, "promiscMode": true, "dscp": 64`,
+				"invalid configuration: invalid VLAN ID 5000 (must be between 0 and 4094); " +
+					"cannot set hairpin mode and promiscuous mode at the same time.; " +
+					"invalid DSCP value 64 (must be between 0 and 63); " +
+					"DSCP marking requires IPAM to be configured",
+			},
+			{
+				`"isDefaultGateway": true, "disableBridgeIP": true, "ecmpGateways": [{"gw": "10.1.2.1", "weight": 300}, {}]`,
+				"invalid configuration: invalid weight 300 for ECMP gateway 10.1.2.1 (must be between 1 and 256); " +
+					"invalid ecmpGateways entry 1: missing gw; " +
+					"ecmpGateways cannot be combined with isDefaultGateway; " +
+					"disableBridgeIP cannot be combined with isGateway or isDefaultGateway; " +
+					"disableBridgeIP requires IPAM to provide the pod addresses",
+			},
+			{
+				`"macPrefix": "01:00", "tap": {"name": "tap/0"}, "vxlan": {"vni": 0}`,
+				`invalid configuration: macPrefix "01:00" is not a locally administered unicast prefix; ` +
+					"invalid VXLAN VNI 0 (must be between 1 and 16777215); " +
+					`invalid tap name: "tap/0" contains an invalid character`,
+			},
+			{
+				// keys match case insensitively, like encoding/json does
+				`"IsGateway": true, "bridgeName": "br1", "mtu": -1, "hairpin": true`,
+				`invalid configuration: unknown field "bridgeName"; unknown field "hairpin"; ` +
+					"invalid MTU -1 (must not be negative)",
+			},
+		} {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "testConfig",
+				"type": "bridge",
+				"bridge": "%s",
+				%s
+			}`, BRNAME, tc.extra)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(conf),
+			}
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).To(MatchError(tc.expErr))
+
+				// nothing was set up before the configuration was rejected
+				_, err = netlink.LinkByName(BRNAME)
+				Expect(err).To(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+	})
+
+	It("cleans up on DEL after a configuration that no longer validates", func() {
+		numCPU = func() int { return 2 }
+		defer func() { numCPU = hostCPUs }()
+
+		conf := `{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			%s
+			"ipam": {"type": "host-local", "subnet": "10.1.2.0/24", "dataDir": "%s"}
+		}`
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(fmt.Sprintf(conf, BRNAME, "", dataDir)),
+		}
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(filepath.Join(dataDir, "testConfig", "10.1.2.2")).To(BeAnExistingFile())
+
+			// the configuration now asks for CPUs the node does not have,
+			// and has picked up a key from a newer version of the plugin
+			args.StdinData = []byte(fmt.Sprintf(conf, BRNAME, `"rpsCPUs": "2-3", "rpsFlowEntries": 4096,`, dataDir))
+			err = testutils.CmdCheckWithArgs(args, func() error {
+				return cmdCheck(args)
+			})
+			Expect(err).To(MatchError(`invalid configuration: unknown field "rpsFlowEntries"; CPU 3 in "2-3" does not exist, the node has 2 CPUs`))
+
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+			Expect(filepath.Join(dataDir, "testConfig", "10.1.2.2")).NotTo(BeAnExistingFile())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, err := netlink.LinkByName(IFNAME)
+			Expect(err).To(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("sets the TX queue length on both ends of the veth", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"txQueueLen": 4000
+		}`, BRNAME)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		var hostVethName string
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			hostVethName = result.Interfaces[1].Name
+
+			link, err := netlink.LinkByName(hostVethName)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().TxQLen).To(Equal(4000))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().TxQLen).To(Equal(4000))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		args.StdinData = []byte(strings.Replace(conf, "4000", "-1", 1))
+		_, _, err = loadNetConf(args.StdinData, "")
+		Expect(err).To(MatchError("invalid txQueueLen -1 (must not be negative)"))
+	})
+
+	It("retries transient netlink failures", func() {
+		var slept []time.Duration
+		origLinkAdd, origSleep := linkAdd, sleep
+		defer func() { linkAdd, sleep = origLinkAdd, origSleep }()
+		sleep = func(d time.Duration) { slept = append(slept, d) }
+
+		failures := 2
+		linkAdd = func(l netlink.Link) error {
+			if failures > 0 {
+				failures--
+				return syscall.EBUSY
+			}
+			return origLinkAdd(l)
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			br, err := ensureBridge(BRNAME, 0, false, false, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(br.Attrs().Name).To(Equal(BRNAME))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(failures).To(Equal(0))
+		Expect(slept).To(Equal([]time.Duration{10 * time.Millisecond, 20 * time.Millisecond}))
+
+		// the configured attempts bound the retries and the backoff is capped
+		slept = nil
+		calls := 0
+		r := &RetryConf{Attempts: 4, InitialBackoffMs: 5, MaxBackoffMs: 8}
+		err = r.retry(func() error {
+			calls++
+			return syscall.ENOENT
+		})
+		Expect(err).To(Equal(syscall.ENOENT))
+		Expect(calls).To(Equal(4))
+		Expect(slept).To(Equal([]time.Duration{5 * time.Millisecond, 8 * time.Millisecond, 8 * time.Millisecond}))
+
+		// other errors are returned right away
+		calls = 0
+		err = r.retry(func() error {
+			calls++
+			return syscall.EPERM
+		})
+		Expect(err).To(Equal(syscall.EPERM))
+		Expect(calls).To(Equal(1))
+
+		// one attempt disables retries
+		calls = 0
+		r = &RetryConf{Attempts: 1}
+		Expect(r.retry(func() error {
+			calls++
+			return syscall.EBUSY
+		})).To(Equal(syscall.EBUSY))
+		Expect(calls).To(Equal(1))
+	})
+
+	It("rejects an invalid netlinkRetry", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"netlinkRetry": {"initialBackoffMs": 100, "maxBackoffMs": 50}
+		}`, BRNAME)
+		_, _, err := loadNetConf([]byte(conf), "")
+		Expect(err).To(MatchError("invalid netlinkRetry backoff: maxBackoffMs 50 is less than initialBackoffMs 100"))
+	})
+
+	It("takes the addresses from the ipamWebhook", func() {
+		var requests []webhookRequest
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			var req webhookRequest
+			Expect(json.NewDecoder(r.Body).Decode(&req)).To(Succeed())
+			requests = append(requests, req)
+			if req.Command == "ADD" {
+				fmt.Fprint(w, `{"ips": [{"address": "10.1.2.5/24", "gateway": "10.1.2.1"}], "routes": [{"dst": "0.0.0.0/0", "gw": "10.1.2.1"}]}`)
+			}
+		}))
+		defer server.Close()
+
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"isGateway": true,
+			"ipamWebhook": {"url": "%s"}
+		}`, BRNAME, server.URL)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+			Args:        "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web-0",
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(1))
+			Expect(result.IPs[0].Address.String()).To(Equal("10.1.2.5/24"))
+			Expect(*result.IPs[0].Interface).To(Equal(2))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(requests).To(Equal([]webhookRequest{{
+			Command:     "ADD",
+			Network:     "testConfig",
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			Pod:         "default/web-0",
+		}}))
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(HaveLen(1))
+			Expect(addrs[0].IPNet.String()).To(Equal("10.1.2.5/24"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requests).To(HaveLen(2))
+		Expect(requests[1].Command).To(Equal("DEL"))
+	})
+
+	It("fails clearly when the ipamWebhook does", func() {
+		block := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				<-block
+				return
+			}
+			http.Error(w, "pool exhausted", http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+		defer close(block)
+
+		n := &NetConf{}
+		req := &webhookRequest{Command: "ADD", ContainerID: "dummy", IfName: IFNAME}
+
+		hook := &IPAMWebhook{URL: server.URL}
+		_, err := webhookAdd(context.Background(), hook, req)
+		Expect(err).To(MatchError("ipamWebhook ADD failed: 503 Service Unavailable: pool exhausted"))
+
+		hook = &IPAMWebhook{URL: server.URL + "/slow", TimeoutMs: 50}
+		ctx, cancel := webhookContext(hook)
+		defer cancel()
+		_, err = webhookAdd(ctx, hook, req)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("context deadline exceeded"))
+
+		n.IPAMWebhook = &IPAMWebhook{URL: "unix:///run/ipam.sock"}
+		n.IPAM.Type = "host-local"
+		Expect(n.validate()).To(MatchError(`invalid configuration: invalid ipamWebhook url "unix:///run/ipam.sock" (must be an http or https URL); ipamWebhook cannot be combined with an IPAM plugin`))
+	})
+
+	It("limits a dual-stack container to the requested IP families", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"isGateway": true,
+			%%s
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"ranges": [
+					[{"subnet": "10.1.2.0/24"}],
+					[{"subnet": "2001:db8:1::/64"}]
+				],
+				"routes": [{"dst": "0.0.0.0/0"}, {"dst": "::/0"}]
+			}
+		}`, BRNAME, dataDir)
+
+		for _, tc := range []struct {
+			config, envArgs string
+			family          int
+		}{
+			{envArgs: "IP_FAMILIES=ipv4", family: netlink.FAMILY_V4},
+			{config: `"ipFamilies": ["ipv6"],`, family: netlink.FAMILY_V6},
+		} {
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(fmt.Sprintf(conf, tc.config)),
+				Args:        tc.envArgs,
+			}
+
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				r, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				result, err := types100.GetResult(r)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.IPs).To(HaveLen(1))
+				Expect(ipFamily(result.IPs[0].Address.IP)).To(Equal(tc.family))
+				Expect(result.Routes).To(HaveLen(1))
+				Expect(ipFamily(result.Routes[0].Dst.IP)).To(Equal(tc.family))
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+					addrs, err := netlink.AddrList(link, family)
+					Expect(err).NotTo(HaveOccurred())
+					global := 0
+					for _, a := range addrs {
+						if a.Scope == int(netlink.SCOPE_UNIVERSE) {
+							global++
+						}
+					}
+					if family == tc.family {
+						Expect(global).To(Equal(1))
+					} else {
+						Expect(global).To(Equal(0))
+					}
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// both addresses were allocated and are released again
+			files, err := filepath.Glob(filepath.Join(dataDir, "testConfig", "*:*"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(HaveLen(1))
+
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				return testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, pattern := range []string{"10.1.2.*", "*:*"} {
+				files, err := filepath.Glob(filepath.Join(dataDir, "testConfig", pattern))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(files).To(BeEmpty())
+			}
+		}
+	})
+
+	It("sets the preferred source address on routes via a gateway", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"preferredSource": ["10.1.3.0/24", "2001:db8:1::/64"],
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"ranges": [
+					[{"subnet": "10.1.2.0/24"}],
+					[{"subnet": "10.1.3.0/24"}],
+					[{"subnet": "2001:db8:1::/64"}]
+				],
+				"routes": [{"dst": "0.0.0.0/0", "gw": "10.1.2.1"}, {"dst": "::/0", "gw": "2001:db8:1::1"}]
+			}
+		}`, BRNAME, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			for family, src := range map[int]string{
+				netlink.FAMILY_V4: "10.1.3.2",
+				netlink.FAMILY_V6: "2001:db8:1::2",
+			} {
+				routes, err := netlink.RouteList(link, family)
+				Expect(err).NotTo(HaveOccurred())
+				var gwRoutes int
+				for _, r := range routes {
+					if r.Gw == nil {
+						continue
+					}
+					gwRoutes++
+					Expect(r.Src.String()).To(Equal(src))
+				}
+				Expect(gwRoutes).To(Equal(1))
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, _, err = loadNetConf([]byte(`{"name": "testConfig", "type": "bridge", "ipam": {"type": "host-local"}, "preferredSource": ["10.1.2.0/24", "10.1.3.1", "fe80::/"]}`), "")
+		Expect(err).To(MatchError(`invalid configuration: invalid preferredSource "10.1.3.1": only one is allowed per IP family; invalid preferredSource "fe80::/" (must be an address or a prefix)`))
+	})
+
+	It("refuses an Open vSwitch bridge with a descriptive error", func() {
+		ovs := &netlink.GenericLink{
+			LinkAttrs: netlink.LinkAttrs{Name: "br-int"},
+			LinkType:  "openvswitch",
+		}
+		_, err := asBridge(ovs)
+		Expect(err).To(MatchError(`"br-int" is an Open vSwitch bridge, not a Linux bridge; use a plugin for OVS such as ovs-cni, or choose another bridge name`))
+
+		other := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "br-int"}}
+		_, err = asBridge(other)
+		Expect(err).To(MatchError(`"br-int" already exists but is not a bridge`))
+
+		br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br-int"}}
+		Expect(asBridge(br)).To(Equal(br))
+	})
+
+	It("sets the interface aliases to the pod identity", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"interfaceAlias": "both"
+		}`, BRNAME)
+
+		longName := strings.Repeat("a", 253)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+			Args:        "K8S_POD_NAMESPACE=tenant;K8S_POD_NAME=" + longName,
+		}
+		expected := ("tenant/" + longName)[:255]
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			link, err := netlink.LinkByName(result.Interfaces[1].Name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().Alias).To(Equal(expected))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().Alias).To(Equal(expected))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, _, err = loadNetConf([]byte(`{"name": "testConfig", "type": "bridge", "interfaceAlias": "veth"}`), "")
+		Expect(err).To(MatchError(`invalid interfaceAlias "veth" (must be host, container or both)`))
+	})
+
+	It("installs and removes the conntrack zone of the pod", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"conntrackZone": 7,
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24"
+			}
+		}`, BRNAME, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+			Args:        "CT_ZONE=42",
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			podIP := result.IPs[0].Address.IP.String()
+
+			ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+			Expect(err).NotTo(HaveOccurred())
+
+			chain := ctZoneChain("testConfig", args.ContainerID)
+			rules, err := ipt.List("raw", chain.name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).Should(ContainElement(ContainSubstring("-j CT --zone 42")))
+
+			rules, err = ipt.List("raw", "PREROUTING")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).Should(ContainElement(ContainSubstring("-s " + podIP + "/32")))
+			Expect(rules).Should(ContainElement(ContainSubstring("-d " + podIP + "/32")))
+
+			err = testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			exists, err := utils.ChainExists(ipt, "raw", chain.name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects conntrack zones that are not a uint16", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"conntrackZone": 65536,
+			"ipam": {"type": "host-local", "subnet": "10.1.2.0/24"}
+		}`, BRNAME)
+		_, _, err := loadNetConf([]byte(conf), "")
+		Expect(err).To(MatchError("invalid conntrack zone 65536 (must be a valid uint16)"))
+
+		_, _, err = loadNetConf([]byte(conf), "CT_ZONE=-1")
+		Expect(err).To(MatchError("invalid conntrack zone -1 (must be a valid uint16)"))
+
+		_, _, err = loadNetConf([]byte(conf), "CT_ZONE=red")
+		Expect(err).To(MatchError(`invalid conntrack zone "red" (must be a valid uint16)`))
+
+		n, _, err := loadNetConf([]byte(conf), "CT_ZONE=65535")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*n.ConntrackZone).To(Equal(65535))
+		Expect(ctZoneRules(65535)).To(Equal([][]string{{"-j", "CT", "--zone", "65535"}}))
+	})
+
+	It("adds and removes host routes to the pod addresses", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"disableBridgeIP": true,
+			"hostRoutes": true,
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"ranges": [
+					[{"subnet": "10.1.2.0/24"}],
+					[{"subnet": "2001:db8:1::/64"}]
+				]
+			}
+		}`, BRNAME, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		hostRoutes := func() []string {
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			routes, err := netlink.RouteList(br, netlink.FAMILY_ALL)
+			Expect(err).NotTo(HaveOccurred())
+			var dsts []string
+			for _, r := range routes {
+				if r.Dst == nil {
+					continue
+				}
+				if ones, bits := r.Dst.Mask.Size(); ones == bits {
+					dsts = append(dsts, r.Dst.String())
+				}
+			}
+			return dsts
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hostRoutes()).To(ConsistOf("10.1.2.2/32", "2001:db8:1::2/128"))
+
+			err = testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hostRoutes()).To(BeEmpty())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(hostRoute(&netlink.Bridge{}, net.ParseIP("10.1.2.2")).Dst.String()).To(Equal("10.1.2.2/32"))
+	})
+
+	It("retries entering a namespace that is still being set up", func() {
+		var slept []time.Duration
+		origGetNS, origSleep := getNS, sleep
+		defer func() { getNS, sleep = origGetNS, origSleep }()
+		sleep = func(d time.Duration) { slept = append(slept, d) }
+
+		missing, entering := 2, 2
+		getNS = func(path string) (ns.NetNS, error) {
+			if missing > 0 {
+				missing--
+				return nil, ns.NSPathNotExistErr{}
+			}
+			netns, err := origGetNS(path)
+			if err != nil {
+				return nil, err
+			}
+			return &flakyNS{NetNS: netns, failures: &entering}, nil
+		}
+
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"netnsRetry": {"timeoutMs": 100, "intervalMs": 5}
+		}`, BRNAME)
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		bridgePorts := func() []string {
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			links, err := netlink.LinkList()
+			Expect(err).NotTo(HaveOccurred())
+			var ports []string
+			for _, l := range links {
+				if l.Attrs().MasterIndex == br.Attrs().Index {
+					ports = append(ports, l.Attrs().Name)
+				}
+			}
+			return ports
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(missing).To(Equal(0))
+			Expect(entering).To(Equal(0))
+			Expect(slept).To(HaveLen(4))
+			Expect(bridgePorts()).To(HaveLen(1))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// a namespace that cannot be entered within the timeout fails the
+		// ADD without leaving an interface behind
+		entering = 100
+		slept = nil
+		args.ContainerID = "dummy2"
+		args.IfName = "eth1"
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(MatchError(ContainSubstring("error switching to ns")))
+			Expect(slept).To(HaveLen(20))
+			Expect(bridgePorts()).To(HaveLen(1))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// without netnsRetry nothing is retried
+		missing = 1
+		_, err = openNetNS(targetNS.Path(), nil)
+		Expect(err).To(BeAssignableToTypeOf(ns.NSPathNotExistErr{}))
+		Expect(missing).To(Equal(0))
+	})
+
+	It("limits the FDB of the bridge to fdbMaxSize", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"fdbMaxSize": 128
+		}`, BRNAME)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			max, ok, err := fdbMaxLearned(br.Attrs().Index)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ok).To(BeTrue())
+			Expect(max).To(Equal(uint32(128)))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		args.StdinData = []byte(strings.Replace(conf, "128", "0", 1))
+		_, _, err = loadNetConf(args.StdinData, "")
+		Expect(err).To(MatchError("invalid fdbMaxSize 0 (must be between 1 and 4294967295)"))
+	})
+
+	It("runs the postSetupHooks with the interface in a clean environment", func() {
+		hookDir, err := ioutil.TempDir("", "bridge_hooks")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(hookDir)
+
+		envFile := filepath.Join(hookDir, "env")
+		hook := filepath.Join(hookDir, "hook.sh")
+		Expect(ioutil.WriteFile(hook, []byte("#!/bin/sh\nenv > "+envFile+"\necho registered\n"), 0755)).To(Succeed())
+		failing := filepath.Join(hookDir, "failing.sh")
+		Expect(ioutil.WriteFile(failing, []byte("#!/bin/sh\necho agent unreachable >&2\nexit 3\n"), 0755)).To(Succeed())
+
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"postSetupHooks": [{"path": "%s", "timeoutMs": 5000}],
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24"
+			}
+		}`, BRNAME, hook, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+			Args:        "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web",
+		}
+
+		os.Setenv("HOOK_SECRET", "leaked")
+		defer os.Unsetenv("HOOK_SECRET")
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			data, err := ioutil.ReadFile(envFile)
+			Expect(err).NotTo(HaveOccurred())
+			var env []string
+			for _, v := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				// set by the shell itself
+				if !strings.HasPrefix(v, "PWD=") && !strings.HasPrefix(v, "SHLVL=") && !strings.HasPrefix(v, "_=") {
+					env = append(env, v)
+				}
+			}
+			Expect(env).To(ConsistOf(
+				"PATH="+hookPath,
+				"CNI_COMMAND=ADD",
+				"CNI_NETWORK=testConfig",
+				"CNI_CONTAINERID=dummy",
+				"CNI_NETNS="+targetNS.Path(),
+				"CNI_IFNAME="+IFNAME,
+				"CNI_HOST_IFNAME="+result.Interfaces[1].Name,
+				"CNI_BRIDGE="+BRNAME,
+				"CNI_IPS=10.1.2.2/24",
+				"CNI_POD=default/web",
+			))
+
+			err = testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			// a failing hook fails the ADD and releases the address
+			args.StdinData = []byte(strings.Replace(conf, hook, failing, 1))
+			_, _, err = testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(MatchError("postSetupHook " + failing + " failed: exit status 3: agent unreachable"))
+			_, err = os.Stat(filepath.Join(dataDir, "testConfig", "10.1.2.2"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, _, err = loadNetConf([]byte(strings.Replace(conf, hook, "hook.sh", 1)), "")
+		Expect(err).To(MatchError(`invalid postSetupHook path "hook.sh" (must be absolute)`))
+	})
+
+	It("configures IPv6 address generation on the container interface", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"ipv6AddrGen": {"mode": "stable-privacy", "stableSecret": "2001:db8::5ec:7e7"}
+		}`, BRNAME)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			mode, err := sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/addr_gen_mode", IFNAME))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mode).To(Equal("2"))
+			secret, err := sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/stable_secret", IFNAME))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(net.ParseIP(secret)).To(Equal(net.ParseIP("2001:db8::5ec:7e7")))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		for conf, msg := range map[string]string{
+			`{"mode": "stable-privacy"}`:                        "ipv6AddrGen mode stable-privacy requires a stableSecret",
+			`{"mode": "stable-privacy", "stableSecret": "x"}`:   `invalid ipv6AddrGen stableSecret "x" (must be formatted as an IPv6 address)`,
+			`{"mode": "random", "stableSecret": "2001:db8::1"}`: "ipv6AddrGen stableSecret requires mode stable-privacy",
+			`{"mode": "privacy"}`:                               `invalid ipv6AddrGen mode "privacy" (must be eui64, none, stable-privacy or random)`,
+		} {
+			_, _, err := loadNetConf([]byte(fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "testConfig", "type": "bridge", "ipv6AddrGen": %s}`, conf)), "")
+			Expect(err).To(MatchError(msg))
+		}
+	})
+
+	It("source-NATs pod egress to the configured host address", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"ipMasq": true,
+			"snatAddress": "10.99.0.9",
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24"
+			}
+		}`, BRNAME, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+			Args:        "SNAT_ADDRESS=10.99.0.10",
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			lo, err := netlink.LinkByName("lo")
+			Expect(err).NotTo(HaveOccurred())
+			addr, err := netlink.ParseAddr("10.99.0.10/32")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(lo, addr)).To(Succeed())
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			podIP := result.IPs[0].Address.IP.String()
+
+			ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+			Expect(err).NotTo(HaveOccurred())
+
+			chain := snatChain("testConfig", args.ContainerID)
+			rules, err := ipt.List("nat", chain.name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).Should(ContainElement(ContainSubstring("-j SNAT --to-source 10.99.0.10")))
+
+			rules, err = ipt.List("nat", "POSTROUTING")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rules).Should(ContainElement(ContainSubstring("-s " + podIP + "/32 -j " + chain.name)))
+			// the pod is not masqueraded as well
+			Expect(rules).ShouldNot(ContainElement(ContainSubstring(utils.FormatChainName("testConfig", args.ContainerID))))
+
+			err = testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			exists, err := utils.ChainExists(ipt, "nat", chain.name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists).To(BeFalse())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("rejects SNAT addresses that are not on the host", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"snatAddress": "10.99.0.9",
+			"ipam": {"type": "host-local", "dataDir": "%s", "subnet": "10.1.2.0/24"}
+		}`, BRNAME, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(MatchError("snatAddress 10.99.0.9 is not configured on the host"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, _, err = loadNetConf([]byte(conf), "SNAT_ADDRESS=red")
+		Expect(err).To(MatchError(`invalid snatAddress "red" (must be an IP address)`))
+
+		_, _, err = loadNetConf([]byte(`{"name": "testConfig", "type": "bridge", "snatAddress": "10.99.0.9"}`), "")
+		Expect(err).To(MatchError("snatAddress requires IPAM to be configured"))
+
+		Expect(snatRules(&net.IPNet{IP: net.ParseIP("10.1.2.5"), Mask: net.CIDRMask(24, 32)}, net.ParseIP("10.99.0.9"))).To(Equal([][]string{
+			{"-d", "10.1.2.0/24", "-j", "ACCEPT"},
+			{"!", "-d", "224.0.0.0/4", "-j", "SNAT", "--to-source", "10.99.0.9"},
+		}))
+	})
+
+	It("sets the ARP sysctls of the container", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"arp": {"announce": 2, "ignore": 1, "scopes": ["interface", "default"]}
+		}`, BRNAME)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			for _, conf := range []string{IFNAME, "default"} {
+				announce, err := sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/arp_announce", conf))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(announce).To(Equal("2"))
+				ignore, err := sysctl.Sysctl(fmt.Sprintf("net/ipv4/conf/%s/arp_ignore", conf))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ignore).To(Equal("1"))
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		for conf, msg := range map[string]string{
+			`{"announce": 3}`:     "invalid arp announce 3 (must be between 0 and 2)",
+			`{"ignore": 5}`:       "invalid arp ignore 5 (must be 0-3 or 8)",
+			`{"scopes": ["all"]}`: `invalid arp scope "all" (must be interface or default)`,
+		} {
+			_, _, err := loadNetConf([]byte(fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "testConfig", "type": "bridge", "arp": %s}`, conf)), "")
+			Expect(err).To(MatchError(msg))
+		}
+	})
+
+	It("keeps the container without carrier until its addresses are configured", func() {
+		var hostUp, contCarrier []bool
+		linkStates := func() {
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				links, err := netlink.LinkList()
+				Expect(err).NotTo(HaveOccurred())
+				for _, link := range links {
+					if _, ok := link.(*netlink.Veth); ok {
+						hostUp = append(hostUp, link.Attrs().Flags&net.FlagUp != 0)
+					}
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				contCarrier = append(contCarrier, link.Attrs().OperState == netlink.OperUp)
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			var req webhookRequest
+			Expect(json.NewDecoder(r.Body).Decode(&req)).To(Succeed())
+			if req.Command == "ADD" {
+				// the interface exists, but has no addresses yet
+				linkStates()
+				fmt.Fprint(w, `{"ips": [{"address": "10.1.2.5/24", "gateway": "10.1.2.1"}]}`)
+			}
+		}))
+		defer server.Close()
+
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"delayCarrier": true,
+			"ipamWebhook": {"url": "%s"}
+		}`, BRNAME, server.URL)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		linkStates()
+		Expect(hostUp).To(Equal([]bool{false, true}))
+		Expect(contCarrier).To(Equal([]bool{false, true}))
+
+		_, _, err = loadNetConf([]byte(`{"name": "testConfig", "type": "bridge", "delayCarrier": true, "tap": {}}`), "")
+		Expect(err).To(MatchError("delayCarrier cannot be combined with tap, which has no veth"))
+	})
+
+	It("installs tableRoutes in their routing tables", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"tableRoutes": [
+				{"dst": "10.9.0.0/16", "gw": "10.1.2.1", "table": 100},
+				{"dst": "192.0.2.0/24", "table": 200}
+			],
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"subnet": "10.1.2.0/24"
+			}
+		}`, BRNAME, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		tableRoutes := func(table int) []netlink.Route {
+			var routes []netlink.Route
+			err := targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				var err error
+				routes, err = netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return routes
+		}
+
+		routes := tableRoutes(100)
+		Expect(routes).To(HaveLen(1))
+		Expect(routes[0].Dst.String()).To(Equal("10.9.0.0/16"))
+		Expect(routes[0].Gw.String()).To(Equal("10.1.2.1"))
+		routes = tableRoutes(200)
+		Expect(routes).To(HaveLen(1))
+		Expect(routes[0].Dst.String()).To(Equal("192.0.2.0/24"))
+		Expect(routes[0].Scope).To(Equal(netlink.SCOPE_LINK))
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(tableRoutes(100)).To(BeEmpty())
+		Expect(tableRoutes(200)).To(BeEmpty())
+
+		for table, msg := range map[int]string{
+			0:   "invalid table 0 for the route to 10.9.0.0/16 (must be between 1 and 4294967295, other than main and local)",
+			254: "invalid table 254 for the route to 10.9.0.0/16 (must be between 1 and 4294967295, other than main and local)",
+			255: "invalid table 255 for the route to 10.9.0.0/16 (must be between 1 and 4294967295, other than main and local)",
+		} {
+			conf := fmt.Sprintf(`{"name": "testConfig", "type": "bridge", "ipam": {"type": "host-local"}, "tableRoutes": [{"dst": "10.9.0.0/16", "table": %d}]}`, table)
+			_, _, err := loadNetConf([]byte(conf), "")
+			Expect(err).To(MatchError(msg))
+		}
+	})
+
+	It("fails without a gateway only with requireGateway", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"ips": [{"address": "10.1.2.5/24"}]}`)
+		}))
+		defer server.Close()
+
+		conf := `{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"requireGateway": %t,
+			"ipamWebhook": {"url": "%s"}
+		}`
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(fmt.Sprintf(conf, BRNAME, true, server.URL)),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(MatchError("requireGateway is set, but there is no gateway for 10.1.2.5/24"))
+			// the runtime cleans up after a failed ADD
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+
+			args.StdinData = []byte(fmt.Sprintf(conf, BRNAME, false, server.URL))
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs[0].Gateway).To(BeNil())
+			Expect(result.Routes).To(BeEmpty())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			for _, route := range routes {
+				Expect(route.Dst).NotTo(BeNil())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("derives the IPv6 address from the container MAC with eui64Prefix", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"ips": [{"address": "10.1.2.5/24"}]}`)
+		}))
+		defer server.Close()
+
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"eui64Prefix": "fd00:1:2:3::/64",
+			"runtimeConfig": {"mac": "0a:58:0a:01:02:05"},
+			"ipamWebhook": {"url": "%s"}
+		}`, BRNAME, server.URL)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		expected := "fd00:1:2:3:858:aff:fe01:205/64"
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(2))
+			Expect(result.IPs[1].Address.String()).To(Equal(expected))
+			Expect(*result.IPs[1].Interface).To(Equal(2))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().HardwareAddr.String()).To(Equal("0a:58:0a:01:02:05"))
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+			var found []string
+			for _, a := range addrs {
+				found = append(found, a.IPNet.String())
+			}
+			Expect(found).To(ContainElement(expected))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("computes the modified EUI-64 interface identifier", func() {
+		_, prefix, err := net.ParseCIDR("2001:db8:1:2::/64")
+		Expect(err).NotTo(HaveOccurred())
+		for mac, expected := range map[string]string{
+			"00:00:5e:00:53:01": "2001:db8:1:2:200:5eff:fe00:5301",
+			"02:42:ac:11:00:02": "2001:db8:1:2:42:acff:fe11:2",
+			"0a:58:0a:f4:00:07": "2001:db8:1:2:858:aff:fef4:7",
+		} {
+			addr, err := eui64Addr(prefix, mac)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addr.IP.String()).To(Equal(expected))
+			Expect(addr.Mask).To(Equal(prefix.Mask))
+		}
+		_, err = eui64Addr(prefix, "00:00:00:00:fe:80:00:00:00:00:00:00:00:00:00:00:00:00:00:00")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("rejects an eui64Prefix that is not an IPv6 /64", func() {
+		for prefix, msg := range map[string]string{
+			"fd00:1::/48":   `invalid eui64Prefix "fd00:1::/48" (must be an IPv6 /64 prefix)`,
+			"fd00:1::":      `invalid eui64Prefix "fd00:1::" (must be an IPv6 /64 prefix)`,
+			"10.1.0.0/16":   `invalid eui64Prefix "10.1.0.0/16" (must be an IPv6 /64 prefix)`,
+			"fd00:1::/64\"": `invalid eui64Prefix "fd00:1::/64\"" (must be an IPv6 /64 prefix)`,
+		} {
+			n := &NetConf{EUI64Prefix: prefix}
+			n.IPAM.Type = "host-local"
+			Expect(n.validate()).To(MatchError(msg))
+		}
+		n := &NetConf{EUI64Prefix: "fd00:1::/64"}
+		Expect(n.validate()).To(MatchError("eui64Prefix requires IPAM to be configured"))
+	})
+
+	It("leaves the host veth down with receiveOnly", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"ips": [{"address": "10.1.2.5/24", "gateway": "10.1.2.1"}]}`)
+		}))
+		defer server.Close()
+
+		for _, ipam := range []string{"", fmt.Sprintf(`, "ipamWebhook": {"url": "%s"}`, server.URL)} {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "testConfig",
+				"type": "bridge",
+				"bridge": "%s",
+				"receiveOnly": true%s
+			}`, BRNAME, ipam)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(conf),
+			}
+
+			var hostName string
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				r, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				result, err := types100.GetResult(r)
+				Expect(err).NotTo(HaveOccurred())
+				hostName = result.Interfaces[1].Name
+
+				link, err := netlink.LinkByName(hostName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().Flags & net.FlagUp).To(BeZero())
+				Expect(link.Attrs().MasterIndex).NotTo(BeZero())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().Flags & net.FlagUp).NotTo(BeZero())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				return testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		_, _, err := loadNetConf([]byte(`{"name": "testConfig", "type": "bridge", "receiveOnly": true, "delayCarrier": true}`), "")
+		Expect(err).To(MatchError("receiveOnly cannot be combined with delayCarrier, which brings the host veth up"))
+	})
+
+	It("adopts a veth that already exists in the container", func() {
+		var contIndex int
+		var contMac string
+		err := targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, contVeth, err := ip.SetupVethWithName(IFNAME, "legacy0", 1500, "", originalNS)
+			Expect(err).NotTo(HaveOccurred())
+			contIndex, contMac = contVeth.Index, contVeth.HardwareAddr.String()
+			link, err := netlink.LinkByIndex(contIndex)
+			Expect(err).NotTo(HaveOccurred())
+			addr, err := netlink.ParseAddr("10.1.2.5/24")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.AddrAdd(link, addr)).To(Succeed())
+			return netlink.RouteAdd(&netlink.Route{LinkIndex: contIndex, Gw: net.ParseIP("10.1.2.1")})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Fail("IPAM is not consulted for an adopted interface")
+		}))
+		defer server.Close()
+
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"adopt": true,
+			"ipamWebhook": {"url": "%s"}
+		}`, BRNAME, server.URL)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).To(MatchError(fmt.Sprintf(`cannot adopt "%s", its host end "legacy0" is not a port of "%s"`, IFNAME, BRNAME)))
+
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			hostVeth, err := netlink.LinkByName("legacy0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetMaster(hostVeth, br.(*netlink.Bridge))).To(Succeed())
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(result.Interfaces).To(HaveLen(3))
+			Expect(result.Interfaces[0].Name).To(Equal(BRNAME))
+			Expect(result.Interfaces[1].Name).To(Equal("legacy0"))
+			Expect(result.Interfaces[2].Name).To(Equal(IFNAME))
+			Expect(result.Interfaces[2].Mac).To(Equal(contMac))
+			Expect(result.Interfaces[2].Sandbox).To(Equal(targetNS.Path()))
+			Expect(result.IPs).To(HaveLen(1))
+			Expect(result.IPs[0].Address.String()).To(Equal("10.1.2.5/24"))
+			Expect(result.IPs[0].Gateway.String()).To(Equal("10.1.2.1"))
+			Expect(*result.IPs[0].Interface).To(Equal(2))
+			Expect(result.Routes).To(HaveLen(1))
+			Expect(result.Routes[0].Dst.String()).To(Equal("0.0.0.0/0"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// nothing was recreated
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().Index).To(Equal(contIndex))
+			Expect(link.Attrs().HardwareAddr.String()).To(Equal(contMac))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("sets acceptRA on the bridge and the container interface with forwarding on", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, `{"ips": [{"address": "fd00:1::5/64", "gateway": "fd00:1::1"}]}`)
+		}))
+		defer server.Close()
+
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"isGateway": true,
+			"acceptRA": {"value": 2, "interfaces": ["bridge", "container"]},
+			"ipamWebhook": {"url": "%s"}
+		}`, BRNAME, server.URL)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			forwarding, err := sysctl.Sysctl("net/ipv6/conf/all/forwarding")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(forwarding).To(Equal("1"))
+			acceptRA, err := sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/accept_ra", BRNAME))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(acceptRA).To(Equal("2"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			acceptRA, err := sysctl.Sysctl(fmt.Sprintf("net/ipv6/conf/%s/accept_ra", IFNAME))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(acceptRA).To(Equal("2"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, _, err = loadNetConf([]byte(`{"name": "testConfig", "type": "bridge", "acceptRA": {"value": 2, "interfaces": ["host"]}}`), "")
+		Expect(err).To(MatchError(`invalid acceptRA interface "host" (must be bridge or container)`))
+	})
+
+	It("leaves the veth down in place on DEL with delAction down", func() {
+		var commands []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			var req webhookRequest
+			Expect(json.NewDecoder(r.Body).Decode(&req)).To(Succeed())
+			commands = append(commands, req.Command)
+			if req.Command == "ADD" {
+				fmt.Fprint(w, `{"ips": [{"address": "10.1.2.5/24", "gateway": "10.1.2.1"}]}`)
+			}
+		}))
+		defer server.Close()
+
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"delAction": "down",
+			"ipamWebhook": {"url": "%s"}
+		}`, BRNAME, server.URL)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		var hostName string
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			hostName = result.Interfaces[1].Name
+
+			Expect(testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})).To(Succeed())
+			// the address is released all the same
+			Expect(commands).To(Equal([]string{"ADD", "DEL"}))
+
+			_, err = netlink.LinkByName(hostName)
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(link.Attrs().Flags & net.FlagUp).To(BeZero())
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(BeEmpty())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// a repeated DEL finds nothing more to do
+		err = originalNS.Do(func(ns.NetNS) error {
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, _, err = loadNetConf([]byte(`{"name": "testConfig", "type": "bridge", "delAction": "keep"}`), "")
+		Expect(err).To(MatchError(`invalid delAction "keep" (must be delete or down)`))
+	})
+
+	It("installs and removes MSS clamping of pod egress", func() {
+		for _, tc := range []struct {
+			clamp string
+			rule  string
+		}{
+			{`{"mss": 1360}`, "--set-mss 1360"},
+			{`{"clampToPMTU": true}`, "--clamp-mss-to-pmtu"},
+		} {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "testConfig",
+				"type": "bridge",
+				"bridge": "%s",
+				"mssClamp": %s,
+				"ipam": {
+					"type": "host-local",
+					"dataDir": "%s",
+					"subnet": "10.1.2.0/24"
+				}
+			}`, BRNAME, tc.clamp, dataDir)
+
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(conf),
+			}
+
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				r, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				result, err := types100.GetResult(r)
+				Expect(err).NotTo(HaveOccurred())
+
+				ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+				Expect(err).NotTo(HaveOccurred())
+
+				chain := mssClampChain("testConfig", args.ContainerID)
+				rules, err := ipt.List("mangle", chain.name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(rules).Should(ContainElement(And(ContainSubstring("-j TCPMSS"), ContainSubstring(tc.rule))))
+
+				rules, err = ipt.List("mangle", "FORWARD")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(rules).Should(ContainElement(ContainSubstring(result.IPs[0].Address.IP.String())))
+
+				err = testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				exists, err := utils.ChainExists(ipt, "mangle", chain.name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(exists).To(BeFalse())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+	})
+
+	It("validates mssClamp", func() {
+		for _, tc := range []struct {
+			clamp  string
+			expErr string
+		}{
+			{`{}`, "mssClamp requires exactly one of mss and clampToPMTU"},
+			{`{"mss": 1400, "clampToPMTU": true}`, "mssClamp requires exactly one of mss and clampToPMTU"},
+			{`{"mss": 535}`, "invalid mssClamp mss 535 (must be between 536 and 65495)"},
+			{`{"mss": 65496}`, "invalid mssClamp mss 65496 (must be between 536 and 65495)"},
+		} {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "testConfig",
+				"type": "bridge",
+				"bridge": "%s",
+				"mssClamp": %s,
+				"ipam": {"type": "host-local", "subnet": "10.1.2.0/24"}
+			}`, BRNAME, tc.clamp)
+			_, _, err := loadNetConf([]byte(conf), "")
+			Expect(err).To(MatchError(tc.expErr))
+		}
+
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"mssClamp": {"mss": 1400}
+		}`, BRNAME)
+		_, _, err := loadNetConf([]byte(conf), "")
+		Expect(err).To(MatchError("mssClamp requires IPAM to be configured"))
+	})
+
+	It("enables learning and flooding on the port with nestedBridging", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"nestedBridging": true
+		}`, BRNAME)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			port, err := netlink.LinkByName(result.Interfaces[1].Name)
+			Expect(err).NotTo(HaveOccurred())
+			protinfo, err := netlink.LinkGetProtinfo(port)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(protinfo.Learning).To(BeTrue())
+			Expect(protinfo.Flood).To(BeTrue())
+
+			// a port with them turned off gets them back
+			Expect(netlink.LinkSetLearning(port, false)).To(Succeed())
+			Expect(netlink.LinkSetFlood(port, false)).To(Succeed())
+			Expect(setNestedBridging(port.Attrs().Name)).To(Succeed())
+			protinfo, err = netlink.LinkGetProtinfo(port)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(protinfo.Learning).To(BeTrue())
+			Expect(protinfo.Flood).To(BeTrue())
+
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("tells a bridge address already ours from one in use elsewhere", func() {
+		conf := testCase{cniVersion: "1.0.0", isGW: true}.netConf()
+		gw := net.IPNet{IP: net.ParseIP("10.1.2.1"), Mask: net.CIDRMask(24, 32)}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+
+			bridge, _, err := setupBridge(conf)
+			Expect(err).NotTo(HaveOccurred())
+
+			// already ours: nothing to do
+			Expect(ensureAddr(bridge, netlink.FAMILY_V4, &gw, false, false, nil)).To(Succeed())
+			Expect(ensureAddr(bridge, netlink.FAMILY_V4, &gw, false, false, nil)).To(Succeed())
+			other := net.IPNet{IP: gw.IP, Mask: net.CIDRMask(16, 32)}
+			err = ensureAddr(bridge, netlink.FAMILY_V4, &other, false, false, nil)
+			Expect(err).To(MatchError(fmt.Sprintf(`%q already has 10.1.2.1/24, with a different prefix length than 10.1.2.1/16`, BRNAME)))
+			Expect(deleteAddr(bridge, &gw)).To(Succeed())
+
+			// someone else's
+			holder := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "conflict0"}}
+			Expect(netlink.LinkAdd(holder)).To(Succeed())
+			defer netlink.LinkDel(holder)
+			Expect(netlink.AddrAdd(holder, &netlink.Addr{IPNet: &gw})).To(Succeed())
+
+			err = ensureAddr(bridge, netlink.FAMILY_V4, &gw, false, false, nil)
+			Expect(err).To(MatchError(fmt.Sprintf(`cannot add 10.1.2.1/24 to %q, the address is already in use by "conflict0"`, BRNAME)))
+			addrs, err := netlink.AddrList(bridge, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(BeEmpty())
+
+			// unless sharing it is allowed
+			Expect(ensureAddr(bridge, netlink.FAMILY_V4, &gw, false, true, nil)).To(Succeed())
+			addrs, err = netlink.AddrList(bridge, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(addrs).To(HaveLen(1))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("applies gsoMaxSize and groMaxSize to both ends of the veth", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"gsoMaxSize": 32768,
+			"groMaxSize": 16384
+		}`, BRNAME)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		gsoLimits := func(name string) (uint32, uint32) {
+			link, err := netlink.LinkByName(name)
+			Expect(err).NotTo(HaveOccurred())
+			req := nl.NewNetlinkRequest(unix.RTM_GETLINK, unix.NLM_F_ACK)
+			msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+			msg.Index = int32(link.Attrs().Index)
+			req.AddData(msg)
+			msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWLINK)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msgs).To(HaveLen(1))
+			gso, err := findAttr(msgs[0][unix.SizeofIfInfomsg:], unix.IFLA_GSO_MAX_SIZE)
+			Expect(err).NotTo(HaveOccurred())
+			gro, err := findAttr(msgs[0][unix.SizeofIfInfomsg:], iflaGROMaxSize)
+			Expect(err).NotTo(HaveOccurred())
+			return nl.NativeEndian().Uint32(gso), nl.NativeEndian().Uint32(gro)
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+
+			gso, gro := gsoLimits(result.Interfaces[1].Name)
+			Expect(gso).To(Equal(uint32(32768)))
+			Expect(gro).To(Equal(uint32(16384)))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			gso, gro := gsoLimits(IFNAME)
+			Expect(gso).To(Equal(uint32(32768)))
+			Expect(gro).To(Equal(uint32(16384)))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, tc := range []struct {
+			field  string
+			size   int
+			expErr string
+		}{
+			{"gsoMaxSize", 0, "invalid gsoMaxSize 0 (must be between 1 and 524280)"},
+			{"groMaxSize", 524281, "invalid groMaxSize 524281 (must be between 1 and 524280)"},
+		} {
+			conf := fmt.Sprintf(`{"name": "testConfig", "type": "bridge", "%s": %d}`, tc.field, tc.size)
+			_, _, err := loadNetConf([]byte(conf), "")
+			Expect(err).To(MatchError(tc.expErr))
+		}
+	})
+
+	It("gives each interface of a pod its own stable MAC with stableMac", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"macPrefix": "0a:58",
+			"stableMac": true
+		}`, BRNAME)
+
+		add := func(containerID, ifName string) string {
+			args := &skel.CmdArgs{
+				ContainerID: containerID,
+				Netns:       targetNS.Path(),
+				IfName:      ifName,
+				StdinData:   []byte(conf),
+				Args:        "K8S_POD_NAMESPACE=default;K8S_POD_NAME=vnf-0",
+			}
+			var mac string
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				r, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				result, err := types100.GetResult(r)
+				Expect(err).NotTo(HaveOccurred())
+				mac = result.Interfaces[2].Mac
+
+				return testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return mac
+		}
+
+		eth0 := add("dummy", "eth0")
+		net1 := add("dummy", "net1")
+		Expect(eth0).To(HavePrefix("0a:58:"))
+		Expect(net1).To(HavePrefix("0a:58:"))
+		Expect(eth0).NotTo(Equal(net1))
+		Expect(eth0).To(Equal(stableMac(net.HardwareAddr{0x0a, 0x58}, "testConfig", "default/vnf-0", "eth0")))
+
+		// the pod recreated under the same name gets the same MACs
+		Expect(add("dummy2", "eth0")).To(Equal(eth0))
+		Expect(add("dummy2", "net1")).To(Equal(net1))
+
+		mac, err := net.ParseMAC(stableMac(nil, "testConfig", "default/vnf-0", "eth0"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mac[0] & 0x03).To(Equal(byte(0x02)))
+	})
+
+	It("reclaims a stale veth holding the stable host veth name with reclaimStaleVeth", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"stableHostVethName": true,
+			"reclaimStaleVeth": true
+		}`, BRNAME)
+
+		args := &skel.CmdArgs{
+			ContainerID: "container2",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+			Args:        "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web-0",
+		}
+
+		// the previous sandbox of the pod is still around, with its veth
+		oldNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer func() {
+			Expect(oldNS.Close()).To(Succeed())
+			Expect(testutils.UnmountNS(oldNS)).To(Succeed())
+		}()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			n, _, err := loadNetConf([]byte(conf), args.Args)
+			Expect(err).NotTo(HaveOccurred())
+			name, err := stableHostVethName(n, args, targetNS)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(netlink.LinkAdd(&netlink.Veth{
+				LinkAttrs: netlink.LinkAttrs{Name: name},
+				PeerName:  "stale0",
+			})).To(Succeed())
+			stale, err := netlink.LinkByName(name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetAlias(stale, hostVethOwner(n, args))).To(Succeed())
+			peer, err := netlink.LinkByName("stale0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(netlink.LinkSetNsFd(peer, int(oldNS.Fd()))).To(Succeed())
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Interfaces[1].Name).To(Equal(name))
+
+			// the veth of the current sandbox is kept
+			again, err := stableHostVethName(n, args, targetNS)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(again).NotTo(Equal(name))
+
+			return testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = oldNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, err := netlink.LinkByName("stale0")
+			Expect(err).To(BeAssignableToTypeOf(netlink.LinkNotFoundError{}))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, _, err = loadNetConf([]byte(`{"name": "testConfig", "type": "bridge", "reclaimStaleVeth": true}`), "")
+		Expect(err).To(MatchError("reclaimStaleVeth requires stableHostVethName"))
+		_, _, err = loadNetConf([]byte(`{"name": "testConfig", "type": "bridge", "stableHostVethName": true, "reclaimStaleVeth": true, "interfaceAlias": "host"}`), "")
+		Expect(err).To(MatchError("reclaimStaleVeth cannot be combined with interfaceAlias host, it keeps the owner in the alias of the host veth"))
+	})
+
+	It("leaves a live veth of another pod at the stable host veth name alone", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"stableHostVethName": true,
+			"reclaimStaleVeth": true
+		}`, BRNAME)
+
+		args := &skel.CmdArgs{
+			ContainerID: "container2",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+			Args:        "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web-0",
+		}
+
+		// another running pod whose veth name collides
+		otherNS, err := testutils.NewNS()
+		Expect(err).NotTo(HaveOccurred())
+		defer func() {
+			Expect(otherNS.Close()).To(Succeed())
+			Expect(testutils.UnmountNS(otherNS)).To(Succeed())
+		}()
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			n, _, err := loadNetConf([]byte(conf), args.Args)
+			Expect(err).NotTo(HaveOccurred())
+			name, err := stableHostVethName(n, args, targetNS)
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, alias := range []string{"", "cni/testConfig/default/web-1/" + IFNAME} {
+				Expect(netlink.LinkAdd(&netlink.Veth{
+					LinkAttrs: netlink.LinkAttrs{Name: name},
+					PeerName:  "other0",
+				})).To(Succeed())
+				foreign, err := netlink.LinkByName(name)
+				Expect(err).NotTo(HaveOccurred())
+				if alias != "" {
+					Expect(netlink.LinkSetAlias(foreign, alias)).To(Succeed())
+				}
+				peer, err := netlink.LinkByName("other0")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkSetNsFd(peer, int(otherNS.Fd()))).To(Succeed())
+
+				r, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				result, err := types100.GetResult(r)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Interfaces[1].Name).NotTo(Equal(name))
+
+				Expect(testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})).To(Succeed())
+
+				// the other pod keeps its veth
+				_, err = netlink.LinkByName(name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(netlink.LinkDel(foreign)).To(Succeed())
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("retries the IPAM plugin and falls back with ipamRetry", func() {
+		// fake IPAM plugins that log their calls and fail as many ADDs
+		// as they are told to, and CHECK until an ADD has succeeded
+		binDir, err := ioutil.TempDir("", "bridge_ipam_retry")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(binDir)
+		calls := filepath.Join(binDir, "calls")
+		fake := func(name string, failures int) {
+			script := fmt.Sprintf(`#!/bin/sh
+echo "%[1]s $CNI_COMMAND" >> %[2]s
+if [ "$CNI_COMMAND" = CHECK ] && [ "$(grep -c '^%[1]s ADD' %[2]s)" -le %[3]d ]; then
+	echo '{"cniVersion": "1.0.0", "code": 7, "msg": "no address allocated"}'
+	exit 1
+fi
+[ "$CNI_COMMAND" = ADD ] || exit 0
+if [ "$(grep -c '^%[1]s ADD' %[2]s)" -le %[3]d ]; then
+	echo '{"cniVersion": "1.0.0", "code": 11, "msg": "try again later"}'
+	exit 1
+fi
+echo '{"cniVersion": "1.0.0", "ips": [{"address": "10.1.2.5/24", "gateway": "10.1.2.1"}]}'
+`, name, calls, failures)
+			Expect(ioutil.WriteFile(filepath.Join(binDir, name), []byte(script), 0755)).To(Succeed())
+		}
+		fake("flaky", 2)
+		fake("broken", 100)
+		fake("spare", 0)
+
+		path := os.Getenv("PATH")
+		os.Setenv("PATH", binDir+":"+path)
+		defer os.Setenv("PATH", path)
+		sleep = func(time.Duration) {}
+		defer func() { sleep = time.Sleep }()
+
+		readCalls := func() []string {
+			data, err := ioutil.ReadFile(calls)
+			Expect(err).NotTo(HaveOccurred())
+			os.Remove(calls)
+			return strings.Split(strings.TrimSpace(string(data)), "\n")
+		}
+
+		addDel := func(ipamConf string) error {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "testConfig",
+				"type": "bridge",
+				"bridge": "%s",
+				%s
+			}`, BRNAME, ipamConf)
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(conf),
+			}
+			return originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				r, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				if err != nil {
+					return err
+				}
+				result, err := types100.GetResult(r)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.IPs[0].Address.String()).To(Equal("10.1.2.5/24"))
+
+				var checkConf map[string]interface{}
+				Expect(json.Unmarshal([]byte(conf), &checkConf)).To(Succeed())
+				checkConf["prevResult"] = result
+				checkArgs := *args
+				checkArgs.StdinData, err = json.Marshal(checkConf)
+				Expect(err).NotTo(HaveOccurred())
+				if err := testutils.CmdCheckWithArgs(&checkArgs, func() error {
+					return cmdCheck(&checkArgs)
+				}); err != nil {
+					return err
+				}
+
+				return testutils.CmdDelWithArgs(args, func() error {
+					return cmdDel(args)
+				})
+			})
+		}
+
+		// each failed try is released before the next
+		Expect(addDel(`"ipam": {"type": "flaky"}, "ipamRetry": {"attempts": 3}`)).To(Succeed())
+		Expect(readCalls()).To(Equal([]string{
+			"flaky ADD", "flaky DEL", "flaky ADD", "flaky DEL", "flaky ADD", "flaky CHECK", "flaky DEL",
+		}))
+
+		// the fallback takes over once the primary has used up its tries,
+		// CHECK passes on the fallback that allocated, and DEL releases
+		// from both
+		Expect(addDel(`"ipam": {"type": "broken"}, "ipamRetry": {"attempts": 2, "fallback": {"type": "spare"}}`)).To(Succeed())
+		Expect(readCalls()).To(Equal([]string{
+			"broken ADD", "broken DEL", "broken ADD", "broken DEL", "spare ADD",
+			"broken CHECK", "spare CHECK", "broken DEL", "spare DEL",
+		}))
+
+		// without ipamRetry the plugin is tried once
+		err = addDel(`"ipam": {"type": "broken"}`)
+		Expect(err).To(MatchError("try again later"))
+		Expect(readCalls()).To(Equal([]string{"broken ADD"}))
+
+		_, _, err = loadNetConf([]byte(`{"name": "testConfig", "type": "bridge", "ipam": {"type": "broken"}, "ipamRetry": {"fallback": {}}}`), "")
+		Expect(err).To(MatchError("ipamRetry fallback must have a type"))
+		_, _, err = loadNetConf([]byte(`{"name": "testConfig", "type": "bridge", "ipamRetry": {"attempts": 2}}`), "")
+		Expect(err).To(MatchError("ipamRetry requires an IPAM plugin"))
+	})
+
+	Context("with sharedNetns", func() {
+		var requests []webhookRequest
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			requests = nil
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				var req webhookRequest
+				Expect(json.NewDecoder(r.Body).Decode(&req)).To(Succeed())
+				requests = append(requests, req)
+				if req.Command == "ADD" {
+					fmt.Fprintf(w, `{"ips": [{"address": "10.1.2.%d/24"}]}`, len(requests)+4)
+				}
+			}))
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		cmd := func(mode, command, containerID string) *types100.Result {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "testConfig",
+				"type": "bridge",
+				"bridge": "%s",
+				"sharedNetns": "%s",
+				"ipamWebhook": {"url": "%s"}
+			}`, BRNAME, mode, server.URL)
+			args := &skel.CmdArgs{
+				ContainerID: containerID,
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(conf),
+			}
+
+			var result *types100.Result
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				if command == "DEL" {
+					return testutils.CmdDelWithArgs(args, func() error {
+						return cmdDel(args)
+					})
+				}
+				r, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				result, err = types100.GetResult(r)
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return result
+		}
+
+		contLinks := func() []string {
+			var names []string
+			err := targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				links, err := netlink.LinkList()
+				Expect(err).NotTo(HaveOccurred())
+				for _, link := range links {
+					if _, ok := link.(*netlink.Veth); ok {
+						names = append(names, link.Attrs().Name)
+					}
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return names
+		}
+
+		It("reports the interface of the first container to the second", func() {
+			first := cmd("reuse", "ADD", "first")
+			second := cmd("reuse", "ADD", "second")
+			Expect(second.Interfaces).To(HaveLen(3))
+			Expect(second.Interfaces[2].Name).To(Equal(IFNAME))
+			Expect(second.Interfaces[2].Mac).To(Equal(first.Interfaces[2].Mac))
+			Expect(second.IPs).To(HaveLen(1))
+			Expect(second.IPs[0].Address.String()).To(Equal("10.1.2.5/24"))
+			// the address stays the first container's
+			Expect(requests).To(HaveLen(1))
+			Expect(requests[0].ContainerID).To(Equal("first"))
+
+			// and so does the interface
+			cmd("reuse", "DEL", "second")
+			Expect(contLinks()).To(ConsistOf(IFNAME))
+			cmd("reuse", "DEL", "first")
+			Expect(contLinks()).To(BeEmpty())
+		})
+
+		It("adds an interface of its own for the second container", func() {
+			cmd("add", "ADD", "first")
+			second := cmd("add", "ADD", "second")
+			name := sharedIfName(IFNAME, "second")
+			Expect(second.Interfaces[2].Name).To(Equal(name))
+			Expect(second.IPs[0].Address.String()).To(Equal("10.1.2.6/24"))
+			Expect(contLinks()).To(ConsistOf(IFNAME, name))
+			Expect(requests[1].ContainerID).To(Equal("second"))
+			Expect(requests[1].IfName).To(Equal(name))
+
+			cmd("add", "DEL", "second")
+			Expect(contLinks()).To(ConsistOf(IFNAME))
+			Expect(requests[2].Command).To(Equal("DEL"))
+			Expect(requests[2].IfName).To(Equal(name))
+			cmd("add", "DEL", "first")
+			Expect(contLinks()).To(BeEmpty())
+		})
+
+		It("rejects unknown modes", func() {
+			_, _, err := loadNetConf([]byte(`{"cniVersion": "1.0.0", "name": "testConfig", "type": "bridge", "sharedNetns": "merge"}`), "")
+			Expect(err).To(MatchError(`invalid sharedNetns "merge" (must be reuse or add)`))
+		})
+	})
+
+	Context("when the firewall fails", func() {
+		var requests []webhookRequest
+		var server *httptest.Server
+
+		BeforeEach(func() {
+			requests = nil
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				var req webhookRequest
+				Expect(json.NewDecoder(r.Body).Decode(&req)).To(Succeed())
+				requests = append(requests, req)
+				if req.Command == "ADD" {
+					fmt.Fprint(w, `{"ips": [{"address": "10.1.2.5/24"}]}`)
+				}
+			}))
+			debugFirewallError = fmt.Errorf("debugFirewallError")
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		add := func(failure string) error {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "testConfig",
+				"type": "bridge",
+				"bridge": "%s",
+				"firewallFailure": "%s",
+				"ipamWebhook": {"url": "%s"}
+			}`, BRNAME, failure, server.URL)
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(conf),
+			}
+			return originalNS.Do(func(ns.NetNS) error {
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				return err
+			})
+		}
+
+		contLinkExists := func() bool {
+			var exists bool
+			err := targetNS.Do(func(ns.NetNS) error {
+				_, err := netlink.LinkByName(IFNAME)
+				exists = err == nil
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return exists
+		}
+
+		It("fails closed by default, undoing the ADD", func() {
+			Expect(add("")).To(MatchError("debugFirewallError"))
+			Expect(contLinkExists()).To(BeFalse())
+			Expect(requests).To(HaveLen(2))
+			Expect(requests[1].Command).To(Equal("DEL"))
+		})
+
+		It("brings the container up without the rules when open", func() {
+			Expect(add("open")).To(Succeed())
+			Expect(contLinkExists()).To(BeTrue())
+			Expect(requests).To(HaveLen(1))
+		})
+
+		It("rejects unknown modes", func() {
+			_, _, err := loadNetConf([]byte(`{"cniVersion": "1.0.0", "name": "testConfig", "type": "bridge", "firewallFailure": "maybe"}`), "")
+			Expect(err).To(MatchError(`invalid firewallFailure "maybe" (must be closed or open)`))
+		})
+	})
+
+	Context("when an ADD fails part way", func() {
+		var requests []webhookRequest
+		var server *httptest.Server
+		var failIPAM bool
+
+		BeforeEach(func() {
+			requests, failIPAM = nil, false
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				var req webhookRequest
+				Expect(json.NewDecoder(r.Body).Decode(&req)).To(Succeed())
+				requests = append(requests, req)
+				if req.Command == "ADD" {
+					if failIPAM {
+						http.Error(w, "out of addresses", http.StatusInternalServerError)
+						return
+					}
+					fmt.Fprint(w, `{"ips": [{"address": "10.1.2.5/24"}]}`)
+				}
+			}))
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		add := func() error {
+			conf := fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "testConfig",
+				"type": "bridge",
+				"bridge": "%s",
+				"disableBridgeIP": true,
+				"hostRoutes": true,
+				"ipamWebhook": {"url": "%s"}
+			}`, BRNAME, server.URL)
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(conf),
+			}
+			return originalNS.Do(func(ns.NetNS) error {
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				return err
+			})
+		}
+
+		// expectClean checks that neither the container nor the host
+		// kept anything of the ADD.
+		expectClean := func() {
+			err := targetNS.Do(func(ns.NetNS) error {
+				_, err := netlink.LinkByName(IFNAME)
+				Expect(err).To(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			err = originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				br, err := netlink.LinkByName(BRNAME)
+				Expect(err).NotTo(HaveOccurred())
+				links, err := netlink.LinkList()
+				Expect(err).NotTo(HaveOccurred())
+				for _, link := range links {
+					Expect(link.Attrs().MasterIndex).NotTo(Equal(br.Attrs().Index), "port %s left on the bridge", link.Attrs().Name)
+				}
+				routes, err := netlink.RouteList(br, netlink.FAMILY_V4)
+				Expect(err).NotTo(HaveOccurred())
+				for _, r := range routes {
+					Expect(r.Dst.String()).NotTo(Equal("10.1.2.5/32"))
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		It("deletes the veth when IPAM fails", func() {
+			failIPAM = true
+			Expect(add()).To(HaveOccurred())
+			expectClean()
+			Expect(requests).To(HaveLen(1))
+		})
+
+		It("deletes the veth when setting it up fails part way", func() {
+			debugSetupVethError = fmt.Errorf("debugSetupVethError")
+			Expect(add()).To(MatchError("debugSetupVethError"))
+			expectClean()
+			// IPAM comes after the veth
+			Expect(requests).To(BeEmpty())
+		})
+
+		It("releases the addresses and deletes the veth when the firewall fails", func() {
+			debugFirewallError = fmt.Errorf("debugFirewallError")
+			Expect(add()).To(MatchError("debugFirewallError"))
+			expectClean()
+			Expect(requests).To(HaveLen(2))
+			Expect(requests[1].Command).To(Equal("DEL"))
+		})
+
+		It("undoes every step when the last one fails", func() {
+			debugPostIPAMError = fmt.Errorf("debugPostIPAMError")
+			Expect(add()).To(MatchError("debugPostIPAMError"))
+			expectClean()
+			Expect(requests).To(HaveLen(2))
+			Expect(requests[1].Command).To(Equal("DEL"))
+		})
+
+		It("undoes the steps in reverse and goes on after a failure", func() {
+			var undone []string
+			var r rollback
+			r.add("first", func() error { undone = append(undone, "first"); return nil })
+			r.add("second", func() error { undone = append(undone, "second"); return fmt.Errorf("gone") })
+			r.add("third", func() error { undone = append(undone, "third"); return nil })
+			r.run("dummy")
+			Expect(undone).To(Equal([]string{"third", "second", "first"}))
+
+			// steps are only undone once
+			r.run("dummy")
+			Expect(undone).To(HaveLen(3))
+		})
+	})
+
+	It("applies a sysctl profile with the explicit sysctls taking precedence", func() {
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"sysctlProfile": "hardened",
+			"sysctl": {"net.ipv4.conf.all.rp_filter": "2", "net.core.somaxconn": "1024"}
+		}`, BRNAME)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			for name, value := range map[string]string{
+				"net.ipv4.conf.all.accept_redirects":   "0",
+				"net.ipv4.conf.all.send_redirects":     "0",
+				"net.ipv4.icmp_echo_ignore_broadcasts": "1",
+				"net.ipv4.conf.all.rp_filter":          "2",
+				"net.core.somaxconn":                   "1024",
+			} {
+				got, err := sysctl.Sysctl(name)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(got).To(Equal(value), name)
+			}
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		for conf, msg := range map[string]string{
+			`"sysctlProfile": "fast"`:                `invalid sysctlProfile "fast" (must be hardened or performance)`,
+			`"sysctl": {"kernel.panic": "1"}`:        `invalid sysctl "kernel.panic" (must be a net sysctl)`,
+			`"sysctl": {"net/../kernel/panic": "1"}`: `invalid sysctl "net/../kernel/panic" (must be a net sysctl)`,
+			`"sysctlProfile": "hardened", "tap": {}`: "sysctlProfile and sysctl cannot be combined with tap, which has no container",
+		} {
+			_, _, err := loadNetConf([]byte(fmt.Sprintf(`{"cniVersion": "1.0.0", "name": "testConfig", "type": "bridge", %s}`, conf)), "")
+			Expect(err).To(MatchError(msg))
+		}
+	})
+
+	Context("when configuring the container interface", func() {
+		add := func(conf string) {
+			args := &skel.CmdArgs{
+				ContainerID: "dummy",
+				Netns:       targetNS.Path(),
+				IfName:      IFNAME,
+				StdinData:   []byte(conf),
+			}
+			err := originalNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				_, _, err := testutils.CmdAddWithArgs(args, func() error {
+					return cmdAdd(args)
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		linkLocalAddrs := func() []netlink.Addr {
+			var addrs []netlink.Addr
+			err := targetNS.Do(func(ns.NetNS) error {
+				defer GinkgoRecover()
+				link, err := netlink.LinkByName(IFNAME)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().Flags & net.FlagUp).NotTo(BeZero())
+				all, err := netlink.AddrList(link, netlink.FAMILY_V6)
+				Expect(err).NotTo(HaveOccurred())
+				for _, addr := range all {
+					if addr.IP.IsLinkLocalUnicast() {
+						addrs = append(addrs, addr)
+					}
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return addrs
+		}
+
+		It("sets the address generation mode before the interface comes up", func() {
+			add(fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "testConfig",
+				"type": "bridge",
+				"bridge": "%s",
+				"ipv6AddrGen": {"mode": "none"}
+			}`, BRNAME))
+			Expect(linkLocalAddrs()).To(BeEmpty())
+		})
+
+		It("sets the sysctls before the interface comes up and gets its addresses", func() {
+			defer func() { configureIface = ipam.ConfigureIface }()
+			var configured bool
+			configureIface = func(ifName string, res *types100.Result) error {
+				defer GinkgoRecover()
+				configured = true
+				link, err := netlink.LinkByName(ifName)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(link.Attrs().Flags & net.FlagUp).To(BeZero())
+				addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(addrs).To(BeEmpty())
+				for name, value := range map[string]string{
+					fmt.Sprintf("net/ipv6/conf/%s/accept_ra", ifName):  "2",
+					fmt.Sprintf("net/ipv4/conf/%s/arp_ignore", ifName): "1",
+					"net/ipv4/conf/all/rp_filter":                      "1",
+				} {
+					got, err := sysctl.Sysctl(name)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(got).To(Equal(value), name)
+				}
+				return ipam.ConfigureIface(ifName, res)
+			}
+
+			add(fmt.Sprintf(`{
+				"cniVersion": "1.0.0",
+				"name": "testConfig",
+				"type": "bridge",
+				"bridge": "%s",
+				"acceptRA": {"value": 2, "interfaces": ["container"]},
+				"arp": {"ignore": 1},
+				"sysctl": {"net.ipv4.conf.all.rp_filter": "1"},
+				"ipam": {
+					"type": "host-local",
+					"dataDir": "%s",
+					"subnet": "10.1.2.0/24"
+				}
+			}`, BRNAME, dataDir))
+			Expect(configured).To(BeTrue())
+			Expect(linkLocalAddrs()).NotTo(BeEmpty())
+		})
+	})
+
+	It("sets up an IPv6-only network without touching IPv4", func() {
+		var neighSysctls []string
+		neighSysctl = func(name string, params ...string) (string, error) {
+			neighSysctls = append(neighSysctls, name)
+			return "0", nil
+		}
+		defer func() { neighSysctl = sysctl.Sysctl }()
+
+		conf := fmt.Sprintf(`{
+			"cniVersion": "1.0.0",
+			"name": "testConfig",
+			"type": "bridge",
+			"bridge": "%s",
+			"isDefaultGateway": true,
+			"hostRoutes": true,
+			"ipFamilies": ["ipv6"],
+			"neighGCThresh": {"thresh1": 1024},
+			"ipam": {
+				"type": "host-local",
+				"dataDir": "%s",
+				"ranges": [[{"subnet": "2001:db8:1::/64"}]]
+			}
+		}`, BRNAME, dataDir)
+
+		args := &skel.CmdArgs{
+			ContainerID: "dummy",
+			Netns:       targetNS.Path(),
+			IfName:      IFNAME,
+			StdinData:   []byte(conf),
+		}
+
+		v4Addrs := func(link netlink.Link) []netlink.Addr {
+			addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			return addrs
+		}
+
+		err := originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			_, err := sysctl.Sysctl("net/ipv4/ip_forward", "0")
+			Expect(err).NotTo(HaveOccurred())
+
+			r, _, err := testutils.CmdAddWithArgs(args, func() error {
+				return cmdAdd(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			result, err := types100.GetResult(r)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.IPs).To(HaveLen(1))
+			Expect(result.IPs[0].Address.String()).To(Equal("2001:db8:1::2/64"))
+			Expect(result.IPs[0].Gateway.String()).To(Equal("2001:db8:1::1"))
+
+			br, err := netlink.LinkByName(BRNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(v4Addrs(br)).To(BeEmpty())
+			addrs, err := netlink.AddrList(br, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+			var global []string
+			for _, addr := range addrs {
+				if !addr.IP.IsLinkLocalUnicast() {
+					global = append(global, addr.IPNet.String())
+				}
+			}
+			Expect(global).To(ConsistOf("2001:db8:1::1/64"))
+			routes, err := netlink.RouteList(br, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(BeEmpty())
+
+			forward, err := sysctl.Sysctl("net/ipv4/ip_forward")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(forward).To(Equal("0"))
+			forward, err = sysctl.Sysctl("net/ipv6/conf/all/forwarding")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(forward).To(Equal("1"))
+
+			for _, name := range neighSysctls {
+				Expect(name).NotTo(ContainSubstring("ipv4"))
+			}
+			Expect(neighSysctls).NotTo(BeEmpty())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = targetNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			link, err := netlink.LinkByName(IFNAME)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(v4Addrs(link)).To(BeEmpty())
+			routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(routes).To(BeEmpty())
+
+			routes, err = netlink.RouteList(link, netlink.FAMILY_V6)
+			Expect(err).NotTo(HaveOccurred())
+			var gws []string
+			for _, r := range routes {
+				if r.Dst == nil && r.Gw != nil {
+					gws = append(gws, r.Gw.String())
+				}
+			}
+			Expect(gws).To(ConsistOf("2001:db8:1::1"))
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		err = originalNS.Do(func(ns.NetNS) error {
+			defer GinkgoRecover()
+			err := testutils.CmdDelWithArgs(args, func() error {
+				return cmdDel(args)
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return nil
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
 })
+
+// flakyNS fails to enter the namespace until failures is used up.
+type flakyNS struct {
+	ns.NetNS
+	failures *int
+}
+
+func (n *flakyNS) Do(toRun func(ns.NetNS) error) error {
+	if *n.failures > 0 {
+		*n.failures--
+		return fmt.Errorf("error switching to ns %s: invalid argument", n.Path())
+	}
+	return n.NetNS.Do(toRun)
+}
@@ -0,0 +1,115 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// IFLA_BR_FDB_MAX_LEARNED, which the vendored netlink does not know yet.
+// Kernels before 6.8 ignore it.
+const iflaBrFdbMaxLearned = 49
+
+// setFdbMaxLearned caps the number of FDB entries the bridge learns;
+// frames from further source MACs are still forwarded but not learned.
+// Kernels without the limit only get a log message.
+func setFdbMaxLearned(br *netlink.Bridge, max uint32) error {
+	req := nl.NewNetlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(br.Attrs().Index)
+	req.AddData(msg)
+
+	linkInfo := nl.NewRtAttr(unix.IFLA_LINKINFO, nil)
+	linkInfo.AddRtAttr(nl.IFLA_INFO_KIND, nl.NonZeroTerminated("bridge"))
+	data := linkInfo.AddRtAttr(nl.IFLA_INFO_DATA, nil)
+	data.AddRtAttr(iflaBrFdbMaxLearned, nl.Uint32Attr(max))
+	req.AddData(linkInfo)
+
+	if _, err := req.Execute(unix.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("failed to set fdbMaxSize on %q: %v", br.Attrs().Name, err)
+	}
+
+	if _, ok, err := fdbMaxLearned(br.Attrs().Index); err != nil {
+		return err
+	} else if !ok {
+		log.Printf("kernel does not support fdbMaxSize, the FDB of %q is not limited", br.Attrs().Name)
+	}
+	return nil
+}
+
+// fdbMaxLearned returns the FDB limit of the bridge with the given index,
+// and whether the kernel reports one at all.
+func fdbMaxLearned(index int) (uint32, bool, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(index)
+	req.AddData(msg)
+
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWLINK)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to get link %d: %v", index, err)
+	}
+	for _, m := range msgs {
+		linkInfo, err := findAttr(m[unix.SizeofIfInfomsg:], unix.IFLA_LINKINFO)
+		if err != nil || linkInfo == nil {
+			return 0, false, err
+		}
+		data, err := findAttr(linkInfo, nl.IFLA_INFO_DATA)
+		if err != nil || data == nil {
+			return 0, false, err
+		}
+		max, err := findAttr(data, iflaBrFdbMaxLearned)
+		if err != nil || len(max) < 4 {
+			return 0, false, err
+		}
+		return nl.NativeEndian().Uint32(max), true, nil
+	}
+	return 0, false, nil
+}
+
+func findAttr(b []byte, attrType uint16) ([]byte, error) {
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range attrs {
+		if a.Attr.Type&nl.NLA_TYPE_MASK == attrType {
+			return a.Value, nil
+		}
+	}
+	return nil, nil
+}
+
+// setNestedBridging makes the bridge port name learn and forward to every
+// source MAC behind it, and flood frames to unknown destinations out of
+// it, which the MACs of a bridge nested behind the port rely on.
+func setNestedBridging(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", name, err)
+	}
+	if err := netlink.LinkSetLearning(link, true); err != nil {
+		return fmt.Errorf("failed to enable learning on %q: %v", name, err)
+	}
+	if err := netlink.LinkSetFlood(link, true); err != nil {
+		return fmt.Errorf("failed to enable flooding on %q: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+// setupFirewall installs the iptables rules of the container's addresses.
+func setupFirewall(n *NetConf, containerID string, ips []*current.IPConfig) error {
+	if n.IPMasq {
+		chain := utils.FormatChainName(n.Name, containerID)
+		comment := utils.FormatComment(n.Name, containerID)
+		for _, ipc := range ips {
+			if n.snatted(ipc.Address.IP) {
+				continue
+			}
+			if err := ip.SetupIPMasq(&ipc.Address, chain, comment); err != nil {
+				return err
+			}
+		}
+	}
+
+	if n.mark != nil {
+		chain := markChain(n.Name, containerID)
+		for _, ipc := range ips {
+			if err := chain.setup(&ipc.Address, markRules(*n.mark)); err != nil {
+				return fmt.Errorf("failed to set up firewall mark: %v", err)
+			}
+		}
+	}
+
+	if n.DSCP != nil {
+		chain := dscpChain(n.Name, containerID)
+		for _, ipc := range ips {
+			if err := chain.setup(&ipc.Address, dscpRules(*n.DSCP)); err != nil {
+				return fmt.Errorf("failed to set up DSCP marking: %v", err)
+			}
+		}
+	}
+
+	if n.MSSClamp != nil {
+		chain := mssClampChain(n.Name, containerID)
+		for _, ipc := range ips {
+			if err := chain.setup(&ipc.Address, mssClampRules(n.MSSClamp)); err != nil {
+				return fmt.Errorf("failed to set up MSS clamping: %v", err)
+			}
+		}
+	}
+
+	if n.ConntrackZone != nil {
+		chain := ctZoneChain(n.Name, containerID)
+		for _, ipc := range ips {
+			if err := chain.setup(&ipc.Address, ctZoneRules(*n.ConntrackZone)); err != nil {
+				return fmt.Errorf("failed to set up conntrack zone: %v", err)
+			}
+		}
+	}
+
+	if n.snatIP != nil {
+		chain := snatChain(n.Name, containerID)
+		for _, ipc := range ips {
+			if !n.snatted(ipc.Address.IP) {
+				continue
+			}
+			if err := chain.setup(&ipc.Address, snatRules(&ipc.Address, n.snatIP)); err != nil {
+				return fmt.Errorf("failed to set up SNAT: %v", err)
+			}
+		}
+	}
+
+	// Return an error requested by testcases, if any
+	return debugFirewallError
+}
+
+// teardownFirewall removes the rules setupFirewall installed for ipnets.
+func teardownFirewall(n *NetConf, containerID string, ipnets []*net.IPNet) error {
+	if n.IPMasq {
+		chain := utils.FormatChainName(n.Name, containerID)
+		comment := utils.FormatComment(n.Name, containerID)
+		for _, ipn := range ipnets {
+			if err := ip.TeardownIPMasq(ipn, chain, comment); err != nil {
+				return err
+			}
+		}
+	}
+
+	if n.mark != nil {
+		chain := markChain(n.Name, containerID)
+		for _, ipn := range ipnets {
+			if err := chain.teardown(ipn); err != nil {
+				return err
+			}
+		}
+	}
+
+	if n.DSCP != nil {
+		chain := dscpChain(n.Name, containerID)
+		for _, ipn := range ipnets {
+			if err := chain.teardown(ipn); err != nil {
+				return err
+			}
+		}
+	}
+
+	if n.MSSClamp != nil {
+		chain := mssClampChain(n.Name, containerID)
+		for _, ipn := range ipnets {
+			if err := chain.teardown(ipn); err != nil {
+				return err
+			}
+		}
+	}
+
+	if n.ConntrackZone != nil {
+		chain := ctZoneChain(n.Name, containerID)
+		for _, ipn := range ipnets {
+			if err := chain.teardown(ipn); err != nil {
+				return err
+			}
+		}
+	}
+
+	if n.snatIP != nil {
+		chain := snatChain(n.Name, containerID)
+		for _, ipn := range ipnets {
+			if !n.snatted(ipn.IP) {
+				continue
+			}
+			if err := chain.teardown(ipn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// IFLA_GRO_MAX_SIZE, which the vendored netlink does not know yet.
+const iflaGROMaxSize = 58
+
+// maxGSOSize is the largest gso_max_size and gro_max_size the kernel
+// accepts, GSO_MAX_SIZE, with BIG TCP.
+const maxGSOSize = 8 * 65535
+
+func validateGSOSize(name string, size *int) error {
+	if size != nil && (*size < 1 || *size > maxGSOSize) {
+		return fmt.Errorf("invalid %s %d (must be between 1 and %d)", name, *size, maxGSOSize)
+	}
+	return nil
+}
+
+// setGSOMaxSize sets the largest segments the interface ifName builds, gso,
+// and aggregates, gro, if they are set. Sizes above 65536, for BIG TCP,
+// need a recent kernel.
+func setGSOMaxSize(ifName string, gso, gro *int) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+
+	req := nl.NewNetlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+	if gso != nil {
+		req.AddData(nl.NewRtAttr(unix.IFLA_GSO_MAX_SIZE, nl.Uint32Attr(uint32(*gso))))
+	}
+	if gro != nil {
+		req.AddData(nl.NewRtAttr(iflaGROMaxSize, nl.Uint32Attr(uint32(*gro))))
+	}
+
+	if _, err := req.Execute(unix.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("failed to set the GSO/GRO max size of %q: %v", ifName, err)
+	}
+	return nil
+}
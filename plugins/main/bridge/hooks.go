@@ -0,0 +1,112 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+const (
+	defaultHookTimeout = 10 * time.Second
+	hookPath           = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+// Hook is a command run after a successful ADD, e.g. to register the pod
+// with a local agent. It does not inherit the plugin's environment and
+// only gets the variables of hookEnv. A failing hook fails the ADD: the
+// addresses are released and the runtime's DEL removes the interface, so
+// a hook has to undo its own partial work, or cope with being run again.
+type Hook struct {
+	Path      string   `json:"path"`
+	Args      []string `json:"args,omitempty"`
+	TimeoutMs int      `json:"timeoutMs,omitempty"`
+}
+
+func (h *Hook) validate() error {
+	if !filepath.IsAbs(h.Path) {
+		return fmt.Errorf("invalid postSetupHook path %q (must be absolute)", h.Path)
+	}
+	if h.TimeoutMs < 0 {
+		return fmt.Errorf("invalid postSetupHook timeoutMs %d (must not be negative)", h.TimeoutMs)
+	}
+	return nil
+}
+
+// hookEnv describes the container's interface to a hook.
+func hookEnv(n *NetConf, args *skel.CmdArgs, result *current.Result) []string {
+	var ips []string
+	for _, ipc := range result.IPs {
+		ips = append(ips, ipc.Address.String())
+	}
+	hostIfName := ""
+	if len(result.Interfaces) > 1 {
+		hostIfName = result.Interfaces[1].Name
+	}
+	return []string{
+		"PATH=" + hookPath,
+		"CNI_COMMAND=ADD",
+		"CNI_NETWORK=" + n.Name,
+		"CNI_CONTAINERID=" + args.ContainerID,
+		"CNI_NETNS=" + args.Netns,
+		"CNI_IFNAME=" + args.IfName,
+		"CNI_HOST_IFNAME=" + hostIfName,
+		"CNI_BRIDGE=" + n.BrName,
+		"CNI_IPS=" + strings.Join(ips, ","),
+		"CNI_POD=" + n.podID,
+	}
+}
+
+// runHooks runs the postSetupHooks in order and stops at the first one
+// that fails. Their output is logged.
+func runHooks(n *NetConf, args *skel.CmdArgs, result *current.Result) error {
+	env := hookEnv(n, args, result)
+	for _, h := range n.PostSetupHooks {
+		timeout := defaultHookTimeout
+		if h.TimeoutMs != 0 {
+			timeout = time.Duration(h.TimeoutMs) * time.Millisecond
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		cmd := exec.CommandContext(ctx, h.Path, h.Args...)
+		cmd.Env = env
+		cmd.Dir = "/"
+		out, err := cmd.CombinedOutput()
+		cancel()
+
+		out = bytes.TrimSpace(out)
+		if len(out) > 0 {
+			log.Printf("postSetupHook %s: %s", h.Path, out)
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("postSetupHook %s timed out after %v", h.Path, timeout)
+		}
+		if err != nil {
+			if len(out) > 0 {
+				return fmt.Errorf("postSetupHook %s failed: %v: %s", h.Path, err, out)
+			}
+			return fmt.Errorf("postSetupHook %s failed: %v", h.Path, err)
+		}
+	}
+	return nil
+}
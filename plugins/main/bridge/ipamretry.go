@@ -0,0 +1,184 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/containernetworking/plugins/pkg/ipam"
+)
+
+const (
+	defaultIPAMRetryAttempts  = 3
+	defaultIPAMInitialBackoff = 100 * time.Millisecond
+	defaultIPAMMaxBackoff     = time.Second
+)
+
+// IPAMRetryConf retries the IPAM plugin when ADD fails, releasing whatever
+// the failed try may have allocated first, and then tries Fallback, an
+// IPAM section like the network's own, the same way. Zero values pick the
+// defaults.
+type IPAMRetryConf struct {
+	// Attempts is the total number of tries of each IPAM section
+	Attempts int `json:"attempts,omitempty"`
+	// InitialBackoffMs is doubled after every failed try, up to
+	// MaxBackoffMs
+	InitialBackoffMs int                    `json:"initialBackoffMs,omitempty"`
+	MaxBackoffMs     int                    `json:"maxBackoffMs,omitempty"`
+	Fallback         map[string]interface{} `json:"fallback,omitempty"`
+}
+
+func (c *IPAMRetryConf) validate() error {
+	if c.Attempts < 0 {
+		return fmt.Errorf("invalid ipamRetry attempts %d (must not be negative)", c.Attempts)
+	}
+	if c.InitialBackoffMs < 0 || c.MaxBackoffMs < 0 {
+		return fmt.Errorf("invalid ipamRetry backoff: must not be negative")
+	}
+	if c.MaxBackoffMs != 0 && c.MaxBackoffMs < c.InitialBackoffMs {
+		return fmt.Errorf("invalid ipamRetry backoff: maxBackoffMs %d is less than initialBackoffMs %d", c.MaxBackoffMs, c.InitialBackoffMs)
+	}
+	if c.Fallback != nil {
+		if t, _ := c.Fallback["type"].(string); t == "" {
+			return fmt.Errorf("ipamRetry fallback must have a type")
+		}
+	}
+	return nil
+}
+
+func (c *IPAMRetryConf) policy() (int, time.Duration, time.Duration) {
+	attempts, initial, max := 1, defaultIPAMInitialBackoff, defaultIPAMMaxBackoff
+	if c == nil {
+		return attempts, initial, max
+	}
+	attempts = defaultIPAMRetryAttempts
+	if c.Attempts != 0 {
+		attempts = c.Attempts
+	}
+	if c.InitialBackoffMs != 0 {
+		initial = time.Duration(c.InitialBackoffMs) * time.Millisecond
+	}
+	if c.MaxBackoffMs != 0 {
+		max = time.Duration(c.MaxBackoffMs) * time.Millisecond
+	}
+	if max < initial {
+		max = initial
+	}
+	return attempts, initial, max
+}
+
+// ipamSection is an IPAM plugin to run and the network configuration to
+// run it with.
+type ipamSection struct {
+	plugin string
+	stdin  []byte
+}
+
+// ipamSections returns the network's IPAM plugin and, with a fallback, the
+// fallback in its place.
+func ipamSections(n *NetConf, stdin []byte) ([]ipamSection, error) {
+	sections := []ipamSection{{plugin: n.IPAM.Type, stdin: stdin}}
+	if n.IPAMRetry == nil || n.IPAMRetry.Fallback == nil {
+		return sections, nil
+	}
+	var conf map[string]interface{}
+	if err := json.Unmarshal(stdin, &conf); err != nil {
+		return nil, fmt.Errorf("failed to load netconf: %v", err)
+	}
+	conf["ipam"] = n.IPAMRetry.Fallback
+	fallback, err := json.Marshal(conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build the fallback IPAM config: %v", err)
+	}
+	plugin, _ := n.IPAMRetry.Fallback["type"].(string)
+	return append(sections, ipamSection{plugin: plugin, stdin: fallback}), nil
+}
+
+// ipamAdd runs ADD of the IPAM plugin, retrying and falling back as
+// configured, and returns the result and the section it came from, to
+// release it from on failure. It returns the last error if every try
+// fails.
+func ipamAdd(n *NetConf, stdin []byte) (types.Result, *ipamSection, error) {
+	sections, err := ipamSections(n, stdin)
+	if err != nil {
+		return nil, nil, err
+	}
+	attempts, initial, max := n.IPAMRetry.policy()
+	for i := range sections {
+		sec := &sections[i]
+		backoff := initial
+		for try := 1; try <= attempts; try++ {
+			if try > 1 {
+				sleep(backoff)
+				if backoff *= 2; backoff > max {
+					backoff = max
+				}
+			}
+			var r types.Result
+			if r, err = ipam.ExecAdd(sec.plugin, sec.stdin); err == nil {
+				return r, sec, nil
+			}
+			if n.IPAMRetry == nil {
+				return nil, nil, err
+			}
+			log.Printf("IPAM plugin %s failed on try %d of %d: %v", sec.plugin, try, attempts, err)
+			// a plugin that failed part way may hold an address
+			ipam.ExecDel(sec.plugin, sec.stdin)
+		}
+	}
+	return nil, nil, err
+}
+
+// ipamDel runs DEL of the IPAM plugin and of the fallback, either of
+// which may have allocated the addresses, and returns the first error.
+func ipamDel(n *NetConf, stdin []byte) error {
+	sections, err := ipamSections(n, stdin)
+	if err != nil {
+		return err
+	}
+	var first error
+	for _, sec := range sections {
+		if err := ipam.ExecDel(sec.plugin, sec.stdin); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// ipamCheck runs CHECK of the IPAM plugin and, if that fails, of the
+// fallback, since as on DEL either may hold the addresses. It returns the
+// first error if no section passes.
+func ipamCheck(n *NetConf, stdin []byte) error {
+	sections, err := ipamSections(n, stdin)
+	if err != nil {
+		return err
+	}
+	var first error
+	for _, sec := range sections {
+		err := ipam.ExecCheck(sec.plugin, sec.stdin)
+		if err == nil {
+			return nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return first
+}
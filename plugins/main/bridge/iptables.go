@@ -0,0 +1,220 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/utils"
+)
+
+// podChain is a per-container iptables chain that the traffic sourced from
+// the container's address is sent through. Every container gets its own
+// chain in the given table, referenced from a single rule in hook, so the
+// whole thing can be torn down without knowing the rules it contained.
+// With bothWays, traffic to the container's address is sent through it as
+// well.
+type podChain struct {
+	table    string
+	hook     string
+	name     string
+	comment  string
+	bothWays bool
+}
+
+func newPodChain(table, hook, prefix, netName, containerID string) *podChain {
+	return &podChain{
+		table:   table,
+		hook:    hook,
+		name:    utils.MustFormatChainNameWithPrefix(netName, containerID, prefix),
+		comment: utils.FormatComment(netName, containerID),
+	}
+}
+
+func iptablesFor(ipn *net.IPNet) (*iptables.IPTables, error) {
+	proto := iptables.ProtocolIPv4
+	if ipn.IP.To4() == nil {
+		proto = iptables.ProtocolIPv6
+	}
+	ipt, err := iptables.NewWithProtocol(proto)
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate iptables: %v", err)
+	}
+	return ipt, nil
+}
+
+// setup creates the chain with the given rules and sends traffic from ipn
+// through it.
+func (c *podChain) setup(ipn *net.IPNet, rules [][]string) error {
+	ipt, err := iptablesFor(ipn)
+	if err != nil {
+		return err
+	}
+
+	if err := utils.EnsureChain(ipt, c.table, c.name); err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		rule = append(rule, "-m", "comment", "--comment", c.comment)
+		if err := ipt.AppendUnique(c.table, c.name, rule...); err != nil {
+			return err
+		}
+	}
+
+	for _, jump := range c.jumpRules(ipn) {
+		if err := ipt.AppendUnique(c.table, c.hook, jump...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// teardown removes the jump for ipn and deletes the chain.
+func (c *podChain) teardown(ipn *net.IPNet) error {
+	ipt, err := iptablesFor(ipn)
+	if err != nil {
+		return err
+	}
+
+	for _, jump := range c.jumpRules(ipn) {
+		if err := utils.DeleteRule(ipt, c.table, c.hook, jump...); err != nil {
+			return err
+		}
+	}
+
+	if err := ipt.ClearChain(c.table, c.name); err != nil {
+		return err
+	}
+
+	return utils.DeleteChain(ipt, c.table, c.name)
+}
+
+func (c *podChain) jumpRules(ipn *net.IPNet) [][]string {
+	rules := [][]string{{"-s", ipn.IP.String(), "-j", c.name, "-m", "comment", "--comment", c.comment}}
+	if c.bothWays {
+		rules = append(rules, []string{"-d", ipn.IP.String(), "-j", c.name, "-m", "comment", "--comment", c.comment})
+	}
+	return rules
+}
+
+// markChain tags the container's egress with the requested firewall mark
+// and saves it to the connection so replies carry it as well.
+func markChain(netName, containerID string) *podChain {
+	return newPodChain("mangle", "PREROUTING", "MARK-", netName, containerID)
+}
+
+func markRules(mark uint32) [][]string {
+	return [][]string{
+		{"-j", "MARK", "--set-xmark", fmt.Sprintf("0x%x/0xffffffff", mark)},
+		{"-j", "CONNMARK", "--save-mark"},
+	}
+}
+
+// dscpChain rewrites the DSCP field of the container's egress.
+func dscpChain(netName, containerID string) *podChain {
+	return newPodChain("mangle", "PREROUTING", "DSCP-", netName, containerID)
+}
+
+func dscpRules(dscp int) [][]string {
+	return [][]string{
+		{"-j", "DSCP", "--set-dscp", fmt.Sprintf("0x%02x", dscp)},
+	}
+}
+
+// MSSClampConf sets the MSS of the container's TCP SYNs to MSS, or with
+// ClampToPMTU to what the path MTU of the route out allows.
+type MSSClampConf struct {
+	MSS         int  `json:"mss,omitempty"`
+	ClampToPMTU bool `json:"clampToPMTU,omitempty"`
+}
+
+func (c *MSSClampConf) validate() error {
+	if c.ClampToPMTU == (c.MSS != 0) {
+		return fmt.Errorf("mssClamp requires exactly one of mss and clampToPMTU")
+	}
+	if c.MSS != 0 && (c.MSS < 536 || c.MSS > 65495) {
+		return fmt.Errorf("invalid mssClamp mss %d (must be between 536 and 65495)", c.MSS)
+	}
+	return nil
+}
+
+// mssClampChain clamps the MSS of the container's egress. The kernel only
+// clamps to the path MTU, which needs the route, once it is forwarded.
+func mssClampChain(netName, containerID string) *podChain {
+	return newPodChain("mangle", "FORWARD", "MSS-", netName, containerID)
+}
+
+func mssClampRules(c *MSSClampConf) [][]string {
+	rule := []string{"-p", "tcp", "--tcp-flags", "SYN,RST", "SYN", "-j", "TCPMSS"}
+	if c.ClampToPMTU {
+		rule = append(rule, "--clamp-mss-to-pmtu")
+	} else {
+		rule = append(rule, "--set-mss", fmt.Sprintf("%d", c.MSS))
+	}
+	return [][]string{rule}
+}
+
+// ctZoneChain places the container's connections in a conntrack zone of
+// their own. Replies have to be looked up in the same zone, so traffic to
+// the container goes through the chain too.
+func ctZoneChain(netName, containerID string) *podChain {
+	c := newPodChain("raw", "PREROUTING", "CTZONE-", netName, containerID)
+	c.bothWays = true
+	return c
+}
+
+func ctZoneRules(zone int) [][]string {
+	return [][]string{
+		{"-j", "CT", "--zone", fmt.Sprintf("%d", zone)},
+	}
+}
+
+// snatChain source-NATs the container's egress to a fixed host address.
+// Traffic that stays within the container's subnet is left alone.
+func snatChain(netName, containerID string) *podChain {
+	return newPodChain("nat", "POSTROUTING", "SNAT-", netName, containerID)
+}
+
+func snatRules(ipn *net.IPNet, addr net.IP) [][]string {
+	multicast := "224.0.0.0/4"
+	if addr.To4() == nil {
+		multicast = "ff00::/8"
+	}
+	network := &net.IPNet{IP: ipn.IP.Mask(ipn.Mask), Mask: ipn.Mask}
+	return [][]string{
+		{"-d", network.String(), "-j", "ACCEPT"},
+		{"!", "-d", multicast, "-j", "SNAT", "--to-source", addr.String()},
+	}
+}
+
+// checkHostAddr makes sure addr is configured on an interface of the
+// current namespace; SNAT to any other address blackholes the replies.
+func checkHostAddr(addr net.IP) error {
+	addrs, err := netlink.AddrList(nil, ipFamily(addr))
+	if err != nil {
+		return fmt.Errorf("failed to list host addresses: %v", err)
+	}
+	for _, a := range addrs {
+		if a.IP.Equal(addr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("snatAddress %s is not configured on the host", addr)
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxMacPrefixLen keeps at least 24 random bits in generated addresses.
+const maxMacPrefixLen = 3
+
+// parseMacPrefix parses a colon separated MAC prefix such as "0a:58". The
+// prefix must denote locally administered unicast addresses so generated
+// MACs never clash with vendor assigned ones.
+func parseMacPrefix(s string) (net.HardwareAddr, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) > maxMacPrefixLen {
+		return nil, fmt.Errorf("macPrefix %q is too long (at most %d bytes)", s, maxMacPrefixLen)
+	}
+
+	prefix := make(net.HardwareAddr, len(parts))
+	for i, part := range parts {
+		if len(part) != 2 {
+			return nil, fmt.Errorf("invalid macPrefix %q", s)
+		}
+		b, err := strconv.ParseUint(part, 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid macPrefix %q", s)
+		}
+		prefix[i] = byte(b)
+	}
+
+	if prefix[0]&0x02 == 0 || prefix[0]&0x01 != 0 {
+		return nil, fmt.Errorf("macPrefix %q is not a locally administered unicast prefix", s)
+	}
+	return prefix, nil
+}
+
+// randomMac returns a random MAC address starting with prefix.
+func randomMac(prefix net.HardwareAddr) (string, error) {
+	mac := make(net.HardwareAddr, 6)
+	if _, err := rand.Read(mac); err != nil {
+		return "", fmt.Errorf("failed to generate MAC address: %v", err)
+	}
+	copy(mac, prefix)
+	return mac.String(), nil
+}
+
+// stableMac returns the MAC address derived from the network, pod and
+// interface name, starting with prefix, so a pod recreated under the same
+// name gets the same MAC on each of its interfaces. Without a prefix the
+// address is made locally administered unicast.
+func stableMac(prefix net.HardwareAddr, network, pod, ifName string) string {
+	sum := sha256.Sum256([]byte(network + "\x00" + pod + "\x00" + ifName))
+	mac := net.HardwareAddr(sum[:6])
+	if prefix == nil {
+		mac[0] = mac[0]&^0x01 | 0x02
+	}
+	copy(mac, prefix)
+	return mac.String()
+}
@@ -0,0 +1,208 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+)
+
+const (
+	defaultRetryAttempts  = 4
+	defaultInitialBackoff = 10 * time.Millisecond
+	defaultMaxBackoff     = 200 * time.Millisecond
+
+	defaultNetnsTimeout  = time.Second
+	defaultNetnsInterval = 50 * time.Millisecond
+)
+
+// For testcases to inject failing netlink requests and skip the backoff
+var (
+	linkAdd  = netlink.LinkAdd
+	addrAdd  = netlink.AddrAdd
+	routeAdd = netlink.RouteAdd
+	sleep    = time.Sleep
+	getNS    = ns.GetNS
+)
+
+// RetryConf bounds how often the idempotent netlink requests are retried
+// when they fail with an error that is transient under heavy pod churn.
+// Zero values pick the defaults.
+type RetryConf struct {
+	// Attempts is the total number of tries, 1 disables retries
+	Attempts int `json:"attempts,omitempty"`
+	// InitialBackoffMs is doubled after every failed try, up to
+	// MaxBackoffMs
+	InitialBackoffMs int `json:"initialBackoffMs,omitempty"`
+	MaxBackoffMs     int `json:"maxBackoffMs,omitempty"`
+}
+
+func (c *RetryConf) validate() error {
+	if c.Attempts < 0 {
+		return fmt.Errorf("invalid netlinkRetry attempts %d (must not be negative)", c.Attempts)
+	}
+	if c.InitialBackoffMs < 0 || c.MaxBackoffMs < 0 {
+		return fmt.Errorf("invalid netlinkRetry backoff: must not be negative")
+	}
+	if c.MaxBackoffMs != 0 && c.MaxBackoffMs < c.InitialBackoffMs {
+		return fmt.Errorf("invalid netlinkRetry backoff: maxBackoffMs %d is less than initialBackoffMs %d", c.MaxBackoffMs, c.InitialBackoffMs)
+	}
+	return nil
+}
+
+func (c *RetryConf) policy() (int, time.Duration, time.Duration) {
+	attempts, initial, max := defaultRetryAttempts, defaultInitialBackoff, defaultMaxBackoff
+	if c == nil {
+		return attempts, initial, max
+	}
+	if c.Attempts != 0 {
+		attempts = c.Attempts
+	}
+	if c.InitialBackoffMs != 0 {
+		initial = time.Duration(c.InitialBackoffMs) * time.Millisecond
+	}
+	if c.MaxBackoffMs != 0 {
+		max = time.Duration(c.MaxBackoffMs) * time.Millisecond
+	}
+	if max < initial {
+		max = initial
+	}
+	return attempts, initial, max
+}
+
+// retry calls op until it succeeds, fails with an error that is not
+// transient, or runs out of attempts, and returns its last error. A nil
+// RetryConf retries with the defaults.
+func (c *RetryConf) retry(op func() error) error {
+	attempts, backoff, max := c.policy()
+	for i := 1; ; i++ {
+		err := op()
+		if err == nil || !isTransient(err) || i >= attempts {
+			return err
+		}
+		sleep(backoff)
+		if backoff *= 2; backoff > max {
+			backoff = max
+		}
+	}
+}
+
+// isTransient reports errors the kernel returns while a link that is
+// being created or deleted elsewhere settles.
+func isTransient(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	switch errno {
+	case syscall.EBUSY, syscall.EAGAIN, syscall.ENOENT:
+		return true
+	}
+	return false
+}
+
+// NetnsRetryConf retries entering the container's network namespace while
+// the runtime is still setting it up, which shows as the path not existing
+// or not being a namespace yet. Zero values pick the defaults.
+type NetnsRetryConf struct {
+	// TimeoutMs bounds the time spent waiting between tries
+	TimeoutMs  int `json:"timeoutMs,omitempty"`
+	IntervalMs int `json:"intervalMs,omitempty"`
+}
+
+func (c *NetnsRetryConf) validate() error {
+	if c.TimeoutMs < 0 || c.IntervalMs < 0 {
+		return fmt.Errorf("invalid netnsRetry: timeoutMs and intervalMs must not be negative")
+	}
+	return nil
+}
+
+// retry calls op until it succeeds, fails with an error it does not report
+// as transient, or the timeout is used up. A nil NetnsRetryConf calls op
+// once.
+func (c *NetnsRetryConf) retry(op func() (bool, error)) error {
+	if c == nil {
+		_, err := op()
+		return err
+	}
+	timeout, interval := defaultNetnsTimeout, defaultNetnsInterval
+	if c.TimeoutMs != 0 {
+		timeout = time.Duration(c.TimeoutMs) * time.Millisecond
+	}
+	if c.IntervalMs != 0 {
+		interval = time.Duration(c.IntervalMs) * time.Millisecond
+	}
+	for waited := time.Duration(0); ; waited += interval {
+		transient, err := op()
+		if err == nil || !transient || waited+interval > timeout {
+			return err
+		}
+		sleep(interval)
+	}
+}
+
+// openNetNS opens the network namespace at path. With a NetnsRetryConf,
+// opening it and entering it in Do are retried.
+func openNetNS(path string, c *NetnsRetryConf) (ns.NetNS, error) {
+	var netns ns.NetNS
+	err := c.retry(func() (bool, error) {
+		var err error
+		netns, err = getNS(path)
+		switch err.(type) {
+		case ns.NSPathNotExistErr, ns.NSPathNotNSErr:
+			return true, err
+		}
+		return false, err
+	})
+	if err != nil || c == nil {
+		return netns, err
+	}
+	return &retryNS{NetNS: netns, conf: c}, nil
+}
+
+// withNetNSPath is ns.WithNetNSPath using openNetNS.
+func withNetNSPath(path string, c *NetnsRetryConf, toRun func(ns.NetNS) error) error {
+	netns, err := openNetNS(path, c)
+	if err != nil {
+		return err
+	}
+	defer netns.Close()
+	return netns.Do(toRun)
+}
+
+// retryNS retries failures to enter the namespace in Do. The closure
+// itself runs at most once, so nothing it set up before failing is set up
+// a second time.
+type retryNS struct {
+	ns.NetNS
+	conf *NetnsRetryConf
+}
+
+func (n *retryNS) Do(toRun func(ns.NetNS) error) error {
+	return n.conf.retry(func() (bool, error) {
+		ran := false
+		err := n.NetNS.Do(func(hostNS ns.NetNS) error {
+			ran = true
+			return toRun(hostNS)
+		})
+		return !ran, err
+	})
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+)
+
+// rollback collects how to undo each step of an ADD that succeeded, so a
+// failing ADD leaves nothing behind. The steps are undone in reverse, and
+// each undo has to cope with what it removes being gone already, since
+// the runtime may DEL the container as well.
+type rollback struct {
+	steps []rollbackStep
+}
+
+type rollbackStep struct {
+	what string
+	undo func() error
+}
+
+// add records how to undo what, e.g. "delete eth0".
+func (r *rollback) add(what string, undo func() error) {
+	r.steps = append(r.steps, rollbackStep{what, undo})
+}
+
+// run undoes every step, the last one first. Failures are logged and do
+// not stop the others; the error of the ADD is the one reported.
+func (r *rollback) run(containerID string) {
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+		log.Printf("rolling back the ADD of container %s: %s", containerID, step.what)
+		if err := step.undo(); err != nil {
+			log.Printf("failed to roll back the ADD of container %s: %s: %v", containerID, step.what, err)
+		}
+	}
+	r.steps = nil
+}
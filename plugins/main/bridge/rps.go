@@ -0,0 +1,108 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// For testcases to fake the node's CPUs and the sysfs of the host namespace,
+// which is not the one the test runs in
+var (
+	numCPU         = hostCPUs
+	sysClassNet    = "/sys/class/net"
+	sysCPUPossible = "/sys/devices/system/cpu/possible"
+)
+
+// hostCPUs returns the number of CPUs of the node, one more than the
+// highest possible CPU ID. runtime.NumCPU only counts the CPUs in the
+// affinity mask of the plugin, which the runtime may have narrowed, so it
+// is merely the fallback when sysfs cannot tell.
+func hostCPUs() int {
+	data, err := ioutil.ReadFile(sysCPUPossible)
+	if err != nil {
+		return runtime.NumCPU()
+	}
+	// a list such as "0-63" or "0,2-5", in ascending order
+	list := strings.TrimSpace(string(data))
+	last := list[strings.LastIndexAny(list, ",-")+1:]
+	id, err := strconv.Atoi(last)
+	if err != nil {
+		return runtime.NumCPU()
+	}
+	return id + 1
+}
+
+// rpsMask converts a CPU list such as "0-3,8" into the hex mask format of
+// rps_cpus: comma separated 32 bit words, most significant first.
+func rpsMask(list string, ncpu int) (string, error) {
+	words := make([]uint32, (ncpu+31)/32)
+
+	for _, part := range strings.Split(list, ",") {
+		bounds := strings.SplitN(strings.TrimSpace(part), "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return "", fmt.Errorf("invalid CPU list %q", list)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil {
+				return "", fmt.Errorf("invalid CPU list %q", list)
+			}
+		}
+		if first < 0 || last < first {
+			return "", fmt.Errorf("invalid CPU list %q", list)
+		}
+		if last >= ncpu {
+			return "", fmt.Errorf("CPU %d in %q does not exist, the node has %d CPUs", last, list, ncpu)
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			words[cpu/32] |= 1 << uint(cpu%32)
+		}
+	}
+
+	mask := make([]string, len(words))
+	for i, w := range words {
+		format := "%08x"
+		if i == len(words)-1 {
+			format = "%x"
+		}
+		mask[len(words)-1-i] = fmt.Sprintf(format, w)
+	}
+	return strings.Join(mask, ","), nil
+}
+
+// setRPSMask steers packets received on every queue of ifName to the CPUs
+// in mask.
+func setRPSMask(ifName, mask string) error {
+	queues, err := filepath.Glob(filepath.Join(sysClassNet, ifName, "queues", "rx-*", "rps_cpus"))
+	if err != nil {
+		return err
+	}
+	if len(queues) == 0 {
+		return fmt.Errorf("no receive queues found for %q", ifName)
+	}
+	for _, q := range queues {
+		if err := ioutil.WriteFile(q, []byte(mask), 0644); err != nil {
+			return fmt.Errorf("failed to set RPS mask of %q: %v", ifName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// sharedPort returns the name and the owner of the veth in netns whose
+// host end is a port of br, left by another ADD into the same namespace.
+// The owner is the container ID recorded in its alias by
+// setSharedOwner. It returns an empty name if there is none.
+func sharedPort(netns ns.NetNS, br *netlink.Bridge) (string, string, error) {
+	type port struct {
+		name, owner string
+		peerIndex   int
+	}
+	var ports []port
+
+	err := netns.Do(func(_ ns.NetNS) error {
+		links, err := netlink.LinkList()
+		if err != nil {
+			return fmt.Errorf("failed to list links: %v", err)
+		}
+		for _, link := range links {
+			veth, ok := link.(*netlink.Veth)
+			if !ok {
+				continue
+			}
+			peerIndex, err := netlink.VethPeerIndex(veth)
+			if err != nil {
+				return fmt.Errorf("failed to get the peer of %q: %v", link.Attrs().Name, err)
+			}
+			ports = append(ports, port{link.Attrs().Name, link.Attrs().Alias, peerIndex})
+		}
+		return nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	for _, p := range ports {
+		peer, err := netlink.LinkByIndex(p.peerIndex)
+		if err != nil {
+			continue
+		}
+		if peer.Attrs().MasterIndex == br.Attrs().Index {
+			return p.name, p.owner, nil
+		}
+	}
+	return "", "", nil
+}
+
+// sharedIfName derives the name of the additional interface of containerID
+// when ifName is taken by another container sharing its namespace.
+func sharedIfName(ifName, containerID string) string {
+	sum := sha256.Sum256([]byte(containerID))
+	if len(ifName) > 8 {
+		ifName = ifName[:8]
+	}
+	return fmt.Sprintf("%s-%x", ifName, sum[:3])
+}
+
+// setSharedOwner records containerID as the owner of the container
+// interface ifName, so a DEL of another container sharing the namespace
+// leaves it alone.
+func setSharedOwner(netns ns.NetNS, ifName, containerID string) error {
+	return setInterfaceAlias(netns, "container", "", ifName, containerID)
+}
+
+// ownedIfName returns the interface of containerID in netns: ifName unless
+// another container owns it, the name sharedIfName derives otherwise.
+func ownedIfName(netns ns.NetNS, ifName, containerID string) (string, error) {
+	var owner string
+	err := netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+		owner = link.Attrs().Alias
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if owner != "" && owner != containerID {
+		return sharedIfName(ifName, containerID), nil
+	}
+	return ifName, nil
+}
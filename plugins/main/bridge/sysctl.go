@@ -0,0 +1,95 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/containernetworking/plugins/pkg/utils/sysctl"
+)
+
+// sysctlProfiles are the sets of sysctls sysctlProfile selects. They are
+// all namespaced, so they only affect the container.
+var sysctlProfiles = map[string]map[string]string{
+	// hardened drops source routed and redirected packets, checks the
+	// source of the ones received and does not answer broadcast pings.
+	"hardened": {
+		"net.ipv4.conf.all.rp_filter":           "1",
+		"net.ipv4.conf.all.accept_redirects":    "0",
+		"net.ipv4.conf.all.send_redirects":      "0",
+		"net.ipv4.conf.all.accept_source_route": "0",
+		"net.ipv6.conf.all.accept_redirects":    "0",
+		"net.ipv6.conf.all.accept_source_route": "0",
+		"net.ipv4.icmp_echo_ignore_broadcasts":  "1",
+		"net.ipv4.tcp_syncookies":               "1",
+	},
+	// performance is for servers handling many short connections.
+	"performance": {
+		"net.core.somaxconn":                 "4096",
+		"net.ipv4.ip_local_port_range":       "1024 65535",
+		"net.ipv4.tcp_fin_timeout":           "15",
+		"net.ipv4.tcp_tw_reuse":              "1",
+		"net.ipv4.tcp_slow_start_after_idle": "0",
+	},
+}
+
+func validateSysctls(n *NetConf) error {
+	if _, ok := sysctlProfiles[n.SysctlProfile]; n.SysctlProfile != "" && !ok {
+		return fmt.Errorf("invalid sysctlProfile %q (must be hardened or performance)", n.SysctlProfile)
+	}
+	for _, name := range sortedSysctls(n.Sysctl) {
+		if !strings.HasPrefix(name, "net.") && !strings.HasPrefix(name, "net/") || strings.Contains(name, "..") {
+			return fmt.Errorf("invalid sysctl %q (must be a net sysctl)", name)
+		}
+	}
+	return nil
+}
+
+// resolveSysctls returns the sysctls of the profile of n, overridden by
+// the ones n sets explicitly.
+func resolveSysctls(n *NetConf) map[string]string {
+	sysctls := map[string]string{}
+	for name, value := range sysctlProfiles[n.SysctlProfile] {
+		sysctls[name] = value
+	}
+	for name, value := range n.Sysctl {
+		sysctls[name] = value
+	}
+	return sysctls
+}
+
+// setSysctls applies sysctls in netns, in the order of their names.
+func setSysctls(netns ns.NetNS, sysctls map[string]string) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		for _, name := range sortedSysctls(sysctls) {
+			if _, err := sysctl.Sysctl(name, sysctls[name]); err != nil {
+				return fmt.Errorf("failed to set sysctl %s to %q: %v", name, sysctls[name], err)
+			}
+		}
+		return nil
+	})
+}
+
+func sortedSysctls(sysctls map[string]string) []string {
+	names := make([]string, 0, len(sysctls))
+	for name := range sysctls {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,195 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// noTapOwner lets any user open the tap device.
+const noTapOwner = ^uint32(0)
+
+// TapConf bridges a tap device for a VM instead of a veth pair. The tap
+// lives in the host namespace; the VM process owning it configures its own
+// addresses from the result.
+type TapConf struct {
+	// Name of the tap to attach. An existing tap is only attached and
+	// detached again on DEL; when empty, a tap named after the container
+	// is created and deleted on DEL.
+	Name  string  `json:"name,omitempty"`
+	Owner *uint32 `json:"owner,omitempty"`
+	Group *uint32 `json:"group,omitempty"`
+}
+
+func (c *TapConf) validate() error {
+	if c.Name != "" {
+		if err := validateIfName(c.Name); err != nil {
+			return fmt.Errorf("invalid tap name: %v", err)
+		}
+	}
+	if c.Owner != nil && *c.Owner == noTapOwner {
+		return fmt.Errorf("invalid tap owner %d", *c.Owner)
+	}
+	if c.Group != nil && *c.Group == noTapOwner {
+		return fmt.Errorf("invalid tap group %d", *c.Group)
+	}
+	return nil
+}
+
+// validateIfName applies the kernel's rules for interface names.
+func validateIfName(name string) error {
+	if len(name) > 15 {
+		return fmt.Errorf("%q is longer than 15 characters", name)
+	}
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("%q is not a valid interface name", name)
+	}
+	if strings.ContainsAny(name, "/: \t\n") {
+		return fmt.Errorf("%q contains an invalid character", name)
+	}
+	return nil
+}
+
+func tapName(c *TapConf, containerID string) string {
+	if c.Name != "" {
+		return c.Name
+	}
+	if len(containerID) > 12 {
+		containerID = containerID[:12]
+	}
+	return "tap" + containerID
+}
+
+// setupTap creates the container's tap, or checks that the existing one
+// has the requested owner, and connects it to the bridge.
+func setupTap(br *netlink.Bridge, n *NetConf, containerID string) (*current.Interface, error) {
+	c := n.Tap
+	name := tapName(c, containerID)
+
+	l, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		tap := &netlink.Tuntap{
+			LinkAttrs: netlink.LinkAttrs{Name: name, MTU: n.MTU},
+			Mode:      netlink.TUNTAP_MODE_TAP,
+			Flags:     netlink.TUNTAP_DEFAULTS | netlink.TUNTAP_NO_PI,
+			Owner:     noTapOwner,
+			Group:     noTapOwner,
+		}
+		if c.Owner != nil {
+			tap.Owner = *c.Owner
+		}
+		if c.Group != nil {
+			tap.Group = *c.Group
+		}
+		if err := netlink.LinkAdd(tap); err != nil {
+			return nil, fmt.Errorf("failed to create tap %q: %v", name, err)
+		}
+		l, err = netlink.LinkByName(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup tap %q: %v", name, err)
+	}
+
+	tap, ok := l.(*netlink.Tuntap)
+	if !ok || tap.Mode != netlink.TUNTAP_MODE_TAP {
+		return nil, fmt.Errorf("%q already exists but is not a tap device", name)
+	}
+	if c.Owner != nil && tap.Owner != *c.Owner {
+		return nil, fmt.Errorf("tap %q is owned by uid %d, not %d", name, tap.Owner, *c.Owner)
+	}
+	if c.Group != nil && tap.Group != *c.Group {
+		return nil, fmt.Errorf("tap %q is owned by gid %d, not %d", name, tap.Group, *c.Group)
+	}
+
+	switch tap.MasterIndex {
+	case br.Attrs().Index:
+	case 0:
+		if err := netlink.LinkSetMaster(tap, br); err != nil {
+			return nil, fmt.Errorf("failed to connect %q to bridge %v: %v", name, br.Attrs().Name, err)
+		}
+	default:
+		return nil, fmt.Errorf("tap %q is already enslaved to another device", name)
+	}
+
+	if err := netlink.LinkSetHairpin(tap, n.HairpinMode); err != nil {
+		return nil, fmt.Errorf("failed to setup hairpin mode for %v: %v", name, err)
+	}
+
+	if n.Vlan != 0 {
+		if err := netlink.BridgeVlanAdd(tap, uint16(n.Vlan), true, true, false, true); err != nil {
+			return nil, fmt.Errorf("failed to setup vlan tag on interface %q: %v", name, err)
+		}
+	}
+	for _, id := range n.VlanTrunk {
+		if err := netlink.BridgeVlanAdd(tap, uint16(id), false, false, false, true); err != nil {
+			return nil, fmt.Errorf("failed to add trunk vlan %d on interface %q: %v", id, name, err)
+		}
+	}
+
+	if err := netlink.LinkSetUp(tap); err != nil {
+		return nil, fmt.Errorf("failed to set %q up: %v", name, err)
+	}
+
+	return &current.Interface{
+		Name: name,
+		Mac:  tap.Attrs().HardwareAddr.String(),
+	}, nil
+}
+
+// teardownTap deletes the tap created for the container, or only detaches
+// the one it was given from the bridge.
+func teardownTap(c *TapConf, containerID string) error {
+	name := tapName(c, containerID)
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return fmt.Errorf("failed to lookup tap %q: %v", name, err)
+	}
+
+	if c.Name != "" {
+		if err := netlink.LinkSetNoMaster(l); err != nil {
+			return fmt.Errorf("failed to detach tap %q: %v", name, err)
+		}
+		return nil
+	}
+
+	if err := netlink.LinkDel(l); err != nil {
+		return fmt.Errorf("failed to delete tap %q: %v", name, err)
+	}
+	return nil
+}
+
+// checkTap verifies the tap is still connected to the bridge.
+func checkTap(c *TapConf, containerID string, br cniBridgeIf) error {
+	name := tapName(c, containerID)
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		return fmt.Errorf("tap %s not found: %v", name, err)
+	}
+	if _, ok := l.(*netlink.Tuntap); !ok {
+		return fmt.Errorf("Interface %s does not have link type of tuntap", name)
+	}
+	if l.Attrs().MasterIndex != br.ifIndex {
+		return fmt.Errorf("tap %s is not connected to bridge %s", name, br.Name)
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// validate checks the ranges of the individual options and the constraints
+// between them, and fills in the values derived from them. All problems are
+// reported at once, so a broken configuration can be fixed in one go.
+func (n *NetConf) validate() error {
+	var problems []string
+	check := func(err error) {
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	checkf := func(failed bool, format string, a ...interface{}) {
+		if failed {
+			problems = append(problems, fmt.Sprintf(format, a...))
+		}
+	}
+
+	isLayer3 := n.IPAM.Type != "" || n.IPAMWebhook != nil
+	isGW := n.IsGW || n.IsDefaultGW
+
+	for _, key := range n.unknown {
+		checkf(true, "unknown field %q", key)
+	}
+	checkf(n.Vlan < 0 || n.Vlan > 4094, "invalid VLAN ID %d (must be between 0 and 4094)", n.Vlan)
+	checkf(len(n.VlanTrunk) > 0 && !n.VlanAware, "vlanTrunk requires vlanAware to be set")
+	for _, id := range n.VlanTrunk {
+		checkf(id < 1 || id > 4094, "invalid trunk VLAN ID %d (must be between 1 and 4094)", id)
+		checkf(id != 0 && id == n.Vlan, "trunk VLAN ID %d is already the port's PVID", id)
+	}
+	switch n.VlanPortMode {
+	case "":
+	case "access":
+		checkf(n.Vlan == 0, "an access port needs exactly one untagged VLAN, set vlan")
+	case "trunk":
+		checkf(n.Vlan != 0, "a trunk port has no untagged VLAN, move vlan %d to vlanTrunk", n.Vlan)
+	default:
+		checkf(true, "invalid vlanPortMode %q (must be access or trunk)", n.VlanPortMode)
+	}
+	checkf(n.VlanPortMode != "" && !n.VlanAware, "vlanPortMode requires vlanAware to be set")
+
+	if len(n.IPFamilies) > 0 {
+		n.families = map[int]bool{}
+		for _, f := range n.IPFamilies {
+			switch strings.TrimSpace(f) {
+			case "ipv4":
+				n.families[netlink.FAMILY_V4] = true
+			case "ipv6":
+				n.families[netlink.FAMILY_V6] = true
+			default:
+				checkf(true, "invalid IP family %q (must be ipv4 or ipv6)", f)
+			}
+		}
+		checkf(!isLayer3, "ipFamilies requires IPAM to be configured")
+	}
+
+	seen := map[int]bool{}
+	for _, s := range n.PreferredSource {
+		prefix, err := parsePrefix(s)
+		if err != nil {
+			checkf(true, "invalid preferredSource %q (must be an address or a prefix)", s)
+			continue
+		}
+		family := ipFamily(prefix.IP)
+		checkf(seen[family], "invalid preferredSource %q: only one is allowed per IP family", s)
+		seen[family] = true
+		n.preferred = append(n.preferred, prefix)
+	}
+	checkf(len(n.PreferredSource) > 0 && !isLayer3, "preferredSource requires IPAM to be configured")
+
+	checkf(n.MTU < 0, "invalid MTU %d (must not be negative)", n.MTU)
+	if n.TxQueueLen != nil {
+		checkf(*n.TxQueueLen < 0, "invalid txQueueLen %d (must not be negative)", *n.TxQueueLen)
+	}
+	check(validateGSOSize("gsoMaxSize", n.GSOMaxSize))
+	check(validateGSOSize("groMaxSize", n.GROMaxSize))
+	checkf(n.ReclaimStaleVeth && !n.StableHostVethName, "reclaimStaleVeth requires stableHostVethName")
+	checkf(n.ReclaimStaleVeth && (n.InterfaceAlias == "host" || n.InterfaceAlias == "both"), "reclaimStaleVeth cannot be combined with interfaceAlias %s, it keeps the owner in the alias of the host veth", n.InterfaceAlias)
+	checkf(n.HairpinMode && n.PromiscMode, "cannot set hairpin mode and promiscuous mode at the same time.")
+
+	if n.DSCP != nil {
+		checkf(*n.DSCP < 0 || *n.DSCP > 63, "invalid DSCP value %d (must be between 0 and 63)", *n.DSCP)
+		checkf(!isLayer3, "DSCP marking requires IPAM to be configured")
+	}
+	if n.MSSClamp != nil {
+		check(n.MSSClamp.validate())
+		checkf(!isLayer3, "mssClamp requires IPAM to be configured")
+	}
+	checkf(n.mark != nil && !isLayer3, "a firewall mark requires IPAM to be configured")
+	if n.ConntrackZone != nil {
+		checkf(*n.ConntrackZone < 0 || *n.ConntrackZone > 65535, "invalid conntrack zone %d (must be a valid uint16)", *n.ConntrackZone)
+		checkf(!isLayer3, "a conntrack zone requires IPAM to be configured")
+	}
+	if n.SNATAddress != "" {
+		n.snatIP = net.ParseIP(n.SNATAddress)
+		checkf(n.snatIP == nil, "invalid snatAddress %q (must be an IP address)", n.SNATAddress)
+		checkf(!isLayer3, "snatAddress requires IPAM to be configured")
+	}
+
+	if n.RPSCPUs != "" {
+		mask, err := rpsMask(n.RPSCPUs, numCPU())
+		check(err)
+		n.rpsMask = mask
+	}
+
+	if t := n.NeighGCThresh; t != nil {
+		checkf(t.Thresh1 < 0 || t.Thresh2 < 0 || t.Thresh3 < 0, "invalid neighGCThresh: thresholds must not be negative")
+	}
+
+	if n.FdbMaxSize != nil {
+		checkf(*n.FdbMaxSize < 1 || int64(*n.FdbMaxSize) > math.MaxUint32, "invalid fdbMaxSize %d (must be between 1 and %d)", *n.FdbMaxSize, uint32(math.MaxUint32))
+	}
+
+	if n.MacPrefix != "" {
+		prefix, err := parseMacPrefix(n.MacPrefix)
+		check(err)
+		n.macPrefix = prefix
+	}
+
+	if n.VXLAN != nil {
+		check(n.VXLAN.validate())
+	}
+	if n.IPAMWebhook != nil {
+		check(n.IPAMWebhook.validate())
+		checkf(n.IPAM.Type != "", "ipamWebhook cannot be combined with an IPAM plugin")
+	}
+	if n.IPAMRetry != nil {
+		check(n.IPAMRetry.validate())
+		checkf(n.IPAM.Type == "", "ipamRetry requires an IPAM plugin")
+	}
+	if n.NetlinkRetry != nil {
+		check(n.NetlinkRetry.validate())
+	}
+	if n.NetnsRetry != nil {
+		check(n.NetnsRetry.validate())
+	}
+	for i := range n.PostSetupHooks {
+		check(n.PostSetupHooks[i].validate())
+	}
+	switch n.DelAction {
+	case "", "delete", "down":
+	default:
+		checkf(true, "invalid delAction %q (must be delete or down)", n.DelAction)
+	}
+	switch n.FirewallFailure {
+	case "", "closed", "open":
+	default:
+		checkf(true, "invalid firewallFailure %q (must be closed or open)", n.FirewallFailure)
+	}
+	switch n.InterfaceAlias {
+	case "", "host", "container", "both":
+	default:
+		checkf(true, "invalid interfaceAlias %q (must be host, container or both)", n.InterfaceAlias)
+	}
+	switch n.SharedNetns {
+	case "", "reuse", "add":
+	default:
+		checkf(true, "invalid sharedNetns %q (must be reuse or add)", n.SharedNetns)
+	}
+	if n.SharedNetns != "" {
+		checkf(n.Adopt, "sharedNetns cannot be combined with adopt")
+		checkf(n.InterfaceAlias == "container" || n.InterfaceAlias == "both", "sharedNetns cannot be combined with interfaceAlias %s, it keeps the owner in the alias of the container interface", n.InterfaceAlias)
+	}
+	checkf(n.ReceiveOnly && n.DelayCarrier, "receiveOnly cannot be combined with delayCarrier, which brings the host veth up")
+	if n.IPv6AddrGen != nil {
+		check(n.IPv6AddrGen.validate())
+	}
+	if n.AcceptRA != nil {
+		check(n.AcceptRA.validate())
+	}
+	if n.ARP != nil {
+		check(n.ARP.validate())
+	}
+	check(validateSysctls(n))
+	if n.EUI64Prefix != "" {
+		ip, prefix, err := net.ParseCIDR(n.EUI64Prefix)
+		if err == nil && ip.To4() == nil {
+			if ones, _ := prefix.Mask.Size(); ones == 64 {
+				n.eui64 = prefix
+			}
+		}
+		checkf(n.eui64 == nil, "invalid eui64Prefix %q (must be an IPv6 /64 prefix)", n.EUI64Prefix)
+		checkf(!isLayer3, "eui64Prefix requires IPAM to be configured")
+	}
+	if n.Tap != nil {
+		check(n.Tap.validate())
+		checkf(n.IPv6AddrGen != nil, "ipv6AddrGen cannot be combined with tap, which has no container interface")
+		checkf(n.ARP != nil, "arp cannot be combined with tap, which has no container interface")
+		checkf(n.SysctlProfile != "" || len(n.Sysctl) > 0, "sysctlProfile and sysctl cannot be combined with tap, which has no container")
+		checkf(n.AcceptRA != nil && n.AcceptRA.applies("container"), "acceptRA cannot be set on the container interface with tap, which has none")
+		checkf(n.EUI64Prefix != "", "eui64Prefix cannot be combined with tap, which has no container interface")
+		checkf(n.DelayCarrier, "delayCarrier cannot be combined with tap, which has no veth")
+		checkf(n.ReceiveOnly, "receiveOnly cannot be combined with tap, which has no veth")
+		checkf(n.Adopt, "adopt cannot be combined with tap, which has no veth")
+		checkf(n.SharedNetns != "", "sharedNetns cannot be combined with tap, which has no veth")
+		checkf(n.DelAction == "down", "delAction down cannot be combined with tap, which has no veth")
+		checkf(n.InterfaceAlias == "container" || n.InterfaceAlias == "both", "interfaceAlias %s cannot be combined with tap, which has no container interface", n.InterfaceAlias)
+		checkf(len(n.ECMPGateways) > 0, "ecmpGateways cannot be combined with tap")
+		checkf(len(n.TableRoutes) > 0, "tableRoutes cannot be combined with tap")
+	}
+
+	for i := range n.ECMPGateways {
+		gw := &n.ECMPGateways[i]
+		if gw.GW == nil {
+			checkf(true, "invalid ecmpGateways entry %d: missing gw", i)
+			continue
+		}
+		if gw.Weight == 0 {
+			gw.Weight = 1
+		}
+		checkf(gw.Weight < 1 || gw.Weight > 256, "invalid weight %d for ECMP gateway %s (must be between 1 and 256)", gw.Weight, gw.GW)
+	}
+	checkf(len(n.ECMPGateways) > 0 && n.IsDefaultGW, "ecmpGateways cannot be combined with isDefaultGateway")
+
+	for _, r := range n.TableRoutes {
+		dst := net.IPNet(r.Dst)
+		checkf(r.Table < 1 || int64(r.Table) > math.MaxUint32 || r.Table == unix.RT_TABLE_MAIN || r.Table == unix.RT_TABLE_LOCAL,
+			"invalid table %d for the route to %s (must be between 1 and %d, other than main and local)", r.Table, &dst, uint32(math.MaxUint32))
+		checkf(r.GW != nil && ipFamily(r.GW) != ipFamily(dst.IP), "gw %s of the route to %s is not of the same family", r.GW, &dst)
+	}
+	checkf(len(n.TableRoutes) > 0 && !isLayer3, "tableRoutes requires IPAM to be configured")
+
+	checkf(n.HostRoutes && !isLayer3, "hostRoutes requires IPAM to provide the pod addresses")
+	checkf(n.RequireGateway && !isLayer3, "requireGateway requires IPAM to be configured")
+
+	if n.DisableBridgeIP {
+		checkf(isGW, "disableBridgeIP cannot be combined with isGateway or isDefaultGateway")
+		checkf(!isLayer3, "disableBridgeIP requires IPAM to provide the pod addresses")
+	}
+
+	switch len(problems) {
+	case 0:
+		return nil
+	case 1:
+		return errors.New(problems[0])
+	default:
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+}
+
+// unknownFields returns the top level keys of the configuration that
+// NetConf, including the standard CNI keys it embeds, has no field for.
+// Like encoding/json, it matches the keys case insensitively. The IPAM
+// section and the other nested objects are left to their owners.
+func unknownFields(bytes []byte) []string {
+	var conf map[string]json.RawMessage
+	if err := json.Unmarshal(bytes, &conf); err != nil {
+		return nil
+	}
+	known := map[string]bool{}
+	var collect func(t reflect.Type)
+	collect = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Anonymous {
+				collect(f.Type)
+				continue
+			}
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if f.PkgPath != "" || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			known[strings.ToLower(name)] = true
+		}
+	}
+	collect(reflect.TypeOf(NetConf{}))
+
+	var unknown []string
+	for key := range conf {
+		if !known[strings.ToLower(key)] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// parsePrefix accepts a prefix, or an address as a host prefix.
+func parsePrefix(s string) (*net.IPNet, error) {
+	if addr := net.ParseIP(s); addr != nil {
+		if v4 := addr.To4(); v4 != nil {
+			return &net.IPNet{IP: v4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: addr, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, prefix, err := net.ParseCIDR(s)
+	return prefix, err
+}
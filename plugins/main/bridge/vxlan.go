@@ -0,0 +1,205 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	defaultVXLANPort = 4789
+	maxVNI           = 1<<24 - 1
+)
+
+// VXLANConf describes a VXLAN device that extends the bridge to the same
+// network on other nodes. Broadcast and unknown unicast traffic is flooded
+// to every remote VTEP; the rest is learned.
+type VXLANConf struct {
+	VNI      int      `json:"vni"`
+	Remotes  []net.IP `json:"remotes"`
+	Underlay string   `json:"underlay,omitempty"`
+	Port     int      `json:"port,omitempty"`
+}
+
+func (c *VXLANConf) validate() error {
+	if c.VNI < 1 || c.VNI > maxVNI {
+		return fmt.Errorf("invalid VXLAN VNI %d (must be between 1 and %d)", c.VNI, maxVNI)
+	}
+	if len(c.Remotes) == 0 {
+		return fmt.Errorf("VXLAN requires at least one remote VTEP")
+	}
+	for _, r := range c.Remotes {
+		if r == nil {
+			return fmt.Errorf("VXLAN remote VTEPs must be IP addresses")
+		}
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("invalid VXLAN port %d", c.Port)
+	}
+	if c.Port == 0 {
+		c.Port = defaultVXLANPort
+	}
+	return nil
+}
+
+func vxlanName(vni int) string {
+	return fmt.Sprintf("vxlan%d", vni)
+}
+
+// ensureVXLAN creates the VXLAN device for c if necessary, attaches it to
+// the bridge and points its flood entries at the remote VTEPs. The device
+// is shared by every container on the bridge.
+func ensureVXLAN(br *netlink.Bridge, c *VXLANConf) (*netlink.Vxlan, error) {
+	name := vxlanName(c.VNI)
+
+	l, err := netlink.LinkByName(name)
+	if _, ok := err.(netlink.LinkNotFoundError); ok {
+		vx := &netlink.Vxlan{
+			LinkAttrs: netlink.LinkAttrs{Name: name},
+			VxlanId:   c.VNI,
+			Port:      c.Port,
+			Learning:  true,
+		}
+		if c.Underlay != "" {
+			u, err := netlink.LinkByName(c.Underlay)
+			if err != nil {
+				return nil, fmt.Errorf("failed to lookup underlay %q: %v", c.Underlay, err)
+			}
+			vx.VtepDevIndex = u.Attrs().Index
+			vx.MTU = u.Attrs().MTU - vxlanOverhead(c.Remotes[0])
+		}
+		if err := netlink.LinkAdd(vx); err != nil && err != syscall.EEXIST {
+			return nil, fmt.Errorf("could not add %q: %v", name, err)
+		}
+		l, err = netlink.LinkByName(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", name, err)
+	}
+
+	vx, ok := l.(*netlink.Vxlan)
+	if !ok || vx.VxlanId != c.VNI {
+		return nil, fmt.Errorf("%q already exists but is not a VXLAN device with VNI %d", name, c.VNI)
+	}
+
+	switch vx.MasterIndex {
+	case br.Attrs().Index:
+	case 0:
+		if err := netlink.LinkSetMaster(vx, br); err != nil {
+			return nil, fmt.Errorf("failed to connect %q to bridge %v: %v", name, br.Attrs().Name, err)
+		}
+	default:
+		return nil, fmt.Errorf("%q is already enslaved to another device", name)
+	}
+
+	for _, remote := range c.Remotes {
+		err := netlink.NeighAppend(&netlink.Neigh{
+			LinkIndex:    vx.Index,
+			Family:       syscall.AF_BRIDGE,
+			State:        netlink.NUD_PERMANENT,
+			Flags:        netlink.NTF_SELF,
+			IP:           remote,
+			HardwareAddr: make(net.HardwareAddr, 6),
+		})
+		if err != nil && err != syscall.EEXIST {
+			return nil, fmt.Errorf("failed to add flood entry for %s on %q: %v", remote, name, err)
+		}
+	}
+
+	if err := netlink.LinkSetUp(vx); err != nil {
+		return nil, fmt.Errorf("failed to set %q up: %v", name, err)
+	}
+
+	return vx, nil
+}
+
+// vxlanOverhead is the encapsulation overhead on an underlay towards remote.
+func vxlanOverhead(remote net.IP) int {
+	if remote.To4() == nil {
+		return 70
+	}
+	return 50
+}
+
+// releaseVXLAN deletes the VXLAN device once no container port is left on
+// the bridge. The bridge's own uplink and the VLAN gateways, if any, do not
+// count.
+func releaseVXLAN(n *NetConf) error {
+	if n.VXLAN == nil {
+		return nil
+	}
+
+	br, err := bridgeByName(n.BrName)
+	if err != nil {
+		// no bridge, nothing attached to it
+		return nil
+	}
+	vx, err := netlink.LinkByName(vxlanName(n.VXLAN.VNI))
+	if err != nil {
+		return nil
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		if l.Attrs().MasterIndex != br.Attrs().Index {
+			continue
+		}
+		if l.Attrs().Index == vx.Attrs().Index || l.Attrs().Name == n.Master {
+			continue
+		}
+		if !vlanGatewayPort(l, br) {
+			return nil
+		}
+	}
+
+	if err := netlink.LinkDel(vx); err != nil {
+		return fmt.Errorf("failed to delete %q: %v", vx.Attrs().Name, err)
+	}
+	return nil
+}
+
+// vlanGatewayPort reports whether the bridge port l is the host end of a
+// VLAN gateway from ensureVlanInterface, a veth whose peer, named after the
+// bridge and the VLAN, is in the host namespace as well.
+func vlanGatewayPort(l netlink.Link, br netlink.Link) bool {
+	veth, ok := l.(*netlink.Veth)
+	if !ok {
+		return false
+	}
+	peerIndex, err := netlink.VethPeerIndex(veth)
+	if err != nil {
+		return false
+	}
+	// the peer of a container port is in another namespace, where its
+	// index may well be taken here by an unrelated link
+	peer, err := netlink.LinkByIndex(peerIndex)
+	if err != nil || !strings.HasPrefix(peer.Attrs().Name, br.Attrs().Name+".") {
+		return false
+	}
+	peerVeth, ok := peer.(*netlink.Veth)
+	if !ok {
+		return false
+	}
+	index, err := netlink.VethPeerIndex(peerVeth)
+	return err == nil && index == l.Attrs().Index
+}
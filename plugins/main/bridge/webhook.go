@@ -0,0 +1,150 @@
+// Copyright 2021 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+const defaultWebhookTimeout = 10 * time.Second
+
+// IPAMWebhook hands address allocation to an external service instead of
+// an IPAM plugin. The plugin POSTs a webhookRequest to URL on ADD and DEL;
+// the ADD response is the ips, routes and dns of a CNI result.
+type IPAMWebhook struct {
+	URL       string `json:"url"`
+	TimeoutMs int    `json:"timeoutMs,omitempty"`
+}
+
+type webhookRequest struct {
+	Command     string `json:"command"`
+	Network     string `json:"network"`
+	ContainerID string `json:"containerID"`
+	Netns       string `json:"netns,omitempty"`
+	IfName      string `json:"ifName"`
+	// Pod is "namespace/name" when the runtime passed the pod identity
+	Pod string `json:"pod,omitempty"`
+}
+
+func (w *IPAMWebhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid ipamWebhook url %q (must be an http or https URL)", w.URL)
+	}
+	if w.TimeoutMs < 0 {
+		return fmt.Errorf("invalid ipamWebhook timeoutMs %d (must not be negative)", w.TimeoutMs)
+	}
+	return nil
+}
+
+func (w *IPAMWebhook) timeout() time.Duration {
+	if w.TimeoutMs == 0 {
+		return defaultWebhookTimeout
+	}
+	return time.Duration(w.TimeoutMs) * time.Millisecond
+}
+
+func newWebhookRequest(command string, n *NetConf, args *skel.CmdArgs) *webhookRequest {
+	return &webhookRequest{
+		Command:     command,
+		Network:     n.Name,
+		ContainerID: args.ContainerID,
+		Netns:       args.Netns,
+		IfName:      args.IfName,
+		Pod:         n.podID,
+	}
+}
+
+// webhookContext bounds a webhook call by its timeout and cancels it when
+// the runtime gives up on the plugin.
+func webhookContext(w *IPAMWebhook) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx, cancel := context.WithTimeout(ctx, w.timeout())
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// webhookAdd asks the webhook for the container's addresses.
+func webhookAdd(ctx context.Context, w *IPAMWebhook, req *webhookRequest) (*current.Result, error) {
+	body, err := w.post(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &current.Result{}
+	if err := json.Unmarshal(body, result); err != nil {
+		return nil, fmt.Errorf("ipamWebhook returned an invalid result: %v", err)
+	}
+	if len(result.IPs) == 0 {
+		return nil, fmt.Errorf("ipamWebhook returned missing IP config")
+	}
+	for _, ipc := range result.IPs {
+		// there is a single container interface, which IPAM results
+		// leave to the plugin to point at
+		ipc.Interface = nil
+	}
+	result.CNIVersion = current.ImplementedSpecVersion
+	return result, nil
+}
+
+// webhookDel tells the webhook the container's addresses are free again.
+func webhookDel(ctx context.Context, w *IPAMWebhook, req *webhookRequest) error {
+	_, err := w.post(ctx, req)
+	return err
+}
+
+func (w *IPAMWebhook) post(ctx context.Context, req *webhookRequest) ([]byte, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		return nil, fmt.Errorf("ipamWebhook %s failed: %v", req.Command, err)
+	}
+	defer resp.Body.Close()
+
+	// results are small, anything bigger is not one
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("ipamWebhook %s failed: %v", req.Command, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("ipamWebhook %s failed: %s: %s", req.Command, resp.Status, bytes.TrimSpace(body))
+	}
+	return body, nil
+}